@@ -0,0 +1,494 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package codecs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/issue9/session/types"
+)
+
+// cbor的主类型
+const (
+	cborUint byte = iota
+	cborNegInt
+	cborBytes
+	cborText
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+)
+
+// 部分预定义的tag
+const (
+	cborTagTime  = 0 // RFC3339格式的时间
+	cborTagEpoch = 1 // 以秒为单位的时间戳
+)
+
+// 不定长数据的结束标记
+const cborBreak = 0xff
+
+var errCBORBreak = errors.New("cbor: 非预期的结束标记")
+
+type cborCodec struct{}
+
+type cborEncoder struct {
+	buf *bytes.Buffer
+}
+
+type cborDecoder struct {
+	reader
+}
+
+// 声明一个以CBOR(RFC 8949)进行编解码的Codec。
+//
+// 支持的类型与NewMsgPack()相同，time.Time以tag 0的形式保存。
+// 解码时，整数被还原成int64，浮点数为float64(单精度为float32)，
+// 数组为[]interface{}，map为map[interface{}]interface{}，
+// 未知的tag会被忽略，直接返回其内容。
+func NewCBOR() types.Codec {
+	return &cborCodec{}
+}
+
+func (c *cborCodec) Encode(data map[interface{}]interface{}) ([]byte, error) {
+	e := &cborEncoder{buf: new(bytes.Buffer)}
+	if err := e.encode(data, 0); err != nil {
+		return nil, err
+	}
+
+	return e.buf.Bytes(), nil
+}
+
+func (c *cborCodec) Decode(data []byte) (map[interface{}]interface{}, error) {
+	d := &cborDecoder{reader: reader{data: data}}
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.remain() > 0 {
+		return nil, errTrailing
+	}
+
+	mapped, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cbor: 顶层元素必须为 map，实际为 %T", v)
+	}
+	return mapped, nil
+}
+
+// 写入主类型及其参数
+func (e *cborEncoder) writeHead(major byte, n uint64) {
+	major <<= 5
+	var bs [8]byte
+
+	switch {
+	case n < 24:
+		e.buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		e.buf.Write([]byte{major | 24, byte(n)})
+	case n <= math.MaxUint16:
+		e.buf.WriteByte(major | 25)
+		binary.BigEndian.PutUint16(bs[:], uint16(n))
+		e.buf.Write(bs[:2])
+	case n <= math.MaxUint32:
+		e.buf.WriteByte(major | 26)
+		binary.BigEndian.PutUint32(bs[:], uint32(n))
+		e.buf.Write(bs[:4])
+	default:
+		e.buf.WriteByte(major | 27)
+		binary.BigEndian.PutUint64(bs[:], n)
+		e.buf.Write(bs[:])
+	}
+}
+
+func (e *cborEncoder) writeInt(i int64) {
+	if i >= 0 {
+		e.writeHead(cborUint, uint64(i))
+	} else {
+		e.writeHead(cborNegInt, uint64(-1-i))
+	}
+}
+
+func (e *cborEncoder) encode(v interface{}, depth int) error {
+	if depth > maxDepth {
+		return errTooDeep
+	}
+
+	switch val := v.(type) {
+	case nil:
+		e.buf.WriteByte(0xf6)
+	case bool:
+		if val {
+			e.buf.WriteByte(0xf5)
+		} else {
+			e.buf.WriteByte(0xf4)
+		}
+	case string:
+		e.writeHead(cborText, uint64(len(val)))
+		e.buf.WriteString(val)
+	case []byte:
+		e.writeHead(cborBytes, uint64(len(val)))
+		e.buf.Write(val)
+	case time.Time:
+		e.writeHead(cborTag, cborTagTime)
+		return e.encode(val.Format(time.RFC3339Nano), depth)
+	case map[interface{}]interface{}:
+		e.writeHead(cborMap, uint64(len(val)))
+		for k, item := range val {
+			if err := e.encode(k, depth+1); err != nil {
+				return err
+			}
+			if err := e.encode(item, depth+1); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		e.writeHead(cborArray, uint64(len(val)))
+		for _, item := range val {
+			if err := e.encode(item, depth+1); err != nil {
+				return err
+			}
+		}
+	default:
+		return e.encodeReflect(reflect.ValueOf(v), depth)
+	}
+
+	return nil
+}
+
+func (e *cborEncoder) encodeReflect(rv reflect.Value, depth int) error {
+	switch rv.Kind() {
+	case reflect.Bool:
+		return e.encode(rv.Bool(), depth)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeHead(cborUint, rv.Uint())
+	case reflect.Float32:
+		var bs [4]byte
+		binary.BigEndian.PutUint32(bs[:], math.Float32bits(float32(rv.Float())))
+		e.buf.WriteByte(0xfa)
+		e.buf.Write(bs[:])
+	case reflect.Float64:
+		var bs [8]byte
+		binary.BigEndian.PutUint64(bs[:], math.Float64bits(rv.Float()))
+		e.buf.WriteByte(0xfb)
+		e.buf.Write(bs[:])
+	case reflect.String:
+		return e.encode(rv.String(), depth)
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			e.buf.WriteByte(0xf6)
+			return nil
+		}
+
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			bs := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(bs), rv)
+			return e.encode(bs, depth)
+		}
+
+		e.writeHead(cborArray, uint64(rv.Len()))
+		for i := 0; i < rv.Len(); i++ {
+			if err := e.encode(rv.Index(i).Interface(), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if rv.IsNil() {
+			e.buf.WriteByte(0xf6)
+			return nil
+		}
+
+		e.writeHead(cborMap, uint64(rv.Len()))
+		iter := rv.MapRange()
+		for iter.Next() {
+			if err := e.encode(iter.Key().Interface(), depth+1); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value().Interface(), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			e.buf.WriteByte(0xf6)
+			return nil
+		}
+		return e.encode(rv.Elem().Interface(), depth+1)
+	default:
+		return fmt.Errorf("cbor: 不支持的类型 %s", rv.Type())
+	}
+
+	return nil
+}
+
+// 读取数据项的头部，info为附加信息，值为31时表示不定长的数据。
+func (d *cborDecoder) readHead() (major, info byte, n uint64, err error) {
+	b, err := d.readByte()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	major = b >> 5
+	info = b & 0x1f
+
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		n, err = d.readUint(1 << (info - 24))
+		return major, info, n, err
+	case info == 31:
+		switch major {
+		case cborBytes, cborText, cborArray, cborMap:
+			return major, info, 0, nil
+		case cborSimple:
+			return 0, 0, 0, errCBORBreak
+		}
+	}
+
+	return 0, 0, 0, fmt.Errorf("cbor: 无效的附加信息 %d", info)
+}
+
+// 下一个字节是否为结束标记，若是，则跳过该标记。
+func (d *cborDecoder) isBreak() (bool, error) {
+	if d.remain() == 0 {
+		return false, errTruncated
+	}
+
+	if d.data[d.pos] == cborBreak {
+		d.pos++
+		return true, nil
+	}
+	return false, nil
+}
+
+func (d *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+
+	major, info, n, err := d.readHead()
+	if err != nil {
+		return nil, err
+	}
+	indefinite := info == 31
+
+	switch major {
+	case cborUint:
+		return uintValue(n), nil
+	case cborNegInt:
+		if n > math.MaxInt64 {
+			return nil, errors.New("cbor: 负整数超出 int64 的范围")
+		}
+		return -1 - int64(n), nil
+	case cborBytes, cborText:
+		bs, err := d.decodeBytes(major, n, indefinite)
+		if err != nil {
+			return nil, err
+		}
+		if major == cborText {
+			return string(bs), nil
+		}
+		return bs, nil
+	case cborArray:
+		return d.decodeArray(n, indefinite, depth)
+	case cborMap:
+		return d.decodeMap(n, indefinite, depth)
+	case cborTag:
+		return d.decodeTag(n, depth)
+	default: // cborSimple
+		return d.decodeSimple(info, n)
+	}
+}
+
+func (d *cborDecoder) decodeBytes(major byte, n uint64, indefinite bool) ([]byte, error) {
+	if !indefinite {
+		bs, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, bs...), nil
+	}
+
+	// 不定长的内容由多个相同主类型的定长块组成
+	ret := []byte{}
+	for {
+		brk, err := d.isBreak()
+		if err != nil {
+			return nil, err
+		}
+		if brk {
+			return ret, nil
+		}
+
+		m, info, size, err := d.readHead()
+		if err != nil {
+			return nil, err
+		}
+		if m != major || info == 31 {
+			return nil, errors.New("cbor: 无效的不定长数据块")
+		}
+
+		bs, err := d.next(size)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, bs...)
+	}
+}
+
+func (d *cborDecoder) decodeArray(n uint64, indefinite bool, depth int) (interface{}, error) {
+	if indefinite {
+		ret := []interface{}{}
+		for {
+			brk, err := d.isBreak()
+			if err != nil {
+				return nil, err
+			}
+			if brk {
+				return ret, nil
+			}
+
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, v)
+		}
+	}
+
+	size, err := d.checkLen(n)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]interface{}, size)
+	for i := range ret {
+		if ret[i], err = d.decode(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (d *cborDecoder) decodeMap(n uint64, indefinite bool, depth int) (interface{}, error) {
+	size := 0
+	if !indefinite {
+		var err error
+		if size, err = d.checkLen(n); err != nil {
+			return nil, err
+		}
+	}
+
+	ret := make(map[interface{}]interface{}, size)
+	for i := 0; indefinite || i < size; i++ {
+		if indefinite {
+			brk, err := d.isBreak()
+			if err != nil {
+				return nil, err
+			}
+			if brk {
+				break
+			}
+		}
+
+		k, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if err = checkKey(k); err != nil {
+			return nil, err
+		}
+
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		ret[k] = v
+	}
+
+	return ret, nil
+}
+
+func (d *cborDecoder) decodeTag(tag uint64, depth int) (interface{}, error) {
+	v, err := d.decode(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch tag {
+	case cborTagTime:
+		if s, ok := v.(string); ok {
+			return time.Parse(time.RFC3339Nano, s)
+		}
+	case cborTagEpoch:
+		switch val := v.(type) {
+		case int64:
+			return time.Unix(val, 0), nil
+		case float64:
+			sec, frac := math.Modf(val)
+			return time.Unix(int64(sec), int64(frac*1e9)), nil
+		}
+	}
+
+	return v, nil
+}
+
+func (d *cborDecoder) decodeSimple(info byte, n uint64) (interface{}, error) {
+	switch info {
+	case 25:
+		return halfToFloat(uint16(n)), nil
+	case 26:
+		return math.Float32frombits(uint32(n)), nil
+	case 27:
+		return math.Float64frombits(n), nil
+	}
+
+	switch n {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23: // null 和 undefined
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("cbor: 不支持的简单值 %d", n)
+}
+
+// 将半精度浮点数转换成float64
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+
+	var val float64
+	switch exp {
+	case 0:
+		val = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			val = math.Inf(1)
+		} else {
+			val = math.NaN()
+		}
+	default:
+		val = math.Ldexp(mant+1024, exp-25)
+	}
+
+	if h&0x8000 != 0 {
+		return -val
+	}
+	return val
+}
@@ -0,0 +1,229 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package codecs
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert"
+	"github.com/issue9/session/types"
+)
+
+var (
+	_ types.Codec = &gobCodec{}
+	_ types.Codec = &jsonCodec{}
+	_ types.Codec = &msgpackCodec{}
+	_ types.Codec = &cborCodec{}
+)
+
+func TestGob(t *testing.T) {
+	a := assert.New(t)
+	c := NewGob()
+
+	data := map[interface{}]interface{}{"1": 1, 2: "2", "3": []byte("3")}
+	bs, err := c.Encode(data)
+	a.NotError(err).NotEmpty(bs)
+	mapped, err := c.Decode(bs)
+	a.NotError(err).Equal(mapped, data)
+
+	// 未注册的类型
+	type unregistered struct{ ID int }
+	bs, err = c.Encode(map[interface{}]interface{}{"1": unregistered{ID: 1}})
+	a.Error(err).Nil(bs)
+}
+
+func TestJSON(t *testing.T) {
+	a := assert.New(t)
+	c := NewJSON()
+
+	data := map[interface{}]interface{}{
+		"int":    5,
+		"float":  1.5,
+		"string": "str",
+		"bool":   true,
+		"nil":    nil,
+		"map":    map[interface{}]interface{}{"1": 1},
+		"slice":  []interface{}{1, "2"},
+	}
+	bs, err := c.Encode(data)
+	a.NotError(err).NotEmpty(bs)
+	mapped, err := c.Decode(bs)
+	a.NotError(err)
+	a.Equal(mapped, map[interface{}]interface{}{
+		"int":    int64(5),
+		"float":  1.5,
+		"string": "str",
+		"bool":   true,
+		"nil":    nil,
+		"map":    map[string]interface{}{"1": int64(1)},
+		"slice":  []interface{}{int64(1), "2"},
+	})
+
+	// 键名不是字符串
+	bs, err = c.Encode(map[interface{}]interface{}{5: 5})
+	a.Error(err).Nil(bs)
+	bs, err = c.Encode(map[interface{}]interface{}{"5": map[interface{}]interface{}{5: 5}})
+	a.Error(err).Nil(bs)
+
+	_, err = c.Decode([]byte("[1,2]"))
+	a.Error(err)
+}
+
+// 测试msgpack和cbor的编解码
+func testBinary(a *assert.Assertion, c types.Codec) {
+	now := time.Now()
+	data := map[interface{}]interface{}{
+		"nil":     nil,
+		"true":    true,
+		"false":   false,
+		"int":     5,
+		"neg":     -100,
+		"int16":   int16(math.MinInt16),
+		"int64":   int64(math.MaxInt64),
+		"minint":  int64(math.MinInt64),
+		"uint32":  uint32(math.MaxUint32),
+		"uint64":  uint64(math.MaxUint64),
+		"float32": float32(1.5),
+		"float64": 2.25,
+		"string":  "字符串",
+		"long":    string(make([]byte, 300)),
+		"bytes":   []byte{1, 2, 3},
+		"array":   [2]int{1, 2},
+		"slice":   []string{"1", "2"},
+		"map":     map[string]int{"1": 1},
+		"time":    now,
+		5:         "int key",
+		true:      "bool key",
+	}
+
+	bs, err := c.Encode(data)
+	a.NotError(err).NotEmpty(bs)
+	mapped, err := c.Decode(bs)
+	a.NotError(err).Equal(len(mapped), len(data))
+
+	a.Nil(mapped["nil"])
+	a.Equal(mapped["true"], true).Equal(mapped["false"], false)
+	a.Equal(mapped["int"], int64(5))
+	a.Equal(mapped["neg"], int64(-100))
+	a.Equal(mapped["int16"], int64(math.MinInt16))
+	a.Equal(mapped["int64"], int64(math.MaxInt64))
+	a.Equal(mapped["minint"], int64(math.MinInt64))
+	a.Equal(mapped["uint32"], int64(math.MaxUint32))
+	a.Equal(mapped["uint64"], uint64(math.MaxUint64))
+	a.Equal(mapped["float32"], float32(1.5))
+	a.Equal(mapped["float64"], 2.25)
+	a.Equal(mapped["string"], "字符串")
+	a.Equal(mapped["long"], data["long"])
+	a.Equal(mapped["bytes"], []byte{1, 2, 3})
+	a.Equal(mapped["array"], []interface{}{int64(1), int64(2)})
+	a.Equal(mapped["slice"], []interface{}{"1", "2"})
+	a.Equal(mapped["map"], map[interface{}]interface{}{"1": int64(1)})
+	a.Equal(mapped[int64(5)], "int key")
+	a.Equal(mapped[true], "bool key")
+	tm, ok := mapped["time"].(time.Time)
+	a.True(ok).True(tm.Equal(now))
+
+	// 不支持的类型
+	type unsupported struct{ ID int }
+	bs, err = c.Encode(map[interface{}]interface{}{"1": unsupported{ID: 1}})
+	a.Error(err).Nil(bs)
+
+	// 嵌套过深
+	deep := map[interface{}]interface{}{}
+	m := deep
+	for i := 0; i < maxDepth+1; i++ {
+		child := map[interface{}]interface{}{}
+		m["child"] = child
+		m = child
+	}
+	bs, err = c.Encode(deep)
+	a.Equal(err, errTooDeep).Nil(bs)
+
+	// 不完整的数据
+	bs, err = c.Encode(map[interface{}]interface{}{"1": "12345"})
+	a.NotError(err)
+	for i := 0; i < len(bs); i++ {
+		_, err = c.Decode(bs[:i])
+		a.Error(err)
+	}
+
+	// 多余的数据
+	_, err = c.Decode(append(bs, 0))
+	a.Equal(err, errTrailing)
+}
+
+func TestMsgPack(t *testing.T) {
+	a := assert.New(t)
+	c := NewMsgPack()
+	testBinary(a, c)
+
+	// 与规范中的示例进行比较
+	bs, err := c.Encode(map[interface{}]interface{}{"compact": true})
+	a.NotError(err)
+	a.Equal(bs, []byte{0x81, 0xa7, 'c', 'o', 'm', 'p', 'a', 'c', 't', 0xc3})
+
+	// 顶层不是map
+	_, err = c.Decode([]byte{0x91, 0x01})
+	a.Error(err)
+
+	// 伪造的长度
+	_, err = c.Decode([]byte{0xdf, 0xff, 0xff, 0xff, 0xff})
+	a.Equal(err, errTruncated)
+
+	// timestamp 32
+	mapped, err := c.Decode([]byte{0x81, 0xa1, 't', 0xd6, 0xff, 0, 0, 0, 10})
+	a.NotError(err)
+	a.True(mapped["t"].(time.Time).Equal(time.Unix(10, 0)))
+}
+
+func TestCBOR(t *testing.T) {
+	a := assert.New(t)
+	c := NewCBOR()
+	testBinary(a, c)
+
+	// RFC 8949 附录A中的示例：{"a": 1, "b": [2, 3]}
+	mapped, err := c.Decode([]byte{0xa2, 0x61, 0x61, 0x01, 0x61, 0x62, 0x82, 0x02, 0x03})
+	a.NotError(err)
+	a.Equal(mapped, map[interface{}]interface{}{
+		"a": int64(1),
+		"b": []interface{}{int64(2), int64(3)},
+	})
+
+	// 不定长：{_ "a": 1, "b": [_ 2, 3]}
+	mapped, err = c.Decode([]byte{0xbf, 0x61, 0x61, 0x01, 0x61, 0x62, 0x9f, 0x02, 0x03, 0xff, 0xff})
+	a.NotError(err)
+	a.Equal(mapped, map[interface{}]interface{}{
+		"a": int64(1),
+		"b": []interface{}{int64(2), int64(3)},
+	})
+
+	// 不定长字符串和半精度浮点数：{(_ "strea", "ming"): 1.5}
+	mapped, err = c.Decode([]byte{0xa1, 0x7f, 0x65, 's', 't', 'r', 'e', 'a', 0x64, 'm', 'i', 'n', 'g', 0xff, 0xf9, 0x3e, 0x00})
+	a.NotError(err)
+	a.Equal(mapped, map[interface{}]interface{}{"streaming": 1.5})
+
+	// tag 1 的时间戳
+	mapped, err = c.Decode([]byte{0xa1, 0x61, 't', 0xc1, 0x1a, 0x51, 0x4b, 0x67, 0xb0})
+	a.NotError(err)
+	a.True(mapped["t"].(time.Time).Equal(time.Unix(1363896240, 0)))
+
+	// 顶层不是map
+	_, err = c.Decode([]byte{0x82, 0x01, 0x02})
+	a.Error(err)
+
+	// 伪造的长度
+	_, err = c.Decode([]byte{0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	a.Equal(err, errTruncated)
+
+	// 非预期的结束标记
+	_, err = c.Decode([]byte{0xa1, 0xff})
+	a.Equal(err, errCBORBreak)
+
+	// 不能作为键名的类型
+	_, err = c.Decode([]byte{0xa1, 0x80, 0x01})
+	a.Error(err)
+}
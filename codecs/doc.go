@@ -0,0 +1,10 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// 实现了types.Codec接口的几种常用编解码方式。
+//
+// 除了gob之外，其它编码方式在解码之后的值类型可能与编码之前不同，
+// 比如所有的整数都会被解码成int64(超出范围的无符号整数为uint64)，
+// 具体可参考各个函数的说明。
+package codecs
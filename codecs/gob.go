@@ -0,0 +1,39 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package codecs
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/issue9/session/types"
+)
+
+type gobCodec struct{}
+
+// 声明一个以encoding/gob进行编解码的Codec。
+//
+// 除基本类型之外，保存在Session中的值类型都需要通过gob.Register()进行注册。
+func NewGob() types.Codec {
+	return &gobCodec{}
+}
+
+func (c *gobCodec) Encode(data map[interface{}]interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(data); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c *gobCodec) Decode(data []byte) (map[interface{}]interface{}, error) {
+	mapped := make(map[interface{}]interface{}, 0)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&mapped); err != nil {
+		return nil, err
+	}
+
+	return mapped, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package codecs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/issue9/session/types"
+)
+
+type jsonCodec struct{}
+
+// 声明一个以encoding/json进行编解码的Codec。
+//
+// 所有map的键名都必须是字符串，否则Encode()会返回错误。
+// 解码时，整数被还原成int64，其它数值为float64，对象为map[string]interface{}，
+// 数组为[]interface{}。
+func NewJSON() types.Codec {
+	return &jsonCodec{}
+}
+
+func (c *jsonCodec) Encode(data map[interface{}]interface{}) ([]byte, error) {
+	v, err := toJSONValue(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+func (c *jsonCodec) Decode(data []byte) (map[interface{}]interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	mapped := map[string]interface{}{}
+	if err := d.Decode(&mapped); err != nil {
+		return nil, err
+	}
+
+	ret := make(map[interface{}]interface{}, len(mapped))
+	for k, v := range mapped {
+		ret[k] = fromJSONValue(v)
+	}
+	return ret, nil
+}
+
+// 将map[interface{}]interface{}转换成json可以处理的map[string]interface{}。
+func toJSONValue(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		ret := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("json 的键名只能是字符串，%v 的类型为 %T", k, k)
+			}
+
+			item, err := toJSONValue(item)
+			if err != nil {
+				return nil, err
+			}
+			ret[key] = item
+		}
+		return ret, nil
+	case []interface{}:
+		ret := make([]interface{}, len(val))
+		for i, item := range val {
+			item, err := toJSONValue(item)
+			if err != nil {
+				return nil, err
+			}
+			ret[i] = item
+		}
+		return ret, nil
+	default:
+		return v, nil
+	}
+}
+
+// 将json.Number还原成int64或是float64。
+func fromJSONValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case json.Number:
+		if !strings.ContainsAny(val.String(), ".eE") {
+			if i, err := val.Int64(); err == nil {
+				return i
+			}
+		}
+		f, _ := val.Float64()
+		return f
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = fromJSONValue(item)
+		}
+		return val
+	case []interface{}:
+		for i, item := range val {
+			val[i] = fromJSONValue(item)
+		}
+		return val
+	default:
+		return v
+	}
+}
@@ -0,0 +1,425 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package codecs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/issue9/session/types"
+)
+
+// msgpack中时间戳的扩展类型
+const msgpackTimeExt = -1
+
+type msgpackCodec struct{}
+
+type msgpackEncoder struct {
+	buf *bytes.Buffer
+}
+
+type msgpackDecoder struct {
+	reader
+}
+
+// 声明一个以MessagePack进行编解码的Codec。
+//
+// 支持nil、布尔、整数、浮点数、字符串、[]byte、time.Time以及由这些类型组成的
+// 切片、数组和map，指针会被解引用，不支持结构体等其它类型。
+//
+// 解码时，整数被还原成int64，float32和float64保持原类型，
+// 数组为[]interface{}，map为map[interface{}]interface{}。
+func NewMsgPack() types.Codec {
+	return &msgpackCodec{}
+}
+
+func (c *msgpackCodec) Encode(data map[interface{}]interface{}) ([]byte, error) {
+	e := &msgpackEncoder{buf: new(bytes.Buffer)}
+	if err := e.encode(data, 0); err != nil {
+		return nil, err
+	}
+
+	return e.buf.Bytes(), nil
+}
+
+func (c *msgpackCodec) Decode(data []byte) (map[interface{}]interface{}, error) {
+	d := &msgpackDecoder{reader: reader{data: data}}
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.remain() > 0 {
+		return nil, errTrailing
+	}
+
+	mapped, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("msgpack: 顶层元素必须为 map，实际为 %T", v)
+	}
+	return mapped, nil
+}
+
+func (e *msgpackEncoder) writeN(prefix byte, n uint64, size int) {
+	e.buf.WriteByte(prefix)
+	var bs [8]byte
+	binary.BigEndian.PutUint64(bs[:], n)
+	e.buf.Write(bs[8-size:])
+}
+
+func (e *msgpackEncoder) writeUint(u uint64) {
+	switch {
+	case u <= math.MaxInt8:
+		e.buf.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		e.writeN(0xcc, u, 1)
+	case u <= math.MaxUint16:
+		e.writeN(0xcd, u, 2)
+	case u <= math.MaxUint32:
+		e.writeN(0xce, u, 4)
+	default:
+		e.writeN(0xcf, u, 8)
+	}
+}
+
+func (e *msgpackEncoder) writeInt(i int64) {
+	switch {
+	case i >= 0:
+		e.writeUint(uint64(i))
+	case i >= -32:
+		e.buf.WriteByte(byte(i))
+	case i >= math.MinInt8:
+		e.writeN(0xd0, uint64(i), 1)
+	case i >= math.MinInt16:
+		e.writeN(0xd1, uint64(i), 2)
+	case i >= math.MinInt32:
+		e.writeN(0xd2, uint64(i), 4)
+	default:
+		e.writeN(0xd3, uint64(i), 8)
+	}
+}
+
+// 写入字符串、二进制、数组及map等的长度信息，
+// fix为对应的fix类型前缀，为0表示没有fix类型。
+func (e *msgpackEncoder) writeLen(n int, fix byte, fixMax int, p8, p16, p32 byte) {
+	switch {
+	case fix != 0 && n <= fixMax:
+		e.buf.WriteByte(fix | byte(n))
+	case p8 != 0 && n <= math.MaxUint8:
+		e.writeN(p8, uint64(n), 1)
+	case n <= math.MaxUint16:
+		e.writeN(p16, uint64(n), 2)
+	default:
+		e.writeN(p32, uint64(n), 4)
+	}
+}
+
+func (e *msgpackEncoder) writeString(s string) {
+	e.writeLen(len(s), 0xa0, 31, 0xd9, 0xda, 0xdb)
+	e.buf.WriteString(s)
+}
+
+func (e *msgpackEncoder) writeBytes(bs []byte) {
+	e.writeLen(len(bs), 0, 0, 0xc4, 0xc5, 0xc6)
+	e.buf.Write(bs)
+}
+
+// 以timestamp 96的格式写入时间
+func (e *msgpackEncoder) writeTime(t time.Time) {
+	e.buf.Write([]byte{0xc7, 12, byte(msgpackTimeExt & 0xff)})
+	var bs [12]byte
+	binary.BigEndian.PutUint32(bs[:4], uint32(t.Nanosecond()))
+	binary.BigEndian.PutUint64(bs[4:], uint64(t.Unix()))
+	e.buf.Write(bs[:])
+}
+
+func (e *msgpackEncoder) encode(v interface{}, depth int) error {
+	if depth > maxDepth {
+		return errTooDeep
+	}
+
+	switch val := v.(type) {
+	case nil:
+		e.buf.WriteByte(0xc0)
+	case bool:
+		if val {
+			e.buf.WriteByte(0xc3)
+		} else {
+			e.buf.WriteByte(0xc2)
+		}
+	case string:
+		e.writeString(val)
+	case []byte:
+		e.writeBytes(val)
+	case time.Time:
+		e.writeTime(val)
+	case map[interface{}]interface{}:
+		e.writeLen(len(val), 0x80, 15, 0, 0xde, 0xdf)
+		for k, item := range val {
+			if err := e.encode(k, depth+1); err != nil {
+				return err
+			}
+			if err := e.encode(item, depth+1); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		e.writeLen(len(val), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, item := range val {
+			if err := e.encode(item, depth+1); err != nil {
+				return err
+			}
+		}
+	default:
+		return e.encodeReflect(reflect.ValueOf(v), depth)
+	}
+
+	return nil
+}
+
+func (e *msgpackEncoder) encodeReflect(rv reflect.Value, depth int) error {
+	switch rv.Kind() {
+	case reflect.Bool:
+		return e.encode(rv.Bool(), depth)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeUint(rv.Uint())
+	case reflect.Float32:
+		e.writeN(0xca, uint64(math.Float32bits(float32(rv.Float()))), 4)
+	case reflect.Float64:
+		e.writeN(0xcb, math.Float64bits(rv.Float()), 8)
+	case reflect.String:
+		e.writeString(rv.String())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			e.buf.WriteByte(0xc0)
+			return nil
+		}
+
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			bs := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(bs), rv)
+			e.writeBytes(bs)
+			return nil
+		}
+
+		e.writeLen(rv.Len(), 0x90, 15, 0, 0xdc, 0xdd)
+		for i := 0; i < rv.Len(); i++ {
+			if err := e.encode(rv.Index(i).Interface(), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if rv.IsNil() {
+			e.buf.WriteByte(0xc0)
+			return nil
+		}
+
+		e.writeLen(rv.Len(), 0x80, 15, 0, 0xde, 0xdf)
+		iter := rv.MapRange()
+		for iter.Next() {
+			if err := e.encode(iter.Key().Interface(), depth+1); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value().Interface(), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			e.buf.WriteByte(0xc0)
+			return nil
+		}
+		return e.encode(rv.Elem().Interface(), depth+1)
+	default:
+		return fmt.Errorf("msgpack: 不支持的类型 %s", rv.Type())
+	}
+
+	return nil
+}
+
+func (d *msgpackDecoder) decode(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+
+	b, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b >= 0x80 && b <= 0x8f:
+		return d.decodeMap(uint64(b&0x0f), depth)
+	case b >= 0x90 && b <= 0x9f:
+		return d.decodeArray(uint64(b&0x0f), depth)
+	case b >= 0xa0 && b <= 0xbf:
+		return d.decodeString(uint64(b & 0x1f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readUint(1 << (b - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		bs, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, bs...), nil
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.readUint(1 << (b - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeExt(n)
+	case 0xca:
+		u, err := d.readUint(4)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float32frombits(uint32(u)), nil
+	case 0xcb:
+		u, err := d.readUint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(u), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.readUint(1 << (b - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return uintValue(u), nil
+	case 0xd0:
+		u, err := d.readUint(1)
+		return int64(int8(u)), err
+	case 0xd1:
+		u, err := d.readUint(2)
+		return int64(int16(u)), err
+	case 0xd2:
+		u, err := d.readUint(4)
+		return int64(int32(u)), err
+	case 0xd3:
+		u, err := d.readUint(8)
+		return int64(u), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.decodeExt(1 << (b - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readUint(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(n)
+	case 0xdc, 0xdd:
+		n, err := d.readUint(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.readUint(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(n, depth)
+	}
+
+	return nil, fmt.Errorf("msgpack: 无效的类型标记 0x%x", b)
+}
+
+func (d *msgpackDecoder) decodeString(n uint64) (interface{}, error) {
+	bs, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(bs), nil
+}
+
+func (d *msgpackDecoder) decodeArray(n uint64, depth int) (interface{}, error) {
+	size, err := d.checkLen(n)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]interface{}, size)
+	for i := range ret {
+		if ret[i], err = d.decode(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n uint64, depth int) (interface{}, error) {
+	size, err := d.checkLen(n)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[interface{}]interface{}, size)
+	for i := 0; i < size; i++ {
+		k, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if err = checkKey(k); err != nil {
+			return nil, err
+		}
+
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		ret[k] = v
+	}
+	return ret, nil
+}
+
+// 解码扩展类型，目前仅支持时间戳。
+func (d *msgpackDecoder) decodeExt(n uint64) (interface{}, error) {
+	typ, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if int8(typ) != msgpackTimeExt {
+		return nil, fmt.Errorf("msgpack: 不支持的扩展类型 %d", int8(typ))
+	}
+
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0), nil
+	case 8:
+		u := binary.BigEndian.Uint64(data)
+		return time.Unix(int64(u&0x3ffffffff), int64(u>>34)), nil
+	case 12:
+		nsec := binary.BigEndian.Uint32(data[:4])
+		sec := binary.BigEndian.Uint64(data[4:])
+		return time.Unix(int64(sec), int64(nsec)), nil
+	}
+
+	return nil, fmt.Errorf("msgpack: 无效的时间戳长度 %d", n)
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package codecs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// 解码时允许的最大嵌套层数，防止恶意数据耗尽栈空间。
+const maxDepth = 100
+
+var (
+	errTruncated = errors.New("数据不完整")
+	errTooDeep   = errors.New("嵌套层数过多")
+	errTrailing  = errors.New("数据末尾存在多余的内容")
+)
+
+// 二进制编码的读取器，msgpack和cbor共用。
+type reader struct {
+	data []byte
+	pos  int
+}
+
+func (r *reader) remain() int {
+	return len(r.data) - r.pos
+}
+
+func (r *reader) readByte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, errTruncated
+	}
+
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+// 读取n个字节，返回的内容是r.data的一部分，不能修改。
+func (r *reader) next(n uint64) ([]byte, error) {
+	if n > uint64(r.remain()) {
+		return nil, errTruncated
+	}
+
+	start := r.pos
+	r.pos += int(n)
+	return r.data[start:r.pos], nil
+}
+
+// 读取大端序的n(1,2,4,8)字节无符号整数。
+func (r *reader) readUint(n int) (uint64, error) {
+	bs, err := r.next(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+
+	switch n {
+	case 1:
+		return uint64(bs[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(bs)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(bs)), nil
+	default:
+		return binary.BigEndian.Uint64(bs), nil
+	}
+}
+
+// 检测容器的元素数量，每个元素至少占用一个字节，
+// 防止通过伪造的长度值分配大量的内存。
+func (r *reader) checkLen(n uint64) (int, error) {
+	if n > uint64(r.remain()) {
+		return 0, errTruncated
+	}
+	return int(n), nil
+}
+
+// 将无符号整数转换成int64，超出范围的保持为uint64。
+func uintValue(u uint64) interface{} {
+	if u > math.MaxInt64 {
+		return u
+	}
+	return int64(u)
+}
+
+// 判断k是否可以作为map的键名。
+func checkKey(k interface{}) error {
+	if k == nil {
+		return nil
+	}
+
+	if !reflect.TypeOf(k).Comparable() {
+		return fmt.Errorf("类型 %T 不能作为键名", k)
+	}
+	return nil
+}
@@ -4,15 +4,26 @@
 
 // session的操作包。
 //
-// 当前session包的sessionid只能通过cookie传递，
-// 所以只有在启用了cookie的浏览器上，本session包才有用。
+// sessionid的传递方式由Provider决定，providers目录下实现了
+// cookie、报头token、JWT以及URL参数等方式，也可以通过NewComposite()
+// 同时使用多种方式。对于不支持cookie的客户端，可以使用报头token或是URL参数。
 //
 // 用户可以通过实现Store接口，自行实现Session数据的存储，
 // 具体的实现方式可以参考stores目录下的相关实例，
 // 该包实现了一些常用的Store。
+// 若存储后端只处理字节内容，可以实现更简单的RawStore接口，
+// 再通过stores.NewRaw()与codecs目录下的Codec组合成Store。
 //
 // 以下是一个简单的session操作示例：
-//  mgr := session.New(stores.NewMemory(...), providers.NewCookie(...))
+//  prv, err := providers.NewCookie(&providers.CookieOptions{
+//      Lifetime: 3600,
+//      Name:     "__Host-sessid",
+//      Path:     "/",
+//      Secure:   true,
+//      HTTPOnly: true,
+//      SameSite: http.SameSiteLaxMode,
+//  })
+//  mgr := session.New(stores.NewMemory(...), prv)
 //
 //  h := func(w http.ResponseWriter, req *http.Request) {
 //      // 在每一个Handler中调用Start()开始一个Session操作。
@@ -28,8 +39,8 @@
 //  mgr.Close()
 //
 // 也可以多个store同时使用：
-//  frontMgr := session.New(stores.NewMemory(), providers.NewCookie())
-//  adminMgr := session.New(stores.NewFile(), provider.NewCookie())
+//  frontMgr := session.New(stores.NewMemory(...), frontCookie)
+//  adminMgr := session.New(stores.NewRaw(stores.NewFile(...), codecs.NewGob(), 3600), adminCookie)
 //
 //  frontHandler := func(w http.ResponseWriter, req *http.Request) {
 //      sess,err :=frontMgr.Start(w, req)
@@ -5,6 +5,7 @@
 package session
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/issue9/session/types"
@@ -14,33 +15,83 @@ import (
 type Manager struct {
 	store    types.Store
 	provider types.Provider
+
+	// 与store和provider对应的支持context的版本
+	ctxStore    types.ContextStore
+	ctxProvider types.ContextProvider
 }
 
 // 声明一个Manager实例。
+//
+// 若store和prv未实现types.ContextStore和types.ContextProvider接口，
+// 会通过types.NewContextStore()和types.NewContextProvider()进行转换。
 func New(store types.Store, prv types.Provider) *Manager {
 	store.StartGC()
+	return newManager(store, prv)
+}
+
+// 声明一个Manager实例，并根据opt启动store的GC。
+//
+// 若store实现了types.GCer接口，则以ctx和opt调用其StartGCContext()，
+// ctx被取消之后，GC也随之停止，但数据依然保留；
+// 否则忽略ctx和opt，与New()相同。
+func NewWithGC(ctx context.Context, store types.Store, prv types.Provider, opt *types.GCOptions) *Manager {
+	if gc, ok := store.(types.GCer); ok {
+		gc.StartGCContext(ctx, opt)
+	} else {
+		store.StartGC()
+	}
 
+	return newManager(store, prv)
+}
+
+func newManager(store types.Store, prv types.Provider) *Manager {
 	return &Manager{
-		store:    store,
-		provider: prv,
+		store:       store,
+		provider:    prv,
+		ctxStore:    types.NewContextStore(store),
+		ctxProvider: types.NewContextProvider(prv),
 	}
 }
 
-// 关闭，会自动释放关联的Store内容，即会删除所有的session数据。
+// 关闭，同时会关闭关联的Store，其中的session数据是否保留由Store决定。
 func (mgr *Manager) Close() error {
 	return mgr.store.Close()
 }
 
+// 立即执行一次GC，返回被删除的session数量。
+//
+// 若store未实现types.GCer接口，则不执行任何操作。
+func (mgr *Manager) GC(ctx context.Context) (int, error) {
+	if gc, ok := mgr.store.(types.GCer); ok {
+		return gc.GC(ctx)
+	}
+	return 0, nil
+}
+
+// 返回GC的统计信息，若store未实现types.GCer接口，则返回空值。
+func (mgr *Manager) GCStats() types.GCStats {
+	if gc, ok := mgr.store.(types.GCer); ok {
+		return gc.GCStats()
+	}
+	return types.GCStats{}
+}
+
 // 获取与当前请求相关联的session数据。
 // 在一个Session中，不能多次调用Start()。
 // 当然也可以把获取的Session实例保存到Context等实例中，方便之后获取。
+//
+// r.Context()会被传递给Store和Provider，客户端断开连接或是超时之后，
+// 相关的操作会被取消。
 func (mgr *Manager) Start(w http.ResponseWriter, r *http.Request) (*Session, error) {
-	sessID, err := mgr.provider.Get(w, r)
+	ctx := r.Context()
+
+	sessID, err := mgr.ctxProvider.GetContext(ctx, w, r)
 	if err != nil {
 		return nil, err
 	}
 
-	items, err := mgr.store.Get(sessID)
+	items, err := mgr.ctxStore.GetContext(ctx, sessID)
 	if err != nil {
 		return nil, err
 	}
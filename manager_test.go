@@ -5,13 +5,16 @@
 package session
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/issue9/assert"
 	"github.com/issue9/session/providers"
 	"github.com/issue9/session/stores"
+	"github.com/issue9/session/types"
 )
 
 func TestManager_Start(t *testing.T) {
@@ -19,7 +22,15 @@ func TestManager_Start(t *testing.T) {
 
 	// 声明Manager实例。
 	store := stores.NewMemory(10)
-	prv := providers.NewCookie(10, "gosession", "/", "localhost", true)
+	prv, err := providers.NewCookie(&providers.CookieOptions{
+		Lifetime: 10,
+		Name:     "gosession",
+		Path:     "/",
+		Domain:   "localhost",
+		Secure:   true,
+		HTTPOnly: true,
+	})
+	a.NotError(err)
 	mgr := New(store, prv)
 	a.NotNil(mgr)
 	defer func() {
@@ -42,3 +53,57 @@ func TestManager_Start(t *testing.T) {
 	response, err := http.Get(srv.URL)
 	a.NotError(err).NotNil(response)
 }
+
+// 请求被取消之后，Start()和Save()应该返回错误。
+func TestManager_Context(t *testing.T) {
+	a := assert.New(t)
+
+	prv, err := providers.NewURL(&providers.URLOptions{Name: "sid"})
+	a.NotError(err)
+	mgr := New(stores.NewMemory(10), prv)
+	defer mgr.Close()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	sess, err := mgr.Start(w, r)
+	a.NotError(err).NotNil(sess)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	cancel()
+	r = r.WithContext(ctx)
+	a.Equal(sess.Save(w, r), context.Canceled)
+
+	sess, err = mgr.Start(w, r)
+	a.Equal(err, context.Canceled).Nil(sess)
+}
+
+func TestManager_GC(t *testing.T) {
+	a := assert.New(t)
+
+	prv, err := providers.NewURL(&providers.URLOptions{Name: "sid"})
+	a.NotError(err)
+	store := stores.NewMemory(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mgr := NewWithGC(ctx, store, prv, &types.GCOptions{
+		Interval: 50 * time.Millisecond,
+		Jitter:   10 * time.Millisecond,
+	})
+	defer mgr.Close()
+
+	a.NotError(store.Save("id1", map[interface{}]interface{}{"k": "v"}))
+	time.Sleep(1200 * time.Millisecond)
+	stats := mgr.GCStats()
+	a.True(stats.Runs > 10).Equal(stats.Removed, 1).Equal(stats.Errors, 0)
+
+	// 取消之后不再执行GC，但可以手动执行
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	runs := mgr.GCStats().Runs
+	time.Sleep(150 * time.Millisecond)
+	a.Equal(mgr.GCStats().Runs, runs)
+
+	removed, err := mgr.GC(context.Background())
+	a.NotError(err).Equal(removed, 0)
+	a.Equal(mgr.GCStats().Runs, runs+1)
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package providers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/issue9/session/types"
+)
+
+// 将多个Provider组合成一个Provider。
+type composite struct {
+	primary   types.Provider
+	providers []types.Provider
+}
+
+// 声明一个组合多个Provider的Provider。
+//
+// Get()会按顺序从providers中查找sessionid，第一个找到的将被采用，
+// 并由该Provider刷新其有效期；若都不存在，则由primary产生新的sessionid。
+// Delete()会依次调用primary及providers中的所有Provider。
+//
+// providers中的元素必须实现了types.Lookuper接口，primary则没有此限制。
+// 比如同时支持浏览器和移动端：
+//  p, err := providers.NewComposite(cookie, cookie, token)
+func NewComposite(primary types.Provider, providers ...types.Provider) (types.Provider, error) {
+	if primary == nil {
+		return nil, errors.New("primary 不能为空")
+	}
+
+	if len(providers) == 0 {
+		return nil, errors.New("providers 不能为空")
+	}
+
+	for _, p := range providers {
+		if _, ok := p.(types.Lookuper); !ok {
+			return nil, errors.New("providers 中的元素必须实现 types.Lookuper 接口")
+		}
+	}
+
+	return &composite{
+		primary:   primary,
+		providers: providers,
+	}, nil
+}
+
+// 查找第一个带有sessionid的Provider，若都没有，则返回nil。
+func (c *composite) lookup(r *http.Request) (types.Provider, string, error) {
+	for _, p := range c.providers {
+		sessID, found, err := p.(types.Lookuper).Lookup(r)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if found {
+			return p, sessID, nil
+		}
+	}
+
+	return nil, "", nil
+}
+
+// session.Lookuper.Lookup()
+func (c *composite) Lookup(r *http.Request) (sessID string, found bool, err error) {
+	p, sessID, err := c.lookup(r)
+	if err != nil {
+		return "", false, err
+	}
+
+	return sessID, p != nil, nil
+}
+
+// session.Provider.Get()
+func (c *composite) Get(w http.ResponseWriter, r *http.Request) (sessID string, err error) {
+	p, _, err := c.lookup(r)
+	if err != nil {
+		return "", err
+	}
+
+	if p == nil { // 都不存在，由primary产生新值
+		p = c.primary
+	}
+
+	return p.Get(w, r)
+}
+
+// session.Issuer.Issue()
+//
+// 由primary产生新的sessionid，primary必须实现了types.Issuer接口。
+func (c *composite) Issue(w http.ResponseWriter, r *http.Request) (sessID string, err error) {
+	iss, ok := c.primary.(types.Issuer)
+	if !ok {
+		return "", errors.New("primary 未实现 types.Issuer 接口")
+	}
+
+	return iss.Issue(w, r)
+}
+
+// session.Provider.Delete()
+func (c *composite) Delete(w http.ResponseWriter, r *http.Request) error {
+	if err := c.primary.Delete(w, r); err != nil {
+		return err
+	}
+
+	for _, p := range c.providers {
+		if p == c.primary {
+			continue
+		}
+
+		if err := p.Delete(w, r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package providers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/issue9/assert"
+	"github.com/issue9/session/types"
+)
+
+var _ types.Lookuper = &composite{}
+
+// 仅实现了types.Provider接口的Provider
+type simpleProvider struct{}
+
+func (p *simpleProvider) Get(w http.ResponseWriter, r *http.Request) (string, error) {
+	return "simple", nil
+}
+
+func (p *simpleProvider) Delete(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func TestNewComposite(t *testing.T) {
+	a := assert.New(t)
+
+	c := newCookie(a)
+	p, err := NewComposite(nil, c)
+	a.Error(err).Nil(p)
+
+	p, err = NewComposite(c)
+	a.Error(err).Nil(p)
+
+	p, err = NewComposite(c, c, &simpleProvider{})
+	a.Error(err).Nil(p)
+
+	// primary 可以不实现 types.Lookuper
+	p, err = NewComposite(&simpleProvider{}, c)
+	a.NotError(err).NotNil(p)
+}
+
+func TestComposite(t *testing.T) {
+	a := assert.New(t)
+
+	c := newCookie(a)
+	tk, err := NewToken(&TokenOptions{Lifetime: 10, Header: "X-Session"})
+	a.NotError(err).NotNil(tk)
+	p, err := NewComposite(c, c, tk)
+	a.NotError(err).NotNil(p)
+
+	// 都不存在，由primary产生
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	sid, err := p.Get(w, r)
+	a.NotError(err).NotEmpty(sid)
+	a.NotEmpty(w.Header().Get("Set-Cookie"))
+	a.Empty(w.Header().Get("X-Session"))
+
+	// 通过token查找
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Session", "token-id")
+	sid, err = p.Get(w, r)
+	a.NotError(err).Equal(sid, "token-id")
+	a.Equal(w.Header().Get("X-Session"), "token-id")
+	a.Empty(w.Header().Get("Set-Cookie"))
+
+	// cookie优先于token
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Session", "token-id")
+	r.AddCookie(&http.Cookie{Name: "gosession", Value: "cookie-id"})
+	sid, err = p.Get(w, r)
+	a.NotError(err).Equal(sid, "cookie-id")
+
+	sid, found, err := p.(types.Lookuper).Lookup(r)
+	a.NotError(err).True(found).Equal(sid, "cookie-id")
+
+	// Delete 应该作用于所有的Provider
+	w = httptest.NewRecorder()
+	a.NotError(p.Delete(w, r))
+	a.NotEmpty(w.Header().Get("Set-Cookie"))
+	_, found = w.Header()["X-Session"]
+	a.True(found)
+}
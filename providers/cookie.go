@@ -5,13 +5,52 @@
 package providers
 
 import (
+	"errors"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/issue9/session/types"
 )
 
+// cookie名称的前缀，具体规则可参考：
+// https://datatracker.ietf.org/doc/html/draft-ietf-httpbis-rfc6265bis#section-4.1.3
+const (
+	hostPrefix   = "__Host-"
+	securePrefix = "__Secure-"
+)
+
+// CookieOptions 为 NewCookie 的参数。
+type CookieOptions struct {
+	// Session的生存周期，单位为秒。
+	Lifetime int
+
+	// sessionid在cookie中的名称。
+	//
+	// 若以 __Host- 开头，则 Secure 必须为 true，Path 必须为 /，且不能指定 Domain；
+	// 若以 __Secure- 开头，则 Secure 必须为 true。
+	Name string
+
+	// 分别对应cookie中相应的值。
+	Path   string
+	Domain string
+	Secure bool
+
+	// 是否禁止客户端脚本访问该cookie。
+	HTTPOnly bool
+
+	// 对应cookie的SameSite属性，可以是 http.SameSiteLaxMode、
+	// http.SameSiteStrictMode 或是 http.SameSiteNoneMode，
+	// 为零值时不输出该属性。
+	//
+	// 当值为 http.SameSiteNoneMode 时，Secure 必须为 true。
+	SameSite http.SameSite
+
+	// 是否为分区cookie(CHIPS)，若为 true，Secure 必须为 true。
+	Partitioned bool
+}
+
 // session操作的一些设置项。
 // 目前sessionid保存于cookie中，cookie的设置都是通过Cookie完成的。
 type cookie struct {
@@ -19,52 +58,132 @@ type cookie struct {
 	lifetime int
 }
 
+// 检测各个值是否合法。
+func (opt *CookieOptions) sanitize() error {
+	if len(opt.Name) == 0 {
+		return errors.New("Name 不能为空")
+	}
+
+	if opt.Lifetime < 0 {
+		return errors.New("Lifetime 不能小于 0")
+	}
+
+	switch opt.SameSite {
+	case 0, http.SameSiteDefaultMode, http.SameSiteLaxMode, http.SameSiteStrictMode:
+	case http.SameSiteNoneMode:
+		if !opt.Secure {
+			return errors.New("SameSite 为 None 时，Secure 必须为 true")
+		}
+	default:
+		return errors.New("无效的 SameSite 值")
+	}
+
+	if opt.Partitioned && !opt.Secure {
+		return errors.New("Partitioned 为 true 时，Secure 必须为 true")
+	}
+
+	switch {
+	case strings.HasPrefix(opt.Name, hostPrefix):
+		if !opt.Secure {
+			return errors.New("__Host- 前缀的 cookie，Secure 必须为 true")
+		}
+		if opt.Path != "/" {
+			return errors.New("__Host- 前缀的 cookie，Path 必须为 /")
+		}
+		if len(opt.Domain) > 0 {
+			return errors.New("__Host- 前缀的 cookie，不能指定 Domain")
+		}
+	case strings.HasPrefix(opt.Name, securePrefix):
+		if !opt.Secure {
+			return errors.New("__Secure- 前缀的 cookie，Secure 必须为 true")
+		}
+	}
+
+	return nil
+}
+
 // 声明一个新的Cookie实例。
 //
-// lifetime：Session的生存周期，单位为秒；
-// sessionIDName sessionid在cookie中的名称；
-// path,domain,secure也分别对应cookie中相应的值。
-func NewCookie(lifetime int, sessionIDName, path, domain string, secure bool) types.Provider {
+// opt中的各值会在此时进行检测，若不合法，则返回错误信息。
+func NewCookie(opt *CookieOptions) (types.Provider, error) {
+	if opt == nil {
+		return nil, errors.New("opt 不能为空")
+	}
+
+	if err := opt.sanitize(); err != nil {
+		return nil, err
+	}
+
 	return &cookie{
-		lifetime: lifetime,
+		lifetime: opt.Lifetime,
 		cookie: &http.Cookie{
-			Name:     sessionIDName,
-			Secure:   secure,
-			HttpOnly: true,
-			Path:     path,
-			Domain:   domain,
+			Name:        opt.Name,
+			Secure:      opt.Secure,
+			HttpOnly:    opt.HTTPOnly,
+			Path:        opt.Path,
+			Domain:      opt.Domain,
+			SameSite:    opt.SameSite,
+			Partitioned: opt.Partitioned,
 		},
+	}, nil
+}
+
+// session.Lookuper.Lookup()
+func (c *cookie) Lookup(r *http.Request) (sessID string, found bool, err error) {
+	cookie, err := r.Cookie(c.cookie.Name)
+	if err != nil || len(cookie.Value) == 0 {
+		return "", false, nil
+	}
+
+	// 从Cookie中获取sessionid值。
+	if sessID, err = url.QueryUnescape(cookie.Value); err != nil {
+		return "", false, err
 	}
+	return sessID, true, nil
 }
 
 // session.Provider.Get()
 func (c *cookie) Get(w http.ResponseWriter, r *http.Request) (sessID string, err error) {
-	cookie, err := r.Cookie(c.cookie.Name)
+	sessID, found, err := c.Lookup(r)
+	if err != nil {
+		return "", err
+	}
 
-	if err != nil || len(cookie.Value) == 0 { // 不存在，产生新的
-		if sessID, err = sessionID(); err != nil {
-			return "", err
-		}
-	} else { // 从Cookie中获取sessionid值。
-		if sessID, err = url.QueryUnescape(cookie.Value); err != nil {
-			return "", err
-		}
+	if !found { // 不存在，产生新的
+		return c.Issue(w, r)
 	}
 
-	c.cookie.Value = url.QueryEscape(sessID)
-	c.cookie.MaxAge = c.lifetime
-	// NOTE:ie8以下只支持Expires而不支持max_age；http1.0只有只有expires，
-	// 而在http1.1中expires属于废弃的属性，max-age才是正规的。
-	c.cookie.Expires = time.Now().Add(time.Second * time.Duration(c.lifetime))
-	http.SetCookie(w, c.cookie)
+	c.write(w, sessID)
+	return sessID, nil
+}
 
+// session.Issuer.Issue()
+func (c *cookie) Issue(w http.ResponseWriter, r *http.Request) (sessID string, err error) {
+	if sessID, err = sessionID(); err != nil {
+		return "", err
+	}
+
+	c.write(w, sessID)
 	return sessID, nil
 }
 
+// 将sessID写入到cookie中。
+func (c *cookie) write(w http.ResponseWriter, sessID string) {
+	// 复制一份，c.cookie可能同时被多个请求使用。
+	ck := *c.cookie
+	ck.Value = url.QueryEscape(sessID)
+	ck.MaxAge = c.lifetime
+	// NOTE:ie8以下只支持Expires而不支持max_age；http1.0只有只有expires，
+	// 而在http1.1中expires属于废弃的属性，max-age才是正规的。
+	ck.Expires = time.Now().Add(time.Second * time.Duration(c.lifetime))
+	http.SetCookie(w, &ck)
+}
+
 // session.Provider.Delete()
 func (c *cookie) Delete(w http.ResponseWriter, r *http.Request) error {
-	c.cookie.MaxAge = -1
-	http.SetCookie(w, c.cookie)
+	ck := *c.cookie
+	ck.MaxAge = -1
+	http.SetCookie(w, &ck)
 
 	return nil
 }
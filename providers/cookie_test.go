@@ -17,8 +17,14 @@ import (
 var _ types.Provider = &cookie{}
 
 func newCookie(a *assert.Assertion) types.Provider {
-	provider := NewCookie(11, "gosession", "/", "localhost", false)
-	a.NotNil(provider)
+	provider, err := NewCookie(&CookieOptions{
+		Lifetime: 11,
+		Name:     "gosession",
+		Path:     "/",
+		Domain:   "localhost",
+		HTTPOnly: true,
+	})
+	a.NotError(err).NotNil(provider)
 	return provider
 }
 
@@ -135,3 +141,78 @@ func TestCookie_Get(t *testing.T) {
 	a.NotError(err).NotNil(resp)
 	a.True(strings.Index(resp.Header.Get("Set-Cookie"), "Max-Age=0") >= 0)
 }
+
+func TestNewCookie(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewCookie(nil)
+	a.Error(err).Nil(p)
+
+	// 名称不能为空
+	p, err = NewCookie(&CookieOptions{Lifetime: 10, Path: "/"})
+	a.Error(err).Nil(p)
+
+	// SameSite=None 必须指定 Secure
+	p, err = NewCookie(&CookieOptions{Name: "sid", SameSite: http.SameSiteNoneMode})
+	a.Error(err).Nil(p)
+	p, err = NewCookie(&CookieOptions{Name: "sid", SameSite: http.SameSiteNoneMode, Secure: true})
+	a.NotError(err).NotNil(p)
+
+	// Partitioned 必须指定 Secure
+	p, err = NewCookie(&CookieOptions{Name: "sid", Partitioned: true})
+	a.Error(err).Nil(p)
+	p, err = NewCookie(&CookieOptions{Name: "sid", Partitioned: true, Secure: true})
+	a.NotError(err).NotNil(p)
+
+	// __Secure- 前缀
+	p, err = NewCookie(&CookieOptions{Name: "__Secure-sid", Path: "/admin"})
+	a.Error(err).Nil(p)
+	p, err = NewCookie(&CookieOptions{Name: "__Secure-sid", Path: "/admin", Domain: "example.com", Secure: true})
+	a.NotError(err).NotNil(p)
+
+	// __Host- 前缀
+	p, err = NewCookie(&CookieOptions{Name: "__Host-sid", Path: "/"})
+	a.Error(err).Nil(p)
+	p, err = NewCookie(&CookieOptions{Name: "__Host-sid", Path: "/admin", Secure: true})
+	a.Error(err).Nil(p)
+	p, err = NewCookie(&CookieOptions{Name: "__Host-sid", Path: "/", Domain: "example.com", Secure: true})
+	a.Error(err).Nil(p)
+	p, err = NewCookie(&CookieOptions{Name: "__Host-sid", Path: "/", Secure: true})
+	a.NotError(err).NotNil(p)
+}
+
+// 测试输出的cookie属性
+func TestCookie_Attributes(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewCookie(&CookieOptions{
+		Lifetime:    10,
+		Name:        "__Host-sid",
+		Path:        "/",
+		Secure:      true,
+		SameSite:    http.SameSiteStrictMode,
+		Partitioned: true,
+	})
+	a.NotError(err).NotNil(p)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	sid, err := p.Get(w, r)
+	a.NotError(err).NotEmpty(sid)
+
+	header := w.Header().Get("Set-Cookie")
+	a.True(strings.HasPrefix(header, "__Host-sid="))
+	a.True(strings.Contains(header, "SameSite=Strict"))
+	a.True(strings.Contains(header, "Partitioned"))
+	a.True(strings.Contains(header, "Secure"))
+	a.False(strings.Contains(header, "HttpOnly"))
+
+	p, err = NewCookie(&CookieOptions{Lifetime: 10, Name: "sid", Path: "/", HTTPOnly: true, SameSite: http.SameSiteLaxMode})
+	a.NotError(err).NotNil(p)
+	w = httptest.NewRecorder()
+	_, err = p.Get(w, r)
+	a.NotError(err)
+	header = w.Header().Get("Set-Cookie")
+	a.True(strings.Contains(header, "HttpOnly"))
+	a.True(strings.Contains(header, "SameSite=Lax"))
+}
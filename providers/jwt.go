@@ -0,0 +1,425 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package providers
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/issue9/session/types"
+)
+
+// 验证JWT失败时返回的错误信息。
+var (
+	ErrInvalidToken   = errors.New("无效的 token")
+	ErrInvalidSign    = errors.New("token 签名错误")
+	ErrTokenExpired   = errors.New("token 已经过期")
+	ErrTokenIssuedAt  = errors.New("token 的签发时间无效")
+	ErrUnsupportedAlg = errors.New("不支持的签名算法")
+)
+
+var b64 = base64.RawURLEncoding
+
+// 验证iat和exp时允许的时钟误差，
+// 避免签发和验证的服务器之间时间不一致时，刚签发的token无法通过验证。
+const jwtLeeway = 30 * time.Second
+
+// JWT的签名算法。
+type Signer interface {
+	// 算法名称，对应JWT报头中的alg字段。
+	Alg() string
+
+	// 对data进行签名。
+	Sign(data []byte) ([]byte, error)
+
+	// 验证sig是否为data的正确签名，若不是，返回ErrInvalidSign。
+	Verify(data, sig []byte) error
+}
+
+// 记录已经被撤销的JWT。
+type Denylist interface {
+	// 撤销jti，expires为该token原本的过期时间，
+	// 在此时间之后，该记录可以被清除。
+	Revoke(jti string, expires time.Time) error
+
+	// jti是否已经被撤销。
+	Revoked(jti string) (bool, error)
+}
+
+// JWTOptions 为 NewJWT 的参数。
+//
+// Token的传递方式与 NewToken 相同，由 TokenOptions 指定，
+// 只不过报头中的值是签名之后的JWT，而不是sessionid本身。
+type JWTOptions struct {
+	TokenOptions
+
+	// 签名算法，不能为空。
+	Signer Signer
+
+	// 撤销列表，为空表示不检测token是否被撤销，
+	// 此时Delete()仅通知客户端丢弃token。
+	Denylist Denylist
+}
+
+type hs256 struct {
+	key []byte
+}
+
+type eddsa struct {
+	priv ed25519.PrivateKey
+	pub  ed25519.PublicKey
+}
+
+type storeDenylist struct {
+	store types.RawStore
+}
+
+// JWT中的claims部分。
+type claims struct {
+	SessID    string `json:"sid"`
+	ID        string `json:"jti"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type jwt struct {
+	token    *token
+	signer   Signer
+	denylist Denylist
+	header   []byte // 编码之后的JWT报头
+}
+
+// 声明一个HMAC-SHA256的签名算法，key不能为空。
+func NewHS256(key []byte) (Signer, error) {
+	if len(key) == 0 {
+		return nil, errors.New("key 不能为空")
+	}
+
+	return &hs256{key: key}, nil
+}
+
+func (s *hs256) Alg() string {
+	return "HS256"
+}
+
+func (s *hs256) Sign(data []byte) ([]byte, error) {
+	h := hmac.New(sha256.New, s.key)
+	h.Write(data)
+	return h.Sum(nil), nil
+}
+
+func (s *hs256) Verify(data, sig []byte) error {
+	expected, err := s.Sign(data)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(expected, sig) {
+		return ErrInvalidSign
+	}
+	return nil
+}
+
+// 声明一个Ed25519的签名算法。
+//
+// priv可以为nil，此时只能验证token，而不能签发新的token，
+// 适用于仅需要验证session的服务；pub为nil时，从priv中获取。
+// 两者不能同时为nil，且长度必须分别为 ed25519.PrivateKeySize 和 ed25519.PublicKeySize。
+func NewEdDSA(priv ed25519.PrivateKey, pub ed25519.PublicKey) (Signer, error) {
+	if priv != nil {
+		if len(priv) != ed25519.PrivateKeySize {
+			return nil, errors.New("无效的 priv 长度")
+		}
+
+		p := priv.Public().(ed25519.PublicKey)
+		if pub != nil && !p.Equal(pub) {
+			return nil, errors.New("pub 与 priv 不匹配")
+		}
+		pub = p
+	}
+
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("无效的 pub 长度")
+	}
+
+	return &eddsa{priv: priv, pub: pub}, nil
+}
+
+func (s *eddsa) Alg() string {
+	return "EdDSA"
+}
+
+func (s *eddsa) Sign(data []byte) ([]byte, error) {
+	if s.priv == nil {
+		return nil, errors.New("未指定私钥，无法签名")
+	}
+	return ed25519.Sign(s.priv, data), nil
+}
+
+func (s *eddsa) Verify(data, sig []byte) error {
+	if !ed25519.Verify(s.pub, data, sig) {
+		return ErrInvalidSign
+	}
+	return nil
+}
+
+// 声明一个以types.RawStore作为存储的撤销列表。
+//
+// 每条撤销记录的生存时间与token剩余的有效时间相同，
+// 在token过期之前不会被GC清除，之后则由store自行清除。
+//
+// 不接受types.Store：types.Store中数据的生存时间由store统一设置，无法为每条记录单独指定，
+// 若其短于token的有效期，撤销记录会先于token被清除，已经撤销的token又会重新生效。
+func NewDenylist(store types.RawStore) Denylist {
+	return &storeDenylist{store: store}
+}
+
+func (d *storeDenylist) Revoke(jti string, expires time.Time) error {
+	ttl := time.Until(expires)
+	if ttl <= 0 { // 已经过期的token本身就无法通过验证
+		return nil
+	}
+	return d.store.Set(jti, []byte{1}, ttl)
+}
+
+func (d *storeDenylist) Revoked(jti string) (bool, error) {
+	data, _, err := d.store.Get(jti)
+	if err != nil {
+		return false, err
+	}
+	return data != nil, nil
+}
+
+// 声明一个以JWT传递sessionid的Provider。
+//
+// JWT中包含了sid、jti、iat和exp等字段，其中sid为sessionid，
+// jti为该token的唯一ID，用于撤销token。
+func NewJWT(opt *JWTOptions) (types.Provider, error) {
+	if opt == nil {
+		return nil, errors.New("opt 不能为空")
+	}
+
+	if opt.Signer == nil {
+		return nil, errors.New("Signer 不能为空")
+	}
+
+	// 为0时，签发的token在下一次请求时就已经过期。
+	if opt.Lifetime <= 0 {
+		return nil, errors.New("Lifetime 必须大于 0")
+	}
+
+	t, err := opt.TokenOptions.newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := json.Marshal(map[string]string{
+		"alg": opt.Signer.Alg(),
+		"typ": "JWT",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &jwt{
+		token:    t,
+		signer:   opt.Signer,
+		denylist: opt.Denylist,
+		header:   []byte(b64.EncodeToString(header)),
+	}, nil
+}
+
+// 将c签名并编码成JWT格式。
+func (j *jwt) encode(c *claims) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(j.header)
+	buf.WriteByte('.')
+	buf.WriteString(b64.EncodeToString(payload))
+
+	sig, err := j.signer.Sign(buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+	buf.WriteByte('.')
+	buf.WriteString(b64.EncodeToString(sig))
+
+	return buf.String(), nil
+}
+
+// 解析并验证JWT，不会检测是否已经被撤销。
+func (j *jwt) decode(val string, now time.Time) (*claims, error) {
+	parts := strings.Split(val, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	header, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	h := map[string]string{}
+	if err = json.Unmarshal(header, &h); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if h["alg"] != j.signer.Alg() { // 防止 alg=none 之类的攻击
+		return nil, ErrUnsupportedAlg
+	}
+
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if err = j.signer.Verify([]byte(val[:len(parts[0])+1+len(parts[1])]), sig); err != nil {
+		return nil, err
+	}
+
+	payload, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	c := &claims{}
+	if err = json.Unmarshal(payload, c); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if len(c.SessID) == 0 || len(c.ID) == 0 {
+		return nil, ErrInvalidToken
+	}
+
+	if c.IssuedAt <= 0 || c.IssuedAt > now.Add(jwtLeeway).Unix() {
+		return nil, ErrTokenIssuedAt
+	}
+
+	if c.ExpiresAt <= now.Add(-jwtLeeway).Unix() {
+		return nil, ErrTokenExpired
+	}
+
+	return c, nil
+}
+
+// 从请求中获取一个合法的JWT，若不存在或是不合法，返回nil。
+func (j *jwt) claims(r *http.Request) (*claims, error) {
+	val := j.token.lookup(r)
+	if len(val) == 0 {
+		return nil, nil
+	}
+
+	c, err := j.decode(val, time.Now())
+	if err != nil { // 不合法的token，当作不存在处理。
+		return nil, nil
+	}
+
+	if j.denylist != nil {
+		revoked, err := j.denylist.Revoked(c.ID)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, nil
+		}
+	}
+
+	return c, nil
+}
+
+// session.Lookuper.Lookup()
+func (j *jwt) Lookup(r *http.Request) (sessID string, found bool, err error) {
+	c, err := j.claims(r)
+	if err != nil || c == nil {
+		return "", false, err
+	}
+
+	return c.SessID, true, nil
+}
+
+// session.Provider.Get()
+//
+// 若请求中不存在合法的token，则签发一个新的token，并通过报头返回给客户端。
+func (j *jwt) Get(w http.ResponseWriter, r *http.Request) (sessID string, err error) {
+	c, err := j.claims(r)
+	if err != nil {
+		return "", err
+	}
+	if c != nil {
+		return c.SessID, nil
+	}
+
+	return j.issue(w)
+}
+
+// session.Issuer.Issue()
+//
+// 若指定了撤销列表，请求中原有的token会被撤销。
+func (j *jwt) Issue(w http.ResponseWriter, r *http.Request) (sessID string, err error) {
+	if err = j.revoke(r); err != nil {
+		return "", err
+	}
+
+	return j.issue(w)
+}
+
+// 签发一个新的token
+func (j *jwt) issue(w http.ResponseWriter) (sessID string, err error) {
+	if sessID, err = sessionID(); err != nil {
+		return "", err
+	}
+	jti, err := sessionID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	expires := now.Add(time.Second * time.Duration(j.token.lifetime))
+	val, err := j.encode(&claims{
+		SessID:    sessID,
+		ID:        jti,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expires.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	j.token.write(w, val, expires)
+	return sessID, nil
+}
+
+// session.Provider.Delete()
+//
+// 若指定了撤销列表，则会将当前token的jti写入到撤销列表中。
+func (j *jwt) Delete(w http.ResponseWriter, r *http.Request) error {
+	if err := j.revoke(r); err != nil {
+		return err
+	}
+
+	return j.token.Delete(w, r)
+}
+
+// 将请求中的token写入撤销列表。
+func (j *jwt) revoke(r *http.Request) error {
+	if j.denylist == nil {
+		return nil
+	}
+
+	c, err := j.claims(r)
+	if err != nil || c == nil {
+		return err
+	}
+
+	return j.denylist.Revoke(c.ID, time.Unix(c.ExpiresAt, 0))
+}
@@ -0,0 +1,253 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package providers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert"
+	"github.com/issue9/session/stores"
+	"github.com/issue9/session/types"
+)
+
+var (
+	_ types.Provider = &jwt{}
+	_ types.Lookuper = &jwt{}
+)
+
+func newHS256(a *assert.Assertion, key string) Signer {
+	s, err := NewHS256([]byte(key))
+	a.NotError(err).NotNil(s)
+	return s
+}
+
+func newEdDSA(a *assert.Assertion, priv ed25519.PrivateKey, pub ed25519.PublicKey) Signer {
+	s, err := NewEdDSA(priv, pub)
+	a.NotError(err).NotNil(s)
+	return s
+}
+
+// 以文件存储器作为撤销列表
+func newDenylist(a *assert.Assertion) (Denylist, func()) {
+	dir, err := ioutil.TempDir("", "denylist")
+	a.NotError(err)
+
+	store, err := stores.NewFile(dir, 10, nil)
+	a.NotError(err)
+	return NewDenylist(store), func() {
+		a.NotError(store.Close())
+		a.NotError(os.RemoveAll(dir))
+	}
+}
+
+func newJWT(a *assert.Assertion, signer Signer, d Denylist) *jwt {
+	p, err := NewJWT(&JWTOptions{
+		TokenOptions: TokenOptions{
+			Lifetime:       10,
+			Bearer:         true,
+			ResponseHeader: "X-Token",
+		},
+		Signer:   signer,
+		Denylist: d,
+	})
+	a.NotError(err).NotNil(p)
+	return p.(*jwt)
+}
+
+func TestNewJWT(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewJWT(&JWTOptions{TokenOptions: TokenOptions{Bearer: true, ResponseHeader: "X-Token"}})
+	a.Error(err).Nil(p)
+
+	p, err = NewJWT(&JWTOptions{Signer: newHS256(a, "key")})
+	a.Error(err).Nil(p)
+
+	p, err = NewJWT(nil)
+	a.Error(err).Nil(p)
+
+	p, err = NewJWT(&JWTOptions{
+		TokenOptions: TokenOptions{Bearer: true, ResponseHeader: "X-Token"},
+		Signer:       newHS256(a, "key"),
+	})
+	a.Error(err).Nil(p)
+}
+
+func TestNewSigner(t *testing.T) {
+	a := assert.New(t)
+
+	s, err := NewHS256(nil)
+	a.Error(err).Nil(s)
+	s, err = NewHS256([]byte{})
+	a.Error(err).Nil(s)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	a.NotError(err)
+	pub2, _, err := ed25519.GenerateKey(rand.Reader)
+	a.NotError(err)
+
+	s, err = NewEdDSA(nil, nil)
+	a.Error(err).Nil(s)
+	s, err = NewEdDSA(nil, pub[:10])
+	a.Error(err).Nil(s)
+	s, err = NewEdDSA(priv[:10], nil)
+	a.Error(err).Nil(s)
+	s, err = NewEdDSA(priv, pub2)
+	a.Error(err).Nil(s)
+
+	s, err = NewEdDSA(priv, pub)
+	a.NotError(err).NotNil(s)
+	s, err = NewEdDSA(nil, pub)
+	a.NotError(err).NotNil(s)
+}
+
+func TestJWT_Signer(t *testing.T) {
+	a := assert.New(t)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	a.NotError(err)
+
+	signers := []Signer{
+		newHS256(a, "secret"),
+		newEdDSA(a, priv, nil),
+	}
+
+	for _, s := range signers {
+		p := newJWT(a, s, nil)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		sid, err := p.Get(w, r)
+		a.NotError(err).NotEmpty(sid)
+		token := w.Header().Get("X-Token")
+		a.Equal(3, len(strings.Split(token, ".")))
+
+		c, err := p.decode(token, time.Now())
+		a.NotError(err).NotNil(c)
+		a.Equal(c.SessID, sid).NotEmpty(c.ID)
+		a.True(c.ExpiresAt > c.IssuedAt)
+
+		// 带上token再次访问，应该返回相同的sessionid，且不再签发新的token。
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		sid1, err := p.Get(w, r)
+		a.NotError(err).Equal(sid1, sid)
+		a.Empty(w.Header().Get("X-Token"))
+
+		// 允许一定的时钟误差
+		_, err = p.decode(token, time.Now().Add(11*time.Second))
+		a.NotError(err)
+		_, err = p.decode(token, time.Now().Add(-jwtLeeway+time.Second))
+		a.NotError(err)
+
+		// 过期
+		_, err = p.decode(token, time.Now().Add(11*time.Second+jwtLeeway))
+		a.Equal(err, ErrTokenExpired)
+
+		// 篡改内容
+		parts := strings.Split(token, ".")
+		other, err := p.encode(&claims{SessID: "other", ID: "1", IssuedAt: time.Now().Unix(), ExpiresAt: time.Now().Add(time.Hour).Unix()})
+		a.NotError(err)
+		forged := parts[0] + "." + strings.Split(other, ".")[1] + "." + parts[2]
+		_, err = p.decode(forged, time.Now())
+		a.Equal(err, ErrInvalidSign)
+
+		// 不合法的token，产生新的sessionid
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+forged)
+		sid1, err = p.Get(w, r)
+		a.NotError(err).NotEqual(sid1, sid).NotEqual(sid1, "other")
+	}
+
+	// 仅有公钥，可以验证，但不能签发。
+	signer := newEdDSA(a, priv, nil)
+	token, err := newJWT(a, signer, nil).encode(&claims{SessID: "sid", ID: "1", IssuedAt: time.Now().Unix(), ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	a.NotError(err)
+	verifier := newJWT(a, newEdDSA(a, nil, pub), nil)
+	c, err := verifier.decode(token, time.Now())
+	a.NotError(err).Equal(c.SessID, "sid")
+	_, err = verifier.Get(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	a.Error(err)
+
+	// 算法不匹配
+	_, err = newJWT(a, newHS256(a, "secret"), nil).decode(token, time.Now())
+	a.Equal(err, ErrUnsupportedAlg)
+
+	// 签发时间无效
+	p := newJWT(a, signer, nil)
+	for _, iat := range []int64{0, time.Now().Add(time.Hour).Unix(), time.Now().Add(jwtLeeway + 2*time.Second).Unix()} {
+		token, err = p.encode(&claims{SessID: "sid", ID: "1", IssuedAt: iat, ExpiresAt: time.Now().Add(2 * time.Hour).Unix()})
+		a.NotError(err)
+		_, err = p.decode(token, time.Now())
+		a.Equal(err, ErrTokenIssuedAt)
+	}
+
+	// 签发服务器的时间稍快
+	token, err = p.encode(&claims{SessID: "sid", ID: "1", IssuedAt: time.Now().Add(5 * time.Second).Unix(), ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	a.NotError(err)
+	_, err = p.decode(token, time.Now())
+	a.NotError(err)
+}
+
+func TestJWT_Delete(t *testing.T) {
+	a := assert.New(t)
+
+	d, cleanup := newDenylist(a)
+	defer cleanup()
+	p := newJWT(a, newHS256(a, "secret"), d)
+
+	w := httptest.NewRecorder()
+	sid, err := p.Get(w, httptest.NewRequest("GET", "/", nil))
+	a.NotError(err).NotEmpty(sid)
+	token := w.Header().Get("X-Token")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	id, found, err := p.Lookup(r)
+	a.NotError(err).True(found).Equal(id, sid)
+
+	// 撤销之后，不能再使用该token
+	w = httptest.NewRecorder()
+	a.NotError(p.Delete(w, r))
+	_, found = w.Header()["X-Token"]
+	a.True(found).Empty(w.Header().Get("X-Token"))
+
+	_, found, err = p.Lookup(r)
+	a.NotError(err).False(found)
+
+	sid1, err := p.Get(httptest.NewRecorder(), r)
+	a.NotError(err).NotEqual(sid1, sid)
+}
+
+func TestDenylist(t *testing.T) {
+	a := assert.New(t)
+	d, cleanup := newDenylist(a)
+	defer cleanup()
+
+	revoked, err := d.Revoked("jti1")
+	a.NotError(err).False(revoked)
+
+	// 撤销记录的生存时间与token相同，与存储器的设置无关
+	a.NotError(d.Revoke("jti1", time.Now().Add(time.Hour)))
+	a.NotError(d.Revoke("jti2", time.Now().Add(-time.Second)))
+	revoked, err = d.Revoked("jti1")
+	a.NotError(err).True(revoked)
+	revoked, err = d.Revoked("jti2")
+	a.NotError(err).False(revoked)
+
+	a.NotError(d.Revoke("jti3", time.Now().Add(1500*time.Millisecond)))
+	time.Sleep(2 * time.Second)
+	revoked, err = d.Revoked("jti3")
+	a.NotError(err).False(revoked)
+}
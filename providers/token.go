@@ -5,35 +5,151 @@
 package providers
 
 import (
+	"errors"
 	"net/http"
+	"strings"
+	"time"
+
+	"github.com/issue9/session/types"
 )
 
+// Authorization报头中token的前缀。
+const bearerPrefix = "Bearer "
+
+// TokenOptions 为 NewToken 的参数。
+type TokenOptions struct {
+	// Session的生存周期，单位为秒。
+	Lifetime int
+
+	// 客户端传递token的报头名称，为空表示不从自定义报头中读取。
+	Header string
+
+	// 是否从 Authorization: Bearer <token> 中读取token。
+	// Header 和 Bearer 至少需要指定一个。
+	Bearer bool
+
+	// 服务端返回token的报头名称，为空时与 Header 相同。
+	// 在 Bearer 为 true 且 Header 为空的情况下，该值必须指定。
+	ResponseHeader string
+
+	// 服务端返回token过期时间的报头名称，格式为 http.TimeFormat。
+	// 为空表示不输出过期时间。
+	ExpiresHeader string
+}
+
 type token struct {
-	name     string // token在报头中的名称
-	lifetime int
+	name           string // token在报头中的名称
+	bearer         bool
+	responseHeader string
+	expiresHeader  string
+	lifetime       int
 }
 
-func NewToken(name string, lifetime int) *token {
+// 检测各个值是否合法，并根据opt生成token实例。
+//
+// 默认值只会填充到token中，opt本身不会被修改。
+func (opt *TokenOptions) newToken() (*token, error) {
+	if len(opt.Header) == 0 && !opt.Bearer {
+		return nil, errors.New("Header 和 Bearer 至少需要指定一个")
+	}
+
+	if opt.Lifetime < 0 {
+		return nil, errors.New("Lifetime 不能小于 0")
+	}
+
+	responseHeader := opt.ResponseHeader
+	if len(responseHeader) == 0 {
+		if len(opt.Header) == 0 {
+			return nil, errors.New("ResponseHeader 不能为空")
+		}
+		responseHeader = opt.Header
+	}
+
 	return &token{
-		name:     name,
-		lifetime: lifetime,
+		name:           opt.Header,
+		bearer:         opt.Bearer,
+		responseHeader: responseHeader,
+		expiresHeader:  opt.ExpiresHeader,
+		lifetime:       opt.Lifetime,
+	}, nil
+}
+
+// 声明一个通过报头传递sessionid的Provider。
+//
+// 每次调用Get()都会将sessionid及其过期时间写入到响应的报头中，
+// 客户端应该保存该值，并在之后的请求中通过 Header 或是
+// Authorization: Bearer 报头传递回来。
+func NewToken(opt *TokenOptions) (types.Provider, error) {
+	if opt == nil {
+		return nil, errors.New("opt 不能为空")
+	}
+
+	t, err := opt.newToken()
+	if err != nil {
+		return nil, err
 	}
+	return t, nil
+}
+
+// 从请求中获取token值，不存在时返回空值。
+func (t *token) lookup(req *http.Request) string {
+	if len(t.name) > 0 {
+		if sessID := req.Header.Get(t.name); len(sessID) > 0 {
+			return sessID
+		}
+	}
+
+	if t.bearer {
+		auth := req.Header.Get("Authorization")
+		if len(auth) > len(bearerPrefix) && strings.EqualFold(auth[:len(bearerPrefix)], bearerPrefix) {
+			return strings.TrimSpace(auth[len(bearerPrefix):])
+		}
+	}
+
+	return ""
+}
+
+// session.Lookuper.Lookup()
+func (t *token) Lookup(req *http.Request) (sessID string, found bool, err error) {
+	sessID = t.lookup(req)
+	return sessID, len(sessID) > 0, nil
 }
 
 // session.Provider.Get()
 func (t *token) Get(w http.ResponseWriter, req *http.Request) (sessID string, err error) {
-	sessID = req.Header.Get(t.name)
+	sessID = t.lookup(req)
 	if len(sessID) == 0 {
-		if sessID, err = sessionID(); err != nil {
-			return "", err
-		}
+		return t.Issue(w, req)
 	}
 
+	t.write(w, sessID, time.Now().Add(time.Second*time.Duration(t.lifetime)))
 	return sessID, nil
 }
 
+// session.Issuer.Issue()
+func (t *token) Issue(w http.ResponseWriter, req *http.Request) (sessID string, err error) {
+	if sessID, err = sessionID(); err != nil {
+		return "", err
+	}
+
+	t.write(w, sessID, time.Now().Add(time.Second*time.Duration(t.lifetime)))
+	return sessID, nil
+}
+
+// 将val及其过期时间写入到响应的报头中。
+func (t *token) write(w http.ResponseWriter, val string, expires time.Time) {
+	w.Header().Set(t.responseHeader, val)
+	if len(t.expiresHeader) > 0 {
+		w.Header().Set(t.expiresHeader, expires.UTC().Format(http.TimeFormat))
+	}
+}
+
 // session.Provider.Delete()
+//
+// token 由用户在客户端维持，服务端通过将 ResponseHeader 设置为空值，
+// 以及将 ExpiresHeader 设置为一个过去的时间，通知客户端丢弃该token。
+// 只在Session.Destroy()中调用，Session.Free()不会清空报头中的token。
 func (t *token) Delete(w http.ResponseWriter, req *http.Request) error {
-	// token 由用户在客户端维持。服务端并不用做特殊处理。
+	t.write(w, "", time.Unix(0, 0))
 	return nil
 }
@@ -0,0 +1,106 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package providers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert"
+	"github.com/issue9/session/types"
+)
+
+var _ types.Provider = &token{}
+
+func TestNewToken(t *testing.T) {
+	a := assert.New(t)
+
+	// Header 和 Bearer 都未指定
+	p, err := NewToken(&TokenOptions{Lifetime: 10})
+	a.Error(err).Nil(p)
+
+	// 仅 Bearer，未指定 ResponseHeader
+	p, err = NewToken(&TokenOptions{Lifetime: 10, Bearer: true})
+	a.Error(err).Nil(p)
+
+	p, err = NewToken(&TokenOptions{Lifetime: 10, Bearer: true, ResponseHeader: "X-Session"})
+	a.NotError(err).NotNil(p)
+
+	// ResponseHeader 默认与 Header 相同，但不会修改opt
+	opt := &TokenOptions{Lifetime: 10, Header: "X-Session"}
+	p, err = NewToken(opt)
+	a.NotError(err).NotNil(p)
+	a.Equal(p.(*token).responseHeader, "X-Session")
+	a.Empty(opt.ResponseHeader)
+
+	p, err = NewToken(nil)
+	a.Error(err).Nil(p)
+}
+
+func TestToken_Get(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewToken(&TokenOptions{
+		Lifetime:      10,
+		Header:        "X-Session",
+		Bearer:        true,
+		ExpiresHeader: "X-Session-Expires",
+	})
+	a.NotError(err).NotNil(p)
+
+	// 不存在token，产生新值，并通过报头返回给客户端。
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	sid, err := p.Get(w, r)
+	a.NotError(err).NotEmpty(sid)
+	a.Equal(w.Header().Get("X-Session"), sid)
+	expires, err := http.ParseTime(w.Header().Get("X-Session-Expires"))
+	a.NotError(err).True(expires.After(time.Now()))
+
+	// 从自定义报头中获取
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Session", sid)
+	sid1, err := p.Get(w, r)
+	a.NotError(err).Equal(sid1, sid)
+	a.Equal(w.Header().Get("X-Session"), sid)
+
+	// 从 Authorization 中获取
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+sid)
+	sid1, err = p.Get(w, r)
+	a.NotError(err).Equal(sid1, sid)
+
+	// 非 Bearer 的 Authorization，产生新值
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Basic "+sid)
+	sid1, err = p.Get(w, r)
+	a.NotError(err).NotEqual(sid1, sid)
+}
+
+func TestToken_Delete(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewToken(&TokenOptions{
+		Lifetime:      10,
+		Header:        "X-Session",
+		ExpiresHeader: "X-Session-Expires",
+	})
+	a.NotError(err).NotNil(p)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Session", "sid")
+	a.NotError(p.Delete(w, r))
+
+	vals, found := w.Header()["X-Session"]
+	a.True(found).Equal(vals, []string{""})
+	expires, err := http.ParseTime(w.Header().Get("X-Session-Expires"))
+	a.NotError(err).True(expires.Before(time.Now()))
+}
@@ -0,0 +1,235 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package providers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// URLOptions 为 NewURL 的参数。
+type URLOptions struct {
+	// sessionid在URL中的参数名称。
+	Name string
+
+	// 为 true 时，sessionid以路径参数的形式附加在路径的最后一段上，
+	// 比如 /path/to/page;sessid=xxx；
+	// 否则以查询参数的形式传递，比如 /path/to/page?sessid=xxx。
+	PathParam bool
+}
+
+// URL 通过URL传递sessionid的Provider，由 NewURL 声明。
+//
+// 除了types.Provider接口之外，还提供了Rewrite()、RewriteWriter()和Strip()
+// 等改写链接的方法。
+type URL struct {
+	name      string
+	pathParam bool
+	param     string // 路径参数的前缀，即 ;name=
+}
+
+// 保存在context中的sessionid，由Strip()写入。
+type urlContextKey string
+
+// 重定向时改写Location报头的ResponseWriter。
+type urlResponseWriter struct {
+	http.ResponseWriter
+	p      *URL
+	r      *http.Request
+	sessID string
+}
+
+// 声明一个通过URL传递sessionid的Provider，
+// 适用于不支持cookie的客户端。
+//
+// 服务端需要通过Rewrite()和RewriteWriter()将sessionid附加到输出的链接及重定向地址上。
+//
+// NOTE: 通过URL传递的sessionid很容易通过Referer报头、日志及分享链接等途径泄漏，
+// 在用户登录等权限变化之后，应该调用Session.Regenerate()重新生成sessionid。
+func NewURL(opt *URLOptions) (*URL, error) {
+	if opt == nil {
+		return nil, errors.New("opt 不能为空")
+	}
+
+	if len(opt.Name) == 0 {
+		return nil, errors.New("Name 不能为空")
+	}
+
+	return &URL{
+		name:      opt.Name,
+		pathParam: opt.PathParam,
+		param:     ";" + opt.Name + "=",
+	}, nil
+}
+
+// 从路径中分离出sessionid，返回去除了路径参数之后的路径。
+func (p *URL) splitPath(path string) (string, string) {
+	index := strings.LastIndex(path, p.param)
+	if index < 0 {
+		return path, ""
+	}
+
+	val := path[index+len(p.param):]
+	if end := strings.IndexAny(val, ";/"); end >= 0 {
+		return path[:index] + val[end:], val[:end]
+	}
+	return path[:index], val
+}
+
+// session.Lookuper.Lookup()
+func (p *URL) Lookup(r *http.Request) (sessID string, found bool, err error) {
+	if sessID, ok := r.Context().Value(urlContextKey(p.name)).(string); ok {
+		return sessID, len(sessID) > 0, nil
+	}
+
+	if !p.pathParam {
+		sessID = r.URL.Query().Get(p.name)
+		return sessID, len(sessID) > 0, nil
+	}
+
+	if _, sessID = p.splitPath(r.URL.EscapedPath()); len(sessID) == 0 {
+		return "", false, nil
+	}
+	if sessID, err = url.PathUnescape(sessID); err != nil {
+		return "", false, err
+	}
+	return sessID, len(sessID) > 0, nil
+}
+
+// session.Provider.Get()
+func (p *URL) Get(w http.ResponseWriter, r *http.Request) (sessID string, err error) {
+	sessID, found, err := p.Lookup(r)
+	if err != nil {
+		return "", err
+	}
+
+	if !found {
+		return p.Issue(w, r)
+	}
+	return sessID, nil
+}
+
+// session.Issuer.Issue()
+//
+// 仅产生新的sessionid，需要通过Rewrite()等方法将其传递给客户端。
+func (p *URL) Issue(w http.ResponseWriter, r *http.Request) (sessID string, err error) {
+	return sessionID()
+}
+
+// session.Provider.Delete()
+//
+// sessionid保存在客户端的URL中，服务端无法将其删除，
+// 只要之后的链接不再附带该sessionid即可。
+func (p *URL) Delete(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// 将路径参数形式的sessionid从请求路径中去掉，
+// 以免影响路由的匹配，仅在 PathParam 为 true 时才有效果。
+func (p *URL) Strip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !p.pathParam {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		path, sessID := p.splitPath(r.URL.EscapedPath())
+		if len(sessID) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if s, err := url.PathUnescape(sessID); err == nil {
+			sessID = s
+		}
+		ctx := context.WithValue(r.Context(), urlContextKey(p.name), sessID)
+		r = r.WithContext(ctx)
+		if unescaped, err := url.PathUnescape(path); err == nil {
+			u := *r.URL
+			u.Path = unescaped
+			u.RawPath = ""
+			r.URL = &u
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 判断link是否指向当前站点。
+func sameOrigin(r *http.Request, u *url.URL) bool {
+	if len(u.Scheme) > 0 && u.Scheme != "http" && u.Scheme != "https" {
+		return false // mailto:、javascript: 等
+	}
+
+	if len(u.Host) == 0 {
+		return len(u.Opaque) == 0
+	}
+
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// 将sessID附加到link中，r为当前请求，用于判断link是否指向当前站点。
+//
+// 指向其它站点的链接、非http链接以及仅有锚点的链接，都会原样返回，
+// 以免sessionid泄漏给第三方。
+func (p *URL) Rewrite(r *http.Request, link, sessID string) string {
+	if len(link) == 0 || link[0] == '#' {
+		return link
+	}
+
+	u, err := url.Parse(link)
+	if err != nil || !sameOrigin(r, u) {
+		return link
+	}
+
+	if !p.pathParam {
+		q := u.Query()
+		q.Set(p.name, sessID)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+
+	path := u.EscapedPath()
+	if len(path) == 0 {
+		if len(u.Host) > 0 {
+			path = "/"
+		} else {
+			path = r.URL.EscapedPath()
+		}
+	}
+	path, _ = p.splitPath(path)
+	path += p.param + url.PathEscape(sessID)
+
+	// 直接拼接，避免url.URL.String()对路径中的 ; 进行转义。
+	u.Path = ""
+	u.RawPath = ""
+	ret := u.String()
+	if index := strings.IndexAny(ret, "?#"); index >= 0 {
+		return ret[:index] + path + ret[index:]
+	}
+	return ret + path
+}
+
+// 返回一个http.ResponseWriter，在重定向时会将sessID附加到Location报头中。
+func (p *URL) RewriteWriter(w http.ResponseWriter, r *http.Request, sessID string) http.ResponseWriter {
+	return &urlResponseWriter{
+		ResponseWriter: w,
+		p:              p,
+		r:              r,
+		sessID:         sessID,
+	}
+}
+
+func (w *urlResponseWriter) WriteHeader(status int) {
+	if status >= 300 && status < 400 {
+		if loc := w.Header().Get("Location"); len(loc) > 0 {
+			w.Header().Set("Location", w.p.Rewrite(w.r, loc, w.sessID))
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
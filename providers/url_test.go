@@ -0,0 +1,95 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package providers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/issue9/assert"
+	"github.com/issue9/session/types"
+)
+
+var (
+	_ types.Provider = &URL{}
+	_ types.Lookuper = &URL{}
+	_ types.Issuer   = &URL{}
+)
+
+func TestURL_Query(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewURL(&URLOptions{})
+	a.Error(err).Nil(p)
+	p, err = NewURL(nil)
+	a.Error(err).Nil(p)
+
+	p, err = NewURL(&URLOptions{Name: "sid"})
+	a.NotError(err).NotNil(p)
+
+	// 不存在，产生新值
+	r := httptest.NewRequest("GET", "http://example.com/page?a=1", nil)
+	sid, err := p.Get(httptest.NewRecorder(), r)
+	a.NotError(err).NotEmpty(sid)
+
+	r = httptest.NewRequest("GET", "http://example.com/page?a=1&sid=abc", nil)
+	sid, err = p.Get(httptest.NewRecorder(), r)
+	a.NotError(err).Equal(sid, "abc")
+
+	a.Equal(p.Rewrite(r, "/other?b=2", "abc"), "/other?b=2&sid=abc")
+	a.Equal(p.Rewrite(r, "/other?sid=old", "abc"), "/other?sid=abc")
+	a.Equal(p.Rewrite(r, "http://example.com/other", "abc"), "http://example.com/other?sid=abc")
+
+	// 不能改写的链接
+	a.Equal(p.Rewrite(r, "http://other.com/other", "abc"), "http://other.com/other")
+	a.Equal(p.Rewrite(r, "//other.com/other", "abc"), "//other.com/other")
+	a.Equal(p.Rewrite(r, "mailto:a@example.com", "abc"), "mailto:a@example.com")
+	a.Equal(p.Rewrite(r, "javascript:void(0)", "abc"), "javascript:void(0)")
+	a.Equal(p.Rewrite(r, "#top", "abc"), "#top")
+}
+
+func TestURL_PathParam(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewURL(&URLOptions{Name: "sid", PathParam: true})
+	a.NotError(err).NotNil(p)
+
+	r := httptest.NewRequest("GET", "http://example.com/dir/page;sid=abc?a=1", nil)
+	sid, found, err := p.Lookup(r)
+	a.NotError(err).True(found).Equal(sid, "abc")
+
+	a.Equal(p.Rewrite(r, "/other?b=2#top", "abc"), "/other;sid=abc?b=2#top")
+	a.Equal(p.Rewrite(r, "/other;sid=old", "abc"), "/other;sid=abc")
+	a.Equal(p.Rewrite(r, "http://example.com", "abc"), "http://example.com/;sid=abc")
+	a.Equal(p.Rewrite(r, "http://other.com/", "abc"), "http://other.com/")
+
+	// Strip 之后，路由看到的是不带sessionid的路径，但依然可以获取sessionid。
+	var path string
+	h := p.Strip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		sid, err = p.Get(w, r)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	a.NotError(err).Equal(sid, "abc").Equal(path, "/dir/page")
+}
+
+func TestURL_RewriteWriter(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewURL(&URLOptions{Name: "sid"})
+	a.NotError(err).NotNil(p)
+
+	r := httptest.NewRequest("GET", "http://example.com/login", nil)
+
+	w := httptest.NewRecorder()
+	http.Redirect(p.RewriteWriter(w, r, "abc"), r, "/home", http.StatusFound)
+	a.Equal(w.Header().Get("Location"), "/home?sid=abc")
+
+	// 外部链接不改写
+	w = httptest.NewRecorder()
+	http.Redirect(p.RewriteWriter(w, r, "abc"), r, "https://other.com/home", http.StatusFound)
+	a.Equal(w.Header().Get("Location"), "https://other.com/home")
+}
@@ -8,6 +8,8 @@ import (
 	"errors"
 	"net/http"
 	"sync"
+
+	"github.com/issue9/session/types"
 )
 
 // Session操作接口。
@@ -57,9 +59,48 @@ func (sess *Session) Exists(key interface{}) bool {
 
 // 当前session的sessionid
 func (sess *Session) ID() string {
+	sess.Lock()
+	defer sess.Unlock()
 	return sess.id
 }
 
+// 重新生成当前Session的sessionid，Session中的数据保持不变。
+//
+// 数据会先以新的sessionid保存到Store中，再删除原sessionid对应的数据，
+// 所以之后即使只调用Free()，数据也不会丢失。
+//
+// 在用户登录等权限发生变化时，应该调用此方法，以防止会话固定攻击。
+// 关联的Provider必须实现了types.Issuer接口。
+func (sess *Session) Regenerate(w http.ResponseWriter, r *http.Request) error {
+	sess.Lock()
+	defer sess.Unlock()
+
+	if sess.items == nil {
+		return errors.New("数据已经被释放。")
+	}
+
+	iss, ok := sess.manager.provider.(types.Issuer)
+	if !ok {
+		return errors.New("Provider 未实现 types.Issuer 接口")
+	}
+
+	sessID, err := iss.Issue(w, r)
+	if err != nil {
+		return err
+	}
+
+	ctx := r.Context()
+	if err = sess.manager.ctxStore.SaveContext(ctx, sessID, sess.items); err != nil {
+		return err
+	}
+	if err = sess.manager.ctxStore.DeleteContext(ctx, sess.id); err != nil {
+		return err
+	}
+
+	sess.id = sessID
+	return nil
+}
+
 // 关闭当前的Session，相当于按顺序执行Session.Save()和Session.Free()。
 func (sess *Session) Close(w http.ResponseWriter, r *http.Request) error {
 	if err := sess.Save(w, r); err != nil {
@@ -71,10 +112,10 @@ func (sess *Session) Close(w http.ResponseWriter, r *http.Request) error {
 
 // 释放当前的Session空间，但依然存在于Store中。
 // 之后Session.Get等操作数据的函数将不在可用。
-// 若需要同时从Store中去除，请执行Store.Delete()方法。
+//
+// 不会通知Provider删除sessionid，客户端在之后的请求中依然可以使用该session，
+// 若需要注销当前的session，请执行Session.Destroy()方法。
 func (sess *Session) Free(w http.ResponseWriter, r *http.Request) error {
-	sess.manager.provider.Delete(w, r)
-
 	// 清空数据。
 	sess.Lock()
 	sess.items = nil
@@ -84,12 +125,38 @@ func (sess *Session) Free(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// 销毁当前的Session，一般用于用户注销。
+//
+// 从Store中删除数据，并通过Provider.Delete()通知客户端丢弃sessionid，
+// 比如使cookie过期、清空报头中的token或是将JWT写入撤销列表，之后再释放Session空间。
+func (sess *Session) Destroy(w http.ResponseWriter, r *http.Request) error {
+	sess.Lock()
+	mgr, sessID := sess.manager, sess.id
+	sess.Unlock()
+
+	if mgr == nil {
+		return errors.New("数据已经被释放。")
+	}
+
+	ctx := r.Context()
+	if err := mgr.ctxStore.DeleteContext(ctx, sessID); err != nil {
+		return err
+	}
+	if err := mgr.ctxProvider.DeleteContext(ctx, w, r); err != nil {
+		return err
+	}
+
+	return sess.Free(w, r)
+}
+
 // 保存当前的Session值到Store中。
 // Session中的数据依然存在，可以继续使用Get()等函数获取数据。
+//
+// r.Context()会被传递给Store，在请求被取消之后，保存操作也会被取消。
 func (sess *Session) Save(w http.ResponseWriter, r *http.Request) error {
 	if sess.items == nil {
 		return errors.New("数据已经被释放。")
 	}
 
-	return sess.manager.store.Save(sess.ID(), sess.items)
+	return sess.manager.ctxStore.SaveContext(r.Context(), sess.ID(), sess.items)
 }
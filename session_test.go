@@ -5,11 +5,14 @@
 package session
 
 import (
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
 
 	"github.com/issue9/assert"
+	"github.com/issue9/session/codecs"
 	"github.com/issue9/session/providers"
 	"github.com/issue9/session/stores"
 )
@@ -20,7 +23,15 @@ func TestSessionAccess1(t *testing.T) {
 
 	// 声明Manager实例。
 	store := stores.NewMemory(10)
-	prv := providers.NewCookie(10, "gosession", "/", "localhost", true)
+	prv, err := providers.NewCookie(&providers.CookieOptions{
+		Lifetime: 10,
+		Name:     "gosession",
+		Path:     "/",
+		Domain:   "localhost",
+		Secure:   true,
+		HTTPOnly: true,
+	})
+	a.NotError(err)
 	mgr := New(store, prv)
 	a.NotNil(mgr)
 	defer func() {
@@ -79,8 +90,24 @@ func TestSessionAccess2(t *testing.T) {
 
 	s1 := stores.NewMemory(10)
 	s2 := stores.NewMemory(10)
-	p1 := providers.NewCookie(10, "gosession1", "/", "locahost", true)
-	p2 := providers.NewCookie(10, "gosession2", "/", "locahost", true)
+	p1, err := providers.NewCookie(&providers.CookieOptions{
+		Lifetime: 10,
+		Name:     "gosession1",
+		Path:     "/",
+		Domain:   "locahost",
+		Secure:   true,
+		HTTPOnly: true,
+	})
+	a.NotError(err)
+	p2, err := providers.NewCookie(&providers.CookieOptions{
+		Lifetime: 10,
+		Name:     "gosession2",
+		Path:     "/",
+		Domain:   "locahost",
+		Secure:   true,
+		HTTPOnly: true,
+	})
+	a.NotError(err)
 	mgr1 := New(s1, p1)
 	mgr2 := New(s2, p2)
 	defer mgr1.Close()
@@ -119,3 +146,148 @@ func TestSessionAccess2(t *testing.T) {
 	response, err := http.Get(srv.URL)
 	a.NotError(err).NotNil(response)
 }
+
+func TestSession_Regenerate(t *testing.T) {
+	a := assert.New(t)
+
+	store := stores.NewMemory(10)
+	prv, err := providers.NewURL(&providers.URLOptions{Name: "sid"})
+	a.NotError(err)
+	mgr := New(store, prv)
+	defer mgr.Close()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/?sid=old", nil)
+	sess, err := mgr.Start(w, r)
+	a.NotError(err).NotNil(sess)
+	a.Equal(sess.ID(), "old")
+	sess.Set("uid", 1)
+	a.NotError(sess.Save(w, r))
+
+	a.NotError(sess.Regenerate(w, r))
+	a.NotEqual(sess.ID(), "old")
+	a.Equal(sess.MustGet("uid", 0), 1)
+
+	// 原来的数据已经被删除
+	items, err := store.Get("old")
+	a.NotError(err).Equal(0, len(items))
+
+	// 新的sessionid已经保存了数据，只调用Free()也不会丢失数据
+	newID := sess.ID()
+	a.NotError(sess.Free(w, r))
+	items, err = store.Get(newID)
+	a.NotError(err).Equal(items["uid"], 1)
+}
+
+// Close()不会清除响应报头中的token，Destroy()才会。
+func TestSession_Destroy(t *testing.T) {
+	a := assert.New(t)
+
+	store := stores.NewMemory(10)
+	prv, err := providers.NewToken(&providers.TokenOptions{Lifetime: 10, Header: "X-Session"})
+	a.NotError(err)
+	mgr := New(store, prv)
+	defer mgr.Close()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	sess, err := mgr.Start(w, r)
+	a.NotError(err).NotNil(sess)
+	sessID := sess.ID()
+	sess.Set("uid", 1)
+	a.NotError(sess.Close(w, r))
+	a.Equal(w.Header().Get("X-Session"), sessID)
+
+	// 以返回的token再次请求，依然是同一个session
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Session", sessID)
+	sess, err = mgr.Start(w, r)
+	a.NotError(err).NotNil(sess)
+	a.Equal(sess.ID(), sessID).Equal(sess.MustGet("uid", 0), 1)
+
+	a.NotError(sess.Destroy(w, r))
+	a.Equal(w.Header().Get("X-Session"), "")
+	items, err := store.Get(sessID)
+	a.NotError(err).Equal(0, len(items))
+	a.False(sess.Exists("uid"))
+	a.Error(sess.Destroy(w, r))
+}
+
+// 按 Start、Close、Start 的顺序使用JWT，sessionid保持不变，
+// 只有Destroy()才会撤销token。
+func TestSession_JWT(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "session")
+	a.NotError(err)
+	defer os.RemoveAll(dir)
+	denylist, err := stores.NewFile(dir, 10, nil)
+	a.NotError(err)
+
+	signer, err := providers.NewHS256([]byte("secret"))
+	a.NotError(err)
+	prv, err := providers.NewJWT(&providers.JWTOptions{
+		TokenOptions: providers.TokenOptions{Lifetime: 10, Bearer: true, ResponseHeader: "X-Token"},
+		Signer:       signer,
+		Denylist:     providers.NewDenylist(denylist),
+	})
+	a.NotError(err)
+	mgr := New(stores.NewMemory(10), prv)
+	defer mgr.Close()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	sess, err := mgr.Start(w, r)
+	a.NotError(err).NotNil(sess)
+	sessID := sess.ID()
+	a.NotError(sess.Close(w, r))
+	token := w.Header().Get("X-Token")
+	a.NotEmpty(token)
+
+	for i := 0; i < 3; i++ {
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		sess, err = mgr.Start(w, r)
+		a.NotError(err).NotNil(sess)
+		a.Equal(sess.ID(), sessID)
+		a.NotError(sess.Close(w, r))
+	}
+
+	// 注销之后，token被撤销
+	sess, err = mgr.Start(w, r)
+	a.NotError(err)
+	a.NotError(sess.Destroy(w, r))
+	sess, err = mgr.Start(httptest.NewRecorder(), r)
+	a.NotError(err).NotEqual(sess.ID(), sessID)
+}
+
+// Codec的编码错误应该由Session.Save()返回
+func TestSession_SaveCodecError(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "session")
+	a.NotError(err)
+	defer os.RemoveAll(dir)
+
+	f, err := stores.NewFile(dir, 10, nil)
+	a.NotError(err).NotNil(f)
+	store := stores.NewRaw(f, codecs.NewJSON(), 10)
+	prv, err := providers.NewURL(&providers.URLOptions{Name: "sid"})
+	a.NotError(err)
+	mgr := New(store, prv)
+	defer mgr.Close()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	sess, err := mgr.Start(w, r)
+	a.NotError(err).NotNil(sess)
+
+	sess.Set("string", 1)
+	a.NotError(sess.Save(w, r))
+
+	// json不支持非字符串的键名
+	sess.Set(5, 5)
+	a.Error(sess.Save(w, r))
+}
@@ -0,0 +1,518 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 日志中的记录类型
+const (
+	logSet    byte = 1 // 保存数据
+	logDelete byte = 2 // 删除数据
+	logTouch  byte = 3 // 修改过期时间
+)
+
+// 记录的格式为：
+// crc32(4) type(1) expires(8) idLen(2) dataLen(4) id data，
+// 其中crc32为之后所有内容的校验值，expires为纳秒级的时间戳。
+const (
+	logHeaderSize = 4 + 1 + 8 + 2 + 4
+	logMaxIDLen   = 1<<16 - 1
+	logMaxDataLen = 1 << 30
+)
+
+// 默认的压缩阈值
+const logMinCompactSize = 1024 * 1024
+
+// AppendLogOptions 为 NewAppendLog 的参数。
+type AppendLogOptions struct {
+	// 日志文件的路径，不存在时会自动创建。
+	Path string
+
+	// GC和压缩检测的执行间隔，单位为秒，小于等于0时为1分钟。
+	Interval int
+
+	// 是否在每次写入之后都调用fsync，
+	// 为false时，进程崩溃不会丢失数据，但系统崩溃可能会丢失最后写入的部分数据。
+	Sync bool
+
+	// 日志文件超过此大小，且无效的记录占一半以上时，才会进行压缩，默认为1MB。
+	MinCompactSize int64
+
+	// 记录在GC过程中发生的错误，若指定为nil，则会向stderr输出错误信息。
+	Log *log.Logger
+}
+
+// 内存中的索引项
+type logEntry struct {
+	offset  int64 // 数据在文件中的位置
+	size    int   // 数据的长度
+	record  int64 // 保存数据的记录的长度
+	expires int64
+}
+
+// 以追加日志的形式保存数据的RawStore。
+type appendLog struct {
+	*gcRunner
+
+	path           string
+	sync           bool
+	minCompactSize int64
+	log            *log.Logger
+
+	compactMu sync.Mutex // 同一时间只能有一个压缩操作
+
+	mu    sync.RWMutex
+	f     *os.File
+	size  int64 // 文件的大小，即下一条记录的写入位置
+	live  int64 // 有效记录的总长度
+	index map[string]*logEntry
+}
+
+// 声明一个实现session.RawStore接口的存储器，
+// 所有的Set()、Touch()和Delete()操作都以记录的形式追加到日志文件的末尾，
+// 同时在内存中维护一个从sessionid到数据位置的索引。
+// 可以通过NewRaw()将其转换成session.Store接口。
+//
+// 启动时会重放整个日志以重建索引，若日志末尾的记录不完整或校验失败，
+// 比如在写入时崩溃，则会从该记录开始截断日志。
+//
+// 被覆盖、删除或是已经过期的记录会一直保留在日志中，
+// StartGC()会定期将有效的记录写入新的日志文件，以替换原有的文件。
+func NewAppendLog(opt *AppendLogOptions) (*appendLog, error) {
+	if opt == nil {
+		return nil, errors.New("opt 不能为空")
+	}
+
+	if len(opt.Path) == 0 {
+		return nil, errors.New("Path 不能为空")
+	}
+
+	l := opt.Log
+	if l == nil {
+		l = log.New(os.Stderr, "session.AppendLogStore", log.LstdFlags)
+	}
+
+	minCompactSize := opt.MinCompactSize
+	if minCompactSize <= 0 {
+		minCompactSize = logMinCompactSize
+	}
+
+	// 上次压缩时未完成的文件
+	if err := os.Remove(opt.Path + ".compact"); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(opt.Path, os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &appendLog{
+		path:           opt.Path,
+		sync:           opt.Sync,
+		minCompactSize: minCompactSize,
+		log:            l,
+		f:              f,
+		index:          map[string]*logEntry{},
+	}
+	s.gcRunner = newGCRunner(time.Second*time.Duration(opt.Interval), l, s.gc)
+
+	if err = s.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// 将一条记录编码成字节
+func encodeLogRecord(typ byte, sessID string, expires int64, data []byte) []byte {
+	buf := make([]byte, logHeaderSize+len(sessID)+len(data))
+	buf[4] = typ
+	binary.BigEndian.PutUint64(buf[5:], uint64(expires))
+	binary.BigEndian.PutUint16(buf[13:], uint16(len(sessID)))
+	binary.BigEndian.PutUint32(buf[15:], uint32(len(data)))
+	copy(buf[logHeaderSize:], sessID)
+	copy(buf[logHeaderSize+len(sessID):], data)
+
+	binary.BigEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// 从r中读取一条记录，返回的记录长度为0时，表示已经没有更多的记录。
+// 记录不完整或是校验失败时，返回errLogTorn。
+//
+// remain为r中剩余的字节数，在校验之前，头部中的长度信息并不可信，
+// 超过remain的长度直接当作不完整的记录，以免根据损坏的头部分配过大的内存。
+func readLogRecord(r io.Reader, remain int64) (typ byte, sessID string, expires int64, data []byte, size int64, err error) {
+	header := make([]byte, logHeaderSize)
+	if _, err = io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return 0, "", 0, nil, 0, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = errLogTorn
+		}
+		return 0, "", 0, nil, 0, err
+	}
+
+	typ = header[4]
+	expires = int64(binary.BigEndian.Uint64(header[5:]))
+	idLen := int(binary.BigEndian.Uint16(header[13:]))
+	dataLen := int(binary.BigEndian.Uint32(header[15:]))
+	if typ < logSet || typ > logTouch || dataLen > logMaxDataLen ||
+		int64(logHeaderSize+idLen+dataLen) > remain {
+		return 0, "", 0, nil, 0, errLogTorn
+	}
+
+	body := make([]byte, idLen+dataLen)
+	if _, err = io.ReadFull(r, body); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errLogTorn
+		}
+		return 0, "", 0, nil, 0, err
+	}
+
+	h := crc32.NewIEEE()
+	h.Write(header[4:])
+	h.Write(body)
+	if h.Sum32() != binary.BigEndian.Uint32(header) {
+		return 0, "", 0, nil, 0, errLogTorn
+	}
+
+	size = int64(logHeaderSize + idLen + dataLen)
+	return typ, string(body[:idLen]), expires, body[idLen:], size, nil
+}
+
+var (
+	errLogTorn   = errors.New("不完整的日志记录")
+	errLogClosed = errors.New("日志文件已经关闭")
+)
+
+// 将一条记录应用到索引，offset为记录在文件中的位置。
+// 调用方需要加锁。
+func (s *appendLog) apply(typ byte, sessID string, expires int64, dataLen int, offset, size int64) {
+	old, found := s.index[sessID]
+
+	switch typ {
+	case logSet:
+		if found {
+			s.live -= old.record
+		}
+		s.index[sessID] = &logEntry{
+			offset:  offset + logHeaderSize + int64(len(sessID)),
+			size:    dataLen,
+			record:  size,
+			expires: expires,
+		}
+		s.live += size
+	case logTouch:
+		if found {
+			old.expires = expires
+		}
+	case logDelete:
+		if found {
+			s.live -= old.record
+			delete(s.index, sessID)
+		}
+	}
+}
+
+// 重放日志，重建索引。
+func (s *appendLog) replay() error {
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	stat, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(s.f)
+	now := time.Now().UnixNano()
+
+	var offset int64
+	for {
+		typ, sessID, expires, data, size, err := readLogRecord(r, stat.Size()-offset)
+		if err == errLogTorn { // 截断不完整的记录
+			s.log.Printf("日志 %v 在 %d 处的记录不完整，之后的内容将被截断\n", s.path, offset)
+			if err = s.f.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			break
+		}
+
+		s.apply(typ, sessID, expires, len(data), offset, size)
+		offset += size
+	}
+	s.size = offset
+
+	// 已经过期的数据不需要加载到索引中
+	for id, e := range s.index {
+		if e.expires <= now {
+			s.live -= e.record
+			delete(s.index, id)
+		}
+	}
+
+	return nil
+}
+
+// 追加一条记录，调用方需要加锁。
+func (s *appendLog) append(typ byte, sessID string, expires int64, data []byte) error {
+	if s.f == nil {
+		return errLogClosed
+	}
+	if len(sessID) > logMaxIDLen {
+		return errors.New("sessionid 过长")
+	}
+	if len(data) > logMaxDataLen {
+		return errors.New("数据过长")
+	}
+
+	buf := encodeLogRecord(typ, sessID, expires, data)
+	if _, err := s.f.WriteAt(buf, s.size); err != nil {
+		// 写入了部分内容，截断之后，文件依然保持完整。
+		s.f.Truncate(s.size)
+		return err
+	}
+
+	s.apply(typ, sessID, expires, len(data), s.size, int64(len(buf)))
+	s.size += int64(len(buf))
+
+	if s.sync {
+		return s.f.Sync()
+	}
+	return nil
+}
+
+// session.RawStore.Get()
+func (s *appendLog) Get(sessID string) ([]byte, time.Duration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.f == nil {
+		return nil, 0, errLogClosed
+	}
+
+	e, found := s.index[sessID]
+	if !found {
+		return nil, 0, nil
+	}
+
+	ttl := time.Until(time.Unix(0, e.expires))
+	if ttl <= 0 { // 已经过期，但还未被GC回收
+		return nil, 0, nil
+	}
+
+	data := make([]byte, e.size)
+	if _, err := s.f.ReadAt(data, e.offset); err != nil {
+		return nil, 0, err
+	}
+	return data, ttl, nil
+}
+
+// session.RawStore.Set()
+func (s *appendLog) Set(sessID string, data []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.append(logSet, sessID, time.Now().Add(ttl).UnixNano(), data)
+}
+
+// session.RawStore.Touch()
+func (s *appendLog) Touch(sessID string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 不存在或是已经过期的数据，不需要修改过期时间。
+	if e, found := s.index[sessID]; !found || e.expires <= time.Now().UnixNano() {
+		return nil
+	}
+	return s.append(logTouch, sessID, time.Now().Add(ttl).UnixNano(), nil)
+}
+
+// session.RawStore.Delete()
+func (s *appendLog) Delete(sessID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.index[sessID]; !found {
+		return nil
+	}
+	return s.append(logDelete, sessID, 0, nil)
+}
+
+// 从索引中删除过期的数据，若无效的记录过多，则压缩日志。
+func (s *appendLog) gc(ctx context.Context) (int, error) {
+	now := time.Now().UnixNano()
+
+	removed := 0
+	s.mu.Lock()
+	for id, e := range s.index {
+		if e.expires <= now {
+			s.live -= e.record
+			delete(s.index, id)
+			removed++
+		}
+	}
+	needCompact := s.size >= s.minCompactSize && s.live*2 <= s.size
+	s.mu.Unlock()
+
+	if !needCompact {
+		return removed, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return removed, err
+	}
+	return removed, s.compact()
+}
+
+// 将有效的记录写入到新的日志文件，并替换原来的文件。
+//
+// 复制数据时不会阻塞其它的操作，在此期间追加的记录，会在最后替换文件时一并复制到新文件。
+func (s *appendLog) compact() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	// 复制当前索引的快照
+	now := time.Now().UnixNano()
+	s.mu.RLock()
+	if s.f == nil {
+		s.mu.RUnlock()
+		return nil
+	}
+	old := s.f
+	end := s.size
+	snapshot := make(map[string]logEntry, len(s.index))
+	for id, e := range s.index {
+		if e.expires > now {
+			snapshot[id] = *e
+		}
+	}
+	s.mu.RUnlock()
+
+	tmpPath := s.path + ".compact"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	index := make(map[string]*logEntry, len(snapshot))
+	w := bufio.NewWriter(f)
+	var size, live int64
+	for id, e := range snapshot {
+		data := make([]byte, e.size)
+		if _, err = old.ReadAt(data, e.offset); err != nil {
+			return fail(err)
+		}
+
+		buf := encodeLogRecord(logSet, id, e.expires, data)
+		if _, err = w.Write(buf); err != nil {
+			return fail(err)
+		}
+		index[id] = &logEntry{
+			offset:  size + logHeaderSize + int64(len(id)),
+			size:    e.size,
+			record:  int64(len(buf)),
+			expires: e.expires,
+		}
+		size += int64(len(buf))
+		live += int64(len(buf))
+	}
+	if err = w.Flush(); err != nil {
+		return fail(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 复制期间追加的记录
+	tail := io.NewSectionReader(old, end, s.size-end)
+	if _, err = io.Copy(io.NewOffsetWriter(f, size), tail); err != nil {
+		return fail(err)
+	}
+	if _, err = tail.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+
+	oldIndex, oldLive := s.index, s.live
+	s.index, s.live = index, live
+	r := bufio.NewReader(tail)
+	for remain := tail.Size(); ; {
+		typ, sessID, expires, data, n, err := readLogRecord(r, remain)
+		if err != nil {
+			s.index, s.live = oldIndex, oldLive
+			return fail(err)
+		}
+		if n == 0 {
+			break
+		}
+		s.apply(typ, sessID, expires, len(data), size, n)
+		size += n
+		remain -= n
+	}
+
+	if err = f.Sync(); err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		s.index, s.live = oldIndex, oldLive
+		return fail(err)
+	}
+	syncDir(filepath.Dir(s.path))
+
+	s.f, s.size = f, size
+	return old.Close()
+}
+
+// 同步目录，保证rename操作已经写入磁盘，不支持的系统上会忽略错误。
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// session.RawStore.Close()
+//
+// 关闭日志文件，其中的数据会被保留，下次打开时依然有效。
+func (s *appendLog) Close() error {
+	s.stopGC()
+
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
@@ -0,0 +1,267 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert"
+	"github.com/issue9/session/types"
+)
+
+var _ types.RawStore = &appendLog{}
+
+func newAppendLogPath(a *assert.Assertion) (string, func()) {
+	dir, err := ioutil.TempDir("", "session")
+	a.NotError(err)
+
+	return filepath.Join(dir, "session.log"), func() {
+		a.NotError(os.RemoveAll(dir))
+	}
+}
+
+func fileSize(a *assert.Assertion, path string) int64 {
+	info, err := os.Stat(path)
+	a.NotError(err)
+	return info.Size()
+}
+
+func TestAppendLog(t *testing.T) {
+	a := assert.New(t)
+	path, cleanup := newAppendLogPath(a)
+	defer cleanup()
+
+	s, err := NewAppendLog(nil)
+	a.Error(err).Nil(s)
+
+	s, err = NewAppendLog(&AppendLogOptions{})
+	a.Error(err).Nil(s)
+
+	s, err = NewAppendLog(&AppendLogOptions{Path: path, Interval: 10, Sync: true})
+	a.NotError(err).NotNil(s)
+
+	data, ttl, err := s.Get("id1")
+	a.NotError(err).Nil(data).Equal(ttl, 0)
+
+	a.NotError(s.Set("id1", rawData1, time.Minute))
+	a.NotError(s.Set("id2", rawData1, time.Minute))
+	a.NotError(s.Set("id2", rawData2, time.Minute))
+	a.NotError(s.Set("id3", rawData1, time.Millisecond))
+	data, ttl, err = s.Get("id2")
+	a.NotError(err).Equal(data, rawData2)
+	a.True(ttl > 50*time.Second && ttl <= time.Minute)
+
+	a.NotError(s.Touch("id1", time.Hour))
+	a.NotError(s.Touch("not-exists", time.Hour))
+	a.NotError(s.Delete("id2"))
+	a.NotError(s.Delete("not-exists"))
+	time.Sleep(5 * time.Millisecond)
+
+	// 重放日志之后，状态与关闭之前相同
+	a.NotError(s.Close())
+	a.NotError(s.Close())
+	_, _, err = s.Get("id1")
+	a.Error(err)
+	a.Error(s.Set("id1", rawData1, time.Minute))
+
+	s, err = NewAppendLog(&AppendLogOptions{Path: path})
+	a.NotError(err)
+	defer s.Close()
+
+	data, ttl, err = s.Get("id1")
+	a.NotError(err).Equal(data, rawData1)
+	a.True(ttl > 50*time.Minute)
+	data, _, err = s.Get("id2")
+	a.NotError(err).Nil(data)
+	data, _, err = s.Get("id3") // 已经过期
+	a.NotError(err).Nil(data)
+	a.Equal(len(s.index), 1)
+
+	// 通过NewRaw()转换成Store
+	store := NewRaw(s, nil, 60)
+	a.NotError(store.Save("id4", testData1))
+	mapped, err := store.Get("id4")
+	a.NotError(err).Equal(mapped, testData1)
+}
+
+// 日志末尾不完整的记录会被截断
+func TestAppendLog_Torn(t *testing.T) {
+	a := assert.New(t)
+	path, cleanup := newAppendLogPath(a)
+	defer cleanup()
+
+	s, err := NewAppendLog(&AppendLogOptions{Path: path})
+	a.NotError(err)
+	a.NotError(s.Set("id1", rawData1, time.Minute))
+	a.NotError(s.Set("id2", rawData2, time.Minute))
+	a.NotError(s.Close())
+	size := fileSize(a, path)
+
+	// 写入了一半的记录
+	record := encodeLogRecord(logSet, "id3", time.Now().Add(time.Minute).UnixNano(), rawData1)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	a.NotError(err)
+	_, err = f.Write(record[:len(record)-2])
+	a.NotError(err)
+	a.NotError(f.Close())
+
+	s, err = NewAppendLog(&AppendLogOptions{Path: path})
+	a.NotError(err)
+	a.Equal(fileSize(a, path), size)
+	data, _, err := s.Get("id2")
+	a.NotError(err).Equal(data, rawData2)
+	data, _, err = s.Get("id3")
+	a.NotError(err).Nil(data)
+
+	// 截断之后可以继续写入
+	a.NotError(s.Set("id3", rawData1, time.Minute))
+	a.NotError(s.Close())
+
+	// 校验值错误
+	f, err = os.OpenFile(path, os.O_RDWR, 0600)
+	a.NotError(err)
+	_, err = f.WriteAt([]byte{0xff}, size+logHeaderSize+1)
+	a.NotError(err)
+	a.NotError(f.Close())
+
+	s, err = NewAppendLog(&AppendLogOptions{Path: path})
+	a.NotError(err)
+	defer s.Close()
+	a.Equal(fileSize(a, path), size)
+	data, _, err = s.Get("id3")
+	a.NotError(err).Nil(data)
+	data, _, err = s.Get("id1")
+	a.NotError(err).Equal(data, rawData1)
+}
+
+func TestReadLogRecord(t *testing.T) {
+	a := assert.New(t)
+
+	record := encodeLogRecord(logSet, "id", 100, rawData1)
+	typ, id, expires, data, size, err := readLogRecord(bytes.NewReader(record), int64(len(record)))
+	a.NotError(err).Equal(typ, logSet).Equal(id, "id").Equal(expires, 100)
+	a.Equal(data, rawData1).Equal(size, len(record))
+
+	// 头部中的长度超过了剩余的内容，不会按该长度分配内存
+	binary.BigEndian.PutUint32(record[15:], logMaxDataLen)
+	_, _, _, _, _, err = readLogRecord(bytes.NewReader(record), int64(len(record)))
+	a.Equal(err, errLogTorn)
+
+	// 没有更多的记录
+	_, _, _, _, size, err = readLogRecord(bytes.NewReader(nil), 0)
+	a.NotError(err).Equal(size, 0)
+}
+
+func TestAppendLog_Compact(t *testing.T) {
+	a := assert.New(t)
+	path, cleanup := newAppendLogPath(a)
+	defer cleanup()
+
+	s, err := NewAppendLog(&AppendLogOptions{Path: path, Interval: 1, MinCompactSize: 1024})
+	a.NotError(err)
+
+	// 不断覆盖相同的数据
+	for i := 0; i < 100; i++ {
+		a.NotError(s.Set("id1", []byte("data-"+strconv.Itoa(i)), time.Minute))
+		a.NotError(s.Set("expired", rawData1, time.Millisecond))
+	}
+	a.NotError(s.Set("deleted", rawData1, time.Minute))
+	a.NotError(s.Delete("deleted"))
+	a.NotError(s.Touch("id1", time.Hour))
+	time.Sleep(5 * time.Millisecond)
+	size := fileSize(a, path)
+
+	removed, err := s.GC(context.Background())
+	a.NotError(err).Equal(removed, 1)
+	a.True(fileSize(a, path) < size/10)
+	a.Equal(s.live, s.size)
+	_, err = os.Stat(path + ".compact")
+	a.True(os.IsNotExist(err))
+
+	data, ttl, err := s.Get("id1")
+	a.NotError(err).Equal(data, []byte("data-99"))
+	a.True(ttl > 50*time.Minute)
+
+	// 压缩之后可以继续写入，并且重放的结果相同
+	a.NotError(s.Set("id2", rawData2, time.Minute))
+	a.NotError(s.Close())
+	s, err = NewAppendLog(&AppendLogOptions{Path: path})
+	a.NotError(err)
+	defer s.Close()
+	data, _, err = s.Get("id1")
+	a.NotError(err).Equal(data, []byte("data-99"))
+	data, _, err = s.Get("id2")
+	a.NotError(err).Equal(data, rawData2)
+	a.Equal(len(s.index), 2)
+}
+
+// 压缩的同时进行写入
+func TestAppendLog_CompactConcurrent(t *testing.T) {
+	a := assert.New(t)
+	path, cleanup := newAppendLogPath(a)
+	defer cleanup()
+
+	s, err := NewAppendLog(&AppendLogOptions{Path: path, MinCompactSize: 1})
+	a.NotError(err)
+
+	errs := make(chan error, 5)
+	for g := 0; g < 4; g++ {
+		go func(g int) {
+			for i := 0; i < 200; i++ {
+				id := "id-" + strconv.Itoa(g) + "-" + strconv.Itoa(i%10)
+				if err := s.Set(id, []byte(strconv.Itoa(i)), time.Minute); err != nil {
+					errs <- err
+					return
+				}
+				if i%7 == 0 {
+					if err := s.Delete(id); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+			errs <- nil
+		}(g)
+	}
+
+	go func() {
+		for i := 0; i < 20; i++ {
+			if err := s.compact(); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	for i := 0; i < 5; i++ {
+		a.NotError(<-errs)
+	}
+
+	// 内存中的状态与重放之后的状态相同
+	expected := map[string][]byte{}
+	for id := range s.index {
+		data, _, err := s.Get(id)
+		a.NotError(err)
+		expected[id] = data
+	}
+	a.NotError(s.Close())
+
+	s, err = NewAppendLog(&AppendLogOptions{Path: path})
+	a.NotError(err)
+	defer s.Close()
+	a.Equal(len(s.index), len(expected))
+	for id, data := range expected {
+		d, _, err := s.Get(id)
+		a.NotError(err).Equal(d, data)
+	}
+}
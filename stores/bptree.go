@@ -0,0 +1,213 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"context"
+	"encoding/binary"
+	"log"
+	"os"
+	"time"
+
+	"github.com/issue9/session/stores/internal/bptree"
+)
+
+// bptree中各个bucket的用途
+const (
+	// 保存session数据，键名为sessionid，
+	// 值为 过期时间(8字节，纳秒) + 数据。
+	bpData = iota
+
+	// 过期时间索引，键名为 过期时间(8字节，纳秒) + sessionid，值为空。
+	// 按键名排列之后，即为按过期时间排列，GC时只需要从头开始遍历即可。
+	bpExpires
+)
+
+// 每个GC事务中最多删除的session数量，避免长时间锁定数据库。
+const bpGCBatch = 1000
+
+// 以单个文件保存所有session的RawStore。
+type bpTree struct {
+	*gcRunner
+
+	db *bptree.DB
+}
+
+// 声明一个实现session.RawStore接口的存储器，
+// 所有的session都保存在path指定的单个文件中，内部以B+树组织，
+// 每次修改都在一个事务中完成，进程崩溃之后，可以恢复到最后一次成功写入的状态。
+// 可以通过NewRaw()将其转换成session.Store接口。
+//
+// 除了以sessionid为键名的数据之外，还维护了一个以过期时间排序的索引，
+// 所以GC只需要遍历已经过期的session，而不需要扫描所有的数据。
+//
+// 数据文件同时只能被一个实例打开，会在 path+".lock" 文件上加锁，
+// 若该文件已经被其它实例或是进程打开，则返回错误。
+// 在不支持flock(2)的系统上，只能阻止同一进程中的重复打开。
+//
+// interval为GC的执行间隔，单位为秒，小于等于0时为1分钟。
+// l用户记录在GC过程中发生的错误，若指定为nil，则会向stderr输出错误信息。
+func NewBPTree(path string, interval int, l *log.Logger) (*bpTree, error) {
+	db, err := bptree.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if l == nil {
+		l = log.New(os.Stderr, "session.BPTreeStore", log.LstdFlags)
+	}
+
+	b := &bpTree{db: db}
+	b.gcRunner = newGCRunner(time.Second*time.Duration(interval), l, b.gc)
+	return b, nil
+}
+
+// 过期时间索引的键名
+func bpExpiresKey(expires int64, sessID string) []byte {
+	key := make([]byte, 8+len(sessID))
+	binary.BigEndian.PutUint64(key, uint64(expires))
+	copy(key[8:], sessID)
+	return key
+}
+
+// 获取sessID的过期时间，不存在时返回0。
+func bpExpiresOf(tx *bptree.Tx, sessID string) (int64, error) {
+	val, err := tx.Get(bpData, []byte(sessID))
+	if err != nil || len(val) < 8 {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(val)), nil
+}
+
+// session.RawStore.Get()
+func (b *bpTree) Get(sessID string) (data []byte, ttl time.Duration, err error) {
+	err = b.db.View(func(tx *bptree.Tx) error {
+		val, err := tx.Get(bpData, []byte(sessID))
+		if err != nil || len(val) < 8 {
+			return err
+		}
+
+		ttl = time.Until(time.Unix(0, int64(binary.BigEndian.Uint64(val))))
+		if ttl <= 0 { // 已经过期，但还未被GC回收
+			ttl = 0
+			return nil
+		}
+
+		data = append(make([]byte, 0, len(val)-8), val[8:]...)
+		return nil
+	})
+
+	return data, ttl, err
+}
+
+// session.RawStore.Set()
+func (b *bpTree) Set(sessID string, data []byte, ttl time.Duration) error {
+	return b.db.Update(func(tx *bptree.Tx) error {
+		return b.set(tx, sessID, data, ttl)
+	})
+}
+
+func (b *bpTree) set(tx *bptree.Tx, sessID string, data []byte, ttl time.Duration) error {
+	old, err := bpExpiresOf(tx, sessID)
+	if err != nil {
+		return err
+	}
+	if old > 0 {
+		if err = tx.Delete(bpExpires, bpExpiresKey(old, sessID)); err != nil {
+			return err
+		}
+	}
+
+	expires := time.Now().Add(ttl).UnixNano()
+	val := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint64(val, uint64(expires))
+	copy(val[8:], data)
+
+	if err = tx.Put(bpData, []byte(sessID), val); err != nil {
+		return err
+	}
+	return tx.Put(bpExpires, bpExpiresKey(expires, sessID), nil)
+}
+
+// session.RawStore.Touch()
+func (b *bpTree) Touch(sessID string, ttl time.Duration) error {
+	return b.db.Update(func(tx *bptree.Tx) error {
+		val, err := tx.Get(bpData, []byte(sessID))
+		if err != nil || len(val) < 8 {
+			return err
+		}
+
+		return b.set(tx, sessID, val[8:], ttl)
+	})
+}
+
+// session.RawStore.Delete()
+func (b *bpTree) Delete(sessID string) error {
+	return b.db.Update(func(tx *bptree.Tx) error {
+		return b.delete(tx, sessID)
+	})
+}
+
+func (b *bpTree) delete(tx *bptree.Tx, sessID string) error {
+	expires, err := bpExpiresOf(tx, sessID)
+	if err != nil || expires == 0 {
+		return err
+	}
+
+	if err = tx.Delete(bpExpires, bpExpiresKey(expires, sessID)); err != nil {
+		return err
+	}
+	return tx.Delete(bpData, []byte(sessID))
+}
+
+// 通过过期时间索引删除已经过期的数据，每个事务最多删除bpGCBatch条。
+func (b *bpTree) gc(ctx context.Context) (removed int, err error) {
+	now := time.Now().UnixNano()
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return removed, err
+		}
+
+		count := 0
+		err = b.db.Update(func(tx *bptree.Tx) error {
+			ids := make([]string, 0, 100)
+			err := tx.Scan(bpExpires, nil, func(key, val []byte) bool {
+				if int64(binary.BigEndian.Uint64(key)) > now {
+					return false
+				}
+				ids = append(ids, string(key[8:]))
+				return len(ids) < bpGCBatch
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, id := range ids {
+				if err = b.delete(tx, id); err != nil {
+					return err
+				}
+			}
+			count = len(ids)
+			return nil
+		})
+
+		if err != nil {
+			return removed, err
+		}
+		removed += count
+		if count < bpGCBatch {
+			return removed, nil
+		}
+	}
+}
+
+// session.RawStore.Close()
+//
+// 关闭数据文件，其中的数据会被保留，下次打开时依然有效。
+func (b *bpTree) Close() error {
+	b.stopGC()
+	return b.db.Close()
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert"
+	"github.com/issue9/session/stores/internal/bptree"
+	"github.com/issue9/session/types"
+)
+
+var _ types.RawStore = &bpTree{}
+
+// 过期索引中的记录数量
+func bpExpiresCount(a *assert.Assertion, b *bpTree) int {
+	count := 0
+	a.NotError(b.db.View(func(tx *bptree.Tx) error {
+		return tx.Scan(bpExpires, nil, func(key, val []byte) bool {
+			count++
+			return true
+		})
+	}))
+	return count
+}
+
+func TestBPTree(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "session")
+	a.NotError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.db")
+
+	b, err := NewBPTree(path, 10, nil)
+	a.NotError(err).NotNil(b)
+
+	data, ttl, err := b.Get("id1")
+	a.NotError(err).Nil(data).Equal(ttl, 0)
+
+	a.NotError(b.Set("id1", rawData1, time.Minute))
+	a.NotError(b.Set("id2", rawData2, time.Minute))
+	data, ttl, err = b.Get("id1")
+	a.NotError(err).Equal(data, rawData1)
+	a.True(ttl > 50*time.Second && ttl <= time.Minute)
+
+	// 覆盖数据，过期索引中不会有多余的记录
+	a.NotError(b.Set("id1", rawData2, time.Hour))
+	a.Equal(bpExpiresCount(a, b), 2)
+
+	a.NotError(b.Touch("id2", time.Hour))
+	_, ttl, err = b.Get("id2")
+	a.NotError(err).True(ttl > 50*time.Minute)
+	a.Equal(bpExpiresCount(a, b), 2)
+	a.NotError(b.Touch("not-exists", time.Hour))
+
+	a.NotError(b.Delete("id2"))
+	a.NotError(b.Delete("id2"))
+	data, _, err = b.Get("id2")
+	a.NotError(err).Nil(data)
+	a.Equal(bpExpiresCount(a, b), 1)
+
+	// 重新打开之后，数据依然存在
+	a.NotError(b.Close())
+	b, err = NewBPTree(path, 10, nil)
+	a.NotError(err)
+	data, _, err = b.Get("id1")
+	a.NotError(err).Equal(data, rawData2)
+
+	// 通过NewRaw()转换成Store
+	store := NewRaw(b, nil, 60)
+	a.NotError(store.Save("id3", testData1))
+	mapped, err := store.Get("id3")
+	a.NotError(err).Equal(mapped, testData1)
+
+	a.NotError(store.Close())
+}
+
+func TestBPTree_GC(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "session")
+	a.NotError(err)
+	defer os.RemoveAll(dir)
+
+	b, err := NewBPTree(filepath.Join(dir, "session.db"), 1, nil)
+	a.NotError(err).NotNil(b)
+	defer b.Close()
+
+	// 超过一个批次的过期数据
+	a.NotError(b.db.Update(func(tx *bptree.Tx) error {
+		for i := 0; i < bpGCBatch+10; i++ {
+			a.NotError(b.set(tx, "expired"+strconv.Itoa(i), rawData1, time.Millisecond))
+		}
+		return nil
+	}))
+	a.NotError(b.Set("alive", rawData2, time.Hour))
+	time.Sleep(10 * time.Millisecond)
+
+	// 已经过期，但还未被GC回收
+	data, _, err := b.Get("expired0")
+	a.NotError(err).Nil(data)
+
+	removed, err := b.GC(context.Background())
+	a.NotError(err).Equal(removed, bpGCBatch+10)
+	a.Equal(bpExpiresCount(a, b), 1)
+	data, _, err = b.Get("alive")
+	a.NotError(err).Equal(data, rawData2)
+
+	b.StartGC()
+	a.NotError(b.Set("expired", rawData1, time.Millisecond))
+	time.Sleep(1500 * time.Millisecond)
+	a.Equal(bpExpiresCount(a, b), 1)
+}
@@ -0,0 +1,228 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/issue9/session/types"
+)
+
+// 带有数据头的数据以该字节开头。
+//
+// 0xc1在msgpack中为保留的字节，不会出现在gob、JSON和CBOR编码的map开头，
+// 所以使用该字节可以与启用压缩之前保存的数据区分开。
+const compressMagic byte = 0xc1
+
+// 数据头的第二个字节，表示数据的保存方式。
+const (
+	compressStored byte = iota // 未压缩
+	compressFlate              // 以flate压缩
+)
+
+// 数据头的长度：compressMagic + 保存方式。
+const compressHeaderSize = 2
+
+// CompressOptions.MaxSize的默认值
+const compressMaxSize = 1 << 20
+
+// 以下错误中，ErrCompressTooLarge 会由Set()返回；
+// 读取时遇到的错误都不会由Get()返回，无法还原的数据会被当作不存在，
+// 这些错误只会记录在CompressOptions.Log中。
+var (
+	// ErrCompressHeader 表示数据头中的保存方式无法识别。
+	ErrCompressHeader = errors.New("无法识别的压缩数据头")
+
+	// ErrCompressTooLarge 表示数据的长度超过了 CompressOptions.MaxSize。
+	ErrCompressTooLarge = errors.New("数据长度超过了允许的最大值")
+)
+
+// CompressOptions 为 NewCompressed 的参数。
+type CompressOptions struct {
+	// 数据长度超过该值时才会被压缩，默认为1024字节。
+	Threshold int
+
+	// flate的压缩级别，取值为flate.HuffmanOnly到flate.BestCompression，
+	// 为0时使用flate.DefaultCompression。
+	Level int
+
+	// 未压缩的数据允许的最大长度，默认为1M，
+	// 超过该值的数据无法保存，解压时超过该值的数据则被当作已经损坏，
+	// 避免解压一条很小的数据时占用大量的内存。
+	MaxSize int
+
+	// 记录无法还原的数据，若指定为nil，则会向stderr输出。
+	Log *log.Logger
+}
+
+// 对数据进行压缩的RawStore。
+type compressed struct {
+	decorator
+
+	threshold int
+	maxSize   int
+	writers   *sync.Pool
+	log       *log.Logger
+}
+
+// 声明一个对数据进行压缩的RawStore，数据压缩之后再交由store保存，
+// 可以通过NewRaw()将其转换成session.Store接口。
+//
+// 只有超过 CompressOptions.Threshold 的数据才会以flate压缩，
+// 压缩之后的数据以两个字节的数据头开始，第一个字节固定为0xc1，第二个字节为保存方式；
+// 未压缩的数据则原样保存，不带数据头，所以启用压缩之前保存的数据依然可以正常读取。
+// 仅当未压缩的数据刚好以0xc1开头时，才会添加一个表示未压缩的数据头。
+//
+// 若同时需要加密，应该先压缩后加密，即 NewCompressed(NewEncrypted(store, keys...), opt)，
+// 加密之后的数据无法被压缩。
+//
+// 无法识别或是无法解压的数据，Get()会将其当作不存在的数据，并将其从store中删除，
+// 与NewEncrypted()处理无法解密的数据的方式相同。
+//
+// GC及Close()等操作都直接交由store处理。
+func NewCompressed(store types.RawStore, opt *CompressOptions) (*compressed, error) {
+	if opt == nil {
+		return nil, errors.New("opt 不能为空")
+	}
+
+	threshold := opt.Threshold
+	if threshold <= 0 {
+		threshold = 1024
+	}
+
+	level := opt.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	if _, err := flate.NewWriter(ioutil.Discard, level); err != nil {
+		return nil, err
+	}
+
+	maxSize := opt.MaxSize
+	if maxSize <= 0 {
+		maxSize = compressMaxSize
+	}
+
+	l := opt.Log
+	if l == nil {
+		l = log.New(os.Stderr, "session.CompressedStore", log.LstdFlags)
+	}
+
+	return &compressed{
+		decorator: newDecorator(store),
+		threshold: threshold,
+		maxSize:   maxSize,
+		writers: &sync.Pool{New: func() interface{} {
+			w, _ := flate.NewWriter(nil, level)
+			return w
+		}},
+		log: l,
+	}, nil
+}
+
+// session.RawStore.Get()
+func (c *compressed) Get(sessID string) ([]byte, time.Duration, error) {
+	return c.GetContext(context.Background(), sessID)
+}
+
+// session.ContextRawStore.GetContext()
+func (c *compressed) GetContext(ctx context.Context, sessID string) ([]byte, time.Duration, error) {
+	data, ttl, err := c.store.GetContext(ctx, sessID)
+	if err != nil || data == nil {
+		return nil, 0, err
+	}
+
+	if data, err = c.decompress(data); err != nil {
+		c.log.Printf("无法还原 %v 的数据，该数据将被删除：%v\n", sessID, err)
+		return nil, 0, c.store.DeleteContext(ctx, sessID)
+	}
+	return data, ttl, nil
+}
+
+// 还原compress()的内容，不带数据头的内容原样返回。
+func (c *compressed) decompress(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != compressMagic {
+		return data, nil
+	}
+
+	if len(data) < compressHeaderSize {
+		return nil, ErrCompressHeader
+	}
+
+	switch data[1] {
+	case compressStored:
+		return data[compressHeaderSize:], nil
+	case compressFlate:
+		r := flate.NewReader(bytes.NewReader(data[compressHeaderSize:]))
+		defer r.Close()
+		data, err := ioutil.ReadAll(io.LimitReader(r, int64(c.maxSize)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > c.maxSize {
+			return nil, ErrCompressTooLarge
+		}
+		return data, nil
+	default:
+		return nil, ErrCompressHeader
+	}
+}
+
+// session.RawStore.Set()
+func (c *compressed) Set(sessID string, data []byte, ttl time.Duration) error {
+	return c.SetContext(context.Background(), sessID, data, ttl)
+}
+
+// session.ContextRawStore.SetContext()
+func (c *compressed) SetContext(ctx context.Context, sessID string, data []byte, ttl time.Duration) error {
+	if len(data) > c.maxSize {
+		return ErrCompressTooLarge
+	}
+
+	data, err := c.compress(data)
+	if err != nil {
+		return err
+	}
+	return c.store.SetContext(ctx, sessID, data, ttl)
+}
+
+// 压缩数据，若压缩之后的数据并没有变小，则依然保存原始数据。
+func (c *compressed) compress(data []byte) ([]byte, error) {
+	if len(data) > c.threshold {
+		buf := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+		buf.WriteByte(compressMagic)
+		buf.WriteByte(compressFlate)
+
+		w := c.writers.Get().(*flate.Writer)
+		w.Reset(buf)
+		_, err := w.Write(data)
+		if err == nil {
+			err = w.Close()
+		}
+		w.Reset(nil)
+		c.writers.Put(w)
+		if err != nil {
+			return nil, err
+		}
+
+		if buf.Len() < len(data) {
+			return buf.Bytes(), nil
+		}
+	}
+
+	if len(data) > 0 && data[0] == compressMagic {
+		return append([]byte{compressMagic, compressStored}, data...), nil
+	}
+	return data, nil
+}
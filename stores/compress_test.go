@@ -0,0 +1,202 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert"
+	"github.com/issue9/session/codecs"
+	"github.com/issue9/session/types"
+)
+
+var (
+	_ types.ContextRawStore = &compressed{}
+	_ types.GCer            = &compressed{}
+)
+
+// 返回文件存储器中sessID对应文件的内容
+func fileContent(a *assert.Assertion, f *file, sessID string) []byte {
+	data, err := ioutil.ReadFile(filePath(f, sessID))
+	a.NotError(err)
+	return data
+}
+
+func TestNewCompressed(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	f, err := NewFile(dir, 10, nil)
+	a.NotError(err)
+
+	c, err := NewCompressed(f, nil)
+	a.Error(err).Nil(c)
+
+	c, err = NewCompressed(f, &CompressOptions{Level: 100})
+	a.Error(err).Nil(c)
+
+	c, err = NewCompressed(f, &CompressOptions{})
+	a.NotError(err).NotNil(c)
+	a.Equal(c.threshold, 1024).Equal(c.maxSize, compressMaxSize)
+
+	c, err = NewCompressed(f, &CompressOptions{Threshold: 10, Level: flate.BestSpeed})
+	a.NotError(err).NotNil(c)
+	a.Equal(c.threshold, 10)
+}
+
+func TestCompressed(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	f, err := NewFile(dir, 10, nil)
+	a.NotError(err)
+	buf := new(bytes.Buffer)
+	c, err := NewCompressed(f, &CompressOptions{Threshold: 100, MaxSize: 20000, Log: log.New(buf, "", 0)})
+	a.NotError(err)
+
+	data, ttl, err := c.Get("non")
+	a.NotError(err).Nil(data).Equal(ttl, 0)
+
+	// 未超过Threshold的数据原样保存
+	a.NotError(c.Set("small", rawData1, time.Minute))
+	a.Equal(fileContent(a, f, "small"), rawData1)
+	data, ttl, err = c.Get("small")
+	a.NotError(err).Equal(data, rawData1)
+	a.True(ttl > 50*time.Second)
+
+	// 超过Threshold的数据被压缩
+	large := bytes.Repeat([]byte("wizard state "), 1000)
+	a.NotError(c.Set("large", large, time.Minute))
+	stored := fileContent(a, f, "large")
+	a.Equal(stored[:compressHeaderSize], []byte{compressMagic, compressFlate})
+	a.True(len(stored) < len(large)/10)
+	data, _, err = c.Get("large")
+	a.NotError(err).Equal(data, large)
+
+	// 无法压缩的数据原样保存
+	random := make([]byte, 1000)
+	_, err = rand.Read(random)
+	a.NotError(err)
+	random[0] = 'r'
+	a.NotError(c.Set("random", random, time.Minute))
+	a.Equal(fileContent(a, f, "random"), random)
+	data, _, err = c.Get("random")
+	a.NotError(err).Equal(data, random)
+
+	// 刚好以compressMagic开头的未压缩数据
+	magic := []byte{compressMagic, compressFlate, 1, 2}
+	a.NotError(c.Set("magic", magic, time.Minute))
+	a.Equal(fileContent(a, f, "magic"), append([]byte{compressMagic, compressStored}, magic...))
+	data, _, err = c.Get("magic")
+	a.NotError(err).Equal(data, magic)
+
+	// 空数据
+	a.NotError(c.Set("empty", []byte{}, time.Minute))
+	data, _, err = c.Get("empty")
+	a.NotError(err).Equal(len(data), 0)
+
+	// 无效的数据当作不存在，并被删除
+	a.NotError(f.Set("invalid", []byte{compressMagic}, time.Minute))
+	data, _, err = c.Get("invalid")
+	a.NotError(err).Nil(data)
+	a.True(strings.Contains(buf.String(), ErrCompressHeader.Error()))
+	a.FileNotExists(filePath(f, "invalid"))
+
+	buf.Reset()
+	a.NotError(f.Set("invalid", []byte{compressMagic, 100, 1}, time.Minute))
+	data, _, err = c.Get("invalid")
+	a.NotError(err).Nil(data)
+	a.True(strings.Contains(buf.String(), ErrCompressHeader.Error()))
+	a.FileNotExists(filePath(f, "invalid"))
+
+	buf.Reset()
+	a.NotError(f.Set("invalid", []byte{compressMagic, compressFlate, 0xff, 0xff}, time.Minute))
+	data, _, err = c.Get("invalid")
+	a.NotError(err).Nil(data)
+	a.True(buf.Len() > 0)
+	a.FileNotExists(filePath(f, "invalid"))
+
+	// 超过MaxSize的数据
+	a.Equal(c.Set("huge", bytes.Repeat([]byte("x"), 20001), time.Minute), ErrCompressTooLarge)
+	huge, err := NewCompressed(f, &CompressOptions{})
+	a.NotError(err)
+	a.NotError(huge.Set("huge", bytes.Repeat([]byte("x"), 1<<20), time.Minute))
+	a.True(len(fileContent(a, f, "huge")) < 20000)
+	buf.Reset()
+	data, _, err = c.Get("huge")
+	a.NotError(err).Nil(data)
+	a.True(strings.Contains(buf.String(), ErrCompressTooLarge.Error()))
+	a.FileNotExists(filePath(f, "huge"))
+
+	a.NotError(c.Touch("large", time.Hour))
+	_, ttl, err = c.Get("large")
+	a.NotError(err).True(ttl > 50*time.Minute)
+	a.NotError(c.Delete("large"))
+	data, _, err = c.Get("large")
+	a.NotError(err).Nil(data)
+
+	a.NotError(c.Close())
+}
+
+// 启用压缩之前保存的数据依然可以读取
+func TestCompressed_Legacy(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	f, err := NewFile(dir, 10, nil)
+	a.NotError(err)
+
+	// 各个编码方式都能原样还原的数据
+	small := map[interface{}]interface{}{"name": "value"}
+	large := map[interface{}]interface{}{"state": string(bytes.Repeat([]byte("x"), 5000))}
+	for _, codec := range []types.Codec{codecs.NewGob(), codecs.NewJSON(), codecs.NewMsgPack(), codecs.NewCBOR()} {
+		plain := NewRaw(f, codec, 60)
+		a.NotError(plain.Save("legacy", small))
+		a.NotError(plain.Save("legacy-large", large))
+
+		c, err := NewCompressed(f, &CompressOptions{})
+		a.NotError(err)
+		store := NewRaw(c, codec, 60)
+		mapped, err := store.Get("legacy")
+		a.NotError(err).Equal(mapped, small)
+		mapped, err = store.Get("legacy-large")
+		a.NotError(err).Equal(mapped, large)
+
+		a.NotError(store.Save("legacy-large", large))
+		a.Equal(fileContent(a, f, "legacy-large")[0], compressMagic)
+		mapped, err = store.Get("legacy-large")
+		a.NotError(err).Equal(mapped, large)
+	}
+}
+
+// 先压缩后加密
+func TestCompressed_Encrypted(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	f, err := NewFile(dir, 10, nil)
+	a.NotError(err)
+	e, err := NewEncrypted(f, encryptKey1)
+	a.NotError(err)
+	c, err := NewCompressed(e, &CompressOptions{})
+	a.NotError(err)
+
+	large := bytes.Repeat([]byte("wizard state "), 1000)
+	a.NotError(c.Set("id", large, time.Minute))
+	a.True(len(fileContent(a, f, "id")) < len(large)/10)
+	data, _, err := c.Get("id")
+	a.NotError(err).Equal(data, large)
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"context"
+	"time"
+
+	"github.com/issue9/session/types"
+)
+
+// 包装另一个RawStore的存储器的公共部分，
+// 除数据的读写之外，GC及Close()等操作都直接交由被包装的store处理。
+type decorator struct {
+	store types.ContextRawStore
+	gc    types.GCer // 若store未实现types.GCer，则为nil
+}
+
+func newDecorator(store types.RawStore) decorator {
+	gc, _ := store.(types.GCer)
+	return decorator{
+		store: types.NewContextRawStore(store),
+		gc:    gc,
+	}
+}
+
+// session.RawStore.Delete()
+func (d *decorator) Delete(sessID string) error {
+	return d.store.DeleteContext(context.Background(), sessID)
+}
+
+// session.ContextRawStore.DeleteContext()
+func (d *decorator) DeleteContext(ctx context.Context, sessID string) error {
+	return d.store.DeleteContext(ctx, sessID)
+}
+
+// session.RawStore.Touch()
+func (d *decorator) Touch(sessID string, ttl time.Duration) error {
+	return d.store.TouchContext(context.Background(), sessID, ttl)
+}
+
+// session.ContextRawStore.TouchContext()
+func (d *decorator) TouchContext(ctx context.Context, sessID string, ttl time.Duration) error {
+	return d.store.TouchContext(ctx, sessID, ttl)
+}
+
+// session.RawStore.StartGC()
+func (d *decorator) StartGC() {
+	d.store.StartGC()
+}
+
+// types.GCer.GC()
+//
+// 若被包装的store未实现types.GCer，则不执行任何操作。
+func (d *decorator) GC(ctx context.Context) (int, error) {
+	if d.gc == nil {
+		return 0, nil
+	}
+	return d.gc.GC(ctx)
+}
+
+// types.GCer.StartGCContext()
+//
+// 若被包装的store未实现types.GCer，则忽略参数，直接调用其StartGC()。
+func (d *decorator) StartGCContext(ctx context.Context, opt *types.GCOptions) {
+	if d.gc == nil {
+		d.store.StartGC()
+		return
+	}
+	d.gc.StartGCContext(ctx, opt)
+}
+
+// types.GCer.GCStats()
+func (d *decorator) GCStats() types.GCStats {
+	if d.gc == nil {
+		return types.GCStats{}
+	}
+	return d.gc.GCStats()
+}
+
+// session.RawStore.Close()
+func (d *decorator) Close() error {
+	return d.store.Close()
+}
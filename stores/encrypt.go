@@ -0,0 +1,208 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/issue9/session/types"
+)
+
+// 加密数据的格式版本，保存在数据的第一个字节。
+const encryptVersion byte = 1
+
+// 数据头的长度：版本(1字节) + 密钥编号(4字节)。
+const encryptHeaderSize = 1 + 4
+
+// 以下错误不会由Get()返回，无法解密的数据会被当作不存在，
+// 这些错误只会记录在EncryptOptions.Log中。
+var (
+	// ErrUnknownKey 表示数据头中的密钥编号不在当前的密钥列表中，
+	// 一般是因为对应的密钥已经被移除，或是由拥有新密钥的其它实例写入。
+	ErrUnknownKey = errors.New("找不到数据对应的密钥")
+
+	// ErrDecrypt 表示数据无法解密，可能是数据已经损坏、被篡改，
+	// 或是被移到了其它的sessionid之下。
+	ErrDecrypt = errors.New("数据解密失败")
+)
+
+// EncryptOptions 为 NewEncryptedWithOptions 的参数。
+type EncryptOptions struct {
+	// 密钥列表，第一个密钥用于加密，所有的密钥都可以用于解密，不能为空。
+	Keys []EncryptKey
+
+	// 记录无法解密的数据，若指定为nil，则会向stderr输出。
+	Log *log.Logger
+}
+
+// EncryptKey 为 NewEncrypted 使用的密钥。
+type EncryptKey struct {
+	// 密钥的编号，会保存在每条数据的头部，解密时根据该值查找对应的密钥。
+	ID uint32
+
+	// AES的密钥，长度只能是16、24或32字节，分别对应AES-128、AES-192和AES-256。
+	Secret []byte
+}
+
+// 对数据进行加密的RawStore。
+type encrypted struct {
+	decorator
+
+	current uint32 // 加密时使用的密钥编号
+	aeads   map[uint32]cipher.AEAD
+	log     *log.Logger
+}
+
+// 声明一个对数据进行加密的RawStore，数据加密之后再交由store保存，
+// 可以通过NewRaw()将其转换成session.Store接口，此时加密的是Codec编码之后的内容。
+//
+// 数据以AES-GCM加密，sessionid作为附加数据参与认证，
+// 所以将一条数据移到其它的sessionid之下，会因为无法解密而读取不到。
+//
+// keys中的第一个密钥用于加密，所有的密钥都可以用于解密。
+// 多个实例共享同一个store时，更换密钥需要分两步部署：
+// 先将新的密钥添加在第二位，待所有实例都可以用新的密钥解密之后，
+// 再将新的密钥移到第一位，否则还未更新的实例无法读取以新密钥加密的数据。
+// 旧数据在下次保存时会以新的密钥重新加密，待旧数据都过期之后，即可移除旧的密钥。
+//
+// 找不到对应密钥的数据，Get()会将其当作不存在，但不会删除，
+// 这些数据可能是其它实例以当前实例还不知道的密钥加密的；
+// 无法解密的数据则会被当作已经损坏，从store中删除。
+// 两种情况下用户都需要重新登录，而不是一直返回错误。
+//
+// GC及Close()等操作都直接交由store处理。
+func NewEncrypted(store types.RawStore, keys ...EncryptKey) (*encrypted, error) {
+	return NewEncryptedWithOptions(store, &EncryptOptions{Keys: keys})
+}
+
+// 根据opt声明一个对数据进行加密的RawStore，其它与NewEncrypted()相同。
+func NewEncryptedWithOptions(store types.RawStore, opt *EncryptOptions) (*encrypted, error) {
+	if opt == nil {
+		return nil, errors.New("opt 不能为空")
+	}
+
+	keys := opt.Keys
+	if len(keys) == 0 {
+		return nil, errors.New("keys 不能为空")
+	}
+
+	aeads := make(map[uint32]cipher.AEAD, len(keys))
+	for _, key := range keys {
+		if _, found := aeads[key.ID]; found {
+			return nil, fmt.Errorf("重复的密钥编号：%d", key.ID)
+		}
+
+		block, err := aes.NewCipher(key.Secret)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		aeads[key.ID] = aead
+	}
+
+	l := opt.Log
+	if l == nil {
+		l = log.New(os.Stderr, "session.EncryptedStore", log.LstdFlags)
+	}
+
+	return &encrypted{
+		decorator: newDecorator(store),
+		current:   keys[0].ID,
+		aeads:     aeads,
+		log:       l,
+	}, nil
+}
+
+// 附加数据，包含数据头和sessionid。
+func encryptAdditional(header []byte, sessID string) []byte {
+	ad := make([]byte, 0, len(header)+len(sessID))
+	return append(append(ad, header...), sessID...)
+}
+
+// session.RawStore.Get()
+func (e *encrypted) Get(sessID string) ([]byte, time.Duration, error) {
+	return e.GetContext(context.Background(), sessID)
+}
+
+// session.ContextRawStore.GetContext()
+//
+// 无法解密的数据当作不存在处理，记录到日志之后从store中删除。
+func (e *encrypted) GetContext(ctx context.Context, sessID string) ([]byte, time.Duration, error) {
+	data, ttl, err := e.store.GetContext(ctx, sessID)
+	if err != nil || data == nil {
+		return nil, 0, err
+	}
+
+	plain, err := e.decrypt(sessID, data)
+	switch {
+	case err == ErrUnknownKey: // 可能由拥有新密钥的实例写入，不能删除。
+		e.log.Printf("无法解密 %v 的数据：%v\n", sessID, err)
+		return nil, 0, nil
+	case err != nil:
+		e.log.Printf("无法解密 %v 的数据，该数据将被删除：%v\n", sessID, err)
+		return nil, 0, e.store.DeleteContext(ctx, sessID)
+	}
+	return plain, ttl, nil
+}
+
+// 解密数据，返回ErrUnknownKey或是ErrDecrypt。
+func (e *encrypted) decrypt(sessID string, data []byte) ([]byte, error) {
+	if len(data) < encryptHeaderSize || data[0] != encryptVersion {
+		return nil, ErrDecrypt
+	}
+
+	aead, found := e.aeads[binary.BigEndian.Uint32(data[1:encryptHeaderSize])]
+	if !found {
+		return nil, ErrUnknownKey
+	}
+
+	header, body := data[:encryptHeaderSize], data[encryptHeaderSize:]
+	if len(body) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce, body := body[:aead.NonceSize()], body[aead.NonceSize():]
+
+	plain, err := aead.Open(nil, nonce, body, encryptAdditional(header, sessID))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+// session.RawStore.Set()
+func (e *encrypted) Set(sessID string, data []byte, ttl time.Duration) error {
+	return e.SetContext(context.Background(), sessID, data, ttl)
+}
+
+// session.ContextRawStore.SetContext()
+//
+// 数据的格式为：版本(1字节) + 密钥编号(4字节) + nonce + 密文。
+func (e *encrypted) SetContext(ctx context.Context, sessID string, data []byte, ttl time.Duration) error {
+	aead := e.aeads[e.current]
+
+	buf := make([]byte, encryptHeaderSize+aead.NonceSize(), encryptHeaderSize+aead.NonceSize()+len(data)+aead.Overhead())
+	buf[0] = encryptVersion
+	binary.BigEndian.PutUint32(buf[1:encryptHeaderSize], e.current)
+	nonce := buf[encryptHeaderSize:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	buf = aead.Seal(buf, nonce, data, encryptAdditional(buf[:encryptHeaderSize], sessID))
+	return e.store.SetContext(ctx, sessID, buf, ttl)
+}
@@ -0,0 +1,197 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert"
+	"github.com/issue9/session/types"
+)
+
+var (
+	_ types.ContextRawStore = &encrypted{}
+	_ types.GCer            = &encrypted{}
+)
+
+var (
+	encryptKey1 = EncryptKey{ID: 1, Secret: bytes.Repeat([]byte{1}, 32)}
+	encryptKey2 = EncryptKey{ID: 2, Secret: bytes.Repeat([]byte{2}, 16)}
+)
+
+func TestNewEncrypted(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	f, err := NewFile(dir, 10, nil)
+	a.NotError(err)
+
+	e, err := NewEncrypted(f)
+	a.Error(err).Nil(e)
+
+	e, err = NewEncrypted(f, EncryptKey{ID: 1, Secret: []byte("short")})
+	a.Error(err).Nil(e)
+
+	e, err = NewEncrypted(f, encryptKey1, encryptKey2, EncryptKey{ID: 1, Secret: encryptKey2.Secret})
+	a.Error(err).Nil(e)
+
+	e, err = NewEncrypted(f, encryptKey1, encryptKey2)
+	a.NotError(err).NotNil(e)
+	a.Equal(e.current, encryptKey1.ID)
+
+	e, err = NewEncryptedWithOptions(f, nil)
+	a.Error(err).Nil(e)
+
+	l := log.New(ioutil.Discard, "", 0)
+	e, err = NewEncryptedWithOptions(f, &EncryptOptions{Keys: []EncryptKey{encryptKey2}, Log: l})
+	a.NotError(err).NotNil(e)
+	a.Equal(e.current, encryptKey2.ID).Equal(e.log, l)
+}
+
+// 返回一个记录到buf的加密存储器
+func newEncryptedLog(a *assert.Assertion, store types.RawStore, buf *bytes.Buffer, keys ...EncryptKey) *encrypted {
+	e, err := NewEncryptedWithOptions(store, &EncryptOptions{Keys: keys, Log: log.New(buf, "", 0)})
+	a.NotError(err)
+	return e
+}
+
+func TestEncrypted(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	f, err := NewFile(dir, 10, nil)
+	a.NotError(err)
+	buf := new(bytes.Buffer)
+	e := newEncryptedLog(a, f, buf, encryptKey1)
+
+	data, ttl, err := e.Get("id1")
+	a.NotError(err).Nil(data).Equal(ttl, 0)
+
+	plain := []byte("plain session data")
+	a.NotError(e.Set("id1", plain, time.Minute))
+	data, ttl, err = e.Get("id1")
+	a.NotError(err).Equal(data, plain)
+	a.True(ttl > 50*time.Second)
+
+	// 保存的内容为密文，相同的数据每次加密的结果都不同
+	stored, err := ioutil.ReadFile(filePath(f, "id1"))
+	a.NotError(err)
+	a.False(bytes.Contains(stored, plain))
+	a.Equal(stored[0], encryptVersion)
+	a.NotError(e.Set("id1", plain, time.Minute))
+	stored2, err := ioutil.ReadFile(filePath(f, "id1"))
+	a.NotError(err).NotEqual(stored, stored2)
+
+	// 空数据
+	a.NotError(e.Set("empty", []byte{}, time.Minute))
+	data, _, err = e.Get("empty")
+	a.NotError(err).Equal(len(data), 0)
+
+	// 移到其它的sessionid之下，当作不存在的数据，并被删除
+	a.NotError(f.Set("id2", stored, time.Minute))
+	data, _, err = e.Get("id2")
+	a.NotError(err).Nil(data)
+	a.FileNotExists(filePath(f, "id2"))
+	a.True(strings.Contains(buf.String(), ErrDecrypt.Error()))
+
+	// 被篡改的数据
+	for _, i := range []int{0, encryptHeaderSize, len(stored) - 1} {
+		tampered := append([]byte{}, stored...)
+		tampered[i] ^= 0xff
+		a.NotError(f.Set("id1", tampered, time.Minute))
+		data, _, err = e.Get("id1")
+		a.NotError(err, i).Nil(data)
+		a.FileNotExists(filePath(f, "id1"))
+	}
+	for _, bad := range [][]byte{stored[:encryptHeaderSize+2], plain} {
+		a.NotError(f.Set("id1", bad, time.Minute))
+		data, _, err = e.Get("id1")
+		a.NotError(err).Nil(data)
+		a.FileNotExists(filePath(f, "id1"))
+	}
+
+	// Touch和Delete直接交由被包装的store处理
+	a.NotError(e.Set("id1", plain, time.Minute))
+	a.NotError(e.Touch("id1", time.Hour))
+	_, ttl, err = e.Get("id1")
+	a.NotError(err).True(ttl > 50*time.Minute)
+	a.NotError(e.Delete("id1"))
+	data, _, err = e.Get("id1")
+	a.NotError(err).Nil(data)
+
+	a.NotError(e.Set("expired", plain, -time.Second))
+	removed, err := e.GC(context.Background())
+	a.NotError(err).Equal(removed, 1)
+
+	// 通过NewRaw()转换成Store
+	store := NewRaw(e, nil, 60)
+	a.NotError(store.Save("id3", testData1))
+	mapped, err := store.Get("id3")
+	a.NotError(err).Equal(mapped, testData1)
+	a.NotError(store.Close())
+}
+
+func TestEncrypted_Rotate(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	f, err := NewFile(dir, 10, nil)
+	a.NotError(err)
+
+	old, err := NewEncrypted(f, encryptKey1)
+	a.NotError(err)
+	a.NotError(old.Set("id1", rawData1, time.Minute))
+
+	// 新的密钥用于加密，旧的密钥依然可以解密
+	e, err := NewEncrypted(f, encryptKey2, encryptKey1)
+	a.NotError(err)
+	data, _, err := e.Get("id1")
+	a.NotError(err).Equal(data, rawData1)
+
+	a.NotError(e.Set("id1", rawData2, time.Minute))
+	a.NotError(e.Set("id3", rawData2, time.Minute))
+	buf := new(bytes.Buffer)
+	old = newEncryptedLog(a, f, buf, encryptKey1)
+	data, _, err = old.Get("id1")
+	a.NotError(err).Nil(data)
+	a.True(strings.Contains(buf.String(), ErrUnknownKey.Error()))
+
+	// 还未更新的实例不能删除以新密钥加密的数据
+	data, _, err = e.Get("id1")
+	a.NotError(err).Equal(data, rawData2)
+
+	// 移除旧的密钥之后，以旧密钥加密的数据当作不存在，而不是一直返回错误
+	a.NotError(old.Set("id2", rawData1, time.Minute))
+	buf.Reset()
+	e = newEncryptedLog(a, f, buf, encryptKey2)
+	data, _, err = e.Get("id3")
+	a.NotError(err).Equal(data, rawData2)
+	data, _, err = e.Get("id2")
+	a.NotError(err).Nil(data)
+	a.True(strings.Contains(buf.String(), ErrUnknownKey.Error()))
+	a.FileExists(filePath(f, "id2"))
+
+	// 可以重新保存
+	a.NotError(e.Set("id2", rawData1, time.Minute))
+	data, _, err = e.Get("id2")
+	a.NotError(err).Equal(data, rawData1)
+
+	// 编号相同，但密钥不同
+	buf.Reset()
+	e = newEncryptedLog(a, f, buf, EncryptKey{ID: encryptKey2.ID, Secret: encryptKey1.Secret})
+	data, _, err = e.Get("id3")
+	a.NotError(err).Nil(data)
+	a.True(strings.Contains(buf.String(), ErrDecrypt.Error()))
+	a.FileNotExists(filePath(f, "id3"))
+}
@@ -5,176 +5,594 @@
 package stores
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/issue9/session/stores/internal/expiry"
+	"github.com/issue9/session/stores/internal/flock"
+	"github.com/issue9/session/types"
 )
 
 // session文件创建的权限。
 const mode os.FileMode = 0600
 
+// 文件存储器创建目录的权限。
+const dirMode os.FileMode = 0700
+
+// 写入时临时文件的前缀，不符合fileIDPattern，所以不会被当作session文件。
+const fileTempPrefix = ".tmp-"
+
+// 临时文件超过此时间未被修改，则认为是写入过程中崩溃遗留的文件，GC时会被删除。
+const fileTempLifetime = time.Hour
+
+// 锁文件所在的子目录，以.开头，不会与session的子目录冲突。
+const fileLockDir = ".locks"
+
+// 锁文件的数量，sessionid根据哈希值共用这些锁文件，
+// 避免为每一个session创建一个锁文件。
+const fileLockStripes = 64
+
+// GC的锁文件名，同一时间只有获得该锁的进程才会执行GC。
+const fileGCLock = "gc"
+
+// 文件存储器中有效的sessionid，只能包含字母、数字、下划线和减号，
+// 可以涵盖十六进制和base64url编码的sessionid。
+var fileIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// 子目录的名称，为两位十六进制数。
+var fileSubdirPattern = regexp.MustCompile(`^[0-9a-f]{2}$`)
+
+// 当sessionid包含fileIDPattern之外的字符时返回的错误，
+// 比如包含路径分隔符或是..等可能访问到其它文件的sessionid。
+var ErrInvalidID = errors.New("无效的 sessionid")
+
 type file struct {
-	dir      string // session保存的路径
-	ticker   *time.Ticker
-	lifetime time.Duration
-	log      *log.Logger
+	*gcRunner
+
+	dir     string // session保存的路径
+	log     *log.Logger
+	expires *expiry.Scheduler
+
+	mu          sync.Mutex
+	onError     func(error) // 调度器删除文件时发生的错误
+	stopExpires func() bool // 取消在ctx结束时停止调度器的操作
+
+	locksMu sync.Mutex
+	locks   [fileLockStripes]*flock.Locker // 按需打开
+	gcLock  *flock.Locker
+
+	closeMu sync.Mutex
+	closed  bool
+	ops     sync.WaitGroup // 正在使用锁文件的操作，Close()需要等待这些操作完成
 }
 
-// 声明一个实现session.Store接口的文件存储器，
-// 在该存储器下，每个session都将以单独的文件存储。
-// dir为session文件的存放路径。创建的文件权限默认为0600。
+// 关闭之后再使用锁文件时返回的错误
+var errFileClosed = errors.New("文件存储器已经关闭")
+
+// 声明一个实现session.RawStore接口的文件存储器，
+// 在该存储器下，每个session都将以单独的文件存储，
+// 文件的修改时间即为该session的过期时间。
+//
+// 文件根据sessionid的哈希值分散到两级子目录中，比如 dir/ab/cd/<sessionid>，
+// 避免单个目录中的文件过多。
+// GC和Purge()只会处理符合该结构的文件，dir中的其它文件不受影响。
+// 可以通过NewRaw()将其转换成session.Store接口。
+//
+// dir为session文件的存放路径，不存在时会以0700的权限创建，创建的文件权限默认为0600。
+// sessionid只能包含字母、数字、下划线和减号，否则返回ErrInvalidID，
+// 写入时先写入临时文件，再替换原有的文件，所以写入过程中崩溃也不会留下不完整的文件。
+//
+// 多个进程可以共用同一个目录：读取时加共享锁，写入和删除时加排它锁，
+// 锁文件保存在dir/.locks中；GC时会尝试获取一个全局的锁，
+// 同一时间只有一个进程在扫描目录，其它进程会跳过此次GC。
+// 锁为建议性的，只对同样使用该存储器的进程有效，windows等不支持flock(2)的系统上只在进程内有效。
+//
+// interval为重新扫描目录的间隔，单位为秒，小于等于0时为1分钟，用于发现不是通过当前实例写入的文件，
+// 通过当前实例写入的文件，会在过期时由调度器直接删除，而不需要等待扫描。
 // l用户记录在GC过程中发生的错误，若指定为nil，则会向stderr输出错误信息。
-func NewFile(dir string, lifetime int, l *log.Logger) (*file, error) {
+func NewFile(dir string, interval int, l *log.Logger) (*file, error) {
 	stat, err := os.Stat(dir)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return nil, err
-		}
-
-		// 尝试创建目录
-		if err = os.MkdirAll(dir, mode); err != nil {
+	switch {
+	case os.IsNotExist(err): // 尝试创建目录
+		if err = os.MkdirAll(dir, dirMode); err != nil {
 			return nil, err
 		}
+	case err != nil:
+		return nil, err
+	case !stat.IsDir():
+		return nil, fmt.Errorf("[%v]存在，但不是一个有效的路径。", dir)
 	}
 
-	if !stat.IsDir() {
-		return nil, fmt.Errorf("[%v]存在，但不是一个有效的路径。", dir)
+	if err = os.MkdirAll(filepath.Join(dir, fileLockDir), dirMode); err != nil {
+		return nil, err
 	}
 
 	if l == nil { // TODO 若log.std公开，则可以直接使用log.std变量
 		l = log.New(os.Stderr, "session.FileStore", log.LstdFlags)
 	}
 
-	return &file{
-		dir:      dir + string(os.PathSeparator),
-		lifetime: time.Second * time.Duration(lifetime),
-		log:      l,
-	}, nil
+	f := &file{
+		dir: filepath.Clean(dir) + string(os.PathSeparator),
+		log: l,
+	}
+	if f.gcLock, err = flock.New(filepath.Join(f.dir, fileLockDir, fileGCLock)); err != nil {
+		return nil, err
+	}
+	f.gcRunner = newGCRunner(time.Second*time.Duration(interval), l, f.gc)
+	f.gcRunner.runAtStart = true
+	f.expires = expiry.NewScheduler(f.expire)
+	return f, nil
 }
 
-// 该文件是否不存在
-func (f *file) isNotExists(path string) bool {
-	_, err := os.Stat(path)
-
-	if err != nil && os.IsNotExist(err) {
-		return true
+// 返回sessID对应的文件路径，sessID无效时返回ErrInvalidID。
+func (f *file) path(sessID string) (string, error) {
+	if !fileIDPattern.MatchString(sessID) {
+		return "", ErrInvalidID
 	}
+	return f.dir + fileSubdir(sessID) + sessID, nil
+}
 
-	return false
+// 返回sessID所在的子目录，以路径分隔符结尾。
+func fileSubdir(sessID string) string {
+	h := crc32.ChecksumIEEE([]byte(sessID))
+	return fmt.Sprintf("%02x%c%02x%c", byte(h>>24), os.PathSeparator, byte(h>>16), os.PathSeparator)
 }
 
-// session.Store.Delete()
-func (f *file) Delete(sessID string) error {
-	path := f.dir + sessID
+// 返回sessID对应的锁，锁文件在第一次使用时才打开。
+func (f *file) locker(sessID string) (*flock.Locker, error) {
+	i := crc32.ChecksumIEEE([]byte(sessID)) % fileLockStripes
 
-	if f.isNotExists(path) {
-		return nil
+	f.locksMu.Lock()
+	defer f.locksMu.Unlock()
+
+	if f.locks[i] == nil {
+		l, err := flock.New(filepath.Join(f.dir, fileLockDir, fmt.Sprintf("%02x", i)))
+		if err != nil {
+			return nil, err
+		}
+		f.locks[i] = l
 	}
+	return f.locks[i], nil
+}
+
+// 标记一个使用锁文件的操作开始，返回的函数用于标记该操作结束。
+//
+// 存储器已经关闭时返回errFileClosed。
+func (f *file) acquire() (func(), error) {
+	f.closeMu.Lock()
+	defer f.closeMu.Unlock()
 
-	return os.Remove(path)
+	if f.closed {
+		return nil, errFileClosed
+	}
+	f.ops.Add(1)
+	return f.ops.Done, nil
 }
 
-// session.Store.Get()
-func (f *file) Get(sessID string) (map[interface{}]interface{}, error) {
-	path := f.dir + sessID
+// 在sessID对应的锁中执行fn，exclusive表示是否为排它锁。
+func (f *file) locked(sessID string, exclusive bool, fn func() error) error {
+	release, err := f.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
 
-	if f.isNotExists(path) { // 不存在，返回一个空值
-		return map[interface{}]interface{}{}, nil
+	l, err := f.locker(sessID)
+	if err != nil {
+		return err
 	}
 
-	fp, err := os.Open(path)
+	if exclusive {
+		if err = l.Lock(); err != nil {
+			return err
+		}
+		defer l.Unlock()
+	} else {
+		if err = l.RLock(); err != nil {
+			return err
+		}
+		defer l.RUnlock()
+	}
+
+	return fn()
+}
+
+// session.RawStore.Delete()
+func (f *file) Delete(sessID string) error {
+	path, err := f.path(sessID)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer fp.Close()
+	f.expires.Cancel(sessID)
 
-	d := gob.NewDecoder(fp)
-	mapped := make(map[interface{}]interface{}, 0)
-	if err := d.Decode(&mapped); err != nil {
-		return nil, err
+	return f.locked(sessID, true, func() error {
+		return removeFile(path)
+	})
+}
+
+// session.RawStore.Get()
+func (f *file) Get(sessID string) ([]byte, time.Duration, error) {
+	path, err := f.path(sessID)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	return mapped, nil
+	var data []byte
+	var ttl time.Duration
+	err = f.locked(sessID, false, func() error {
+		stat, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) { // 不存在，返回一个空值
+				return nil
+			}
+			return err
+		}
+
+		ttl = stat.ModTime().Sub(time.Now())
+		if ttl <= 0 { // 已经过期，但还未被GC回收
+			ttl = 0
+			return nil
+		}
+
+		data, err = ioutil.ReadFile(path)
+		return err
+	})
+	if err != nil || data == nil {
+		return nil, 0, err
+	}
+	return data, ttl, nil
 }
 
-// session.Store.Save()
-func (f *file) Save(sessID string, data map[interface{}]interface{}) error {
-	path := f.dir + sessID
+// session.RawStore.Set()
+//
+// 数据先写入同一目录下的临时文件，设置好过期时间之后，
+// 在排它锁中替换原有的文件。
+func (f *file) Set(sessID string, data []byte, ttl time.Duration) error {
+	path, err := f.path(sessID)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, fileTempPrefix+sessID+"-")
+	if os.IsNotExist(err) { // 子目录不存在
+		if err = os.MkdirAll(dir, dirMode); err != nil {
+			return err
+		}
+		tmp, err = ioutil.TempFile(dir, fileTempPrefix+sessID+"-")
+	}
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
 
-	context := new(bytes.Buffer)
-	e := gob.NewEncoder(context)
-	e.Encode(data)
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, mode)
+	}
 
-	fp, err := os.Create(path)
+	now := time.Now()
+	if err == nil {
+		err = os.Chtimes(tmpPath, now, now.Add(ttl))
+	}
+	if err == nil {
+		err = f.locked(sessID, true, func() error {
+			return os.Rename(tmpPath, path)
+		})
+	}
 	if err != nil {
+		os.Remove(tmpPath)
 		return err
 	}
-	defer fp.Close()
 
-	_, err = context.WriteTo(fp)
-	return err
+	f.expires.Schedule(sessID, now.Add(ttl))
+	return nil
 }
 
-func (f *file) gc() error {
-	d := time.Now().Add(-f.lifetime)
+// 将文件的修改时间设置为过期时间，并添加到调度器中。
+func (f *file) chtimes(sessID, path string, ttl time.Duration) error {
+	now := time.Now()
+	if err := os.Chtimes(path, now, now.Add(ttl)); err != nil {
+		return err
+	}
+
+	f.expires.Schedule(sessID, now.Add(ttl))
+	return nil
+}
 
-	fs, err := ioutil.ReadDir(f.dir)
+// session.RawStore.Touch()
+func (f *file) Touch(sessID string, ttl time.Duration) error {
+	path, err := f.path(sessID)
 	if err != nil {
 		return err
 	}
 
-	for _, info := range fs {
-		if info.IsDir() {
-			continue
+	return f.locked(sessID, true, func() error {
+		stat, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
 		}
 
-		if info.ModTime().After(d) { // 未过期： info.ModTime() > (time.Now() - maxAge)
+		// 已经过期，但还未被GC回收的session不能再延长其过期时间。
+		if !stat.ModTime().After(time.Now()) {
+			return nil
+		}
+		return f.chtimes(sessID, path, ttl)
+	})
+}
+
+// 由调度器调用，删除已经到期的文件。
+//
+// 文件可能已经被其它实例更新，所以删除之前需要再次确认其修改时间。
+func (f *file) expire(ids []string) {
+	now := time.Now()
+	for _, id := range ids {
+		path, err := f.path(id)
+		if err != nil {
 			continue
 		}
 
-		// 过期
-		if err = os.Remove(f.dir + info.Name()); err != nil {
-			return err
+		if _, err = f.removeExpired(id, path, now); err != nil {
+			f.error(err)
 		}
 	}
-	return nil
 }
 
-// session.Store.StartGC()
-func (f *file) StartGC() {
-	f.ticker = time.NewTicker(f.lifetime)
-	go func() {
-		for range f.ticker.C {
-			if err := f.gc(); err != nil {
-				f.log.Println(err.Error())
+// 在排它锁中删除已经过期的文件，返回是否删除了文件。
+//
+// 文件可能在加锁之前被其它进程更新，所以需要在锁中再次确认其修改时间，
+// 未过期的文件会重新添加到调度器中。
+func (f *file) removeExpired(sessID, path string, now time.Time) (removed bool, err error) {
+	err = f.locked(sessID, true, func() error {
+		stat, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
 			}
+			return err
+		}
+
+		if stat.ModTime().After(now) {
+			f.expires.Schedule(sessID, stat.ModTime())
+			return nil
+		}
+
+		if err = removeFile(path); err != nil {
+			return err
 		}
-	}()
+		removed = true
+		return nil
+	})
+
+	return removed, err
 }
 
-// session.Store.Close()
-func (f *file) Close() error {
-	if f.ticker != nil {
-		f.ticker.Stop()
+func (f *file) error(err error) {
+	f.mu.Lock()
+	onError := f.onError
+	f.mu.Unlock()
+
+	if onError != nil {
+		onError(err)
+	} else {
+		f.log.Println(err.Error())
 	}
+}
 
-	fs, err := ioutil.ReadDir(f.dir)
+// 遍历所有的session文件以及写入时的临时文件。
+//
+// 只会访问 ab/cd/<sessionid> 结构的文件，且sessionid的哈希值必须与所在的子目录相符，
+// 其它的文件和目录都会被忽略。temp表示是否为临时文件，此时的id为空。
+func (f *file) walk(ctx context.Context, fn func(id, path string, info os.FileInfo, temp bool) error) error {
+	level1, err := ioutil.ReadDir(f.dir)
 	if err != nil {
 		return err
 	}
 
-	for _, info := range fs {
-		if info.IsDir() {
+	for _, d1 := range level1 {
+		if !d1.IsDir() || !fileSubdirPattern.MatchString(d1.Name()) {
 			continue
 		}
 
-		if err := os.Remove(f.dir + info.Name()); err != nil {
+		level2, err := ioutil.ReadDir(f.dir + d1.Name())
+		if err != nil {
 			return err
 		}
+
+		for _, d2 := range level2 {
+			if !d2.IsDir() || !fileSubdirPattern.MatchString(d2.Name()) {
+				continue
+			}
+
+			sub := d1.Name() + string(os.PathSeparator) + d2.Name() + string(os.PathSeparator)
+			fs, err := ioutil.ReadDir(f.dir + sub)
+			if err != nil {
+				return err
+			}
+
+			for _, info := range fs {
+				if err = ctx.Err(); err != nil {
+					return err
+				}
+
+				name := info.Name()
+				switch {
+				case info.IsDir():
+					continue
+				case strings.HasPrefix(name, fileTempPrefix):
+					err = fn("", f.dir+sub+name, info, true)
+				case fileIDPattern.MatchString(name) && fileSubdir(name) == sub:
+					err = fn(name, f.dir+sub+name, info, false)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// 扫描整个目录，删除已经过期的文件，未过期的文件则添加到调度器中。
+//
+// 写入时崩溃遗留的临时文件也会被删除。
+// 若其它进程正在执行GC，则直接返回。
+func (f *file) gc(ctx context.Context) (int, error) {
+	release, err := f.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	ok, err := f.gcLock.TryLock()
+	if err != nil || !ok {
+		return 0, err
+	}
+	defer f.gcLock.Unlock()
+
+	now := time.Now()
+	removed := 0
+
+	err = f.walk(ctx, func(id, path string, info os.FileInfo, temp bool) error {
+		if temp {
+			if info.ModTime().Before(now.Add(-fileTempLifetime)) {
+				return removeFile(path)
+			}
+			return nil
+		}
+
+		if info.ModTime().After(now) { // 未过期
+			f.expires.Schedule(id, info.ModTime())
+			return nil
+		}
+
+		// 过期
+		ok, err := f.removeExpired(id, path, now)
+		if ok {
+			removed++
+		}
+		return err
+	})
+
+	return removed, err
+}
+
+// 删除文件，文件不存在时不返回错误。
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// session.RawStore.StartGC()
+//
+// 与StartGCContext(context.Background(), nil)相同。
+func (f *file) StartGC() {
+	f.StartGCContext(context.Background(), nil)
+}
+
+// types.GCer.StartGCContext()
+//
+// 启动之后立即在后台扫描一次目录，之后每个文件都在其过期时被删除，
+// 每隔interval会重新扫描目录，以发现其它实例写入的文件。
+// 扫描不会阻塞StartGCContext()的返回，目录中的文件很多时也不会影响启动。
+func (f *file) StartGCContext(ctx context.Context, opt *types.GCOptions) {
+	f.mu.Lock()
+	f.onError = nil
+	if opt != nil {
+		f.onError = opt.OnError
+	}
+	f.mu.Unlock()
+
+	f.expires.Start()
+	f.mu.Lock()
+	if f.stopExpires != nil {
+		f.stopExpires()
+	}
+	f.stopExpires = context.AfterFunc(ctx, f.expires.Stop)
+	f.mu.Unlock()
+
+	f.gcRunner.StartGCContext(ctx, opt)
+}
+
+// session.RawStore.Close()
+//
+// 仅停止GC并关闭已经打开的锁文件，所有的session文件都会保留，下次启动时依然有效。
+// 若需要删除所有的session，可以调用Purge()。
+//
+// 会等待正在执行的GC以及读写操作完成之后，再关闭锁文件，
+// 之后的读写操作都将返回错误。
+func (f *file) Close() error {
+	f.stopGC()
+	f.expires.Stop()
+
+	f.closeMu.Lock()
+	if f.closed {
+		f.closeMu.Unlock()
+		return nil
+	}
+	f.closed = true
+	f.closeMu.Unlock()
+	f.ops.Wait()
+
+	f.locksMu.Lock()
+	defer f.locksMu.Unlock()
+	for i, l := range f.locks {
+		if l != nil {
+			l.Close()
+			f.locks[i] = nil
+		}
+	}
+	f.gcLock.Close()
+	return nil
+}
+
+// 删除所有的session文件以及空的子目录。
+//
+// 只会删除符合 ab/cd/<sessionid> 结构的文件，dir中的其它文件不受影响。
+func (f *file) Purge() error {
+	err := f.walk(context.Background(), func(id, path string, info os.FileInfo, temp bool) error {
+		if temp {
+			return removeFile(path)
+		}
+
+		f.expires.Cancel(id)
+		return f.locked(id, true, func() error {
+			return removeFile(path)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// 删除空的子目录，非空的目录会删除失败，忽略这些错误。
+	subdirs, err := filepath.Glob(f.dir + "[0-9a-f][0-9a-f]" + string(os.PathSeparator) + "[0-9a-f][0-9a-f]")
+	if err != nil {
+		return err
+	}
+	for _, sub := range subdirs {
+		os.Remove(sub)
+		os.Remove(filepath.Dir(sub))
 	}
 
 	return nil
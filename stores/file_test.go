@@ -5,6 +5,13 @@
 package stores
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,72 +19,328 @@ import (
 	"github.com/issue9/session/types"
 )
 
-var s types.Store = &file{}
+var s types.RawStore = &file{}
+
+// 声明两行测试数据。
+var (
+	rawData1 = []byte("data1")
+	rawData2 = []byte("data2")
+)
+
+// 返回一个临时目录，以及用于清除的函数。
+func newFileDir(a *assert.Assertion) (string, func()) {
+	dir, err := ioutil.TempDir("", "session")
+	a.NotError(err)
+
+	return filepath.Join(dir, "testdata"), func() {
+		a.NotError(os.RemoveAll(dir))
+	}
+}
+
+// 返回sessID对应的文件路径
+func filePath(f *file, sessID string) string {
+	return f.dir + fileSubdir(sessID) + sessID
+}
 
 func TestFile(t *testing.T) {
 	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
 
-	store, err := NewFile("./testdata", 2, nil)
+	store, err := NewFile(dir, 2, nil)
 	a.NotError(err).NotNil(store)
 
 	// 添加一个数据
-	a.NotError(store.Save("testData1", testData1))
-	a.FileExists(store.dir + "testData1")
+	a.NotError(store.Set("testData1", rawData1, time.Minute))
+	a.FileExists(filePath(store, "testData1"))
 
 	// Delete,删除一个不存在的数据，不应该发生错误
 	a.NotError(store.Delete("non"))
 
 	// Delete,删除添加的数据
 	a.NotError(store.Delete("testData1"))
-	a.FileNotExists(store.dir + "testData1")
+	a.FileNotExists(filePath(store, "testData1"))
 
 	// 添加两条数据
-	a.NotError(store.Save("testData1", testData1))
-	a.FileExists(store.dir + "testData1")
-	a.NotError(store.Save("testData2", testData2))
-	a.FileExists(store.dir + "testData2")
+	a.NotError(store.Set("testData1", rawData1, time.Minute))
+	a.FileExists(filePath(store, "testData1"))
+	a.NotError(store.Set("testData2", rawData2, time.Minute))
+	a.FileExists(filePath(store, "testData2"))
 
 	// 测试正常状态的Get
-	mapped, err := store.Get("testData1")
-	a.NotError(err).NotNil(mapped)
-	a.Equal(mapped, testData1)
+	data, ttl, err := store.Get("testData1")
+	a.NotError(err).Equal(data, rawData1)
+	a.True(ttl > 50*time.Second && ttl <= time.Minute)
 
 	// 测试Get()一个不存在的数据。
-	mapped, err = store.Get("non")
-	a.NotError(err).Equal(0, len(mapped))
+	data, ttl, err = store.Get("non")
+	a.NotError(err).Nil(data).Equal(ttl, 0)
+
+	// Touch
+	a.NotError(store.Touch("testData1", time.Hour))
+	data, ttl, err = store.Get("testData1")
+	a.NotError(err).Equal(data, rawData1)
+	a.True(ttl > time.Minute)
+	a.NotError(store.Touch("non", time.Hour))
+	a.FileNotExists(filePath(store, "non"))
+
+	// 已经过期的数据
+	a.NotError(store.Touch("testData1", -time.Second))
+	data, _, err = store.Get("testData1")
+	a.NotError(err).Nil(data)
+
+	// 已经过期的数据不能通过Touch()恢复
+	a.NotError(store.Touch("testData1", time.Hour))
+	data, _, err = store.Get("testData1")
+	a.NotError(err).Nil(data)
 
 	// Free
-	a.NotError(store.Save("testData1", testData1))
-	a.NotError(store.Save("testData2", testData2))
-	a.FileExists(store.dir + "testData1")
-	a.FileExists(store.dir + "testData2")
+	a.NotError(store.Set("testData1", rawData1, time.Minute))
+	a.NotError(store.Set("testData2", rawData2, time.Minute))
+	a.FileExists(filePath(store, "testData1"))
+	a.FileExists(filePath(store, "testData2"))
 	a.NotError(store.Close())
-	a.FileNotExists(store.dir + "testData1")
-	a.FileNotExists(store.dir + "testData2")
+	a.FileExists(filePath(store, "testData1"))
+	a.FileExists(filePath(store, "testData2"))
+
+	// 重新打开之后数据依然有效
+	store, err = NewFile(dir, 2, nil)
+	a.NotError(err)
+	data, _, err = store.Get("testData1")
+	a.NotError(err).Equal(data, rawData1)
 }
 
 func TestFile_StartGC(t *testing.T) {
 	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
 
-	// 2秒后开始执行GC
-	store, err := NewFile("./testdata", 2, nil)
+	// 过期的文件由调度器删除，不需要等待重新扫描目录
+	store, err := NewFile(dir, 100, nil)
 	a.NotError(err).NotNil(store)
 
 	// 添加两条数据
-	a.NotError(store.Save("testData1", testData1))
-	a.NotError(store.Save("testData2", testData2))
-	a.FileExists(store.dir + "testData1")
-	a.FileExists(store.dir + "testData2")
+	a.NotError(store.Set("testData1", rawData1, 2*time.Second))
+	a.NotError(store.Set("testData2", rawData2, time.Minute))
+	a.FileExists(filePath(store, "testData1"))
+	a.FileExists(filePath(store, "testData2"))
 
 	store.StartGC()
-	a.FileExists(store.dir + "testData1")
-	a.FileExists(store.dir + "testData2")
+	a.FileExists(filePath(store, "testData1"))
+	a.FileExists(filePath(store, "testData2"))
 	time.Sleep(time.Second) // 延时1秒，数据还在
-	a.FileExists(store.dir + "testData1")
-	a.FileExists(store.dir + "testData2")
-	time.Sleep(time.Second * 2) // 再延时2秒，数据应该没了
-	a.FileNotExists(store.dir + "testData1")
-	a.FileNotExists(store.dir + "testData2")
+	a.FileExists(filePath(store, "testData1"))
+	a.FileExists(filePath(store, "testData2"))
+	time.Sleep(1500 * time.Millisecond) // 第2秒时过期，testData1应该没了
+	a.FileNotExists(filePath(store, "testData1"))
+	a.FileExists(filePath(store, "testData2"))
+
+	a.NotError(store.Close())
+
+	// 启动之后在后台扫描一次目录，删除其它实例写入的过期文件
+	store, err = NewFile(dir, 100, nil)
+	a.NotError(err)
+	expired := filePath(store, "expired")
+	a.NotError(os.MkdirAll(filepath.Dir(expired), dirMode))
+	a.NotError(ioutil.WriteFile(expired, rawData1, mode))
+	old := time.Now().Add(-time.Minute)
+	a.NotError(os.Chtimes(expired, old, old))
+
+	store.StartGC()
+	for i := 0; i < 100 && store.GCStats().Runs == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.Equal(store.GCStats().Runs, 1)
+	a.FileNotExists(expired)
+	a.NotError(store.Close())
+}
+
+// Close()与GC和读写同时进行，需要通过-race检测。
+func TestFile_CloseConcurrent(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	store, err := NewFile(dir, 100, nil)
+	a.NotError(err)
+	store.StartGCContext(context.Background(), &types.GCOptions{Interval: time.Millisecond, OnError: func(error) {}})
+
+	errs := make(chan error, 200)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := "id" + strconv.Itoa(i)
+			for j := 0; j < 50; j++ {
+				if err := store.Set(id, rawData1, time.Minute); err != nil {
+					errs <- err
+					return
+				}
+				if _, _, err := store.Get(id); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	time.Sleep(5 * time.Millisecond)
+	a.NotError(store.Close())
+	a.NotError(store.Close())
+	wg.Wait()
+	close(errs)
+
+	// 关闭之后的操作只会返回errFileClosed
+	for err := range errs {
+		a.Equal(err, errFileClosed)
+	}
+	a.Equal(store.Set("id", rawData1, time.Minute), errFileClosed)
+	_, err = store.GC(context.Background())
+	a.Equal(err, errFileClosed)
+}
+
+func TestNewFile(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	// 不存在的多级目录
+	store, err := NewFile(filepath.Join(dir, "a", "b"), 10, nil)
+	a.NotError(err).NotNil(store)
+	for _, d := range []string{dir, filepath.Join(dir, "a"), filepath.Join(dir, "a", "b")} {
+		stat, err := os.Stat(d)
+		a.NotError(err).True(stat.IsDir())
+		a.Equal(stat.Mode().Perm(), dirMode)
+	}
+	a.NotError(store.Set("id", rawData1, time.Minute))
+
+	// 已经存在的目录
+	store, err = NewFile(dir+string(os.PathSeparator), 10, nil)
+	a.NotError(err).NotNil(store)
+	a.Equal(store.dir, dir+string(os.PathSeparator))
+
+	// 存在，但不是目录
+	path := filepath.Join(dir, "file")
+	a.NotError(ioutil.WriteFile(path, rawData1, 0600))
+	store, err = NewFile(path, 10, nil)
+	a.Error(err).Nil(store)
+}
+
+func TestFile_InvalidID(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	store, err := NewFile(dir, 10, nil)
+	a.NotError(err)
+
+	// 目录之外的文件
+	outside := filepath.Join(filepath.Dir(dir), "outside")
+	a.NotError(ioutil.WriteFile(outside, rawData1, 0600))
+
+	for _, id := range []string{
+		"",
+		"../outside",
+		"..",
+		"a/b",
+		`a\b`,
+		"/etc/passwd",
+		".hidden",
+		"id\x00",
+		"id with space",
+		strings.Repeat("a", 129),
+	} {
+		data, _, err := store.Get(id)
+		a.Equal(err, ErrInvalidID, id).Nil(data)
+		a.Equal(store.Set(id, rawData2, time.Minute), ErrInvalidID, id)
+		a.Equal(store.Touch(id, time.Minute), ErrInvalidID, id)
+		a.Equal(store.Delete(id), ErrInvalidID, id)
+	}
+
+	data, err := ioutil.ReadFile(outside)
+	a.NotError(err).Equal(data, rawData1)
+
+	// 十六进制和base64url编码的sessionid
+	for _, id := range []string{"0123456789abcdef", "AZaz09-_", strings.Repeat("a", 128)} {
+		a.NotError(store.Set(id, rawData1, time.Minute), id)
+	}
+}
+
+func TestFile_AtomicWrite(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	store, err := NewFile(dir, 10, nil)
+	a.NotError(err)
+
+	a.NotError(store.Set("id", rawData1, time.Minute))
+	a.NotError(store.Set("id", rawData2, time.Minute))
+	stat, err := os.Stat(filePath(store, "id"))
+	a.NotError(err).Equal(stat.Mode().Perm(), mode)
+
+	// 没有遗留的临时文件
+	fs, err := ioutil.ReadDir(filepath.Dir(filePath(store, "id")))
+	a.NotError(err).Equal(len(fs), 1)
+
+	// 模拟写入时崩溃，原有的数据不受影响
+	tmp := store.dir + fileSubdir("id") + fileTempPrefix + "id-123"
+	a.NotError(ioutil.WriteFile(tmp, []byte("dat"), 0600))
+	data, _, err := store.Get("id")
+	a.NotError(err).Equal(data, rawData2)
+
+	// 刚写入的临时文件可能还在使用中，只删除较旧的临时文件
+	removed, err := store.gc(context.Background())
+	a.NotError(err).Equal(removed, 0)
+	a.FileExists(tmp)
+	old := time.Now().Add(-2 * fileTempLifetime)
+	a.NotError(os.Chtimes(tmp, old, old))
+	removed, err = store.gc(context.Background())
+	a.NotError(err).Equal(removed, 0)
+	a.FileNotExists(tmp)
+
+}
+
+func TestFile_Purge(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	store, err := NewFile(dir, 10, nil)
+	a.NotError(err)
+
+	a.NotError(store.Set("id1", rawData1, time.Minute))
+	a.NotError(store.Set("id2", rawData2, time.Minute))
+	a.NotError(store.Set("expired", rawData2, -time.Minute))
+	a.True(strings.HasPrefix(filePath(store, "id1"), filepath.Join(dir, fileSubdir("id1")[:2])))
+	a.NotEqual(fileSubdir("id1"), fileSubdir("id3"))
+
+	// 不属于存储器的文件
+	old := time.Now().Add(-time.Hour)
+	others := []string{
+		filepath.Join(dir, "id3"),                          // 不在子目录中
+		filepath.Join(dir, "zz", "zz", "id3"),              // 无效的子目录
+		filepath.Join(dir, fileSubdir("id1"), "id3"),       // 与哈希值不符的子目录
+		filepath.Join(dir, fileSubdir("id1"), "other.txt"), // 无效的sessionid
+	}
+	for _, path := range others {
+		a.NotError(os.MkdirAll(filepath.Dir(path), 0700))
+		a.NotError(ioutil.WriteFile(path, rawData1, 0600))
+		a.NotError(os.Chtimes(path, old, old))
+	}
+
+	removed, err := store.gc(context.Background())
+	a.NotError(err).Equal(removed, 1)
+	for _, path := range others {
+		a.FileExists(path)
+	}
 
+	a.NotError(store.Purge())
+	a.FileNotExists(filePath(store, "id1"))
+	a.FileNotExists(filePath(store, "id2"))
+	a.FileNotExists(filepath.Join(dir, fileSubdir("id2")))
+	for _, path := range others {
+		a.FileExists(path)
+	}
 	a.NotError(store.Close())
 }
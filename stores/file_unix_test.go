@@ -0,0 +1,223 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package stores
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert"
+)
+
+// 子进程的相关环境变量
+const (
+	fileHelperDir    = "SESSION_FILE_HELPER_DIR"
+	fileHelperMode   = "SESSION_FILE_HELPER_MODE"
+	fileHelperWorker = "SESSION_FILE_HELPER_WORKER"
+)
+
+// 以子进程的方式运行当前测试程序中的TestFile_HelperProcess
+func fileHelper(dir, mode string, worker int) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFile_HelperProcess$")
+	cmd.Env = append(os.Environ(),
+		fileHelperDir+"="+dir,
+		fileHelperMode+"="+mode,
+		fileHelperWorker+"="+strconv.Itoa(worker),
+	)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// 启动一个持有锁的子进程，在子进程获得锁之后返回，
+// 调用返回的函数释放锁并等待子进程结束。
+func startFileHolder(a *assert.Assertion, dir, mode string) func() {
+	cmd := fileHelper(dir, mode, 0)
+	stdin, err := cmd.StdinPipe()
+	a.NotError(err)
+	stdout, err := cmd.StdoutPipe()
+	a.NotError(err)
+	a.NotError(cmd.Start())
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	a.NotError(err).Equal(line, "locked\n")
+
+	return func() {
+		a.NotError(stdin.Close())
+		a.NotError(cmd.Wait())
+	}
+}
+
+// 子进程的入口，非子进程时直接返回。
+func TestFile_HelperProcess(t *testing.T) {
+	dir := os.Getenv(fileHelperDir)
+	if dir == "" {
+		return
+	}
+
+	if err := fileHelperMain(dir, os.Getenv(fileHelperMode)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func fileHelperMain(dir, mode string) error {
+	store, err := NewFile(dir, 100, nil)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	switch mode {
+	case "gc": // 持有GC锁，直到标准输入被关闭
+		if err = store.gcLock.Lock(); err != nil {
+			return err
+		}
+		fmt.Println("locked")
+		_, err = io.Copy(ioutil.Discard, os.Stdin)
+		return err
+	case "lock": // 持有id的排它锁，直到标准输入被关闭
+		return store.locked("id", true, func() error {
+			fmt.Println("locked")
+			_, err := io.Copy(ioutil.Discard, os.Stdin)
+			return err
+		})
+	case "worker": // 反复读写相同的几个session
+		worker, err := strconv.Atoi(os.Getenv(fileHelperWorker))
+		if err != nil {
+			return err
+		}
+		data := bytes.Repeat([]byte{byte('a' + worker)}, 4096+worker)
+
+		for i := 0; i < 200; i++ {
+			id := "shared" + strconv.Itoa(i%5)
+			if err = store.Set(id, data, time.Minute); err != nil {
+				return err
+			}
+
+			got, _, err := store.Get(id)
+			if err != nil {
+				return err
+			}
+			// 可能已经被其它进程删除或是覆盖，但不能是不完整的数据
+			if got != nil && (len(got) != 4096+int(got[0]-'a') || bytes.Count(got, got[:1]) != len(got)) {
+				return fmt.Errorf("读取到不完整的数据：%d", len(got))
+			}
+
+			if i%10 == 0 {
+				if err = store.Delete(id); err != nil {
+					return err
+				}
+			}
+			if i%50 == 0 {
+				if _, err = store.GC(context.Background()); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("无效的模式：%s", mode)
+	}
+}
+
+// 多个进程同时读写同一个目录
+func TestFile_MultiProcess(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	store, err := NewFile(dir, 100, nil)
+	a.NotError(err)
+	defer store.Close()
+
+	cmds := make([]*exec.Cmd, 0, 4)
+	for i := 0; i < 4; i++ {
+		cmd := fileHelper(dir, "worker", i)
+		a.NotError(cmd.Start())
+		cmds = append(cmds, cmd)
+	}
+	for _, cmd := range cmds {
+		a.NotError(cmd.Wait())
+	}
+
+	removed, err := store.GC(context.Background())
+	a.NotError(err).Equal(removed, 0)
+	for i := 0; i < 5; i++ {
+		data, _, err := store.Get("shared" + strconv.Itoa(i))
+		a.NotError(err)
+		if data != nil {
+			a.Equal(len(data), 4096+int(data[0]-'a'))
+		}
+	}
+}
+
+// 其它进程持有排它锁时，读写都会被阻塞
+func TestFile_MultiProcessLock(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	store, err := NewFile(dir, 100, nil)
+	a.NotError(err)
+	defer store.Close()
+	a.NotError(store.Set("id", rawData1, time.Minute))
+
+	release := startFileHolder(a, dir, "lock")
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() { // 不能在其它协程中调用t.Fatal()，结果通过done返回。
+		data, _, err := store.Get("id")
+		done <- result{data: data, err: err}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	var r result
+	select {
+	case r = <-done:
+		t.Error("Get() 未被其它进程的锁阻塞")
+		release()
+	default:
+		release()
+		r = <-done
+	}
+	a.NotError(r.err).Equal(r.data, rawData1)
+}
+
+// 同一时间只有一个进程执行GC
+func TestFile_MultiProcessGC(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	store, err := NewFile(dir, 100, nil)
+	a.NotError(err)
+	defer store.Close()
+	a.NotError(store.Set("expired", rawData1, -time.Minute))
+
+	release := startFileHolder(a, dir, "gc")
+	removed, err := store.GC(context.Background())
+	a.NotError(err).Equal(removed, 0)
+	a.FileExists(filePath(store, "expired"))
+
+	release()
+	removed, err = store.GC(context.Background())
+	a.NotError(err).Equal(removed, 1)
+	a.FileNotExists(filePath(store, "expired"))
+}
@@ -0,0 +1,155 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/issue9/session/types"
+)
+
+// 未指定GC间隔时的默认值
+const gcDefaultInterval = time.Minute
+
+// 各个存储器共用的GC调度，实现了types.GCer接口。
+//
+// 存储器只需要提供执行一次GC的函数，以及默认的执行间隔。
+type gcRunner struct {
+	pass     func(ctx context.Context) (int, error)
+	interval time.Duration
+	log      *log.Logger
+
+	// 启动之后立即在后台执行一次GC，而不是等待第一个间隔。
+	runAtStart bool
+
+	runMu sync.Mutex // 同一时间只执行一次GC
+
+	mu     sync.Mutex
+	stats  types.GCStats
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// interval小于等于0时使用gcDefaultInterval，否则后台的GC会不停地执行。
+func newGCRunner(interval time.Duration, l *log.Logger, pass func(ctx context.Context) (int, error)) *gcRunner {
+	if interval <= 0 {
+		interval = gcDefaultInterval
+	}
+
+	return &gcRunner{
+		pass:     pass,
+		interval: interval,
+		log:      l,
+	}
+}
+
+// types.GCer.GC()
+func (r *gcRunner) GC(ctx context.Context) (int, error) {
+	r.runMu.Lock()
+	defer r.runMu.Unlock()
+
+	start := time.Now()
+	removed, err := r.pass(ctx)
+
+	r.mu.Lock()
+	r.stats.Runs++
+	r.stats.Removed += uint64(removed)
+	r.stats.LastRun = start
+	r.stats.LastDuration = time.Since(start)
+	r.stats.LastError = err
+	if err != nil {
+		r.stats.Errors++
+	}
+	r.mu.Unlock()
+
+	return removed, err
+}
+
+// types.GCer.GCStats()
+func (r *gcRunner) GCStats() types.GCStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// session.Store.StartGC()
+func (r *gcRunner) StartGC() {
+	r.StartGCContext(context.Background(), nil)
+}
+
+// types.GCer.StartGCContext()
+func (r *gcRunner) StartGCContext(ctx context.Context, opt *types.GCOptions) {
+	r.stopGC()
+
+	if opt == nil {
+		opt = &types.GCOptions{}
+	}
+
+	interval := opt.Interval
+	if interval <= 0 {
+		interval = r.interval
+	}
+
+	onError := opt.OnError
+	if onError == nil {
+		onError = func(err error) { r.log.Println(err.Error()) }
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	r.mu.Lock()
+	r.cancel = cancel
+	r.done = done
+	r.mu.Unlock()
+
+	go func() {
+		defer close(done)
+
+		first := jitter(interval, opt.Jitter)
+		if r.runAtStart {
+			first = 0
+		}
+		timer := time.NewTimer(first)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+
+			if _, err := r.GC(ctx); err != nil && ctx.Err() == nil {
+				onError(err)
+			}
+			timer.Reset(jitter(interval, opt.Jitter))
+		}
+	}()
+}
+
+// 停止后台的GC，并等待正在执行的GC完成。
+func (r *gcRunner) stopGC() {
+	r.mu.Lock()
+	cancel, done := r.cancel, r.done
+	r.cancel, r.done = nil, nil
+	r.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// 在interval的基础上随机增加[0, j)的时间
+func jitter(interval, j time.Duration) time.Duration {
+	if j <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Int63n(int64(j)))
+}
@@ -0,0 +1,123 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert"
+	"github.com/issue9/session/types"
+)
+
+var (
+	_ types.GCer = &memory{}
+	_ types.GCer = &file{}
+	_ types.GCer = &bpTree{}
+	_ types.GCer = &appendLog{}
+	_ types.GCer = &sqlStore{}
+	_ types.GCer = &raw{}
+)
+
+func TestGCRunner(t *testing.T) {
+	a := assert.New(t)
+
+	var passes int32
+	errGC := errors.New("gc")
+	r := newGCRunner(time.Hour, log.New(os.Stderr, "", 0), func(ctx context.Context) (int, error) {
+		if atomic.AddInt32(&passes, 1)%2 == 0 {
+			return 0, errGC
+		}
+		return 2, nil
+	})
+
+	// 手动执行
+	removed, err := r.GC(context.Background())
+	a.NotError(err).Equal(removed, 2)
+	_, err = r.GC(context.Background())
+	a.Equal(err, errGC)
+	stats := r.GCStats()
+	a.Equal(stats.Runs, 2).Equal(stats.Removed, 2).Equal(stats.Errors, 1)
+	a.Equal(stats.LastError, errGC).False(stats.LastRun.IsZero())
+
+	// 由OnError处理后台GC的错误
+	var errs int32
+	ctx, cancel := context.WithCancel(context.Background())
+	r.StartGCContext(ctx, &types.GCOptions{
+		Interval: 20 * time.Millisecond,
+		OnError:  func(error) { atomic.AddInt32(&errs, 1) },
+	})
+	time.Sleep(110 * time.Millisecond)
+	a.True(atomic.LoadInt32(&errs) >= 2)
+
+	// 取消之后停止
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	runs := r.GCStats().Runs
+	time.Sleep(50 * time.Millisecond)
+	a.Equal(r.GCStats().Runs, runs)
+
+	// 重复启动只会保留最后一个
+	r.StartGCContext(context.Background(), &types.GCOptions{Interval: 20 * time.Millisecond, OnError: func(error) {}})
+	r.StartGCContext(context.Background(), &types.GCOptions{Interval: time.Hour})
+	runs = r.GCStats().Runs
+	time.Sleep(50 * time.Millisecond)
+	a.Equal(r.GCStats().Runs, runs)
+	r.stopGC()
+	r.stopGC()
+}
+
+func TestGCRunner_Interval(t *testing.T) {
+	a := assert.New(t)
+
+	var passes int32
+	pass := func(ctx context.Context) (int, error) {
+		atomic.AddInt32(&passes, 1)
+		return 0, nil
+	}
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		r := newGCRunner(interval, log.New(os.Stderr, "", 0), pass)
+		a.Equal(r.interval, gcDefaultInterval)
+
+		// 不会不停地执行GC
+		r.StartGC()
+		time.Sleep(50 * time.Millisecond)
+		r.stopGC()
+		a.Equal(atomic.LoadInt32(&passes), 0)
+	}
+
+	// 各个存储器的间隔为0时，使用默认值
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+	f, err := NewFile(dir, 0, nil)
+	a.NotError(err)
+	a.Equal(f.interval, gcDefaultInterval)
+	a.NotError(f.Close())
+
+	path, cleanup2 := newAppendLogPath(a)
+	defer cleanup2()
+	l, err := NewAppendLog(&AppendLogOptions{Path: path})
+	a.NotError(err)
+	a.Equal(l.interval, gcDefaultInterval)
+	a.NotError(l.Close())
+
+	a.Equal(NewMemory(0).interval, memGCInterval)
+}
+
+func TestJitter(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal(jitter(time.Second, 0), time.Second)
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second, 100*time.Millisecond)
+		a.True(d >= time.Second && d < 1100*time.Millisecond)
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package bptree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/issue9/assert"
+)
+
+// 返回一个新数据文件的路径，以及用于清除的函数。
+func newPath(a *assert.Assertion) (string, func()) {
+	dir, err := ioutil.TempDir("", "bptree")
+	a.NotError(err)
+
+	return filepath.Join(dir, "data.db"), func() {
+		a.NotError(os.RemoveAll(dir))
+	}
+}
+
+func newDB(a *assert.Assertion, path string) *DB {
+	db, err := Open(path)
+	a.NotError(err).NotNil(db)
+	return db
+}
+
+// 验证bucket中的内容与model完全相同
+func checkModel(a *assert.Assertion, db *DB, bucket int, model map[string]string) {
+	keys := make([]string, 0, len(model))
+	for k := range model {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	a.NotError(db.View(func(tx *Tx) error {
+		for _, k := range keys {
+			v, err := tx.Get(bucket, []byte(k))
+			a.NotError(err).Equal(string(v), model[k], k)
+		}
+
+		scanned := make([]string, 0, len(keys))
+		err := tx.Scan(bucket, nil, func(key, val []byte) bool {
+			scanned = append(scanned, string(key))
+			a.Equal(string(val), model[string(key)])
+			return true
+		})
+		a.NotError(err).Equal(scanned, keys)
+		return nil
+	}))
+}
+
+func TestDB(t *testing.T) {
+	a := assert.New(t)
+	path, cleanup := newPath(a)
+	defer cleanup()
+	db := newDB(a, path)
+	defer func() { db.Close() }()
+
+	a.NotError(db.Update(func(tx *Tx) error {
+		a.NotError(tx.Put(0, []byte("k1"), []byte("v1")))
+		a.NotError(tx.Put(1, []byte("k1"), []byte("bucket1")))
+		a.Equal(tx.Put(0, nil, []byte("v")), ErrKeyRequired)
+		a.Equal(tx.Put(MaxBuckets, []byte("k"), nil), ErrBucket)
+
+		// 未提交的数据在当前事务中可见
+		v, err := tx.Get(0, []byte("k1"))
+		a.NotError(err).Equal(v, []byte("v1"))
+		return nil
+	}))
+
+	a.NotError(db.View(func(tx *Tx) error {
+		v, err := tx.Get(0, []byte("k1"))
+		a.NotError(err).Equal(v, []byte("v1"))
+		v, err = tx.Get(1, []byte("k1"))
+		a.NotError(err).Equal(v, []byte("bucket1"))
+		v, err = tx.Get(2, []byte("k1"))
+		a.NotError(err).Nil(v)
+
+		a.Equal(tx.Put(0, []byte("k2"), nil), ErrTxReadOnly)
+		a.Equal(tx.Delete(0, []byte("k1")), ErrTxReadOnly)
+		return nil
+	}))
+
+	// 回滚
+	errRollback := errors.New("rollback")
+	a.Equal(db.Update(func(tx *Tx) error {
+		a.NotError(tx.Put(0, []byte("k2"), []byte("v2")))
+		a.NotError(tx.Delete(0, []byte("k1")))
+		return errRollback
+	}), errRollback)
+	checkModel(a, db, 0, map[string]string{"k1": "v1"})
+
+	// 事务结束之后不能再使用
+	var saved *Tx
+	a.NotError(db.View(func(tx *Tx) error {
+		saved = tx
+		return nil
+	}))
+	_, err := saved.Get(0, []byte("k1"))
+	a.Equal(err, ErrTxClosed)
+
+	// 重新打开
+	a.NotError(db.Close())
+	a.Equal(db.View(func(*Tx) error { return nil }), ErrClosed)
+	db = newDB(a, path)
+	checkModel(a, db, 0, map[string]string{"k1": "v1"})
+	checkModel(a, db, 1, map[string]string{"k1": "bucket1"})
+}
+
+func TestDB_Random(t *testing.T) {
+	a := assert.New(t)
+	path, cleanup := newPath(a)
+	defer cleanup()
+	db := newDB(a, path)
+	defer func() { db.Close() }()
+
+	rnd := rand.New(rand.NewSource(1))
+	model := map[string]string{}
+
+	for round := 0; round < 30; round++ {
+		a.NotError(db.Update(func(tx *Tx) error {
+			for i := 0; i < 300; i++ {
+				key := "key-" + strconv.Itoa(rnd.Intn(3000))
+				if rnd.Intn(3) == 0 {
+					delete(model, key)
+					a.NotError(tx.Delete(0, []byte(key)))
+					continue
+				}
+
+				val := key + "-" + strconv.Itoa(round) + "-" + string(bytes.Repeat([]byte("x"), rnd.Intn(200)))
+				model[key] = val
+				a.NotError(tx.Put(0, []byte(key), []byte(val)))
+			}
+			return nil
+		}))
+	}
+	checkModel(a, db, 0, model)
+
+	// 删除所有数据
+	a.NotError(db.Update(func(tx *Tx) error {
+		for k := range model {
+			a.NotError(tx.Delete(0, []byte(k)))
+		}
+		return nil
+	}))
+	checkModel(a, db, 0, map[string]string{})
+
+	// 所有的页面都已经释放
+	a.NotError(db.Close())
+	db = newDB(a, path)
+	stats := db.Stats()
+	a.Equal(stats.FreePages, stats.PageCount-2)
+}
+
+func TestDB_Scan(t *testing.T) {
+	a := assert.New(t)
+	path, cleanup := newPath(a)
+	defer cleanup()
+	db := newDB(a, path)
+	defer db.Close()
+
+	a.NotError(db.Update(func(tx *Tx) error {
+		for i := 0; i < 1000; i++ {
+			key := []byte(strconv.Itoa(10000 + i))
+			a.NotError(tx.Put(0, key, key))
+		}
+		return nil
+	}))
+
+	a.NotError(db.View(func(tx *Tx) error {
+		keys := []string{}
+		err := tx.Scan(0, []byte("10500"), func(key, val []byte) bool {
+			keys = append(keys, string(key))
+			return len(keys) < 3
+		})
+		a.NotError(err).Equal(keys, []string{"10500", "10501", "10502"})
+
+		// 不存在的起始位置
+		keys = keys[:0]
+		err = tx.Scan(0, []byte("10500a"), func(key, val []byte) bool {
+			keys = append(keys, string(key))
+			return false
+		})
+		a.NotError(err).Equal(keys, []string{"10501"})
+
+		keys = keys[:0]
+		err = tx.Scan(0, []byte("2"), func(key, val []byte) bool {
+			keys = append(keys, string(key))
+			return true
+		})
+		a.NotError(err).Equal(len(keys), 0)
+		return nil
+	}))
+}
+
+func TestDB_Overflow(t *testing.T) {
+	a := assert.New(t)
+	path, cleanup := newPath(a)
+	defer cleanup()
+	db := newDB(a, path)
+	defer func() { db.Close() }()
+
+	large := bytes.Repeat([]byte("0123456789"), 3*pageSize)
+	a.NotError(db.Update(func(tx *Tx) error {
+		a.NotError(tx.Put(0, []byte("small"), []byte("1")))
+		return tx.Put(0, []byte("large"), large)
+	}))
+
+	a.NotError(db.Close())
+	db = newDB(a, path)
+	checkModel(a, db, 0, map[string]string{"small": "1", "large": string(large)})
+}
+
+// 反复更新相同的数据，文件大小应该保持稳定。
+func TestDB_Reuse(t *testing.T) {
+	a := assert.New(t)
+	path, cleanup := newPath(a)
+	defer cleanup()
+	db := newDB(a, path)
+	defer db.Close()
+
+	update := func(i int) {
+		a.NotError(db.Update(func(tx *Tx) error {
+			for j := 0; j < 500; j++ {
+				key := []byte("key" + strconv.Itoa(j))
+				a.NotError(tx.Put(0, key, []byte(strconv.Itoa(i))))
+			}
+			return nil
+		}))
+	}
+
+	for i := 0; i < 5; i++ {
+		update(i)
+	}
+	pages := db.Stats().PageCount
+
+	for i := 5; i < 50; i++ {
+		update(i)
+	}
+	a.True(db.Stats().PageCount <= pages*2, db.Stats().PageCount, pages)
+}
+
+// 删除大部分数据之后，过小的节点应该被合并。
+func TestDB_Merge(t *testing.T) {
+	a := assert.New(t)
+	path, cleanup := newPath(a)
+	defer cleanup()
+	db := newDB(a, path)
+	defer func() { db.Close() }()
+
+	model := make(map[string]string, 20)
+	a.NotError(db.Update(func(tx *Tx) error {
+		for i := 0; i < 10000; i++ {
+			key := fmt.Sprintf("key%05d", i)
+			a.NotError(tx.Put(0, []byte(key), []byte(key)))
+			if i%500 == 0 {
+				model[key] = key
+			}
+		}
+		return nil
+	}))
+	a.True(db.Stats().PageCount-db.Stats().FreePages > 50, db.Stats())
+
+	a.NotError(db.Update(func(tx *Tx) error {
+		for i := 0; i < 10000; i++ {
+			if i%500 != 0 {
+				a.NotError(tx.Delete(0, []byte(fmt.Sprintf("key%05d", i))))
+			}
+		}
+		return nil
+	}))
+	checkModel(a, db, 0, model)
+
+	// 两个元数据页和一个根节点
+	used := db.Stats().PageCount - db.Stats().FreePages
+	a.True(used <= 3, used)
+
+	a.NotError(db.Close())
+	db = newDB(a, path)
+	checkModel(a, db, 0, model)
+}
+
+// 最后一次提交的元数据页损坏时，恢复到之前的状态。
+func TestDB_Recovery(t *testing.T) {
+	a := assert.New(t)
+	path, cleanup := newPath(a)
+	defer cleanup()
+	db := newDB(a, path)
+	defer func() { db.Close() }()
+
+	a.NotError(db.Update(func(tx *Tx) error {
+		return tx.Put(0, []byte("k1"), []byte("v1"))
+	}))
+	a.NotError(db.Update(func(tx *Tx) error {
+		a.NotError(tx.Delete(0, []byte("k1")))
+		return tx.Put(0, []byte("k2"), []byte("v2"))
+	}))
+	txid := db.Stats().TxID
+	a.NotError(db.Close())
+
+	// 模拟写入元数据页时崩溃
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	a.NotError(err)
+	_, err = f.WriteAt([]byte("broken"), int64(txid%2)*pageSize+16)
+	a.NotError(err)
+	// 未提交的页面
+	info, err := f.Stat()
+	a.NotError(err)
+	_, err = f.WriteAt(bytes.Repeat([]byte{0xff}, pageSize), info.Size())
+	a.NotError(err)
+	a.NotError(f.Close())
+
+	db = newDB(a, path)
+	a.Equal(db.Stats().TxID, txid-1)
+	checkModel(a, db, 0, map[string]string{"k1": "v1"})
+
+	// 恢复之后可以继续写入
+	a.NotError(db.Update(func(tx *Tx) error {
+		return tx.Put(0, []byte("k3"), []byte("v3"))
+	}))
+	checkModel(a, db, 0, map[string]string{"k1": "v1", "k3": "v3"})
+
+	// 两个元数据页都损坏
+	a.NotError(db.Close())
+	f, err = os.OpenFile(path, os.O_RDWR, 0600)
+	a.NotError(err)
+	_, err = f.WriteAt(make([]byte, 2*pageSize), 0)
+	a.NotError(err)
+	a.NotError(f.Close())
+	db2, err := Open(path)
+	a.Equal(err, ErrInvalid).Nil(db2)
+}
@@ -0,0 +1,28 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package bptree
+
+import (
+	"testing"
+
+	"github.com/issue9/assert"
+)
+
+// 同一个数据文件不能被同时打开，与不同进程之间的情况相同。
+func TestOpen_Locked(t *testing.T) {
+	a := assert.New(t)
+	path, cleanup := newPath(a)
+	defer cleanup()
+	db := newDB(a, path)
+
+	db2, err := Open(path)
+	a.Equal(err, ErrLocked).Nil(db2)
+
+	a.NotError(db.Close())
+	db2 = newDB(a, path)
+	a.NotError(db2.Close())
+}
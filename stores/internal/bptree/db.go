@@ -0,0 +1,386 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package bptree 实现了一个以单个文件保存数据的B+树，供stores.NewBPTree()使用。
+//
+// 文件以页为单位，前两页为元数据页，交替写入；其余为B+树的节点页。
+// 所有的修改都以写时复制的方式写入新的页面，
+// 只有在所有节点都写入并同步到磁盘之后，才会写入新的元数据页。
+// 所以在任何时候崩溃，都可以通过校验值正确的、事务ID最大的元数据页恢复到最后一次提交的状态。
+//
+// 空闲页面列表并不保存在文件中，而是在打开文件时通过遍历所有可达的页面重新生成。
+//
+// 数据文件只能被一个DB打开，Open()会对同目录下的 path+".lock" 文件加锁，
+// 在支持flock(2)的系统上，同样可以阻止其它进程同时打开该数据文件。
+package bptree
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/issue9/session/stores/internal/flock"
+)
+
+const (
+	pageSize = 4096
+
+	// 最多支持的B+树数量，每棵树相当于一个独立的键值空间。
+	MaxBuckets = 4
+
+	magic   = 0x53455353 // SESS
+	version = 1
+
+	// 元数据的长度，不包含最后的校验值
+	metaSize = 32 + MaxBuckets*8
+)
+
+// 操作数据库时可能返回的错误
+var (
+	ErrInvalid     = errors.New("bptree: 无效的数据文件")
+	ErrVersion     = errors.New("bptree: 不支持的数据文件版本")
+	ErrClosed      = errors.New("bptree: 数据库已经关闭")
+	ErrTxReadOnly  = errors.New("bptree: 只读事务不能修改数据")
+	ErrTxClosed    = errors.New("bptree: 事务已经结束")
+	ErrKeyRequired = errors.New("bptree: 键名不能为空")
+	ErrKeyTooLarge = errors.New("bptree: 键名过长")
+	ErrValTooLarge = errors.New("bptree: 值过长")
+	ErrBucket      = errors.New("bptree: 无效的 bucket")
+	ErrLocked      = errors.New("bptree: 数据文件已经被其它实例打开")
+)
+
+// 元数据
+type meta struct {
+	txid      uint64
+	pageCount uint64 // 文件中已经使用的页面数量，包含元数据页
+	roots     [MaxBuckets]uint64
+}
+
+// DB 表示一个数据文件。
+//
+// 同一时间只允许一个写事务，写事务与读事务之间也相互排斥。
+type DB struct {
+	mu     sync.RWMutex
+	f      *os.File
+	lock   *flock.Locker
+	meta   meta
+	free   []uint64 // 空闲的页面，按从小到大排列
+	closed bool
+}
+
+// Stats 为数据库的统计信息。
+type Stats struct {
+	TxID      uint64 // 最后一次提交的事务ID
+	PageCount int    // 文件中的页面数量
+	FreePages int    // 空闲页面的数量
+}
+
+// Open 打开或是创建一个数据文件。
+//
+// 若数据文件已经被其它DB打开，则返回ErrLocked。
+func Open(path string) (*DB, error) {
+	lock, err := flock.New(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := lock.TryLock()
+	if err != nil || !ok {
+		lock.Close()
+		if err == nil {
+			err = ErrLocked
+		}
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	db := &DB{f: f, lock: lock}
+	if err = db.init(); err != nil {
+		f.Close()
+		lock.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func (db *DB) init() error {
+	info, err := db.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() == 0 { // 新文件，写入两个相同的元数据页
+		db.meta = meta{pageCount: 2}
+		buf := db.meta.encode()
+		if _, err = db.f.WriteAt(buf, 0); err != nil {
+			return err
+		}
+		if _, err = db.f.WriteAt(buf, pageSize); err != nil {
+			return err
+		}
+		return db.f.Sync()
+	}
+
+	buf := make([]byte, 2*pageSize)
+	if _, err = db.f.ReadAt(buf, 0); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrInvalid
+		}
+		return err
+	}
+
+	m0, err0 := decodeMeta(buf[:pageSize])
+	m1, err1 := decodeMeta(buf[pageSize:])
+	switch {
+	case err0 != nil && err1 != nil:
+		return err0
+	case err0 != nil:
+		db.meta = *m1
+	case err1 != nil:
+		db.meta = *m0
+	case m1.txid > m0.txid:
+		db.meta = *m1
+	default:
+		db.meta = *m0
+	}
+
+	// 已经提交的页面都应该已经写入文件
+	if uint64(info.Size()) < db.meta.pageCount*pageSize {
+		return ErrInvalid
+	}
+
+	return db.rebuildFreelist()
+}
+
+// 遍历所有可达的页面，其余的页面即为空闲页面。
+func (db *DB) rebuildFreelist() error {
+	used := make([]bool, db.meta.pageCount)
+	used[0], used[1] = true, true
+
+	var walk func(pgid uint64) error
+	walk = func(pgid uint64) error {
+		if pgid < 2 || pgid >= db.meta.pageCount {
+			return ErrInvalid
+		}
+
+		n, err := db.read(pgid)
+		if err != nil {
+			return err
+		}
+		if pgid+uint64(n.overflow) >= db.meta.pageCount {
+			return ErrInvalid
+		}
+		for i := pgid; i <= pgid+uint64(n.overflow); i++ {
+			if used[i] { // 同一个页面被引用了两次
+				return ErrInvalid
+			}
+			used[i] = true
+		}
+
+		for _, c := range n.children {
+			if err := walk(c.pgid); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, root := range db.meta.roots {
+		if root == 0 {
+			continue
+		}
+		if err := walk(root); err != nil {
+			return err
+		}
+	}
+
+	db.free = db.free[:0]
+	for pgid, u := range used {
+		if !u {
+			db.free = append(db.free, uint64(pgid))
+		}
+	}
+	return nil
+}
+
+// 读取pgid开始的节点。
+func (db *DB) read(pgid uint64) (*node, error) {
+	buf := make([]byte, pageSize)
+	if _, err := db.f.ReadAt(buf, int64(pgid)*pageSize); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrInvalid
+		}
+		return nil, err
+	}
+
+	if overflow := binary.BigEndian.Uint32(buf[4:]); overflow > 0 {
+		if uint64(overflow) > maxOverflow {
+			return nil, ErrInvalid
+		}
+		buf = append(buf, make([]byte, int(overflow)*pageSize)...)
+		if _, err := db.f.ReadAt(buf[pageSize:], int64(pgid+1)*pageSize); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, ErrInvalid
+			}
+			return nil, err
+		}
+	}
+
+	return decodeNode(buf)
+}
+
+// View 在一个只读事务中执行fn。
+func (db *DB) View(fn func(*Tx) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	tx := db.begin(false)
+	defer tx.close()
+	return fn(tx)
+}
+
+// Update 在一个读写事务中执行fn。
+//
+// fn返回nil时提交事务，否则回滚事务，所有的修改都不会生效。
+func (db *DB) Update(fn func(*Tx) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	tx := db.begin(true)
+	defer tx.close()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// Stats 返回统计信息。
+func (db *DB) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return Stats{
+		TxID:      db.meta.txid,
+		PageCount: int(db.meta.pageCount),
+		FreePages: len(db.free),
+	}
+}
+
+// Close 关闭数据文件。
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	err := db.f.Close()
+	if err2 := db.lock.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (db *DB) begin(writable bool) *Tx {
+	tx := &Tx{
+		db:       db,
+		writable: writable,
+		meta:     db.meta,
+	}
+
+	for i, root := range db.meta.roots {
+		tx.roots[i] = &ref{pgid: root}
+	}
+
+	if writable {
+		tx.free = append([]uint64(nil), db.free...)
+	}
+
+	return tx
+}
+
+// 写入元数据页，并更新数据库的状态。
+func (db *DB) commit(tx *Tx) error {
+	if err := db.f.Sync(); err != nil {
+		return err
+	}
+
+	m := tx.meta
+	m.txid++
+	if _, err := db.f.WriteAt(m.encode(), int64(m.txid%2)*pageSize); err != nil {
+		return err
+	}
+	if err := db.f.Sync(); err != nil {
+		return err
+	}
+
+	db.meta = m
+	db.free = append(tx.free, tx.pending...)
+	sort.Slice(db.free, func(i, j int) bool { return db.free[i] < db.free[j] })
+	return nil
+}
+
+func (m *meta) encode() []byte {
+	buf := make([]byte, pageSize)
+	binary.BigEndian.PutUint32(buf[0:], magic)
+	binary.BigEndian.PutUint32(buf[4:], version)
+	binary.BigEndian.PutUint32(buf[8:], pageSize)
+	binary.BigEndian.PutUint64(buf[16:], m.txid)
+	binary.BigEndian.PutUint64(buf[24:], m.pageCount)
+	for i, root := range m.roots {
+		binary.BigEndian.PutUint64(buf[32+i*8:], root)
+	}
+
+	binary.BigEndian.PutUint64(buf[metaSize:], checksum(buf[:metaSize]))
+	return buf
+}
+
+func decodeMeta(buf []byte) (*meta, error) {
+	if binary.BigEndian.Uint32(buf[0:]) != magic {
+		return nil, ErrInvalid
+	}
+	if binary.BigEndian.Uint64(buf[metaSize:]) != checksum(buf[:metaSize]) {
+		return nil, ErrInvalid
+	}
+	if binary.BigEndian.Uint32(buf[4:]) != version || binary.BigEndian.Uint32(buf[8:]) != pageSize {
+		return nil, ErrVersion
+	}
+
+	m := &meta{
+		txid:      binary.BigEndian.Uint64(buf[16:]),
+		pageCount: binary.BigEndian.Uint64(buf[24:]),
+	}
+	if m.pageCount < 2 {
+		return nil, ErrInvalid
+	}
+	for i := range m.roots {
+		m.roots[i] = binary.BigEndian.Uint64(buf[32+i*8:])
+	}
+	return m, nil
+}
+
+func checksum(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
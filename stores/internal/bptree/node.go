@@ -0,0 +1,205 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package bptree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// 节点页以 flags(2) count(2) overflow(4) reserved(8) 开头，
+// 之后为count个元素，叶子节点的元素为 klen(2) vlen(4) key val，
+// 分支节点的元素为 klen(2) pgid(8) key。
+//
+// 一个节点可以占用多个连续的页面，overflow为第一页之后的页面数量。
+const (
+	headerSize = 16
+
+	branchFlag = 0x01
+	leafFlag   = 0x02
+
+	maxKeySize = math.MaxUint16
+	maxValSize = 1 << 30
+
+	// 节点编码之后小于该值时，会在提交时与相邻的节点合并。
+	minFill = pageSize / 4
+
+	// 一个节点最多可以占用的额外页面数量
+	maxOverflow = (headerSize+2+4+maxKeySize+maxValSize)/pageSize + 1
+)
+
+// 对子节点的引用
+type ref struct {
+	pgid uint64 // 为0表示该节点还未写入文件
+	n    *node  // 已经加载到内存中的节点
+}
+
+// B+树的节点。
+//
+// 分支节点中keys[i]为children[i]中的最小键名，
+// 查找时，选择最后一个keys[i]小于等于目标键名的子节点。
+type node struct {
+	leaf     bool
+	keys     [][]byte
+	vals     [][]byte // 叶子节点的值
+	children []*ref   // 分支节点的子节点
+	overflow uint32   // 从文件中加载时占用的额外页面数量
+	dirty    bool     // 是否在当前事务中被修改过
+}
+
+// 分裂或是合并之后，用于替换原节点的项。
+type entry struct {
+	key []byte
+	r   *ref
+}
+
+func decodeNode(buf []byte) (*node, error) {
+	flags := binary.BigEndian.Uint16(buf[0:])
+	count := int(binary.BigEndian.Uint16(buf[2:]))
+	n := &node{
+		overflow: binary.BigEndian.Uint32(buf[4:]),
+		keys:     make([][]byte, 0, count),
+	}
+
+	switch flags {
+	case leafFlag:
+		n.leaf = true
+		n.vals = make([][]byte, 0, count)
+	case branchFlag:
+		n.children = make([]*ref, 0, count)
+	default:
+		return nil, ErrInvalid
+	}
+
+	p := buf[headerSize:]
+	for i := 0; i < count; i++ {
+		if len(p) < 2 {
+			return nil, ErrInvalid
+		}
+		klen := int(binary.BigEndian.Uint16(p))
+		p = p[2:]
+
+		if n.leaf {
+			if len(p) < 4 {
+				return nil, ErrInvalid
+			}
+			vlen := uint64(binary.BigEndian.Uint32(p))
+			p = p[4:]
+			if uint64(len(p)) < uint64(klen)+vlen {
+				return nil, ErrInvalid
+			}
+			n.keys = append(n.keys, p[:klen:klen])
+			n.vals = append(n.vals, p[klen:klen+int(vlen):klen+int(vlen)])
+			p = p[klen+int(vlen):]
+			continue
+		}
+
+		if len(p) < 8+klen {
+			return nil, ErrInvalid
+		}
+		n.children = append(n.children, &ref{pgid: binary.BigEndian.Uint64(p)})
+		n.keys = append(n.keys, p[8:8+klen:8+klen])
+		p = p[8+klen:]
+	}
+
+	return n, nil
+}
+
+// 将节点编码成size长度的内容。
+func (n *node) encode(size int) []byte {
+	buf := make([]byte, size)
+
+	flags := uint16(branchFlag)
+	if n.leaf {
+		flags = leafFlag
+	}
+	binary.BigEndian.PutUint16(buf[0:], flags)
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(n.keys)))
+	binary.BigEndian.PutUint32(buf[4:], uint32(size/pageSize-1))
+
+	p := buf[headerSize:]
+	for i, key := range n.keys {
+		binary.BigEndian.PutUint16(p, uint16(len(key)))
+		p = p[2:]
+
+		if n.leaf {
+			binary.BigEndian.PutUint32(p, uint32(len(n.vals[i])))
+			p = p[4:]
+			p = p[copy(p, key):]
+			p = p[copy(p, n.vals[i]):]
+			continue
+		}
+
+		binary.BigEndian.PutUint64(p, n.children[i].pgid)
+		p = p[8:]
+		p = p[copy(p, key):]
+	}
+
+	return buf
+}
+
+// 第i个元素编码之后的长度
+func (n *node) elemSize(i int) int {
+	if n.leaf {
+		return 2 + 4 + len(n.keys[i]) + len(n.vals[i])
+	}
+	return 2 + 8 + len(n.keys[i])
+}
+
+// 编码之后的长度
+func (n *node) size() int {
+	size := headerSize
+	for i := range n.keys {
+		size += n.elemSize(i)
+	}
+	return size
+}
+
+// 查找第一个大于等于key的元素位置，以及该元素是否与key相等。
+func (n *node) search(key []byte) (int, bool) {
+	i := sort.Search(len(n.keys), func(i int) bool {
+		return bytes.Compare(n.keys[i], key) >= 0
+	})
+	return i, i < len(n.keys) && bytes.Equal(n.keys[i], key)
+}
+
+// 分支节点中，可能包含key的子节点位置。
+func (n *node) childIndex(key []byte) int {
+	i := sort.Search(len(n.keys), func(i int) bool {
+		return bytes.Compare(n.keys[i], key) > 0
+	})
+	if i > 0 {
+		i--
+	}
+	return i
+}
+
+// 按页面大小将节点拆分成多个节点，每个节点至少包含一个元素。
+func (n *node) split() []*node {
+	nodes := make([]*node, 0, 1)
+	curr := &node{leaf: n.leaf}
+	size := headerSize
+
+	for i := range n.keys {
+		es := n.elemSize(i)
+		if len(curr.keys) > 0 && (size+es > pageSize || len(curr.keys) == math.MaxUint16) {
+			nodes = append(nodes, curr)
+			curr = &node{leaf: n.leaf}
+			size = headerSize
+		}
+
+		curr.keys = append(curr.keys, n.keys[i])
+		if n.leaf {
+			curr.vals = append(curr.vals, n.vals[i])
+		} else {
+			curr.children = append(curr.children, n.children[i])
+		}
+		size += es
+	}
+
+	return append(nodes, curr)
+}
@@ -0,0 +1,417 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package bptree
+
+import "sort"
+
+// Tx 表示一个事务，只能在DB.View()或DB.Update()的回调函数中使用。
+//
+// 通过Get()和Scan()返回的内容在事务结束之后依然有效，但不能修改。
+type Tx struct {
+	db       *DB
+	writable bool
+	done     bool
+	meta     meta
+	roots    [MaxBuckets]*ref
+	free     []uint64 // 当前事务可以使用的空闲页面
+	pending  []uint64 // 当前事务中释放的页面，在提交之后才能再次使用
+}
+
+func (tx *Tx) close() {
+	tx.done = true
+	tx.roots = [MaxBuckets]*ref{}
+}
+
+func (tx *Tx) check(bucket int, write bool) error {
+	switch {
+	case tx.done:
+		return ErrTxClosed
+	case write && !tx.writable:
+		return ErrTxReadOnly
+	case bucket < 0 || bucket >= MaxBuckets:
+		return ErrBucket
+	}
+	return nil
+}
+
+// 获取r引用的节点，若还未加载，则从文件中读取。
+func (tx *Tx) node(r *ref) (*node, error) {
+	if r.n == nil {
+		n, err := tx.db.read(r.pgid)
+		if err != nil {
+			return nil, err
+		}
+		r.n = n
+	}
+	return r.n, nil
+}
+
+// 标记r引用的节点已经被修改，其原有的页面将在提交之后被释放。
+func (tx *Tx) dirty(r *ref) {
+	n := r.n
+	if n.dirty {
+		return
+	}
+
+	if r.pgid != 0 {
+		for i := uint64(0); i <= uint64(n.overflow); i++ {
+			tx.pending = append(tx.pending, r.pgid+i)
+		}
+		r.pgid = 0
+	}
+	n.dirty = true
+}
+
+// Get 获取bucket中key对应的值，不存在时返回nil。
+func (tx *Tx) Get(bucket int, key []byte) ([]byte, error) {
+	if err := tx.check(bucket, false); err != nil {
+		return nil, err
+	}
+
+	r := tx.roots[bucket]
+	if r.pgid == 0 && r.n == nil {
+		return nil, nil
+	}
+
+	for {
+		n, err := tx.node(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if n.leaf {
+			if i, found := n.search(key); found {
+				return n.vals[i], nil
+			}
+			return nil, nil
+		}
+
+		r = n.children[n.childIndex(key)]
+	}
+}
+
+// Put 将key和val写入bucket，若key已经存在，则覆盖原来的值。
+func (tx *Tx) Put(bucket int, key, val []byte) error {
+	if err := tx.check(bucket, true); err != nil {
+		return err
+	}
+
+	switch {
+	case len(key) == 0:
+		return ErrKeyRequired
+	case len(key) > maxKeySize:
+		return ErrKeyTooLarge
+	case len(val) > maxValSize:
+		return ErrValTooLarge
+	}
+
+	// 调用方可能会修改key和val的内容
+	key = append([]byte(nil), key...)
+	val = append(make([]byte, 0, len(val)), val...)
+
+	r := tx.roots[bucket]
+	if r.pgid == 0 && r.n == nil {
+		r.n = &node{leaf: true}
+	}
+
+	for {
+		n, err := tx.node(r)
+		if err != nil {
+			return err
+		}
+		tx.dirty(r)
+
+		if n.leaf {
+			i, found := n.search(key)
+			if found {
+				n.vals[i] = val
+				return nil
+			}
+
+			n.keys = append(n.keys, nil)
+			copy(n.keys[i+1:], n.keys[i:])
+			n.keys[i] = key
+			n.vals = append(n.vals, nil)
+			copy(n.vals[i+1:], n.vals[i:])
+			n.vals[i] = val
+			return nil
+		}
+
+		// 分支节点中的键名会在提交时根据子节点重新生成
+		r = n.children[n.childIndex(key)]
+	}
+}
+
+// Delete 删除bucket中的key，若key不存在，则不作任何操作。
+func (tx *Tx) Delete(bucket int, key []byte) error {
+	if err := tx.check(bucket, true); err != nil {
+		return err
+	}
+
+	r := tx.roots[bucket]
+	if r.pgid == 0 && r.n == nil {
+		return nil
+	}
+
+	path := make([]*ref, 0, 5)
+	for {
+		n, err := tx.node(r)
+		if err != nil {
+			return err
+		}
+		path = append(path, r)
+
+		if n.leaf {
+			break
+		}
+		r = n.children[n.childIndex(key)]
+	}
+
+	leaf := r.n
+	i, found := leaf.search(key)
+	if !found {
+		return nil
+	}
+
+	for _, r := range path {
+		tx.dirty(r)
+	}
+	leaf.keys = append(leaf.keys[:i], leaf.keys[i+1:]...)
+	leaf.vals = append(leaf.vals[:i], leaf.vals[i+1:]...)
+	return nil
+}
+
+// Scan 按键名从小到大的顺序遍历bucket中所有大于等于start的元素，
+// fn返回false时中止遍历。
+//
+// 在fn中不能修改当前bucket的内容。
+func (tx *Tx) Scan(bucket int, start []byte, fn func(key, val []byte) bool) error {
+	if err := tx.check(bucket, false); err != nil {
+		return err
+	}
+
+	r := tx.roots[bucket]
+	if r.pgid == 0 && r.n == nil {
+		return nil
+	}
+
+	_, err := tx.scan(r, start, fn)
+	return err
+}
+
+func (tx *Tx) scan(r *ref, start []byte, fn func(key, val []byte) bool) (bool, error) {
+	n, err := tx.node(r)
+	if err != nil {
+		return false, err
+	}
+
+	if n.leaf {
+		i, _ := n.search(start)
+		for ; i < len(n.keys); i++ {
+			if !fn(n.keys[i], n.vals[i]) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	for i := n.childIndex(start); i < len(n.children); i++ {
+		next, err := tx.scan(n.children[i], start, fn)
+		if err != nil || !next {
+			return next, err
+		}
+	}
+	return true, nil
+}
+
+// 分配n个连续的页面，若空闲页面中没有满足条件的，则从文件末尾分配。
+func (tx *Tx) allocate(n int) uint64 {
+	for i := 0; i+n <= len(tx.free); i++ {
+		if tx.free[i+n-1] == tx.free[i]+uint64(n-1) {
+			pgid := tx.free[i]
+			tx.free = append(tx.free[:i:i], tx.free[i+n:]...)
+			return pgid
+		}
+	}
+
+	pgid := tx.meta.pageCount
+	tx.meta.pageCount += uint64(n)
+	return pgid
+}
+
+// 将n写入新分配的页面
+func (tx *Tx) write(n *node) (uint64, error) {
+	pages := (n.size() + pageSize - 1) / pageSize
+	pgid := tx.allocate(pages)
+
+	if _, err := tx.db.f.WriteAt(n.encode(pages*pageSize), int64(pgid)*pageSize); err != nil {
+		return 0, err
+	}
+
+	n.overflow = uint32(pages - 1)
+	n.dirty = false
+	return pgid, nil
+}
+
+// 将被修改过的节点写入文件，返回用于替换n的节点列表。
+//
+// 节点过大时会被拆分成多个节点；没有任何元素的节点会被删除，返回空列表。
+func (tx *Tx) spill(n *node) ([]entry, error) {
+	if !n.leaf {
+		entries := make([]entry, 0, len(n.children))
+		for i, c := range n.children {
+			if c.n == nil || !c.n.dirty {
+				entries = append(entries, entry{key: n.keys[i], r: c})
+				continue
+			}
+
+			es, err := tx.spill(c.n)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, es...)
+		}
+
+		n.keys = n.keys[:0]
+		n.children = n.children[:0]
+		for _, e := range entries {
+			n.keys = append(n.keys, e.key)
+			n.children = append(n.children, e.r)
+		}
+	}
+
+	if len(n.keys) == 0 {
+		return nil, nil
+	}
+
+	nodes := n.split()
+	entries := make([]entry, 0, len(nodes))
+	for _, nn := range nodes {
+		pgid, err := tx.write(nn)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry{key: nn.keys[0], r: &ref{pgid: pgid, n: nn}})
+	}
+	return entries, nil
+}
+
+// 从下往上将n中被修改过且小于minFill的子节点与相邻的节点合并。
+//
+// 合并之后过大的节点会在spill()中重新拆分，所以只需简单地拼接两个节点的内容。
+func (tx *Tx) merge(n *node) error {
+	if n.leaf {
+		return nil
+	}
+
+	for _, c := range n.children {
+		if c.n != nil && c.n.dirty {
+			if err := tx.merge(c.n); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := 0; i < len(n.children) && len(n.children) > 1; i++ {
+		c := n.children[i].n
+		if c == nil || !c.dirty || c.size() >= minFill {
+			continue
+		}
+
+		// 与右侧的节点合并，最后一个节点则与左侧的节点合并。
+		left := i
+		if i == len(n.children)-1 {
+			left = i - 1
+		}
+		l, r := n.children[left], n.children[left+1]
+		if _, err := tx.node(l); err != nil {
+			return err
+		}
+		if _, err := tx.node(r); err != nil {
+			return err
+		}
+		tx.dirty(l)
+		tx.dirty(r)
+
+		l.n.keys = append(l.n.keys, r.n.keys...)
+		l.n.vals = append(l.n.vals, r.n.vals...)
+		l.n.children = append(l.n.children, r.n.children...)
+		n.keys = append(n.keys[:left+1], n.keys[left+2:]...)
+		n.children = append(n.children[:left+1], n.children[left+2:]...)
+
+		i = left - 1 // 合并之后的节点可能依然过小
+	}
+	return nil
+}
+
+// 写入整棵树，返回新的根节点。
+func (tx *Tx) spillRoot(r *ref) (uint64, error) {
+	if err := tx.merge(r.n); err != nil {
+		return 0, err
+	}
+
+	entries, err := tx.spill(r.n)
+	if err != nil {
+		return 0, err
+	}
+
+	// 根节点被拆分，需要生成新的根节点
+	for len(entries) > 1 {
+		root := &node{dirty: true}
+		for _, e := range entries {
+			root.keys = append(root.keys, e.key)
+			root.children = append(root.children, e.r)
+		}
+
+		if entries, err = tx.spill(root); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	// 只有一个子节点的根节点是多余的，直接以子节点作为根节点。
+	root := entries[0].r
+	for !root.n.leaf && len(root.n.children) == 1 {
+		for i := uint64(0); i <= uint64(root.n.overflow); i++ {
+			tx.free = append(tx.free, root.pgid+i) // 未提交的页面，可以直接使用。
+		}
+
+		sort.Slice(tx.free, func(i, j int) bool { return tx.free[i] < tx.free[j] })
+
+		child := root.n.children[0]
+		if _, err := tx.node(child); err != nil {
+			return 0, err
+		}
+		root = child
+	}
+
+	return root.pgid, nil
+}
+
+// 提交事务
+func (tx *Tx) commit() error {
+	changed := false
+	for i, r := range tx.roots {
+		if r.n == nil || !r.n.dirty {
+			continue
+		}
+
+		root, err := tx.spillRoot(r)
+		if err != nil {
+			return err
+		}
+		tx.meta.roots[i] = root
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return tx.db.commit(tx)
+}
@@ -0,0 +1,135 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package expiry
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert"
+)
+
+func TestQueue(t *testing.T) {
+	a := assert.New(t)
+	q := NewQueue()
+	now := time.Now()
+
+	_, ok := q.Next()
+	a.False(ok)
+	a.Equal(len(q.Expired(now, 0)), 0)
+
+	q.Schedule("3", now.Add(3*time.Second))
+	q.Schedule("1", now.Add(1*time.Second))
+	q.Schedule("2", now.Add(2*time.Second))
+	q.Schedule("4", now.Add(4*time.Second))
+	a.Equal(q.Len(), 4)
+
+	next, ok := q.Next()
+	a.True(ok).Equal(next.UnixNano(), now.Add(time.Second).UnixNano())
+
+	// 更新已有的记录
+	q.Schedule("1", now.Add(5*time.Second))
+	a.Equal(q.Len(), 4)
+	q.Cancel("4")
+	q.Cancel("not-exists")
+	a.Equal(q.Len(), 3)
+
+	a.Equal(q.Expired(now.Add(time.Second), 0), []string(nil))
+	a.Equal(q.Expired(now.Add(10*time.Second), 1), []string{"2"})
+	a.Equal(q.Expired(now.Add(10*time.Second), 0), []string{"3", "1"})
+	a.Equal(q.Len(), 0)
+
+	q.Schedule("1", now)
+	q.Reset()
+	a.Equal(q.Len(), 0)
+	q.Cancel("1")
+}
+
+func TestQueue_Random(t *testing.T) {
+	a := assert.New(t)
+	q := NewQueue()
+	now := time.Now()
+	rnd := rand.New(rand.NewSource(1))
+
+	model := map[string]int{}
+	for i := 0; i < 5000; i++ {
+		id := strconv.Itoa(rnd.Intn(500))
+		if rnd.Intn(4) == 0 {
+			q.Cancel(id)
+			delete(model, id)
+			continue
+		}
+		at := rnd.Intn(100000)
+		q.Schedule(id, now.Add(time.Duration(at)))
+		model[id] = at
+	}
+	a.Equal(q.Len(), len(model))
+
+	ids := q.Expired(now.Add(time.Hour), 0)
+	a.Equal(len(ids), len(model))
+	a.True(sort.SliceIsSorted(ids, func(i, j int) bool {
+		return model[ids[i]] < model[ids[j]]
+	}))
+}
+
+func TestScheduler(t *testing.T) {
+	a := assert.New(t)
+
+	var mu sync.Mutex
+	expired := map[string]time.Time{}
+	s := NewScheduler(func(ids []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, id := range ids {
+			expired[id] = time.Now()
+		}
+	})
+
+	now := time.Now()
+	s.Schedule("late", now.Add(time.Hour))
+	s.Start()
+	s.Start()
+
+	// 比已有的记录更早过期，需要唤醒后台协程
+	s.Schedule("1", now.Add(50*time.Millisecond))
+	s.Schedule("2", now.Add(100*time.Millisecond))
+	s.Schedule("canceled", now.Add(50*time.Millisecond))
+	s.Cancel("canceled")
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	a.Equal(len(expired), 2)
+	a.True(expired["1"].Sub(now) >= 50*time.Millisecond)
+	a.True(expired["2"].Sub(now) >= 100*time.Millisecond)
+	a.True(expired["2"].Sub(now) < 180*time.Millisecond)
+	mu.Unlock()
+	a.Equal(s.Len(), 1)
+
+	// 停止之后不再处理，但可以手动处理
+	s.Stop()
+	s.Stop()
+	s.Schedule("3", time.Now())
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	_, found := expired["3"]
+	mu.Unlock()
+	a.False(found)
+	a.Equal(s.Expire(time.Now()), 1)
+	a.Equal(s.Expire(time.Now()), 0)
+
+	// 再次启动
+	s.Start()
+	defer s.Stop()
+	s.Schedule("4", time.Now().Add(10*time.Millisecond))
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	_, found = expired["4"]
+	mu.Unlock()
+	a.True(found)
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package expiry 实现了按过期时间调度session的最小堆，
+// 添加、更新和删除的复杂度均为O(log n)，
+// 存储器只需要处理已经到期的session，而不需要在每次GC时扫描所有的数据。
+package expiry
+
+import (
+	"container/heap"
+	"time"
+)
+
+type entry struct {
+	id    string
+	at    int64 // 过期时间，纳秒
+	index int
+}
+
+type entries []*entry
+
+func (h entries) Len() int { return len(h) }
+
+func (h entries) Less(i, j int) bool { return h[i].at < h[j].at }
+
+func (h entries) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *entries) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *entries) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// Queue 以过期时间排序的队列，每个id最多只有一条记录。
+//
+// Queue不是并发安全的，调用者需要自行加锁。
+type Queue struct {
+	h     entries
+	index map[string]*entry
+}
+
+// NewQueue 声明一个空的队列。
+func NewQueue() *Queue {
+	return &Queue{index: map[string]*entry{}}
+}
+
+// Len 返回队列中的记录数量。
+func (q *Queue) Len() int {
+	return len(q.h)
+}
+
+// Schedule 设置id的过期时间，已经存在的记录会被更新。
+func (q *Queue) Schedule(id string, at time.Time) {
+	if e, found := q.index[id]; found {
+		e.at = at.UnixNano()
+		heap.Fix(&q.h, e.index)
+		return
+	}
+
+	e := &entry{id: id, at: at.UnixNano()}
+	q.index[id] = e
+	heap.Push(&q.h, e)
+}
+
+// Cancel 删除id的记录，不存在时不作任何操作。
+func (q *Queue) Cancel(id string) {
+	if e, found := q.index[id]; found {
+		heap.Remove(&q.h, e.index)
+		delete(q.index, id)
+	}
+}
+
+// Next 返回最早的过期时间，队列为空时返回false。
+func (q *Queue) Next() (time.Time, bool) {
+	if len(q.h) == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, q.h[0].at), true
+}
+
+// Expired 从队列中删除并返回所有在now之前过期的id，按过期时间排序。
+//
+// max为最多返回的数量，小于等于0表示不限制。
+func (q *Queue) Expired(now time.Time, max int) []string {
+	n := now.UnixNano()
+
+	var ids []string
+	for len(q.h) > 0 && q.h[0].at <= n {
+		e := heap.Pop(&q.h).(*entry)
+		delete(q.index, e.id)
+		ids = append(ids, e.id)
+
+		if max > 0 && len(ids) >= max {
+			break
+		}
+	}
+	return ids
+}
+
+// Reset 清除所有的记录。
+func (q *Queue) Reset() {
+	q.h = nil
+	q.index = map[string]*entry{}
+}
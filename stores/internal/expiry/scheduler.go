@@ -0,0 +1,145 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package expiry
+
+import (
+	"sync"
+	"time"
+)
+
+// Scheduler 在记录到期时自动调用回调函数的并发安全的队列。
+type Scheduler struct {
+	mu      sync.Mutex
+	q       *Queue
+	fn      func(ids []string)
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	running bool
+}
+
+// NewScheduler 声明一个Scheduler。
+//
+// fn在记录到期时调用，ids为到期的记录，调用时不持有Scheduler的锁，
+// 可以在fn中调用Schedule()重新添加记录。
+// 但是不能在fn中调用Stop()，Stop()会等待调用fn的协程退出，从而造成死锁。
+func NewScheduler(fn func(ids []string)) *Scheduler {
+	return &Scheduler{
+		q:    NewQueue(),
+		fn:   fn,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Schedule 设置id的过期时间，已经存在的记录会被更新。
+func (s *Scheduler) Schedule(id string, at time.Time) {
+	s.mu.Lock()
+	next, ok := s.q.Next()
+	s.q.Schedule(id, at)
+	s.mu.Unlock()
+
+	if !ok || at.Before(next) { // 最早的过期时间发生了变化
+		s.notify()
+	}
+}
+
+// Cancel 删除id的记录。
+func (s *Scheduler) Cancel(id string) {
+	s.mu.Lock()
+	s.q.Cancel(id)
+	s.mu.Unlock()
+}
+
+// Len 返回记录的数量。
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.q.Len()
+}
+
+// Expire 立即处理所有已经到期的记录，返回处理的数量。
+func (s *Scheduler) Expire(now time.Time) int {
+	s.mu.Lock()
+	ids := s.q.Expired(now, 0)
+	s.mu.Unlock()
+
+	if len(ids) > 0 {
+		s.fn(ids)
+	}
+	return len(ids)
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start 开始在后台处理到期的记录，重复调用不会启动多个协程。
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return
+	}
+	s.running = true
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run(s.stop, s.done)
+}
+
+// Stop 停止后台处理，记录依然保留，可以再次调用Start()。
+//
+// Stop会等待正在执行的fn返回，所以不能在fn中调用。
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return
+	}
+	s.running = false
+	stop, done := s.stop, s.done
+	s.mu.Unlock()
+
+	close(stop)
+	<-done
+}
+
+func (s *Scheduler) run(stop, done chan struct{}) {
+	defer close(done)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		s.Expire(time.Now())
+
+		s.mu.Lock()
+		next, ok := s.q.Next()
+		s.mu.Unlock()
+
+		wait := time.Hour
+		if ok {
+			wait = time.Until(next)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-stop:
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package flock 实现了基于文件的读写锁，可以同时在进程内和进程之间互斥。
+//
+// 在linux、darwin和bsd等支持flock(2)的系统上实现进程之间的互斥，
+// windows、plan9、js/wasm和wasip1等其它系统上只提供进程内的互斥。
+// flock是建议性的锁，只对同样使用该锁的进程有效。
+package flock
+
+import (
+	"os"
+	"sync"
+)
+
+// Locker 基于文件的读写锁。
+//
+// flock(2)的锁与打开的文件相关，同一进程内的多个协程共享同一个文件，
+// 所以进程内的互斥由sync.RWMutex完成，只有第一个读者和最后一个读者才会加锁和解锁文件。
+type Locker struct {
+	f  *os.File
+	mu sync.RWMutex
+
+	readersMu sync.Mutex
+	readers   int
+}
+
+// New 以path作为锁文件声明一个Locker，文件不存在时会自动创建。
+func New(path string) (*Locker, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Locker{f: f}, nil
+}
+
+// Lock 获取写锁，会一直阻塞到获取成功为止。
+func (l *Locker) Lock() error {
+	l.mu.Lock()
+	if err := lockFile(l.f, true); err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// TryLock 尝试获取写锁，若已经被其它协程或是进程锁定，则立即返回false。
+func (l *Locker) TryLock() (bool, error) {
+	if !l.mu.TryLock() {
+		return false, nil
+	}
+
+	ok, err := tryLockFile(l.f)
+	if err != nil || !ok {
+		l.mu.Unlock()
+		return false, err
+	}
+	return true, nil
+}
+
+// Unlock 释放写锁。
+func (l *Locker) Unlock() error {
+	err := unlockFile(l.f)
+	l.mu.Unlock()
+	return err
+}
+
+// RLock 获取读锁，多个读者可以同时持有读锁。
+func (l *Locker) RLock() error {
+	l.mu.RLock()
+
+	l.readersMu.Lock()
+	defer l.readersMu.Unlock()
+
+	if l.readers == 0 {
+		if err := lockFile(l.f, false); err != nil {
+			l.mu.RUnlock()
+			return err
+		}
+	}
+	l.readers++
+	return nil
+}
+
+// RUnlock 释放读锁。
+func (l *Locker) RUnlock() error {
+	l.readersMu.Lock()
+	l.readers--
+	var err error
+	if l.readers == 0 {
+		err = unlockFile(l.f)
+	}
+	l.readersMu.Unlock()
+
+	l.mu.RUnlock()
+	return err
+}
+
+// Close 关闭锁文件，若还持有锁，则会被释放。
+func (l *Locker) Close() error {
+	return l.f.Close()
+}
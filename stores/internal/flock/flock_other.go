@@ -0,0 +1,17 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package flock
+
+import "os"
+
+// windows等没有flock(2)的系统，只提供进程内的互斥。
+
+func lockFile(f *os.File, exclusive bool) error { return nil }
+
+func tryLockFile(f *os.File) (bool, error) { return true, nil }
+
+func unlockFile(f *os.File) error { return nil }
@@ -0,0 +1,120 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert"
+)
+
+func newLocker(a *assert.Assertion) (*Locker, string, func()) {
+	dir, err := ioutil.TempDir("", "flock")
+	a.NotError(err)
+
+	path := filepath.Join(dir, "lock")
+	l, err := New(path)
+	a.NotError(err).NotNil(l)
+	return l, path, func() {
+		l.Close()
+		a.NotError(os.RemoveAll(dir))
+	}
+}
+
+func TestLocker(t *testing.T) {
+	a := assert.New(t)
+	l, _, cleanup := newLocker(a)
+	defer cleanup()
+
+	a.NotError(l.Lock())
+	ok, err := l.TryLock()
+	a.NotError(err).False(ok)
+	a.NotError(l.Unlock())
+
+	ok, err = l.TryLock()
+	a.NotError(err).True(ok)
+	a.NotError(l.Unlock())
+
+	// 多个读者
+	a.NotError(l.RLock())
+	a.NotError(l.RLock())
+	ok, err = l.TryLock()
+	a.NotError(err).False(ok)
+	a.NotError(l.RUnlock())
+	ok, err = l.TryLock()
+	a.NotError(err).False(ok)
+	a.NotError(l.RUnlock())
+
+	ok, err = l.TryLock()
+	a.NotError(err).True(ok)
+	a.NotError(l.Unlock())
+}
+
+// 写锁会阻塞其它协程的读写
+func TestLocker_Concurrent(t *testing.T) {
+	a := assert.New(t)
+	l, _, cleanup := newLocker(a)
+	defer cleanup()
+
+	counter := 0
+	errs := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		go func() {
+			for j := 0; j < 100; j++ {
+				if err := l.Lock(); err != nil {
+					errs <- err
+					return
+				}
+				counter++
+				if err := l.Unlock(); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+		go func() {
+			for j := 0; j < 100; j++ {
+				if err := l.RLock(); err != nil {
+					errs <- err
+					return
+				}
+				_ = counter
+				if err := l.RUnlock(); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		a.NotError(<-errs)
+	}
+	a.Equal(counter, 1000)
+
+	a.NotError(l.Lock())
+	done := make(chan error, 1)
+	go func() {
+		err := l.RLock()
+		if err == nil {
+			err = l.RUnlock()
+		}
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Error("读锁未被阻塞")
+		done <- err
+	default:
+	}
+	a.NotError(l.Unlock())
+	a.NotError(<-done)
+}
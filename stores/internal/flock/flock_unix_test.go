@@ -0,0 +1,46 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package flock
+
+import (
+	"testing"
+
+	"github.com/issue9/assert"
+)
+
+// 同一个文件的不同Locker之间也是互斥的，与不同进程之间的情况相同。
+func TestLocker_File(t *testing.T) {
+	a := assert.New(t)
+	l1, path, cleanup := newLocker(a)
+	defer cleanup()
+
+	l2, err := New(path)
+	a.NotError(err)
+	defer l2.Close()
+
+	a.NotError(l1.RLock())
+	a.NotError(l2.RLock()) // 共享锁
+	ok, err := l2.TryLock()
+	a.NotError(err).False(ok)
+	a.NotError(l2.RUnlock())
+	ok, err = l2.TryLock()
+	a.NotError(err).False(ok)
+	a.NotError(l1.RUnlock())
+
+	ok, err = l2.TryLock()
+	a.NotError(err).True(ok)
+	ok, err = l1.TryLock()
+	a.NotError(err).False(ok)
+	a.NotError(l2.Unlock())
+
+	// 关闭文件时会释放锁
+	a.NotError(l1.Lock())
+	a.NotError(l1.Close())
+	ok, err = l2.TryLock()
+	a.NotError(err).True(ok)
+	a.NotError(l2.Unlock())
+}
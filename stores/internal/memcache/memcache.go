@@ -0,0 +1,423 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package memcache 实现了一个简单的memcached客户端，
+// 仅支持文本协议中的 mg、set、touch 和 delete 命令，供stores.NewMemcache()使用。
+//
+// 读取时使用了meta命令，需要memcached 1.6及以上的版本。
+// 多台服务器之间通过一致性哈希分配键名。
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 键名的最大长度
+	maxKeyLen = 250
+
+	// 超过此值的过期时间，memcached会将其当作unix时间戳处理。
+	maxRelativeExpiration = 30 * 24 * time.Hour
+
+	// 每个item除了键名和数据之外的额外开销，
+	// 用于在客户端提前判断数据是否会超过服务器的限制。
+	itemOverhead = 64
+)
+
+// 客户端返回的错误信息
+var (
+	ErrClosed     = errors.New("memcache: 客户端已经关闭")
+	ErrInvalidKey = errors.New("memcache: 无效的键名")
+	ErrTooLarge   = errors.New("memcache: 数据超过了服务器允许的最大长度")
+	ErrProtocol   = errors.New("memcache: 无效的协议内容")
+)
+
+// ServerError 表示服务器返回的 ERROR、CLIENT_ERROR 或 SERVER_ERROR 信息。
+type ServerError string
+
+func (err ServerError) Error() string {
+	return "memcache: " + string(err)
+}
+
+// Item 表示memcached中的一条数据。
+type Item struct {
+	Value []byte
+	Flags uint32
+
+	// 剩余的生存时间，仅由Get()返回，小于0表示永不过期。
+	TTL time.Duration
+}
+
+// Client 为memcached客户端，可以同时被多个goroutine使用。
+type Client struct {
+	ring        ring
+	pools       map[string]*pool
+	maxItemSize int
+}
+
+// 单台服务器的连接池
+type pool struct {
+	addr        string
+	dialTimeout time.Duration
+
+	mu     sync.Mutex
+	idle   []*conn
+	max    int
+	closed bool
+}
+
+type conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// New 声明一个客户端。
+//
+// addrs为服务器地址列表；maxIdle为每台服务器最多保留的空闲连接数；
+// maxItemSize为服务器允许的最大item长度，即memcached的 -I 参数。
+func New(addrs []string, maxIdle int, dialTimeout time.Duration, maxItemSize int) (*Client, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("memcache: 未指定服务器地址")
+	}
+
+	pools := make(map[string]*pool, len(addrs))
+	for _, addr := range addrs {
+		if _, found := pools[addr]; found {
+			return nil, fmt.Errorf("memcache: 重复的服务器地址 %v", addr)
+		}
+		pools[addr] = &pool{addr: addr, dialTimeout: dialTimeout, max: maxIdle}
+	}
+
+	return &Client{
+		ring:        newRing(addrs),
+		pools:       pools,
+		maxItemSize: maxItemSize,
+	}, nil
+}
+
+// Get 获取key对应的数据，不存在时返回nil。
+//
+// 通过meta命令mg获取，可以同时得到数据剩余的生存时间，需要memcached 1.6及以上的版本。
+func (c *Client) Get(ctx context.Context, key string) (item *Item, err error) {
+	err = c.do(ctx, key, func(cn *conn) error {
+		cn.w.WriteString("mg " + key + " v f t\r\n")
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+
+		line, err := readLine(cn.r)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(line, []byte("EN")) {
+			return nil
+		}
+		if !bytes.HasPrefix(line, []byte("VA ")) {
+			return lineError(line)
+		}
+
+		// VA <size> f<flags> t<ttl>
+		fields := bytes.Fields(line)
+		if len(fields) < 2 {
+			return ErrProtocol
+		}
+		size, err := strconv.Atoi(string(fields[1]))
+		if err != nil || size < 0 {
+			return ErrProtocol
+		}
+		it := &Item{TTL: -1}
+		for _, field := range fields[2:] {
+			if len(field) < 2 {
+				return ErrProtocol
+			}
+			switch field[0] {
+			case 'f':
+				flags, err := strconv.ParseUint(string(field[1:]), 10, 32)
+				if err != nil {
+					return ErrProtocol
+				}
+				it.Flags = uint32(flags)
+			case 't':
+				secs, err := strconv.ParseInt(string(field[1:]), 10, 64)
+				if err != nil {
+					return ErrProtocol
+				}
+				if secs >= 0 { // -1表示永不过期
+					it.TTL = time.Duration(secs) * time.Second
+				}
+			}
+		}
+
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(cn.r, buf); err != nil {
+			return err
+		}
+		if !bytes.HasSuffix(buf, []byte("\r\n")) {
+			return ErrProtocol
+		}
+		it.Value = buf[:size]
+		item = it
+		return nil
+	})
+
+	return item, err
+}
+
+// Set 保存数据，ttl之后过期。
+func (c *Client) Set(ctx context.Context, key string, item *Item, ttl time.Duration) error {
+	if len(key)+len(item.Value)+itemOverhead > c.maxItemSize {
+		return ErrTooLarge
+	}
+
+	return c.do(ctx, key, func(cn *conn) error {
+		cn.w.WriteString("set " + key + " " + strconv.FormatUint(uint64(item.Flags), 10) + " " +
+			strconv.FormatInt(expiration(ttl), 10) + " " + strconv.Itoa(len(item.Value)) + "\r\n")
+		cn.w.Write(item.Value)
+		cn.w.WriteString("\r\n")
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+
+		line, err := readLine(cn.r)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(line, []byte("STORED")) {
+			return nil
+		}
+		if bytes.Contains(line, []byte("too large")) {
+			return ErrTooLarge
+		}
+		return lineError(line)
+	})
+}
+
+// Touch 将key的过期时间重置为ttl，返回值表示数据是否存在。
+func (c *Client) Touch(ctx context.Context, key string, ttl time.Duration) (found bool, err error) {
+	err = c.do(ctx, key, func(cn *conn) error {
+		found, err = cn.simple("touch "+key+" "+strconv.FormatInt(expiration(ttl), 10), "TOUCHED")
+		return err
+	})
+	return found, err
+}
+
+// Delete 删除数据，返回值表示数据是否存在。
+func (c *Client) Delete(ctx context.Context, key string) (found bool, err error) {
+	err = c.do(ctx, key, func(cn *conn) error {
+		found, err = cn.simple("delete "+key, "DELETED")
+		return err
+	})
+	return found, err
+}
+
+// Close 关闭所有的空闲连接，之后的操作都将返回ErrClosed。
+func (c *Client) Close() error {
+	for _, p := range c.pools {
+		p.close()
+	}
+	return nil
+}
+
+// 获取key所在的服务器地址。
+func (c *Client) addr(key string) string {
+	return c.ring.get(key)
+}
+
+// 在key所在服务器的一个连接上执行f。
+func (c *Client) do(ctx context.Context, key string, f func(*conn) error) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+
+	p := c.pools[c.addr(key)]
+	cn, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = cn.exec(ctx, f); err != nil {
+		if _, ok := err.(ServerError); !ok && err != ErrTooLarge {
+			// 网络或是协议错误，连接的状态已经不可靠。
+			cn.conn.Close()
+			return err
+		}
+	}
+
+	p.put(cn)
+	return err
+}
+
+// 执行一条单行的命令，若返回的内容为ok，返回true；为NOT_FOUND返回false。
+func (cn *conn) simple(cmd, ok string) (bool, error) {
+	cn.w.WriteString(cmd + "\r\n")
+	if err := cn.w.Flush(); err != nil {
+		return false, err
+	}
+
+	line, err := readLine(cn.r)
+	if err != nil {
+		return false, err
+	}
+	switch string(line) {
+	case ok:
+		return true, nil
+	case "NOT_FOUND":
+		return false, nil
+	}
+	return false, lineError(line)
+}
+
+// 以ctx控制f的读写超时。
+func (cn *conn) exec(ctx context.Context, f func(*conn) error) (err error) {
+	deadline, _ := ctx.Deadline()
+	if err = cn.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		cn.conn.SetDeadline(time.Now())
+	})
+	defer func() {
+		if !stop() && err == nil { // 连接已经被中断，不能再放回连接池。
+			err = ctx.Err()
+		}
+	}()
+
+	if err = f(cn); err != nil {
+		return ctxErr(ctx, err)
+	}
+	return nil
+}
+
+// 若是由ctx导致的错误，返回ctx.Err()。
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// 连接的超时时间与ctx的截止时间相同，可能先于ctx触发。
+	var ne net.Error
+	if deadline, ok := ctx.Deadline(); ok && errors.As(err, &ne) && ne.Timeout() && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(p.idle); n > 0 {
+		cn := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return cn, nil
+	}
+	p.mu.Unlock()
+
+	d := &net.Dialer{Timeout: p.dialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{
+		conn: nc,
+		r:    bufio.NewReader(nc),
+		w:    bufio.NewWriter(nc),
+	}, nil
+}
+
+func (p *pool) put(cn *conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || len(p.idle) >= p.max {
+		cn.conn.Close()
+		return
+	}
+	p.idle = append(p.idle, cn)
+}
+
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, cn := range p.idle {
+		cn.conn.Close()
+	}
+	p.idle = nil
+}
+
+// 将ttl转换成memcached的过期时间，不足1秒的按1秒计算。
+//
+// 超过30天的ttl会被转换成unix时间戳。
+func expiration(ttl time.Duration) int64 {
+	secs := int64(ttl / time.Second)
+	if ttl%time.Second > 0 {
+		secs++
+	}
+
+	if ttl > maxRelativeExpiration {
+		return time.Now().Unix() + secs
+	}
+	return secs
+}
+
+// 键名不能包含空白和控制字符，且长度不能超过250字节。
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > maxKeyLen {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// 读取一行，不包含末尾的\r\n
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return nil, ErrProtocol
+		}
+		return nil, err
+	}
+
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, ErrProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+// 将错误信息行转换成error
+func lineError(line []byte) error {
+	switch {
+	case bytes.Equal(line, []byte("ERROR")),
+		bytes.HasPrefix(line, []byte("CLIENT_ERROR ")),
+		bytes.HasPrefix(line, []byte("SERVER_ERROR ")):
+		return ServerError(line)
+	}
+	return ErrProtocol
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package memcache
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert"
+	"github.com/issue9/session/stores/internal/memcache/memcachetest"
+)
+
+func TestRing(t *testing.T) {
+	a := assert.New(t)
+
+	r := newRing([]string{"s1", "s2", "s3"})
+	a.Equal(len(r), 3*replicas)
+
+	// 相同的键名总是映射到同一台服务器，且各服务器都有分配
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := "key" + strconv.Itoa(i)
+		addr := r.get(key)
+		a.Equal(addr, r.get(key))
+		counts[addr]++
+	}
+	a.Equal(len(counts), 3)
+	for _, n := range counts {
+		a.True(n > 500, n)
+	}
+
+	// 增加一台服务器，只有一部分键名会被重新分配，且都分配到了新服务器上
+	r4 := newRing([]string{"s1", "s2", "s3", "s4"})
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		key := "key" + strconv.Itoa(i)
+		if addr := r4.get(key); addr != r.get(key) {
+			a.Equal(addr, "s4")
+			moved++
+		}
+	}
+	a.True(moved > 300 && moved < 1500, moved)
+}
+
+func TestExpiration(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal(expiration(time.Second), 1)
+	a.Equal(expiration(1500*time.Millisecond), 2)
+	a.Equal(expiration(time.Millisecond), 1)
+
+	// 超过30天，转换成时间戳
+	exp := expiration(31 * 24 * time.Hour)
+	a.True(exp > time.Now().Unix())
+}
+
+func TestValidKey(t *testing.T) {
+	a := assert.New(t)
+
+	a.True(validKey("sess:abc-_="))
+	a.False(validKey(""))
+	a.False(validKey("a b"))
+	a.False(validKey("a\r\n"))
+	a.False(validKey(strings.Repeat("a", maxKeyLen+1)))
+}
+
+func TestClient(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+
+	srv1, err := memcachetest.NewServer(1024)
+	a.NotError(err)
+	defer srv1.Close()
+	srv2, err := memcachetest.NewServer(1024)
+	a.NotError(err)
+	defer srv2.Close()
+
+	c, err := New([]string{srv1.Addr(), srv2.Addr()}, 2, time.Second, 1024*1024)
+	a.NotError(err).NotNil(c)
+
+	// 数据分布在两台服务器上
+	for i := 0; i < 20; i++ {
+		key := "key" + strconv.Itoa(i)
+		a.NotError(c.Set(ctx, key, &Item{Value: []byte(key), Flags: uint32(i)}, time.Minute))
+	}
+	a.True(len(srv1.Keys()) > 0).True(len(srv2.Keys()) > 0)
+	a.Equal(len(srv1.Keys())+len(srv2.Keys()), 20)
+
+	item, err := c.Get(ctx, "key5")
+	a.NotError(err).Equal(item.Value, []byte("key5")).Equal(item.Flags, 5)
+	a.True(item.TTL > 50*time.Second && item.TTL <= time.Minute)
+
+	// 永不过期
+	a.NotError(c.Set(ctx, "forever", &Item{Value: []byte("forever")}, 0))
+	item, err = c.Get(ctx, "forever")
+	a.NotError(err).True(item.TTL < 0)
+
+	item, err = c.Get(ctx, "not-exists")
+	a.NotError(err).Nil(item)
+
+	found, err := c.Touch(ctx, "key5", time.Hour)
+	a.NotError(err).True(found)
+	item, err = c.Get(ctx, "key5")
+	a.NotError(err).True(item.TTL > 50*time.Minute)
+	found, err = c.Touch(ctx, "not-exists", time.Hour)
+	a.NotError(err).False(found)
+
+	found, err = c.Delete(ctx, "key5")
+	a.NotError(err).True(found)
+	found, err = c.Delete(ctx, "key5")
+	a.NotError(err).False(found)
+
+	// 无效的键名
+	_, err = c.Get(ctx, "a b")
+	a.Equal(err, ErrInvalidKey)
+
+	// 超过了服务器的限制，连接依然可以继续使用
+	err = c.Set(ctx, "large", &Item{Value: make([]byte, 2048)}, time.Minute)
+	a.Equal(err, ErrTooLarge)
+	item, err = c.Get(ctx, "key6")
+	a.NotError(err).NotNil(item)
+
+	// 超过了客户端的限制，不会发送到服务器
+	c, err = New([]string{srv1.Addr()}, 2, time.Second, 100)
+	a.NotError(err)
+	err = c.Set(ctx, "large", &Item{Value: make([]byte, 100)}, time.Minute)
+	a.Equal(err, ErrTooLarge)
+
+	a.NotError(c.Close())
+	_, err = c.Get(ctx, "key1")
+	a.Equal(err, ErrClosed)
+
+	// 重复的地址
+	c, err = New([]string{srv1.Addr(), srv1.Addr()}, 2, time.Second, 100)
+	a.Error(err).Nil(c)
+}
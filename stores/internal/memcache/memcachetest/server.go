@@ -0,0 +1,326 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package memcachetest 提供了一个运行于当前进程的memcached模拟服务，
+// 仅实现了文本协议中的部分命令，用于离线测试。
+package memcachetest
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 与memcached相同，超过此值的过期时间被当作unix时间戳。
+const maxRelativeExpiration = 30 * 24 * 60 * 60
+
+type item struct {
+	val     []byte
+	flags   uint32
+	expires time.Time // 零值表示永不过期
+}
+
+// Server 为memcached模拟服务。
+type Server struct {
+	ln          net.Listener
+	maxItemSize int
+
+	mu    sync.Mutex
+	items map[string]*item
+	conns int
+	open  map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// NewServer 声明并运行一个模拟服务，监听于127.0.0.1的随机端口。
+//
+// maxItemSize为允许的最大数据长度，超过此值的set命令会返回
+// SERVER_ERROR object too large for cache。
+func NewServer(maxItemSize int) (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &Server{
+		ln:          ln,
+		maxItemSize: maxItemSize,
+		items:       map[string]*item{},
+		open:        map[net.Conn]struct{}{},
+	}
+
+	srv.wg.Add(1)
+	go srv.serve()
+	return srv, nil
+}
+
+// Addr 返回服务的监听地址。
+func (srv *Server) Addr() string {
+	return srv.ln.Addr().String()
+}
+
+// Close 关闭服务及所有的连接。
+func (srv *Server) Close() error {
+	err := srv.ln.Close()
+
+	srv.mu.Lock()
+	for c := range srv.open {
+		c.Close()
+	}
+	srv.mu.Unlock()
+
+	srv.wg.Wait()
+	return err
+}
+
+// Conns 返回累计建立的连接数。
+func (srv *Server) Conns() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.conns
+}
+
+// Keys 返回所有未过期的键名，按字母顺序排列。
+func (srv *Server) Keys() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	keys := make([]string, 0, len(srv.items))
+	for k := range srv.items {
+		if srv.lookup(k) != nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Expires 返回键名的过期时间，不存在或是永不过期时返回零值。
+func (srv *Server) Expires(key string) time.Time {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if it := srv.lookup(key); it != nil {
+		return it.expires
+	}
+	return time.Time{}
+}
+
+func (srv *Server) serve() {
+	defer srv.wg.Done()
+
+	for {
+		conn, err := srv.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		srv.mu.Lock()
+		srv.conns++
+		srv.open[conn] = struct{}{}
+		srv.mu.Unlock()
+
+		srv.wg.Add(1)
+		go srv.handle(conn)
+	}
+}
+
+func (srv *Server) handle(conn net.Conn) {
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.open, conn)
+		srv.mu.Unlock()
+		conn.Close()
+		srv.wg.Done()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			w.WriteString("ERROR\r\n")
+			w.Flush()
+			continue
+		}
+
+		if fields[0] == "set" {
+			if !srv.set(r, w, fields[1:]) {
+				return
+			}
+		} else {
+			srv.exec(w, fields[0], fields[1:])
+		}
+
+		if err = w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// 获取未过期的值，调用方需要加锁。
+func (srv *Server) lookup(key string) *item {
+	it, found := srv.items[key]
+	if !found {
+		return nil
+	}
+
+	if !it.expires.IsZero() && !it.expires.After(time.Now()) {
+		delete(srv.items, key)
+		return nil
+	}
+	return it
+}
+
+// 将memcached的过期时间转换成time.Time，第二个返回值表示是否已经过期。
+func expires(exptime int64) (time.Time, bool) {
+	switch {
+	case exptime == 0:
+		return time.Time{}, false
+	case exptime < 0:
+		return time.Time{}, true
+	case exptime > maxRelativeExpiration:
+		t := time.Unix(exptime, 0)
+		return t, !t.After(time.Now())
+	default:
+		return time.Now().Add(time.Duration(exptime) * time.Second), false
+	}
+}
+
+// 处理 set <key> <flags> <exptime> <bytes>，返回false表示需要断开连接。
+func (srv *Server) set(r *bufio.Reader, w *bufio.Writer, args []string) bool {
+	if len(args) != 4 {
+		w.WriteString("ERROR\r\n")
+		return true
+	}
+
+	flags, err1 := strconv.ParseUint(args[1], 10, 32)
+	exptime, err2 := strconv.ParseInt(args[2], 10, 64)
+	size, err3 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil || err3 != nil || size < 0 {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return false
+	}
+
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return false
+	}
+	if buf[size] != '\r' || buf[size+1] != '\n' {
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return false
+	}
+
+	if size > srv.maxItemSize {
+		w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return true
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	t, expired := expires(exptime)
+	if expired {
+		delete(srv.items, args[0])
+	} else {
+		srv.items[args[0]] = &item{val: buf[:size], flags: uint32(flags), expires: t}
+	}
+	w.WriteString("STORED\r\n")
+	return true
+}
+
+func (srv *Server) exec(w *bufio.Writer, cmd string, args []string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	switch cmd {
+	case "get", "gets":
+		for _, key := range args {
+			if it := srv.lookup(key); it != nil {
+				w.WriteString("VALUE " + key + " " + strconv.FormatUint(uint64(it.flags), 10) + " " + strconv.Itoa(len(it.val)) + "\r\n")
+				w.Write(it.val)
+				w.WriteString("\r\n")
+			}
+		}
+		w.WriteString("END\r\n")
+	case "mg": // 仅支持 v、f 和 t 标记
+		if len(args) == 0 {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return
+		}
+		it := srv.lookup(args[0])
+		if it == nil {
+			w.WriteString("EN\r\n")
+			return
+		}
+
+		line := "VA " + strconv.Itoa(len(it.val))
+		for _, flag := range args[1:] {
+			switch flag {
+			case "f":
+				line += " f" + strconv.FormatUint(uint64(it.flags), 10)
+			case "t":
+				ttl := int64(-1)
+				if !it.expires.IsZero() {
+					ttl = int64(time.Until(it.expires).Round(time.Second) / time.Second)
+				}
+				line += " t" + strconv.FormatInt(ttl, 10)
+			}
+		}
+		w.WriteString(line + "\r\n")
+		w.Write(it.val)
+		w.WriteString("\r\n")
+	case "touch":
+		if len(args) != 2 {
+			w.WriteString("ERROR\r\n")
+			return
+		}
+		exptime, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			w.WriteString("CLIENT_ERROR invalid exptime argument\r\n")
+			return
+		}
+
+		it := srv.lookup(args[0])
+		if it == nil {
+			w.WriteString("NOT_FOUND\r\n")
+			return
+		}
+		t, expired := expires(exptime)
+		if expired {
+			delete(srv.items, args[0])
+		} else {
+			it.expires = t
+		}
+		w.WriteString("TOUCHED\r\n")
+	case "delete":
+		if len(args) != 1 {
+			w.WriteString("ERROR\r\n")
+			return
+		}
+		if srv.lookup(args[0]) == nil {
+			w.WriteString("NOT_FOUND\r\n")
+			return
+		}
+		delete(srv.items, args[0])
+		w.WriteString("DELETED\r\n")
+	case "flush_all":
+		srv.items = map[string]*item{}
+		w.WriteString("OK\r\n")
+	case "version":
+		w.WriteString("VERSION 1.4.0-memcachetest\r\n")
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+}
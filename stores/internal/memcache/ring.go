@@ -0,0 +1,55 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package memcache
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// 每台服务器在哈希环上的虚拟节点数量。
+const replicas = 160
+
+// 哈希环上的一个节点
+type point struct {
+	hash uint32
+	addr string
+}
+
+// 一致性哈希环。
+//
+// 增加或是减少服务器时，只有约 1/n 的键名会被映射到其它服务器上。
+type ring []point
+
+func newRing(addrs []string) ring {
+	r := make(ring, 0, len(addrs)*replicas)
+	for _, addr := range addrs {
+		for i := 0; i < replicas; i++ {
+			r = append(r, point{
+				hash: crc32.ChecksumIEEE([]byte(addr + "-" + strconv.Itoa(i))),
+				addr: addr,
+			})
+		}
+	}
+
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].hash == r[j].hash { // 哈希冲突时，保证顺序的稳定
+			return r[i].addr < r[j].addr
+		}
+		return r[i].hash < r[j].hash
+	})
+	return r
+}
+
+// 获取key所在的服务器地址。
+func (r ring) get(key string) string {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r), func(i int) bool { return r[i].hash >= h })
+	if i == len(r) {
+		i = 0
+	}
+	return r[i].addr
+}
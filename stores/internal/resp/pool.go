@@ -0,0 +1,216 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrClosed 表示连接池已经关闭。
+var ErrClosed = errors.New("resp: 连接池已经关闭")
+
+// Conn 表示与Redis服务器之间的一个连接。
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// Pool 为Redis的连接池。
+type Pool struct {
+	addr        string
+	dialTimeout time.Duration
+	init        func(*Conn) error
+
+	mu     sync.Mutex
+	idle   []*Conn
+	max    int // 最大的空闲连接数
+	closed bool
+}
+
+// NewPool 声明一个连接池。
+//
+// maxIdle为最多保留的空闲连接数；
+// init在每个新连接建立之后调用，可用于执行AUTH、SELECT等命令，可以为nil。
+func NewPool(addr string, maxIdle int, dialTimeout time.Duration, init func(*Conn) error) *Pool {
+	return &Pool{
+		addr:        addr,
+		dialTimeout: dialTimeout,
+		init:        init,
+		max:         maxIdle,
+	}
+}
+
+// Do 从连接池中获取一个连接并执行一条命令。
+//
+// 若返回值为Error类型，表示Redis返回了错误信息，该错误会以err的形式返回。
+func (p *Pool) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	vals, err := p.Pipeline(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := vals[0].(Error); ok {
+		return nil, e
+	}
+	return vals[0], nil
+}
+
+// Pipeline 在同一个连接上一次性发送多条命令，并按顺序返回各命令的结果。
+//
+// 各命令返回的Error不会以err的形式返回，需要调用方自行判断。
+func (p *Pool) Pipeline(ctx context.Context, cmds ...[]interface{}) ([]interface{}, error) {
+	c, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	vals, err := c.pipeline(ctx, cmds...)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	p.put(c)
+	return vals, nil
+}
+
+// Close 关闭连接池及所有的空闲连接。
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, c := range p.idle {
+		c.conn.Close()
+	}
+	p.idle = nil
+	return nil
+}
+
+// IdleLen 返回当前空闲连接的数量。
+func (p *Pool) IdleLen() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+func (p *Pool) get(ctx context.Context) (*Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, nil
+	}
+	p.mu.Unlock()
+
+	d := &net.Dialer{Timeout: p.dialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+
+	if p.init != nil {
+		if err = p.init(c); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (p *Pool) put(c *Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || len(p.idle) >= p.max {
+		c.conn.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+// Do 在当前连接上执行一条命令，用于NewPool()的init参数。
+func (c *Conn) Do(args ...interface{}) (interface{}, error) {
+	vals, err := c.pipeline(context.Background(), args)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := vals[0].(Error); ok {
+		return nil, e
+	}
+	return vals[0], nil
+}
+
+func (c *Conn) pipeline(ctx context.Context, cmds ...[]interface{}) (vals []interface{}, err error) {
+	// ctx的截止时间作为连接的读写超时，ctx取消时立即中断读写。
+	deadline, _ := ctx.Deadline()
+	if err = c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.SetDeadline(time.Now())
+	})
+	defer func() {
+		// 中断操作已经执行，该连接的状态不再可靠，需要由调用方关闭。
+		if !stop() && err == nil {
+			vals, err = nil, ctx.Err()
+		}
+	}()
+
+	for _, cmd := range cmds {
+		if err := WriteCommand(c.w, cmd...); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+
+	vals = make([]interface{}, 0, len(cmds))
+	for range cmds {
+		v, err := ReadValue(c.r)
+		if err != nil {
+			return nil, ctxErr(ctx, err)
+		}
+		vals = append(vals, v)
+	}
+
+	return vals, nil
+}
+
+// 若是由ctx导致的错误，返回ctx.Err()。
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// 连接的超时时间与ctx的截止时间相同，可能先于ctx触发。
+	var ne net.Error
+	if deadline, ok := ctx.Deadline(); ok && errors.As(err, &ne) && ne.Timeout() && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
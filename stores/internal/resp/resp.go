@@ -0,0 +1,155 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package resp 实现了一个简单的Redis客户端，
+// 仅支持RESP2协议中的请求与响应，供stores.NewRedis()使用。
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// 单个bulk string的最大长度，与Redis的默认值相同。
+const maxBulkLen = 512 * 1024 * 1024
+
+// ErrProtocol 表示服务端返回的内容不符合RESP协议。
+var ErrProtocol = errors.New("resp: 无效的协议内容")
+
+// Error 表示Redis返回的错误信息，比如 -ERR unknown command。
+//
+// 与网络错误不同，出现Error时，连接依然可以继续使用。
+type Error string
+
+func (err Error) Error() string {
+	return string(err)
+}
+
+// WriteCommand 将args以RESP数组的形式写入w，
+// args的元素可以是string、[]byte、int、int64或是fmt.Stringer。
+func WriteCommand(w *bufio.Writer, args ...interface{}) error {
+	w.WriteByte('*')
+	w.WriteString(strconv.Itoa(len(args)))
+	w.WriteString("\r\n")
+
+	for _, arg := range args {
+		var bs []byte
+		switch v := arg.(type) {
+		case string:
+			bs = []byte(v)
+		case []byte:
+			bs = v
+		case int:
+			bs = strconv.AppendInt(nil, int64(v), 10)
+		case int64:
+			bs = strconv.AppendInt(nil, v, 10)
+		case fmt.Stringer:
+			bs = []byte(v.String())
+		default:
+			return fmt.Errorf("resp: 不支持的参数类型 %T", arg)
+		}
+
+		w.WriteByte('$')
+		w.WriteString(strconv.Itoa(len(bs)))
+		w.WriteString("\r\n")
+		w.Write(bs)
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadValue 从r中读取一个RESP值。
+//
+// 返回值的类型分别为：
+// 简单字符串为string，错误为Error，整数为int64，
+// bulk string为[]byte，数组为[]interface{}，
+// null bulk string 和 null array 都为nil。
+func ReadValue(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, ErrProtocol
+	}
+
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		return parseInt(line[1:])
+	case '$':
+		n, err := parseInt(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		if n > maxBulkLen {
+			return nil, ErrProtocol
+		}
+
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return nil, ErrProtocol
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := parseInt(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		vals := make([]interface{}, 0, min(n, 1024))
+		for i := int64(0); i < n; i++ {
+			v, err := ReadValue(r)
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, v)
+		}
+		return vals, nil
+	}
+
+	return nil, ErrProtocol
+}
+
+// 读取一行，不包含末尾的\r\n
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return nil, ErrProtocol
+		}
+		return nil, err
+	}
+
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, ErrProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+func parseInt(bs []byte) (int64, error) {
+	n, err := strconv.ParseInt(string(bs), 10, 64)
+	if err != nil {
+		return 0, ErrProtocol
+	}
+	return n, nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert"
+)
+
+func TestWriteCommand(t *testing.T) {
+	a := assert.New(t)
+
+	buf := new(bytes.Buffer)
+	w := bufio.NewWriter(buf)
+	a.NotError(WriteCommand(w, "SET", []byte("k"), 5, int64(-1)))
+	a.NotError(w.Flush())
+	a.Equal(buf.String(), "*4\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\n5\r\n$2\r\n-1\r\n")
+
+	a.Error(WriteCommand(w, 1.5))
+}
+
+func TestReadValue(t *testing.T) {
+	a := assert.New(t)
+
+	read := func(s string) (interface{}, error) {
+		return ReadValue(bufio.NewReader(strings.NewReader(s)))
+	}
+
+	v, err := read("+OK\r\n")
+	a.NotError(err).Equal(v, "OK")
+
+	v, err = read("-ERR wrong\r\n")
+	a.NotError(err).Equal(v, Error("ERR wrong"))
+
+	v, err = read(":-12\r\n")
+	a.NotError(err).Equal(v, int64(-12))
+
+	v, err = read("$5\r\nab\r\nc\r\n")
+	a.NotError(err).Equal(v, []byte("ab\r\nc"))
+
+	v, err = read("$-1\r\n")
+	a.NotError(err).Nil(v)
+
+	v, err = read("*2\r\n$1\r\na\r\n:1\r\n")
+	a.NotError(err).Equal(v, []interface{}{[]byte("a"), int64(1)})
+
+	v, err = read("*-1\r\n")
+	a.NotError(err).Nil(v)
+
+	// 不合法的内容
+	_, err = read("?\r\n")
+	a.Equal(err, ErrProtocol)
+	_, err = read("$5\r\nabc\r\n")
+	a.Error(err)
+	_, err = read(":abc\r\n")
+	a.Error(err)
+	_, err = read("$1024000000\r\n")
+	a.Error(err)
+}
+
+// 一个只会返回固定内容的服务
+func newEchoServer(a *assert.Assertion, reply string, delay time.Duration) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	a.NotError(err)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					if _, err := ReadValue(r); err != nil {
+						return
+					}
+					time.Sleep(delay)
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return ln
+}
+
+func TestPool(t *testing.T) {
+	a := assert.New(t)
+	ln := newEchoServer(a, "+PONG\r\n", 0)
+	defer ln.Close()
+
+	inits := 0
+	p := NewPool(ln.Addr().String(), 1, time.Second, func(c *Conn) error {
+		inits++
+		_, err := c.Do("PING")
+		return err
+	})
+
+	v, err := p.Do(context.Background(), "PING")
+	a.NotError(err).Equal(v, "PONG")
+	a.Equal(p.IdleLen(), 1).Equal(inits, 1)
+
+	// 复用空闲的连接
+	vals, err := p.Pipeline(context.Background(), []interface{}{"PING"}, []interface{}{"PING"})
+	a.NotError(err).Equal(vals, []interface{}{"PONG", "PONG"})
+	a.Equal(p.IdleLen(), 1).Equal(inits, 1)
+
+	a.NotError(p.Close())
+	a.Equal(p.IdleLen(), 0)
+	_, err = p.Do(context.Background(), "PING")
+	a.Equal(err, ErrClosed)
+}
+
+func TestPool_Error(t *testing.T) {
+	a := assert.New(t)
+	ln := newEchoServer(a, "-ERR failed\r\n", 0)
+	defer ln.Close()
+
+	p := NewPool(ln.Addr().String(), 1, time.Second, nil)
+	defer p.Close()
+
+	// Error 不影响连接的使用
+	_, err := p.Do(context.Background(), "PING")
+	a.Equal(err, Error("ERR failed"))
+	a.Equal(p.IdleLen(), 1)
+}
+
+func TestPool_Context(t *testing.T) {
+	a := assert.New(t)
+	ln := newEchoServer(a, "+PONG\r\n", 200*time.Millisecond)
+	defer ln.Close()
+
+	p := NewPool(ln.Addr().String(), 1, time.Second, nil)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := p.Do(ctx, "PING")
+	a.Equal(err, context.DeadlineExceeded)
+	a.Equal(p.IdleLen(), 0) // 超时的连接不会放回连接池
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	_, err = p.Do(ctx, "PING")
+	a.Equal(err, context.Canceled)
+	a.Equal(p.IdleLen(), 0)
+}
@@ -0,0 +1,337 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package resptest 提供了一个运行于当前进程的Redis模拟服务，
+// 仅实现了stores.NewRedis()用到的部分命令，用于离线测试。
+package resptest
+
+import (
+	"bufio"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/issue9/session/stores/internal/resp"
+)
+
+type item struct {
+	val     []byte
+	expires time.Time // 零值表示永不过期
+}
+
+// Server 为Redis模拟服务。
+type Server struct {
+	ln       net.Listener
+	password string
+
+	mu    sync.Mutex
+	items map[string]*item
+	conns int // 累计建立的连接数
+	cmds  int // 累计执行的命令数
+	wg    sync.WaitGroup
+	open  map[net.Conn]struct{}
+}
+
+// NewServer 声明并运行一个模拟服务，监听于127.0.0.1的随机端口。
+//
+// password不为空时，客户端需要先执行AUTH命令。
+func NewServer(password string) (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &Server{
+		ln:       ln,
+		password: password,
+		items:    map[string]*item{},
+		open:     map[net.Conn]struct{}{},
+	}
+
+	srv.wg.Add(1)
+	go srv.serve()
+	return srv, nil
+}
+
+// Addr 返回服务的监听地址。
+func (srv *Server) Addr() string {
+	return srv.ln.Addr().String()
+}
+
+// Close 关闭服务及所有的连接。
+func (srv *Server) Close() error {
+	err := srv.ln.Close()
+
+	srv.mu.Lock()
+	for c := range srv.open {
+		c.Close()
+	}
+	srv.mu.Unlock()
+
+	srv.wg.Wait()
+	return err
+}
+
+// Conns 返回累计建立的连接数。
+func (srv *Server) Conns() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.conns
+}
+
+// Keys 返回所有未过期的键名，按字母顺序排列。
+func (srv *Server) Keys() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	keys := make([]string, 0, len(srv.items))
+	for k := range srv.items {
+		if srv.lookup(k) != nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// TTL 返回键名的剩余生存时间，不存在时返回-2，永不过期返回-1。
+func (srv *Server) TTL(key string) time.Duration {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	it := srv.lookup(key)
+	switch {
+	case it == nil:
+		return -2
+	case it.expires.IsZero():
+		return -1
+	default:
+		return time.Until(it.expires)
+	}
+}
+
+func (srv *Server) serve() {
+	defer srv.wg.Done()
+
+	for {
+		conn, err := srv.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		srv.mu.Lock()
+		srv.conns++
+		srv.open[conn] = struct{}{}
+		srv.mu.Unlock()
+
+		srv.wg.Add(1)
+		go srv.handle(conn)
+	}
+}
+
+func (srv *Server) handle(conn net.Conn) {
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.open, conn)
+		srv.mu.Unlock()
+		conn.Close()
+		srv.wg.Done()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	authed := srv.password == ""
+
+	for {
+		v, err := resp.ReadValue(r)
+		if err != nil {
+			return
+		}
+
+		args, ok := v.([]interface{})
+		if !ok || len(args) == 0 {
+			writeError(w, "ERR protocol error")
+			w.Flush()
+			return
+		}
+
+		strs := make([]string, 0, len(args))
+		for _, arg := range args {
+			bs, ok := arg.([]byte)
+			if !ok {
+				writeError(w, "ERR protocol error")
+				w.Flush()
+				return
+			}
+			strs = append(strs, string(bs))
+		}
+
+		cmd := strings.ToUpper(strs[0])
+		switch {
+		case cmd == "AUTH":
+			if len(strs) == 2 && strs[1] == srv.password {
+				authed = true
+				writeSimple(w, "OK")
+			} else {
+				writeError(w, "WRONGPASS invalid password")
+			}
+		case !authed:
+			writeError(w, "NOAUTH Authentication required.")
+		default:
+			srv.exec(w, cmd, strs[1:])
+		}
+
+		if r.Buffered() == 0 { // 管道中的命令都已经处理完
+			if err = w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// 获取未过期的值，调用方需要加锁。
+func (srv *Server) lookup(key string) *item {
+	it, found := srv.items[key]
+	if !found {
+		return nil
+	}
+
+	if !it.expires.IsZero() && !it.expires.After(time.Now()) {
+		delete(srv.items, key)
+		return nil
+	}
+	return it
+}
+
+func (srv *Server) exec(w *bufio.Writer, cmd string, args []string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.cmds++
+
+	switch cmd {
+	case "PING":
+		writeSimple(w, "PONG")
+	case "SELECT":
+		if len(args) != 1 {
+			writeError(w, "ERR wrong number of arguments for 'select' command")
+			return
+		}
+		writeSimple(w, "OK")
+	case "GET":
+		if len(args) != 1 {
+			writeError(w, "ERR wrong number of arguments for 'get' command")
+			return
+		}
+		if it := srv.lookup(args[0]); it != nil {
+			writeBulk(w, it.val)
+		} else {
+			w.WriteString("$-1\r\n")
+		}
+	case "SET":
+		if len(args) != 2 && len(args) != 4 {
+			writeError(w, "ERR syntax error")
+			return
+		}
+
+		it := &item{val: []byte(args[1])}
+		if len(args) == 4 {
+			n, err := strconv.ParseInt(args[3], 10, 64)
+			if err != nil || n <= 0 {
+				writeError(w, "ERR invalid expire time in 'set' command")
+				return
+			}
+
+			switch strings.ToUpper(args[2]) {
+			case "EX":
+				it.expires = time.Now().Add(time.Duration(n) * time.Second)
+			case "PX":
+				it.expires = time.Now().Add(time.Duration(n) * time.Millisecond)
+			default:
+				writeError(w, "ERR syntax error")
+				return
+			}
+		}
+		srv.items[args[0]] = it
+		writeSimple(w, "OK")
+	case "DEL":
+		n := 0
+		for _, key := range args {
+			if srv.lookup(key) != nil {
+				delete(srv.items, key)
+				n++
+			}
+		}
+		writeInt(w, int64(n))
+	case "EXPIRE", "PEXPIRE":
+		if len(args) != 2 {
+			writeError(w, "ERR wrong number of arguments")
+			return
+		}
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			writeError(w, "ERR value is not an integer or out of range")
+			return
+		}
+
+		it := srv.lookup(args[0])
+		if it == nil {
+			writeInt(w, 0)
+			return
+		}
+
+		unit := time.Second
+		if cmd == "PEXPIRE" {
+			unit = time.Millisecond
+		}
+		if n <= 0 {
+			delete(srv.items, args[0])
+		} else {
+			it.expires = time.Now().Add(time.Duration(n) * unit)
+		}
+		writeInt(w, 1)
+	case "PTTL", "TTL":
+		if len(args) != 1 {
+			writeError(w, "ERR wrong number of arguments")
+			return
+		}
+
+		it := srv.lookup(args[0])
+		switch {
+		case it == nil:
+			writeInt(w, -2)
+		case it.expires.IsZero():
+			writeInt(w, -1)
+		case cmd == "PTTL":
+			writeInt(w, int64(time.Until(it.expires)/time.Millisecond))
+		default:
+			writeInt(w, int64(time.Until(it.expires)/time.Second))
+		}
+	case "FLUSHDB":
+		srv.items = map[string]*item{}
+		writeSimple(w, "OK")
+	default:
+		writeError(w, "ERR unknown command '"+cmd+"'")
+	}
+}
+
+func writeSimple(w *bufio.Writer, s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func writeError(w *bufio.Writer, s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func writeInt(w *bufio.Writer, n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func writeBulk(w *bufio.Writer, bs []byte) {
+	w.WriteString("$" + strconv.Itoa(len(bs)) + "\r\n")
+	w.Write(bs)
+	w.WriteString("\r\n")
+}
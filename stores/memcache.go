@@ -0,0 +1,158 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/issue9/session/stores/internal/memcache"
+)
+
+// ErrTooLarge 表示session数据超过了memcached允许的最大长度。
+//
+// memcached默认的最大长度为1MB，可以通过 MemcacheOptions.MaxItemSize 修改。
+var ErrTooLarge = memcache.ErrTooLarge
+
+// MemcacheOptions 为 NewMemcache 的参数。
+type MemcacheOptions struct {
+	// memcached服务器的地址列表，比如 127.0.0.1:11211。
+	// 多台服务器之间通过一致性哈希分配数据。
+	Servers []string
+
+	// 键名的前缀，用于与同一服务器中的其它数据区分开。
+	Prefix string
+
+	// 每台服务器最多保留的空闲连接数，默认为10。
+	MaxIdle int
+
+	// 建立连接的超时时间，默认为5秒。
+	DialTimeout time.Duration
+
+	// 服务器允许的最大数据长度，即memcached的 -I 参数，默认为1MB。
+	MaxItemSize int
+}
+
+// 以memcached作为存储的RawStore。
+type memcacheStore struct {
+	client *memcache.Client
+	prefix string
+}
+
+// 声明一个以memcached作为存储的RawStore，可以通过NewRaw()将其转换成session.Store接口。
+//
+// 过期数据由memcached自行清除，StartGC()不执行任何操作。
+// 读取时使用了meta命令，需要memcached 1.6及以上的版本。
+// 超过 MaxItemSize 的数据在保存时会返回ErrTooLarge。
+func NewMemcache(opt *MemcacheOptions) (*memcacheStore, error) {
+	if opt == nil {
+		return nil, errors.New("opt 不能为空")
+	}
+
+	if len(opt.Servers) == 0 {
+		return nil, errors.New("Servers 不能为空")
+	}
+
+	maxIdle := opt.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = 10
+	}
+
+	timeout := opt.DialTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	maxItemSize := opt.MaxItemSize
+	if maxItemSize <= 0 {
+		maxItemSize = 1024 * 1024
+	}
+
+	client, err := memcache.New(opt.Servers, maxIdle, timeout, maxItemSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &memcacheStore{
+		client: client,
+		prefix: opt.Prefix,
+	}, nil
+}
+
+// session.RawStore.Get()
+//
+// 返回的ttl为memcached中数据剩余的生存时间，精确到秒。
+func (m *memcacheStore) Get(sessID string) ([]byte, time.Duration, error) {
+	return m.GetContext(context.Background(), sessID)
+}
+
+// session.ContextRawStore.GetContext()
+func (m *memcacheStore) GetContext(ctx context.Context, sessID string) ([]byte, time.Duration, error) {
+	item, err := m.client.Get(ctx, m.prefix+sessID)
+	if err != nil || item == nil {
+		return nil, 0, err
+	}
+
+	ttl := item.TTL
+	if ttl < 0 { // 由其它程序写入的永不过期的数据
+		ttl = 0
+	}
+	return item.Value, ttl, nil
+}
+
+// session.RawStore.Set()
+func (m *memcacheStore) Set(sessID string, data []byte, ttl time.Duration) error {
+	return m.SetContext(context.Background(), sessID, data, ttl)
+}
+
+// session.ContextRawStore.SetContext()
+//
+// ttl小于等于0时，直接删除该数据。
+func (m *memcacheStore) SetContext(ctx context.Context, sessID string, data []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return m.DeleteContext(ctx, sessID)
+	}
+
+	return m.client.Set(ctx, m.prefix+sessID, &memcache.Item{Value: data}, ttl)
+}
+
+// session.RawStore.Touch()
+func (m *memcacheStore) Touch(sessID string, ttl time.Duration) error {
+	return m.TouchContext(context.Background(), sessID, ttl)
+}
+
+// session.ContextRawStore.TouchContext()
+func (m *memcacheStore) TouchContext(ctx context.Context, sessID string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return m.DeleteContext(ctx, sessID)
+	}
+
+	_, err := m.client.Touch(ctx, m.prefix+sessID, ttl)
+	return err
+}
+
+// session.RawStore.Delete()
+func (m *memcacheStore) Delete(sessID string) error {
+	return m.DeleteContext(context.Background(), sessID)
+}
+
+// session.ContextRawStore.DeleteContext()
+func (m *memcacheStore) DeleteContext(ctx context.Context, sessID string) error {
+	_, err := m.client.Delete(ctx, m.prefix+sessID)
+	return err
+}
+
+// session.RawStore.StartGC()
+//
+// 由memcached的过期机制清除数据，不需要额外的GC。
+func (m *memcacheStore) StartGC() {}
+
+// session.RawStore.Close()
+//
+// 仅关闭连接，memcached中的数据会保留，直到过期。
+func (m *memcacheStore) Close() error {
+	return m.client.Close()
+}
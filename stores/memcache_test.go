@@ -0,0 +1,121 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert"
+	"github.com/issue9/session/stores/internal/memcache/memcachetest"
+	"github.com/issue9/session/types"
+)
+
+var _ types.ContextRawStore = &memcacheStore{}
+
+func TestMemcache(t *testing.T) {
+	a := assert.New(t)
+
+	m, err := NewMemcache(nil)
+	a.Error(err).Nil(m)
+
+	m, err = NewMemcache(&MemcacheOptions{})
+	a.Error(err).Nil(m)
+
+	srv, err := memcachetest.NewServer(1024 * 1024)
+	a.NotError(err)
+	defer srv.Close()
+
+	m, err = NewMemcache(&MemcacheOptions{Servers: []string{srv.Addr()}, Prefix: "sess:"})
+	a.NotError(err).NotNil(m)
+	m.StartGC()
+	defer m.Close()
+
+	data, ttl, err := m.Get("id1")
+	a.NotError(err).Nil(data).Equal(ttl, 0)
+
+	a.NotError(m.Set("id1", rawData1, time.Minute))
+	a.Equal(srv.Keys(), []string{"sess:id1"})
+
+	data, ttl, err = m.Get("id1")
+	a.NotError(err).Equal(data, rawData1)
+	a.True(ttl > 50*time.Second && ttl <= time.Minute)
+
+	// Touch
+	a.NotError(m.Touch("id1", time.Hour))
+	a.True(time.Until(srv.Expires("sess:id1")) > 50*time.Minute)
+	data, ttl, err = m.Get("id1")
+	a.NotError(err).Equal(data, rawData1)
+	a.True(ttl > 50*time.Minute && ttl <= time.Hour)
+	a.NotError(m.Touch("not-exists", time.Hour))
+	a.Equal(srv.Keys(), []string{"sess:id1"})
+
+	// ttl<=0 等同于删除
+	a.NotError(m.Set("id2", rawData2, time.Minute))
+	a.NotError(m.Set("id2", rawData2, 0))
+	a.Equal(srv.Keys(), []string{"sess:id1"})
+
+	a.NotError(m.Delete("id1"))
+	a.NotError(m.Delete("id1"))
+	a.Equal(len(srv.Keys()), 0)
+
+	// 通过NewRaw()转换成Store
+	store := NewRaw(m, nil, 60)
+	a.NotError(store.Save("id", testData1))
+	mapped, err := store.Get("id")
+	a.NotError(err).Equal(mapped, testData1)
+}
+
+func TestMemcache_TooLarge(t *testing.T) {
+	a := assert.New(t)
+
+	srv, err := memcachetest.NewServer(1024 * 1024)
+	a.NotError(err)
+	defer srv.Close()
+
+	m, err := NewMemcache(&MemcacheOptions{Servers: []string{srv.Addr()}})
+	a.NotError(err)
+	defer m.Close()
+
+	a.Equal(m.Set("id", make([]byte, 1024*1024), time.Minute), ErrTooLarge)
+	a.Equal(len(srv.Keys()), 0)
+
+	// 服务端的限制小于客户端的设置
+	m, err = NewMemcache(&MemcacheOptions{Servers: []string{srv.Addr()}, MaxItemSize: 2 * 1024 * 1024})
+	a.NotError(err)
+	defer m.Close()
+	a.Equal(m.Set("id", make([]byte, 1024*1024+1), time.Minute), ErrTooLarge)
+	a.NotError(m.Set("id", rawData1, time.Minute))
+}
+
+func TestMemcache_Servers(t *testing.T) {
+	a := assert.New(t)
+
+	srvs := make([]string, 0, 3)
+	for i := 0; i < 3; i++ {
+		srv, err := memcachetest.NewServer(1024 * 1024)
+		a.NotError(err)
+		defer srv.Close()
+		srvs = append(srvs, srv.Addr())
+	}
+
+	m, err := NewMemcache(&MemcacheOptions{Servers: srvs, MaxIdle: 1})
+	a.NotError(err)
+	defer m.Close()
+
+	ids := []string{"id1", "id2", "id3", "id4", "id5", "id6", "id7", "id8"}
+	for _, id := range ids {
+		a.NotError(m.Set(id, []byte(id), time.Minute))
+	}
+	for _, id := range ids {
+		data, _, err := m.Get(id)
+		a.NotError(err).Equal(data, []byte(id))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	a.Equal(m.SetContext(ctx, "id", rawData1, time.Minute), context.Canceled)
+}
@@ -5,93 +5,503 @@
 package stores
 
 import (
+	"container/list"
+	"context"
+	"errors"
+	"log"
+	"os"
 	"sync"
 	"time"
+
+	"github.com/issue9/session/codecs"
+	"github.com/issue9/session/stores/internal/expiry"
+	"github.com/issue9/session/types"
 )
 
+// 默认的分片数量
+const memDefaultShards = 32
+
+// GC的最大间隔，过期的session最多在过期之后这么长时间内被删除。
+const memGCInterval = time.Second
+
+// MemoryOptions 为 NewMemoryWithOptions 的参数。
+type MemoryOptions struct {
+	// session的有效时间，单位为秒。
+	Lifetime int
+
+	// 分片的数量，会被向上调整为2的幂，默认为32。
+	// 若指定了MaxEntries或MaxBytes，分片的数量不会超过这两个值。
+	//
+	// 每个分片都有独立的锁，根据sessionid的哈希值决定保存在哪个分片中，
+	// 分片越多，并发访问时的锁竞争越少。
+	Shards int
+
+	// 快照文件的路径，为空表示不保存快照。
+	//
+	// 指定之后，Close()时会将所有未过期的session写入该文件，
+	// 下次创建时再从该文件中恢复，期间已经过期的session会被忽略。
+	Snapshot string
+
+	// 定期保存快照的时间间隔，单位为秒，
+	// 为0表示只在Close()时保存，仅在指定了Snapshot时有效。
+	SnapshotInterval int
+
+	// 快照中session数据的编解码方式，若指定为nil，则使用codecs.NewGob()。
+	Codec types.Codec
+
+	// 保存和读取时复制session数据的方式。
+	//
+	// 为了避免多个Session实例共享同一个map，保存和读取时都会复制一份数据。
+	// 若指定为nil，则通过反射进行深复制，值的类型保持不变；
+	// 否则通过CopyCodec编码再解码进行复制，其行为与stores.file等需要编码的存储器完全相同。
+	CopyCodec types.Codec
+
+	// 记录在GC和定期保存快照时发生的错误，若指定为nil，则会向stderr输出错误信息。
+	Log *log.Logger
+
+	// 最多保存的session数量，为0表示不限制。
+	//
+	// 该值会平均分配到各个分片，不能整除的部分由前面的分片各多分配一个，
+	// 各分片的上限之和与该值相等。每个分片独立淘汰自己的session，
+	// 所以淘汰的顺序只是整体上近似于Eviction指定的策略。
+	MaxEntries int
+
+	// 所有session数据的估算大小之和的上限，单位为字节，为0表示不限制。
+	// 与MaxEntries相同，也是平均分配到各个分片。
+	//
+	// 数据的大小是通过反射估算的，与实际占用的内存并不完全相同。
+	// 刚保存的session不会被淘汰，所以单个session超过此值时，依然会被保存。
+	MaxBytes int64
+
+	// 超出MaxEntries或MaxBytes时淘汰session的策略，默认为EvictLRU。
+	Eviction EvictionPolicy
+
+	// session因超出限制而被淘汰时调用，过期的session不会触发此函数。
+	//
+	// 在存储器的锁之外调用，可以在其中访问存储器。
+	OnEvict func(sessID string, items map[interface{}]interface{})
+}
+
+// MemoryStats 为内存存储器的统计信息。
+type MemoryStats struct {
+	Entries   int    // 当前的session数量
+	Bytes     int64  // session数据的估算大小之和，仅在指定了MaxBytes时才会统计
+	Evictions uint64 // 因超出限制而被淘汰的session数量
+}
+
 type memSession struct {
+	id       string
 	accessed time.Time
 	items    map[interface{}]interface{}
+	size     int64
+
+	// 淘汰策略使用的数据
+	elem  *list.Element
+	freq  uint64
+	tick  uint64
+	index int
 }
 
-type memory struct {
+// 内存存储器的一个分片，所有字段都由分片自身的锁保护。
+type memShard struct {
 	sync.Mutex
 
 	items    map[string]*memSession
-	ticker   *time.Ticker
+	expires  *expiry.Queue // 按过期时间排序的sessionid
 	lifetime time.Duration
+
+	evict      evictor // 为nil表示不限制数量和大小
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	evictions  uint64
+}
+
+type memory struct {
+	*gcRunner
+
+	shards   []*memShard
+	mask     uint32
+	lifetime time.Duration
+	onEvict  func(string, map[interface{}]interface{})
+	copy     func(map[interface{}]interface{}) (map[interface{}]interface{}, error)
+
+	snapshot         string
+	snapshotInterval time.Duration
+	snapshotMu       sync.Mutex    // 保证同一时间只有一个saveSnapshot()在写入临时文件
+	snapshotStop     chan struct{} // 通知定时保存快照的goroutine退出
+	snapshotDone     chan struct{} // 定时保存快照的goroutine已经退出
+	snapshotOnce     sync.Once
+	codec            types.Codec
+	log              *log.Logger
 }
 
 // 返回一个实现session.Store接口的内存存储器。
 //
 // 内存存储器是不稳定的，随着程序中止或是实例被销毁，
 // 相关的session数据也会随之销毁。
+// 若需要在重启之后保留session，可以使用NewMemoryWithOptions()指定快照文件。
 func NewMemory(lifetime int) *memory {
-	return &memory{
+	return newMemory(lifetime, memDefaultShards)
+}
+
+func newMemory(lifetime, shards int) *memory {
+	size := 1
+	for size < shards {
+		size <<= 1
+	}
+
+	mem := &memory{
+		shards:   make([]*memShard, size),
+		mask:     uint32(size - 1),
 		lifetime: time.Second * time.Duration(lifetime),
-		items:    map[string]*memSession{},
+		copy:     deepCopy,
+		log:      log.New(os.Stderr, "session.MemoryStore", log.LstdFlags),
+	}
+	for i := range mem.shards {
+		mem.shards[i] = &memShard{
+			items:    map[string]*memSession{},
+			expires:  expiry.NewQueue(),
+			lifetime: mem.lifetime,
+		}
+	}
+
+	// GC的间隔与lifetime无关，session最多在过期之后memGCInterval内被删除。
+	interval := memGCInterval
+	if mem.lifetime > 0 && mem.lifetime < interval {
+		interval = mem.lifetime
+	}
+	mem.gcRunner = newGCRunner(interval, mem.log, mem.gc)
+
+	return mem
+}
+
+// 返回分片的数量，为不小于shards的2的幂。
+//
+// 每个分片的上限至少为1，否则为0的上限会被当作不限制，
+// 所以分片的数量还会被调整为不超过maxEntries和maxBytes的2的幂。
+func memShardCount(shards, maxEntries int, maxBytes int64) int {
+	size := 1
+	for size < shards {
+		size <<= 1
+	}
+
+	for size > 1 && ((maxEntries > 0 && size > maxEntries) || (maxBytes > 0 && int64(size) > maxBytes)) {
+		size >>= 1
+	}
+	return size
+}
+
+// 根据opt返回一个实现session.Store接口的内存存储器。
+//
+// 若opt.Snapshot指定的文件存在，会从中恢复session数据，
+// 文件不存在时，与NewMemory()相同。
+func NewMemoryWithOptions(opt *MemoryOptions) (*memory, error) {
+	if opt == nil {
+		return nil, errors.New("opt 不能为空")
+	}
+
+	if opt.Lifetime <= 0 {
+		return nil, errors.New("Lifetime 必须大于0")
+	}
+
+	if opt.MaxEntries < 0 || opt.MaxBytes < 0 || opt.Shards < 0 {
+		return nil, errors.New("MaxEntries、MaxBytes 和 Shards 不能小于0")
+	}
+
+	shards := opt.Shards
+	if shards == 0 {
+		shards = memDefaultShards
+	}
+	mem := newMemory(opt.Lifetime, memShardCount(shards, opt.MaxEntries, opt.MaxBytes))
+	if opt.Log != nil {
+		mem.log = opt.Log
+		mem.gcRunner.log = opt.Log
+	}
+	if opt.CopyCodec != nil {
+		mem.copy = codecCopier(opt.CopyCodec)
+	}
+
+	if opt.MaxEntries > 0 || opt.MaxBytes > 0 {
+		n := len(mem.shards)
+		for i, shard := range mem.shards {
+			evict, err := newEvictor(opt.Eviction)
+			if err != nil {
+				return nil, err
+			}
+			shard.evict = evict
+
+			// 精确地分配上限，保证各分片的上限之和不超过总的上限。
+			shard.maxEntries = opt.MaxEntries / n
+			if i < opt.MaxEntries%n {
+				shard.maxEntries++
+			}
+			shard.maxBytes = opt.MaxBytes / int64(n)
+			if int64(i) < opt.MaxBytes%int64(n) {
+				shard.maxBytes++
+			}
+		}
+		mem.onEvict = opt.OnEvict
+	}
+
+	if len(opt.Snapshot) == 0 {
+		return mem, nil
+	}
+
+	mem.snapshot = opt.Snapshot
+	mem.snapshotInterval = time.Second * time.Duration(opt.SnapshotInterval)
+
+	mem.codec = opt.Codec
+	if mem.codec == nil {
+		mem.codec = codecs.NewGob()
+	}
+
+	if err := mem.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	if mem.snapshotInterval > 0 {
+		mem.snapshotStop = make(chan struct{})
+		mem.snapshotDone = make(chan struct{})
+		go mem.snapshotLoop()
+	}
+
+	return mem, nil
+}
+
+// 每隔snapshotInterval保存一次快照，直到snapshotStop被关闭。
+func (mem *memory) snapshotLoop() {
+	ticker := time.NewTicker(mem.snapshotInterval)
+	defer func() {
+		ticker.Stop()
+		close(mem.snapshotDone)
+	}()
+
+	for {
+		select {
+		case <-mem.snapshotStop:
+			return
+		case <-ticker.C:
+			if err := mem.saveSnapshot(); err != nil {
+				mem.log.Println(err.Error())
+			}
+		}
+	}
+}
+
+// 返回sessID所在的分片，使用FNV-1a计算哈希值。
+func (mem *memory) shard(sessID string) *memShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(sessID); i++ {
+		h ^= uint32(sessID[i])
+		h *= 16777619
+	}
+	return mem.shards[h&mem.mask]
+}
+
+// 返回当前的统计信息。
+func (mem *memory) Stats() MemoryStats {
+	stats := MemoryStats{}
+	for _, shard := range mem.shards {
+		shard.Lock()
+		stats.Entries += len(shard.items)
+		stats.Bytes += shard.bytes
+		stats.Evictions += shard.evictions
+		shard.Unlock()
+	}
+	return stats
+}
+
+// 添加或是替换一个session，返回因超出限制而被淘汰的session。
+//
+// 新添加的session本身不会被淘汰，即使其大小已经超过了MaxBytes。
+// 调用者需要持有分片的锁。
+func (shard *memShard) put(item *memSession) (evicted []*memSession) {
+	if old, found := shard.items[item.id]; found {
+		shard.remove(old)
+	}
+
+	if shard.evict != nil {
+		if shard.maxBytes > 0 {
+			item.size = int64(len(item.id)) + memEntryOverhead + estimateSize(item.items)
+		}
+
+		for len(shard.items) > 0 &&
+			((shard.maxEntries > 0 && len(shard.items) >= shard.maxEntries) ||
+				(shard.maxBytes > 0 && shard.bytes+item.size > shard.maxBytes)) {
+			victim := shard.evict.victim()
+			shard.remove(victim)
+			shard.evictions++
+			evicted = append(evicted, victim)
+		}
+
+		shard.bytes += item.size
+		shard.evict.add(item)
+	}
+
+	shard.items[item.id] = item
+	shard.expires.Schedule(item.id, item.accessed.Add(shard.lifetime))
+	return evicted
+}
+
+// 删除一个session，调用者需要持有分片的锁。
+func (shard *memShard) remove(item *memSession) {
+	delete(shard.items, item.id)
+	shard.expires.Cancel(item.id)
+	if shard.evict != nil {
+		shard.evict.remove(item)
+		shard.bytes -= item.size
+	}
+}
+
+// 删除分片中所有在now之前过期的session，只需要处理已经过期的部分。
+func (shard *memShard) gc(now time.Time) (removed int) {
+	shard.Lock()
+	defer shard.Unlock()
+
+	for _, id := range shard.expires.Expired(now, 0) {
+		if item, found := shard.items[id]; found {
+			shard.remove(item)
+			removed++
+		}
+	}
+	return removed
+}
+
+// 清除分片中的所有数据，之后的分片不能再使用。
+func (shard *memShard) close() {
+	shard.Lock()
+	defer shard.Unlock()
+
+	shard.items = nil
+	shard.expires.Reset()
+	shard.bytes = 0
+	if shard.evict != nil {
+		shard.evict.reset()
+	}
+}
+
+// 在锁之外调用OnEvict
+func (mem *memory) notifyEvicted(evicted []*memSession) {
+	if mem.onEvict == nil {
+		return
+	}
+
+	for _, item := range evicted {
+		mem.onEvict(item.id, item.items)
 	}
 }
 
 // session.Store.Delete()
 func (mem *memory) Delete(sessID string) error {
-	mem.Lock()
-	defer mem.Unlock()
+	shard := mem.shard(sessID)
+	shard.Lock()
+	defer shard.Unlock()
 
-	delete(mem.items, sessID)
+	if item, found := shard.items[sessID]; found {
+		shard.remove(item)
+	}
 	return nil
 }
 
 // session.Store.Get()
+//
+// 返回的是数据的副本，修改返回值不会影响存储器中的数据。
 func (mem *memory) Get(sessID string) (map[interface{}]interface{}, error) {
-	mem.Lock()
-	defer mem.Unlock()
+	shard := mem.shard(sessID)
+	shard.Lock()
+	item, found := shard.items[sessID]
+	if found && time.Since(item.accessed) >= shard.lifetime { // 已经过期，但还未被GC回收
+		found = false
+	}
+	if found && shard.evict != nil {
+		shard.evict.access(item)
+	}
+	shard.Unlock()
 
-	if item, found := mem.items[sessID]; found {
-		return item.items, nil
+	if !found {
+		return make(map[interface{}]interface{}, 0), nil
 	}
 
-	return make(map[interface{}]interface{}, 0), nil
+	// 保存之后的数据不会再被修改，可以在锁之外复制。
+	return mem.copy(item.items)
 }
 
 // session.Store.Save()
+//
+// 保存的是items的副本，之后再修改items不会影响存储器中的数据。
 func (mem *memory) Save(sessID string, items map[interface{}]interface{}) error {
-	mem.Lock()
-	defer mem.Unlock()
+	items, err := mem.copy(items)
+	if err != nil {
+		return err
+	}
 
-	mem.items[sessID] = &memSession{
+	item := &memSession{
+		id:       sessID,
 		accessed: time.Now(),
 		items:    items,
 	}
+
+	shard := mem.shard(sessID)
+	shard.Lock()
+	if old, found := shard.items[sessID]; found {
+		// 保留之前的访问频率，否则LFU会淘汰所有刚更新过的session
+		item.freq = old.freq
+	}
+	evicted := shard.put(item)
+	shard.Unlock()
+
+	mem.notifyEvicted(evicted)
 	return nil
 }
 
-// session.Store.StartGC()
-func (mem *memory) StartGC() {
-	gc := func() {
-		d := time.Now().Add(-mem.lifetime)
-
-		for k, v := range mem.items {
-			if v.accessed.Before(d) { // v.accessed < (time.Now() - maxAge)
-				delete(mem.items, k)
-			}
+// 依次对每个分片执行GC，同一时间只锁定一个分片。
+//
+// 每次GC只处理已经过期的session，而不会遍历所有的数据。
+func (mem *memory) gc(ctx context.Context) (int, error) {
+	now := time.Now()
+	removed := 0
+	for _, shard := range mem.shards {
+		if err := ctx.Err(); err != nil {
+			return removed, err
 		}
+		removed += shard.gc(now)
 	}
+	return removed, nil
+}
 
-	mem.ticker = time.NewTicker(mem.lifetime)
-	go func() {
-		for range mem.ticker.C {
-			gc()
-		}
-	}()
+// 是否已经关闭
+func (mem *memory) closed() bool {
+	shard := mem.shards[0]
+	shard.Lock()
+	defer shard.Unlock()
+	return shard.items == nil
 }
 
 // session.Store.Close()
+//
+// 若指定了快照文件，会在清除数据之前将其写入快照。
 func (mem *memory) Close() error {
-	if mem.ticker != nil {
-		mem.ticker.Stop()
+	if mem.closed() { // 重复关闭时，不能以空数据覆盖快照
+		return nil
 	}
 
-	mem.items = nil
-	return nil
+	mem.stopGC()
+
+	var err error
+	if len(mem.snapshot) > 0 {
+		// 等待定时保存的goroutine退出，之后的快照只能由Close()写入。
+		mem.snapshotOnce.Do(func() {
+			if mem.snapshotStop != nil {
+				close(mem.snapshotStop)
+				<-mem.snapshotDone
+			}
+		})
+		err = mem.saveSnapshot()
+	}
+
+	for _, shard := range mem.shards {
+		shard.close()
+	}
+	return err
 }
@@ -0,0 +1,138 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"reflect"
+
+	"github.com/issue9/session/types"
+)
+
+// 返回通过codec编码再解码的方式复制数据的函数。
+func codecCopier(codec types.Codec) func(map[interface{}]interface{}) (map[interface{}]interface{}, error) {
+	return func(items map[interface{}]interface{}) (map[interface{}]interface{}, error) {
+		data, err := codec.Encode(items)
+		if err != nil {
+			return nil, err
+		}
+		return codec.Decode(data)
+	}
+}
+
+// 通过反射对session数据进行深复制。
+//
+// map、slice、数组、指针、接口以及结构体的导出字段都会被递归复制，
+// 同一个指针或map在复制之后依然指向同一个对象，循环引用也会被保留。
+// 结构体的非导出字段、chan和func无法复制，复制之后与原来的值共享。
+func deepCopy(items map[interface{}]interface{}) (map[interface{}]interface{}, error) {
+	if items == nil {
+		return make(map[interface{}]interface{}, 0), nil
+	}
+
+	c := &copier{visited: map[copyKey]reflect.Value{}}
+	return c.copy(reflect.ValueOf(items)).Interface().(map[interface{}]interface{}), nil
+}
+
+// 已经复制过的引用类型，用于处理循环引用。
+type copyKey struct {
+	typ reflect.Type
+	ptr uintptr
+}
+
+type copier struct {
+	visited map[copyKey]reflect.Value
+}
+
+func (c *copier) copy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		key := copyKey{typ: v.Type(), ptr: v.Pointer()}
+		if dst, found := c.visited[key]; found {
+			return dst
+		}
+
+		dst := reflect.MakeMapWithSize(v.Type(), v.Len())
+		c.visited[key] = dst
+		iter := v.MapRange()
+		for iter.Next() {
+			dst.SetMapIndex(c.copy(iter.Key()), c.copy(iter.Value()))
+		}
+		return dst
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		key := copyKey{typ: v.Type(), ptr: v.Pointer()}
+		if dst, found := c.visited[key]; found && dst.Len() == v.Len() {
+			return dst
+		}
+
+		dst := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		c.visited[key] = dst
+		if !needCopy(v.Type().Elem()) {
+			reflect.Copy(dst, v)
+			return dst
+		}
+		for i := 0; i < v.Len(); i++ {
+			dst.Index(i).Set(c.copy(v.Index(i)))
+		}
+		return dst
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		key := copyKey{typ: v.Type(), ptr: v.Pointer()}
+		if dst, found := c.visited[key]; found {
+			return dst
+		}
+
+		dst := reflect.New(v.Type().Elem())
+		c.visited[key] = dst
+		dst.Elem().Set(c.copy(v.Elem()))
+		return dst
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		dst := reflect.New(v.Type()).Elem()
+		dst.Set(c.copy(v.Elem()))
+		return dst
+	case reflect.Array:
+		if !needCopy(v.Type().Elem()) {
+			return v
+		}
+		dst := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			dst.Index(i).Set(c.copy(v.Index(i)))
+		}
+		return dst
+	case reflect.Struct:
+		dst := reflect.New(v.Type()).Elem()
+		dst.Set(v) // 非导出字段只能整体复制
+		for i := 0; i < v.NumField(); i++ {
+			if f := dst.Field(i); f.CanSet() && needCopy(f.Type()) {
+				f.Set(c.copy(v.Field(i)))
+			}
+		}
+		return dst
+	default: // 基本类型、chan和func
+		return v
+	}
+}
+
+// 类型t的值是否包含需要复制的引用
+func needCopy(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Ptr, reflect.Interface, reflect.Struct:
+		return true
+	case reflect.Array:
+		return needCopy(t.Elem())
+	default:
+		return false
+	}
+}
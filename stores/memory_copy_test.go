@@ -0,0 +1,108 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"testing"
+
+	"github.com/issue9/assert"
+	"github.com/issue9/session/codecs"
+)
+
+type copyUser struct {
+	Name   string
+	Roles  []string
+	Attrs  map[string]interface{}
+	Parent *copyUser
+	secret *int
+}
+
+func TestDeepCopy(t *testing.T) {
+	a := assert.New(t)
+
+	secret := 5
+	parent := &copyUser{Name: "parent"}
+	user := &copyUser{
+		Name:   "user",
+		Roles:  []string{"admin"},
+		Attrs:  map[string]interface{}{"tags": []int{1, 2}},
+		Parent: parent,
+		secret: &secret,
+	}
+	parent.Parent = parent // 循环引用
+
+	src := map[interface{}]interface{}{
+		"int":   1,
+		"bytes": []byte("bytes"),
+		"user":  user,
+		"same":  user,
+		"array": [2][]int{{1}, {2}},
+		"nil":   nil,
+	}
+
+	dst, err := deepCopy(src)
+	a.NotError(err).Equal(dst, src)
+
+	u := dst["user"].(*copyUser)
+	a.True(u != user)
+	a.True(u == dst["same"].(*copyUser)) // 同一个指针复制之后依然相同
+	a.True(u.Parent != parent).True(u.Parent.Parent == u.Parent)
+	a.True(u.secret == user.secret) // 非导出字段与原来的值共享
+
+	// 修改副本不影响原来的数据
+	u.Roles[0] = "guest"
+	u.Attrs["tags"].([]int)[0] = 100
+	dst["bytes"].([]byte)[0] = 'B'
+	dst["array"].([2][]int)[0][0] = 100
+	a.Equal(user.Roles, []string{"admin"})
+	a.Equal(user.Attrs["tags"], []int{1, 2})
+	a.Equal(src["bytes"], []byte("bytes"))
+	a.Equal(src["array"], [2][]int{{1}, {2}})
+
+	dst, err = deepCopy(nil)
+	a.NotError(err).NotNil(dst).Equal(len(dst), 0)
+}
+
+// 同一个sessionid的多个Session实例不会共享数据
+func TestMemory_Isolation(t *testing.T) {
+	a := assert.New(t)
+
+	test := func(store *memory) {
+		items := map[interface{}]interface{}{"list": []string{"1"}}
+		a.NotError(store.Save("id", items))
+		items["list"].([]string)[0] = "changed"
+		items["new"] = 1
+
+		sess1, err := store.Get("id")
+		a.NotError(err)
+		sess2, err := store.Get("id")
+		a.NotError(err)
+		a.Equal(sess1, map[interface{}]interface{}{"list": []string{"1"}})
+
+		sess1["list"].([]string)[0] = "sess1"
+		sess1["sess1"] = true
+		a.Equal(sess2, map[interface{}]interface{}{"list": []string{"1"}})
+
+		mapped, err := store.Get("id")
+		a.NotError(err)
+		a.Equal(mapped, map[interface{}]interface{}{"list": []string{"1"}})
+	}
+
+	test(NewMemory(10))
+
+	store, err := NewMemoryWithOptions(&MemoryOptions{Lifetime: 10, CopyCodec: codecs.NewGob()})
+	a.NotError(err)
+	test(store)
+
+	// 通过JSON复制之后，整数都变成了int64，与stores.file相同。
+	store, err = NewMemoryWithOptions(&MemoryOptions{Lifetime: 10, CopyCodec: codecs.NewJSON()})
+	a.NotError(err)
+	a.Error(store.Save("id", map[interface{}]interface{}{"num": 1, "ch": make(chan int)}))
+	a.NotError(store.Save("id", map[interface{}]interface{}{"num": 1}))
+	mapped, err := store.Get("id")
+	a.NotError(err)
+	_, ok := mapped["num"].(int64)
+	a.True(ok)
+}
@@ -0,0 +1,197 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"container/heap"
+	"container/list"
+	"errors"
+	"reflect"
+)
+
+// EvictionPolicy 表示内存存储器超出限制时淘汰session的策略。
+type EvictionPolicy int
+
+// 可用的淘汰策略
+const (
+	EvictLRU EvictionPolicy = iota // 淘汰最久未被访问的session
+	EvictLFU                       // 淘汰访问次数最少的session，次数相同时淘汰最久未被访问的
+)
+
+// 每个session除数据之外的固定开销的估算值
+const memEntryOverhead = 64
+
+// 估算大小时最多深入的层次，避免循环引用导致的无限递归。
+const maxEstimateDepth = 16
+
+// 淘汰策略的接口，所有方法都在存储器的锁之内调用。
+type evictor interface {
+	add(item *memSession)    // 添加一个session
+	access(item *memSession) // 访问了一个session
+	remove(item *memSession) // 删除一个session
+	victim() *memSession     // 返回下一个应该被淘汰的session
+	reset()                  // 清除所有的记录
+}
+
+func newEvictor(policy EvictionPolicy) (evictor, error) {
+	switch policy {
+	case EvictLRU:
+		return &lru{l: list.New()}, nil
+	case EvictLFU:
+		return &lfu{}, nil
+	default:
+		return nil, errors.New("无效的 Eviction 值")
+	}
+}
+
+// 以双向链表实现的LRU，链表头部为最近访问的session。
+type lru struct {
+	l *list.List
+}
+
+func (e *lru) add(item *memSession) {
+	item.elem = e.l.PushFront(item)
+}
+
+func (e *lru) access(item *memSession) {
+	e.l.MoveToFront(item.elem)
+}
+
+func (e *lru) remove(item *memSession) {
+	e.l.Remove(item.elem)
+	item.elem = nil
+}
+
+func (e *lru) victim() *memSession {
+	return e.l.Back().Value.(*memSession)
+}
+
+func (e *lru) reset() {
+	e.l.Init()
+}
+
+// 以最小堆实现的LFU，堆顶为访问次数最少的session。
+type lfu struct {
+	items lfuHeap
+	tick  uint64 // 每次访问递增，用于在访问次数相同时比较访问的先后
+}
+
+type lfuHeap []*memSession
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	item := x.(*memSession)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	item.index = -1
+	return item
+}
+
+func (e *lfu) add(item *memSession) {
+	e.tick++
+	item.freq++
+	item.tick = e.tick
+	heap.Push(&e.items, item)
+}
+
+func (e *lfu) access(item *memSession) {
+	e.tick++
+	item.freq++
+	item.tick = e.tick
+	heap.Fix(&e.items, item.index)
+}
+
+func (e *lfu) remove(item *memSession) {
+	heap.Remove(&e.items, item.index)
+}
+
+func (e *lfu) victim() *memSession {
+	return e.items[0]
+}
+
+func (e *lfu) reset() {
+	e.items = nil
+	e.tick = 0
+}
+
+// 估算session数据占用的字节数。
+func estimateSize(items map[interface{}]interface{}) int64 {
+	return estimateValue(reflect.ValueOf(items), 0)
+}
+
+func estimateValue(v reflect.Value, depth int) int64 {
+	if !v.IsValid() {
+		return 0
+	}
+	if depth >= maxEstimateDepth {
+		return 8
+	}
+	depth++
+
+	switch v.Kind() {
+	case reflect.String:
+		return int64(v.Type().Size()) + int64(v.Len())
+	case reflect.Slice:
+		size := int64(v.Type().Size())
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return size + int64(v.Len())
+		}
+		for i := 0; i < v.Len(); i++ {
+			size += estimateValue(v.Index(i), depth)
+		}
+		return size
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return int64(v.Len())
+		}
+		var size int64
+		for i := 0; i < v.Len(); i++ {
+			size += estimateValue(v.Index(i), depth)
+		}
+		return size
+	case reflect.Map:
+		size := int64(v.Type().Size())
+		iter := v.MapRange()
+		for iter.Next() {
+			size += estimateValue(iter.Key(), depth) + estimateValue(iter.Value(), depth)
+		}
+		return size
+	case reflect.Ptr, reflect.Interface:
+		size := int64(v.Type().Size())
+		if !v.IsNil() {
+			size += estimateValue(v.Elem(), depth)
+		}
+		return size
+	case reflect.Struct:
+		var size int64
+		for i := 0; i < v.NumField(); i++ {
+			size += estimateValue(v.Field(i), depth)
+		}
+		return size
+	default:
+		return int64(v.Type().Size())
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/issue9/assert"
+)
+
+func TestMemory_EvictLRU(t *testing.T) {
+	a := assert.New(t)
+
+	evicted := []string{}
+	store, err := NewMemoryWithOptions(&MemoryOptions{
+		Lifetime:   100,
+		Shards:     1,
+		MaxEntries: 2,
+		OnEvict: func(sessID string, items map[interface{}]interface{}) {
+			evicted = append(evicted, sessID)
+		},
+	})
+	a.NotError(err).NotNil(store)
+
+	a.NotError(store.Save("id1", testData1))
+	a.NotError(store.Save("id2", testData2))
+	_, err = store.Get("id1") // id2成为最久未访问的
+	a.NotError(err)
+	a.NotError(store.Save("id3", testData1))
+	a.Equal(evicted, []string{"id2"})
+
+	mapped, err := store.Get("id2")
+	a.NotError(err).Equal(0, len(mapped))
+	mapped, err = store.Get("id1")
+	a.NotError(err).Equal(mapped, testData1)
+
+	// 替换已有的数据不会淘汰其它session
+	a.NotError(store.Save("id3", testData2))
+	a.Equal(evicted, []string{"id2"})
+
+	a.NotError(store.Delete("id1"))
+	a.NotError(store.Save("id4", testData1))
+	a.Equal(evicted, []string{"id2"})
+
+	stats := store.Stats()
+	a.Equal(stats.Entries, 2).Equal(stats.Evictions, 1)
+}
+
+func TestMemory_EvictLFU(t *testing.T) {
+	a := assert.New(t)
+
+	store, err := NewMemoryWithOptions(&MemoryOptions{
+		Lifetime:   100,
+		Shards:     1,
+		MaxEntries: 3,
+		Eviction:   EvictLFU,
+	})
+	a.NotError(err).NotNil(store)
+
+	a.NotError(store.Save("id1", testData1))
+	a.NotError(store.Save("id2", testData1))
+	a.NotError(store.Save("id3", testData1))
+	for i := 0; i < 3; i++ {
+		_, err = store.Get("id1")
+		a.NotError(err)
+		_, err = store.Get("id3")
+		a.NotError(err)
+	}
+	a.NotError(store.Save("id2", testData2)) // 更新之后依然保留之前的访问次数
+	_, err = store.Get("id2")
+	a.NotError(err)
+
+	// id2的访问次数最少
+	a.NotError(store.Save("id4", testData1))
+	a.Nil(memItem(store, "id2"))
+
+	// 访问次数相同时，淘汰最久未访问的
+	a.NotError(store.Save("id5", testData1))
+	a.Nil(memItem(store, "id4"))
+	a.Equal(store.Stats().Entries, 3)
+	a.Equal(store.Stats().Evictions, 2)
+
+	_, err = NewMemoryWithOptions(&MemoryOptions{Lifetime: 100, MaxEntries: 3, Eviction: 100})
+	a.Error(err)
+}
+
+func TestMemory_MaxBytes(t *testing.T) {
+	a := assert.New(t)
+
+	large := map[interface{}]interface{}{"data": strings.Repeat("x", 1000)}
+	size := memEntryOverhead + 3 + estimateSize(large)
+
+	store, err := NewMemoryWithOptions(&MemoryOptions{
+		Lifetime: 100,
+		Shards:   1,
+		MaxBytes: 3 * size,
+	})
+	a.NotError(err).NotNil(store)
+
+	for i := 0; i < 10; i++ {
+		a.NotError(store.Save("id"+strconv.Itoa(i), large))
+	}
+	stats := store.Stats()
+	a.Equal(stats.Entries, 3).Equal(stats.Evictions, 7)
+	a.Equal(stats.Bytes, 3*size)
+
+	a.NotError(store.Delete("id9"))
+	a.Equal(store.Stats().Bytes, 2*size)
+
+	a.NotError(store.Close())
+	a.Equal(store.Stats().Bytes, 0)
+
+	_, err = NewMemoryWithOptions(&MemoryOptions{Lifetime: 100, MaxBytes: -1})
+	a.Error(err)
+}
+
+func TestEstimateSize(t *testing.T) {
+	a := assert.New(t)
+
+	small := estimateSize(map[interface{}]interface{}{"k": 1})
+	large := estimateSize(map[interface{}]interface{}{"k": strings.Repeat("x", 1000)})
+	a.True(large-small >= 1000)
+
+	type node struct {
+		Name string
+		Next *node
+		data []byte
+	}
+	n := &node{Name: "n", data: make([]byte, 500)}
+	n.Next = n // 循环引用
+	a.True(estimateSize(map[interface{}]interface{}{"node": n}) >= 500)
+}
@@ -0,0 +1,188 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/issue9/session/types"
+)
+
+// 快照文件的格式：
+//
+// 文件头为 snapshotMagic + 记录数量(4字节)，
+// 之后为各条记录，每条记录为
+// id长度(2字节) + id + 最后访问时间(8字节，纳秒) + 数据长度(4字节) + 数据，
+// 其中数据为经过codec编码之后的内容。
+// 文件的最后4个字节为之前所有内容的crc32校验值。
+const snapshotMagic = "SESSMEM1"
+
+// 快照中id的长度以2字节保存
+const snapshotMaxIDLen = 1<<16 - 1
+
+var errSnapshotInvalid = errors.New("无效的快照文件")
+
+// 将所有未过期的session写入快照文件。
+//
+// 先写入临时文件，再替换原有的文件，
+// 所以在写入过程中崩溃，也不会破坏之前的快照。
+func (mem *memory) saveSnapshot() error {
+	mem.snapshotMu.Lock()
+	defer mem.snapshotMu.Unlock()
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(snapshotMagic)
+	buf.Write(make([]byte, 4)) // 记录数量，最后再填充
+
+	if mem.closed() {
+		return nil
+	}
+
+	deadline := time.Now().Add(-mem.lifetime)
+	var count uint32
+	for _, shard := range mem.shards {
+		n, err := shard.writeSnapshot(buf, mem.codec, mem.log, deadline)
+		if err != nil {
+			return err
+		}
+		count += n
+	}
+
+	bs := buf.Bytes()
+	binary.BigEndian.PutUint32(bs[len(snapshotMagic):], count)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(bs))
+	buf.Write(sum[:])
+
+	tmp := mem.snapshot + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf.Bytes()); err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err = os.Rename(tmp, mem.snapshot); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(mem.snapshot))
+	return nil
+}
+
+// 将分片中在deadline之后访问过的session写入buf，返回写入的数量。
+//
+// id的长度超过snapshotMaxIDLen时返回错误，而不是忽略该session；
+// 无法编码的session则只记录到l中，不影响其它session的写入。
+func (shard *memShard) writeSnapshot(buf *bytes.Buffer, codec types.Codec, l *log.Logger, deadline time.Time) (uint32, error) {
+	shard.Lock()
+	defer shard.Unlock()
+
+	var count uint32
+	for id, item := range shard.items {
+		if item.accessed.Before(deadline) {
+			continue
+		}
+		if len(id) > snapshotMaxIDLen {
+			return 0, fmt.Errorf("sessionid 的长度 %d 超过了快照允许的最大值 %d", len(id), snapshotMaxIDLen)
+		}
+
+		data, err := codec.Encode(item.items)
+		if err != nil {
+			l.Printf("无法编码 %s 的数据，未写入快照：%v\n", id, err)
+			continue
+		}
+
+		var header [8]byte
+		binary.BigEndian.PutUint16(header[:2], uint16(len(id)))
+		buf.Write(header[:2])
+		buf.WriteString(id)
+		binary.BigEndian.PutUint64(header[:], uint64(item.accessed.UnixNano()))
+		buf.Write(header[:])
+		binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+		buf.Write(header[:4])
+		buf.Write(data)
+		count++
+	}
+
+	return count, nil
+}
+
+// 从快照文件中恢复session，已经过期的会被忽略。
+func (mem *memory) loadSnapshot() error {
+	bs, err := ioutil.ReadFile(mem.snapshot)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if len(bs) < len(snapshotMagic)+4+4 || string(bs[:len(snapshotMagic)]) != snapshotMagic {
+		return errSnapshotInvalid
+	}
+	sum := binary.BigEndian.Uint32(bs[len(bs)-4:])
+	bs = bs[:len(bs)-4]
+	if crc32.ChecksumIEEE(bs) != sum {
+		return errSnapshotInvalid
+	}
+
+	count := binary.BigEndian.Uint32(bs[len(snapshotMagic):])
+	bs = bs[len(snapshotMagic)+4:]
+	d := time.Now().Add(-mem.lifetime)
+	var evicted []*memSession
+
+	for i := uint32(0); i < count; i++ {
+		if len(bs) < 2 {
+			return errSnapshotInvalid
+		}
+		idLen := int(binary.BigEndian.Uint16(bs))
+		if len(bs) < 2+idLen+8+4 {
+			return errSnapshotInvalid
+		}
+		id := string(bs[2 : 2+idLen])
+		bs = bs[2+idLen:]
+		accessed := time.Unix(0, int64(binary.BigEndian.Uint64(bs)))
+		dataLen := int(binary.BigEndian.Uint32(bs[8:]))
+		bs = bs[12:]
+		if len(bs) < dataLen {
+			return errSnapshotInvalid
+		}
+		data := bs[:dataLen]
+		bs = bs[dataLen:]
+
+		if accessed.Before(d) { // 在停止期间已经过期
+			continue
+		}
+
+		items, err := mem.codec.Decode(data)
+		if err != nil {
+			return err
+		}
+		shard := mem.shard(id)
+		shard.Lock()
+		evicted = append(evicted, shard.put(&memSession{id: id, accessed: accessed, items: items})...)
+		shard.Unlock()
+	}
+
+	mem.notifyEvicted(evicted)
+	return nil
+}
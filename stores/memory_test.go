@@ -5,6 +5,14 @@
 package stores
 
 import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -27,6 +35,11 @@ var (
 	}
 )
 
+// 返回sessID对应的数据，不存在时返回nil。
+func memItem(mem *memory, sessID string) *memSession {
+	return mem.shard(sessID).items[sessID]
+}
+
 func TestMemory(t *testing.T) {
 	a := assert.New(t)
 
@@ -35,20 +48,20 @@ func TestMemory(t *testing.T) {
 
 	// 添加一个数据
 	a.NotError(store.Save("testData1", testData1))
-	a.Equal(1, len(store.items))
+	a.Equal(1, store.Stats().Entries)
 
 	// Delete,删除一个不存在的数据，不应该发生错误
 	a.NotError(store.Delete("non"))
 
 	// Delete,删除添加的数据
 	a.NotError(store.Delete("testData1"))
-	a.Equal(0, len(store.items))
+	a.Equal(0, store.Stats().Entries)
 
 	// 添加两条数据
 	a.NotError(store.Save("testData1", testData1))
-	a.Equal(1, len(store.items))
+	a.Equal(1, store.Stats().Entries)
 	a.NotError(store.Save("testData2", testData2))
-	a.Equal(2, len(store.items))
+	a.Equal(2, store.Stats().Entries)
 
 	// 测试正常状态的Get
 	mapped, err := store.Get("testData1")
@@ -62,9 +75,9 @@ func TestMemory(t *testing.T) {
 	// Free
 	a.NotError(store.Save("testData1", testData1))
 	a.NotError(store.Save("testData2", testData2))
-	a.Equal(2, len(store.items))
+	a.Equal(2, store.Stats().Entries)
 	a.NotError(store.Close())
-	a.Equal(0, len(store.items))
+	a.Equal(0, store.Stats().Entries)
 }
 
 func TestMemory_StartGC(t *testing.T) {
@@ -77,14 +90,341 @@ func TestMemory_StartGC(t *testing.T) {
 	// 添加两条数据
 	a.NotError(store.Save("testData1", testData1))
 	a.NotError(store.Save("testData2", testData2))
-	a.Equal(2, len(store.items))
+	a.Equal(2, store.Stats().Entries)
 
 	store.StartGC()
-	a.Equal(2, len(store.items))
+	a.Equal(2, store.Stats().Entries)
 	time.Sleep(time.Second) // 延时1秒，数据还在
-	a.Equal(2, len(store.items))
-	time.Sleep(time.Second) // 再延时1秒，数据应该没了
-	a.Equal(0, len(store.items))
+	a.Equal(2, store.Stats().Entries)
+	time.Sleep(1500 * time.Millisecond) // 第2秒时过期，GC的间隔与lifetime无关
+	a.Equal(0, store.Stats().Entries)
+
+	a.NotError(store.Close())
+}
+
+// 已经过期但还未被GC回收的数据
+func TestMemory_Expired(t *testing.T) {
+	a := assert.New(t)
+
+	store := NewMemory(100)
+	a.NotError(store.Save("testData1", testData1))
+	a.NotError(store.Save("testData2", testData2))
+	memItem(store, "testData1").accessed = time.Now().Add(-time.Hour)
+
+	mapped, err := store.Get("testData1")
+	a.NotError(err).Equal(0, len(mapped))
+	a.Equal(2, store.Stats().Entries)
+
+	// GC只处理过期队列中到期的部分
+	removed, err := store.GC(context.Background())
+	a.NotError(err).Equal(removed, 0)
+	a.Equal(2, store.Stats().Entries)
+	shard := store.shard("testData1")
+	shard.expires.Schedule("testData1", time.Now())
+	removed, err = store.GC(context.Background())
+	a.NotError(err).Equal(removed, 1)
+	a.Equal(1, store.Stats().Entries)
+	a.Nil(memItem(store, "testData1"))
+
+	a.NotError(store.Delete("testData2"))
+	a.Equal(0, store.shard("testData2").expires.Len())
+}
+
+func TestMemory_Snapshot(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "session")
+	a.NotError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "memory.snapshot")
+
+	store, err := NewMemoryWithOptions(nil)
+	a.Error(err).Nil(store)
+
+	store, err = NewMemoryWithOptions(&MemoryOptions{Snapshot: path})
+	a.Error(err).Nil(store)
+
+	// 快照文件不存在
+	store, err = NewMemoryWithOptions(&MemoryOptions{Lifetime: 100, Snapshot: path})
+	a.NotError(err).NotNil(store)
+	a.Equal(0, store.Stats().Entries)
+
+	a.NotError(store.Save("testData1", testData1))
+	a.NotError(store.Save("testData2", testData2))
+	a.NotError(store.Save("expired", testData2))
+	memItem(store, "expired").accessed = time.Now().Add(-time.Hour)
+	a.NotError(store.Close())
+	a.NotError(store.Close()) // 重复关闭不会覆盖快照
+	_, err = os.Stat(path + ".tmp")
+	a.True(os.IsNotExist(err))
+
+	store, err = NewMemoryWithOptions(&MemoryOptions{Lifetime: 100, Snapshot: path})
+	a.NotError(err).NotNil(store)
+	a.Equal(2, store.Stats().Entries)
+	mapped, err := store.Get("testData1")
+	a.NotError(err).Equal(mapped, testData1)
+	mapped, err = store.Get("testData2")
+	a.NotError(err).Equal(mapped, testData2)
+
+	// 停止期间过期的数据
+	memItem(store, "testData1").accessed = time.Now().Add(-90 * time.Second)
+	a.NotError(store.Close())
+	store, err = NewMemoryWithOptions(&MemoryOptions{Lifetime: 60, Snapshot: path})
+	a.NotError(err).NotNil(store)
+	a.Equal(1, store.Stats().Entries)
+	mapped, err = store.Get("testData1")
+	a.NotError(err).Equal(0, len(mapped))
+	a.NotError(store.Close())
+
+	// 损坏的快照文件
+	bs, err := ioutil.ReadFile(path)
+	a.NotError(err)
+	bs[len(bs)-5]++
+	a.NotError(ioutil.WriteFile(path, bs, 0600))
+	store, err = NewMemoryWithOptions(&MemoryOptions{Lifetime: 60, Snapshot: path})
+	a.Equal(err, errSnapshotInvalid).Nil(store)
+}
+
+func TestMemory_SnapshotInterval(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "session")
+	a.NotError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "memory.snapshot")
+
+	store, err := NewMemoryWithOptions(&MemoryOptions{
+		Lifetime:         100,
+		Snapshot:         path,
+		SnapshotInterval: 1,
+	})
+	a.NotError(err).NotNil(store)
+	a.NotError(store.Save("testData1", testData1))
+
+	time.Sleep(1500 * time.Millisecond)
+	_, err = os.Stat(path)
+	a.NotError(err)
+
+	// 模拟进程崩溃，直接从定期保存的快照中恢复
+	store2, err := NewMemoryWithOptions(&MemoryOptions{Lifetime: 100, Snapshot: path + ".copy"})
+	a.NotError(err)
+	store2.snapshot = path
+	a.NotError(store2.loadSnapshot())
+	mapped, err := store2.Get("testData1")
+	a.NotError(err).Equal(mapped, testData1)
+
+	// 与定时保存同时进行的保存，不会相互破坏临时文件
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			errs <- store.saveSnapshot()
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		a.NotError(<-errs)
+	}
+
+	// Close()会等待定时保存的goroutine退出
+	a.NotError(store.Close())
+	select {
+	case <-store.snapshotDone:
+	default:
+		t.Error("定时保存快照的goroutine未退出")
+	}
+	a.NotError(store.Close())
+	a.NotError(store2.Close())
+}
+
+func TestMemory_SnapshotIDLen(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "session")
+	a.NotError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "memory.snapshot")
+
+	store, err := NewMemoryWithOptions(&MemoryOptions{Lifetime: 100, Snapshot: path})
+	a.NotError(err)
+	a.NotError(store.Save(strings.Repeat("a", snapshotMaxIDLen), testData1))
+	a.NotError(store.saveSnapshot())
+
+	// 超过快照格式允许的长度，返回错误而不是忽略
+	a.NotError(store.Save(strings.Repeat("a", snapshotMaxIDLen+1), testData1))
+	a.Error(store.saveSnapshot())
+	a.Error(store.Close())
+}
 
+// 无法编码的session被忽略，不影响其它session写入快照。
+func TestMemory_SnapshotEncodeError(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "session")
+	a.NotError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "memory.snapshot")
+
+	logBuf := new(bytes.Buffer)
+	store, err := NewMemoryWithOptions(&MemoryOptions{Lifetime: 100, Snapshot: path, Log: log.New(logBuf, "", 0)})
+	a.NotError(err)
+	a.NotError(store.Save("testData1", testData1))
+	a.NotError(store.Save("chan", map[interface{}]interface{}{"ch": make(chan int)}))
 	a.NotError(store.Close())
+	a.True(strings.Contains(logBuf.String(), "chan"), logBuf.String())
+
+	store, err = NewMemoryWithOptions(&MemoryOptions{Lifetime: 100, Snapshot: path})
+	a.NotError(err)
+	mapped, err := store.Get("testData1")
+	a.NotError(err).Equal(mapped, testData1)
+	mapped, err = store.Get("chan")
+	a.NotError(err).Equal(len(mapped), 0)
+	a.NotError(store.Close())
+}
+
+func TestMemory_Shards(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal(len(NewMemory(10).shards), memDefaultShards)
+
+	store, err := NewMemoryWithOptions(&MemoryOptions{Lifetime: 10, Shards: 5})
+	a.NotError(err)
+	a.Equal(len(store.shards), 8).Equal(store.mask, 7)
+
+	_, err = NewMemoryWithOptions(&MemoryOptions{Lifetime: 10, Shards: -1})
+	a.Error(err)
+
+	// 数据分散到各个分片
+	for i := 0; i < 100; i++ {
+		a.NotError(store.Save("id"+strconv.Itoa(i), testData1))
+	}
+	for _, shard := range store.shards {
+		a.True(len(shard.items) > 0)
+	}
+	a.Equal(store.Stats().Entries, 100)
+
+	// 上限平均分配到各个分片
+	store, err = NewMemoryWithOptions(&MemoryOptions{Lifetime: 10, Shards: 4, MaxEntries: 10})
+	a.NotError(err)
+	for i, shard := range store.shards {
+		if i < 2 {
+			a.Equal(shard.maxEntries, 3)
+		} else {
+			a.Equal(shard.maxEntries, 2)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		a.NotError(store.Save("id"+strconv.Itoa(i), testData1))
+	}
+	a.True(store.Stats().Entries <= 10)
+}
+
+func TestMemory_MaxEntries(t *testing.T) {
+	a := assert.New(t)
+
+	// 默认的分片数量，上限小于分片数量
+	for _, max := range []int{1, 10, 33, 100} {
+		store, err := NewMemoryWithOptions(&MemoryOptions{Lifetime: 10, MaxEntries: max})
+		a.NotError(err)
+		a.True(len(store.shards) <= max, max)
+
+		for i := 0; i < 1000; i++ {
+			a.NotError(store.Save("id"+strconv.Itoa(i), testData1))
+			a.True(store.Stats().Entries <= max, max)
+		}
+	}
+
+	// MaxBytes同样精确分配
+	store, err := NewMemoryWithOptions(&MemoryOptions{Lifetime: 10, MaxBytes: 10})
+	a.NotError(err)
+	a.Equal(len(store.shards), 8)
+	var total int64
+	for _, shard := range store.shards {
+		a.True(shard.maxBytes > 0)
+		total += shard.maxBytes
+	}
+	a.Equal(total, 10)
+
+	a.Equal(memShardCount(5, 0, 0), 8)
+	a.Equal(memShardCount(32, 10, 0), 8)
+	a.Equal(memShardCount(32, 0, 3), 2)
+	a.Equal(memShardCount(32, 1, 1<<20), 1)
+}
+
+// 在GC的同时进行读写，需要通过-race检测。
+func TestMemory_Concurrent(t *testing.T) {
+	a := assert.New(t)
+
+	store, err := NewMemoryWithOptions(&MemoryOptions{Lifetime: 1, Shards: 4, MaxEntries: 50})
+	a.NotError(err)
+
+	errs := make(chan error, 9)
+	for g := 0; g < 8; g++ {
+		go func(g int) {
+			for i := 0; i < 500; i++ {
+				id := strconv.Itoa(g) + "-" + strconv.Itoa(i%30)
+				if err := store.Save(id, testData1); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := store.Get(id); err != nil {
+					errs <- err
+					return
+				}
+				if i%5 == 0 {
+					if err := store.Delete(id); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+			errs <- nil
+		}(g)
+	}
+
+	go func() {
+		for i := 0; i < 50; i++ {
+			if _, err := store.GC(context.Background()); err != nil {
+				errs <- err
+				return
+			}
+			store.Stats()
+		}
+		errs <- nil
+	}()
+	for i := 0; i < 9; i++ {
+		a.NotError(<-errs)
+	}
+
+	a.True(store.Stats().Entries <= 52)
+	a.NotError(store.Close())
+}
+
+// 通过 go test -bench=Memory -cpu=1,2,4,8 比较分片数量对并发性能的影响。
+func BenchmarkMemory(b *testing.B) {
+	for _, shards := range []int{1, memDefaultShards} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			store, err := NewMemoryWithOptions(&MemoryOptions{Lifetime: 100, Shards: shards})
+			if err != nil {
+				b.Fatal(err)
+			}
+			ids := make([]string, 1024)
+			for i := range ids {
+				ids[i] = "session-" + strconv.Itoa(i)
+				store.Save(ids[i], testData1)
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					id := ids[i%len(ids)]
+					if i%4 == 0 {
+						store.Save(id, testData1)
+					} else {
+						store.Get(id)
+					}
+					i++
+				}
+			})
+		})
+	}
 }
@@ -0,0 +1,176 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"context"
+	"time"
+
+	"github.com/issue9/session/codecs"
+	"github.com/issue9/session/types"
+)
+
+// RawBatchSetter 为可以一次写入多条数据的RawStore。
+//
+// NewSQL()返回的实例实现了该接口。
+type RawBatchSetter interface {
+	// 以相同的生存时间写入items中的所有数据，键名为sessionid，
+	// 返回错误时，所有数据都当作未写入。
+	SetMultiContext(ctx context.Context, items map[string][]byte, ttl time.Duration) error
+}
+
+// 将RawStore和Codec组合成一个Store
+type raw struct {
+	store    types.ContextRawStore
+	gc       types.GCer     // 若store未实现types.GCer，则为nil
+	batch    RawBatchSetter // 若store未实现RawBatchSetter，则为nil
+	codec    types.Codec
+	lifetime time.Duration
+}
+
+// 将一个types.RawStore包装成types.Store。
+//
+// codec为session数据的编解码方式，若指定为nil，则使用codecs.NewGob()；
+// lifetime为每次保存数据之后，数据的生存时间，单位为秒。
+//
+// 每次Get()返回的都是解码之后的新数据，
+// 所以多个Session实例之间不会共享同一份数据。
+//
+// 返回的实例实现了types.ContextStore、types.GCer、Toucher和BatchSaver接口，若store实现了types.ContextRawStore，
+// 则ctx会传递给store；若store实现了types.GCer，则GC相关的操作也会交由store处理；
+// 若store实现了RawBatchSetter，则批量保存时会一次写入所有数据。
+func NewRaw(store types.RawStore, codec types.Codec, lifetime int) types.Store {
+	if codec == nil {
+		codec = codecs.NewGob()
+	}
+
+	gc, _ := store.(types.GCer)
+	batch, _ := store.(RawBatchSetter)
+
+	return &raw{
+		store:    types.NewContextRawStore(store),
+		gc:       gc,
+		batch:    batch,
+		codec:    codec,
+		lifetime: time.Second * time.Duration(lifetime),
+	}
+}
+
+// session.Store.Delete()
+func (r *raw) Delete(sessID string) error {
+	return r.DeleteContext(context.Background(), sessID)
+}
+
+// session.ContextStore.DeleteContext()
+func (r *raw) DeleteContext(ctx context.Context, sessID string) error {
+	return r.store.DeleteContext(ctx, sessID)
+}
+
+// session.Store.Get()
+func (r *raw) Get(sessID string) (map[interface{}]interface{}, error) {
+	return r.GetContext(context.Background(), sessID)
+}
+
+// session.ContextStore.GetContext()
+func (r *raw) GetContext(ctx context.Context, sessID string) (map[interface{}]interface{}, error) {
+	data, _, err := r.store.GetContext(ctx, sessID)
+	if err != nil {
+		return nil, err
+	}
+
+	if data == nil { // 不存在，返回一个空值
+		return map[interface{}]interface{}{}, nil
+	}
+
+	return r.codec.Decode(data)
+}
+
+// session.Store.Save()
+func (r *raw) Save(sessID string, data map[interface{}]interface{}) error {
+	return r.SaveContext(context.Background(), sessID, data)
+}
+
+// session.ContextStore.SaveContext()
+func (r *raw) SaveContext(ctx context.Context, sessID string, data map[interface{}]interface{}) error {
+	bs, err := r.codec.Encode(data)
+	if err != nil {
+		return err
+	}
+
+	return r.store.SetContext(ctx, sessID, bs, r.lifetime)
+}
+
+// BatchSaver.SaveMultiContext()
+//
+// 若RawStore实现了RawBatchSetter，则一次写入所有数据，否则逐条写入。
+func (r *raw) SaveMultiContext(ctx context.Context, items map[string]map[interface{}]interface{}) error {
+	if r.batch == nil {
+		for sessID, data := range items {
+			if err := r.SaveContext(ctx, sessID, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	encoded := make(map[string][]byte, len(items))
+	for sessID, data := range items {
+		bs, err := r.codec.Encode(data)
+		if err != nil {
+			return err
+		}
+		encoded[sessID] = bs
+	}
+	return r.batch.SetMultiContext(ctx, encoded, r.lifetime)
+}
+
+// Touch 将数据的生存时间重置为lifetime，实现了Toucher接口。
+func (r *raw) Touch(sessID string) error {
+	return r.TouchContext(context.Background(), sessID)
+}
+
+// Toucher.TouchContext()
+func (r *raw) TouchContext(ctx context.Context, sessID string) error {
+	return r.store.TouchContext(ctx, sessID, r.lifetime)
+}
+
+// session.Store.StartGC()
+func (r *raw) StartGC() {
+	r.store.StartGC()
+}
+
+// types.GCer.GC()
+//
+// 若RawStore未实现types.GCer，则不执行任何操作。
+func (r *raw) GC(ctx context.Context) (int, error) {
+	if r.gc == nil {
+		return 0, nil
+	}
+	return r.gc.GC(ctx)
+}
+
+// types.GCer.StartGCContext()
+//
+// 若RawStore未实现types.GCer，则忽略参数，直接调用其StartGC()。
+func (r *raw) StartGCContext(ctx context.Context, opt *types.GCOptions) {
+	if r.gc == nil {
+		r.store.StartGC()
+		return
+	}
+	r.gc.StartGCContext(ctx, opt)
+}
+
+// types.GCer.GCStats()
+func (r *raw) GCStats() types.GCStats {
+	if r.gc == nil {
+		return types.GCStats{}
+	}
+	return r.gc.GCStats()
+}
+
+// session.Store.Close()
+func (r *raw) Close() error {
+	return r.store.Close()
+}
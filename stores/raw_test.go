@@ -0,0 +1,63 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/issue9/assert"
+	"github.com/issue9/session/codecs"
+	"github.com/issue9/session/types"
+)
+
+var _ types.ContextStore = &raw{}
+
+func TestRaw(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "session")
+	a.NotError(err)
+	defer os.RemoveAll(dir)
+
+	f, err := NewFile(dir, 10, nil)
+	a.NotError(err).NotNil(f)
+	store := NewRaw(f, codecs.NewGob(), 10)
+	a.NotNil(store)
+
+	a.NotError(store.Save("testData1", testData1))
+	a.FileExists(filePath(f, "testData1"))
+
+	mapped, err := store.Get("testData1")
+	a.NotError(err).Equal(mapped, testData1)
+
+	// 每次Get()返回的都是一份新的数据
+	mapped["10"] = 100
+	mapped, err = store.Get("testData1")
+	a.NotError(err).Equal(mapped, testData1)
+
+	// 不存在的数据
+	mapped, err = store.Get("non")
+	a.NotError(err).NotNil(mapped).Equal(0, len(mapped))
+
+	a.NotError(store.Delete("testData1"))
+	a.FileNotExists(filePath(f, "testData1"))
+
+	// 批量保存，file未实现RawBatchSetter，逐条写入
+	a.NotError(store.(BatchSaver).SaveMultiContext(context.Background(), map[string]map[interface{}]interface{}{
+		"testData1": testData1,
+		"testData2": testData2,
+	}))
+	mapped, err = store.Get("testData2")
+	a.NotError(err).Equal(mapped, testData2)
+
+	// 编码错误应该被返回
+	store = NewRaw(f, codecs.NewJSON(), 10)
+	a.Error(store.Save("testData1", map[interface{}]interface{}{1: 1}))
+
+	a.NotError(store.Close())
+}
@@ -0,0 +1,190 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/issue9/session/stores/internal/resp"
+)
+
+// RedisOptions 为 NewRedis 的参数。
+type RedisOptions struct {
+	// Redis服务器的地址，比如 127.0.0.1:6379。
+	Addr string
+
+	// 密码，为空表示不需要AUTH。
+	Password string
+
+	// 数据库编号，默认为0。
+	DB int
+
+	// 键名的前缀，用于与同一数据库中的其它数据区分开。
+	Prefix string
+
+	// 最多保留的空闲连接数，默认为10。
+	MaxIdle int
+
+	// 建立连接的超时时间，默认为5秒。
+	DialTimeout time.Duration
+}
+
+// 以Redis作为存储的RawStore。
+type redis struct {
+	pool   *resp.Pool
+	prefix string
+}
+
+// 声明一个以Redis作为存储的RawStore，可以通过NewRaw()将其转换成session.Store接口。
+//
+// 过期数据由Redis自行清除，StartGC()不执行任何操作。
+func NewRedis(opt *RedisOptions) (*redis, error) {
+	if opt == nil {
+		return nil, errors.New("opt 不能为空")
+	}
+
+	if len(opt.Addr) == 0 {
+		return nil, errors.New("Addr 不能为空")
+	}
+
+	if opt.DB < 0 {
+		return nil, errors.New("DB 不能小于 0")
+	}
+
+	maxIdle := opt.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = 10
+	}
+
+	timeout := opt.DialTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	password, db := opt.Password, opt.DB
+	init := func(c *resp.Conn) error {
+		if len(password) > 0 {
+			if _, err := c.Do("AUTH", password); err != nil {
+				return err
+			}
+		}
+
+		if db > 0 {
+			if _, err := c.Do("SELECT", db); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return &redis{
+		pool:   resp.NewPool(opt.Addr, maxIdle, timeout, init),
+		prefix: opt.Prefix,
+	}, nil
+}
+
+// 将ttl转换成秒数，不足1秒的按1秒计算。
+func redisSeconds(ttl time.Duration) int64 {
+	secs := int64(ttl / time.Second)
+	if ttl%time.Second > 0 {
+		secs++
+	}
+	return secs
+}
+
+// session.RawStore.Get()
+func (r *redis) Get(sessID string) ([]byte, time.Duration, error) {
+	return r.GetContext(context.Background(), sessID)
+}
+
+// session.ContextRawStore.GetContext()
+func (r *redis) GetContext(ctx context.Context, sessID string) ([]byte, time.Duration, error) {
+	key := r.prefix + sessID
+	vals, err := r.pool.Pipeline(ctx, []interface{}{"GET", key}, []interface{}{"PTTL", key})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, val := range vals {
+		if e, ok := val.(resp.Error); ok {
+			return nil, 0, e
+		}
+	}
+
+	data, ok := vals[0].([]byte)
+	if !ok { // 不存在
+		return nil, 0, nil
+	}
+
+	ms, ok := vals[1].(int64)
+	if !ok {
+		return nil, 0, resp.ErrProtocol
+	}
+	switch {
+	case ms == -1: // 永不过期，只有在外部修改了该键时才会出现。
+		return data, 0, nil
+	case ms < 0: // 在GET和PTTL之间过期了
+		return nil, 0, nil
+	}
+
+	return data, time.Duration(ms) * time.Millisecond, nil
+}
+
+// session.RawStore.Set()
+func (r *redis) Set(sessID string, data []byte, ttl time.Duration) error {
+	return r.SetContext(context.Background(), sessID, data, ttl)
+}
+
+// session.ContextRawStore.SetContext()
+//
+// ttl小于等于0时，直接删除该数据。
+func (r *redis) SetContext(ctx context.Context, sessID string, data []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return r.DeleteContext(ctx, sessID)
+	}
+
+	_, err := r.pool.Do(ctx, "SET", r.prefix+sessID, data, "EX", redisSeconds(ttl))
+	return err
+}
+
+// session.RawStore.Touch()
+func (r *redis) Touch(sessID string, ttl time.Duration) error {
+	return r.TouchContext(context.Background(), sessID, ttl)
+}
+
+// session.ContextRawStore.TouchContext()
+func (r *redis) TouchContext(ctx context.Context, sessID string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return r.DeleteContext(ctx, sessID)
+	}
+
+	_, err := r.pool.Do(ctx, "EXPIRE", r.prefix+sessID, redisSeconds(ttl))
+	return err
+}
+
+// session.RawStore.Delete()
+func (r *redis) Delete(sessID string) error {
+	return r.DeleteContext(context.Background(), sessID)
+}
+
+// session.ContextRawStore.DeleteContext()
+func (r *redis) DeleteContext(ctx context.Context, sessID string) error {
+	_, err := r.pool.Do(ctx, "DEL", r.prefix+sessID)
+	return err
+}
+
+// session.RawStore.StartGC()
+//
+// 由Redis的过期机制清除数据，不需要额外的GC。
+func (r *redis) StartGC() {}
+
+// session.RawStore.Close()
+//
+// 仅关闭连接池，Redis中的数据会保留，直到过期。
+func (r *redis) Close() error {
+	return r.pool.Close()
+}
@@ -0,0 +1,169 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert"
+	"github.com/issue9/session/stores/internal/resp/resptest"
+	"github.com/issue9/session/types"
+)
+
+var _ types.ContextRawStore = &redis{}
+
+func TestNewRedis(t *testing.T) {
+	a := assert.New(t)
+
+	r, err := NewRedis(nil)
+	a.Error(err).Nil(r)
+
+	r, err = NewRedis(&RedisOptions{})
+	a.Error(err).Nil(r)
+
+	r, err = NewRedis(&RedisOptions{Addr: "127.0.0.1:6379", DB: -1})
+	a.Error(err).Nil(r)
+
+	r, err = NewRedis(&RedisOptions{Addr: "127.0.0.1:6379"})
+	a.NotError(err).NotNil(r)
+}
+
+func TestRedis(t *testing.T) {
+	a := assert.New(t)
+	srv, err := resptest.NewServer("")
+	a.NotError(err)
+	defer srv.Close()
+
+	r, err := NewRedis(&RedisOptions{Addr: srv.Addr(), Prefix: "sess:", DB: 1})
+	a.NotError(err).NotNil(r)
+	r.StartGC()
+	defer r.Close()
+
+	// 不存在的数据
+	data, ttl, err := r.Get("id1")
+	a.NotError(err).Nil(data).Equal(ttl, 0)
+
+	a.NotError(r.Set("id1", rawData1, 1500*time.Millisecond))
+	a.Equal(srv.Keys(), []string{"sess:id1"})
+	a.True(srv.TTL("sess:id1") > time.Second) // 不足1秒的部分向上取整
+
+	data, ttl, err = r.Get("id1")
+	a.NotError(err).Equal(data, rawData1)
+	a.True(ttl > time.Second && ttl <= 2*time.Second)
+
+	// Touch
+	a.NotError(r.Touch("id1", time.Minute))
+	_, ttl, err = r.Get("id1")
+	a.NotError(err).True(ttl > 50*time.Second)
+
+	// 覆盖
+	a.NotError(r.Set("id1", rawData2, time.Minute))
+	data, _, err = r.Get("id1")
+	a.NotError(err).Equal(data, rawData2)
+
+	// ttl<=0 等同于删除
+	a.NotError(r.Set("id2", rawData1, time.Minute))
+	a.NotError(r.Set("id2", rawData1, 0))
+	a.Equal(srv.Keys(), []string{"sess:id1"})
+
+	a.NotError(r.Delete("id1"))
+	data, _, err = r.Get("id1")
+	a.NotError(err).Nil(data)
+	a.Equal(len(srv.Keys()), 0)
+
+	// 删除不存在的数据
+	a.NotError(r.Delete("id1"))
+}
+
+func TestRedis_Prefix(t *testing.T) {
+	a := assert.New(t)
+	srv, err := resptest.NewServer("")
+	a.NotError(err)
+	defer srv.Close()
+
+	r1, err := NewRedis(&RedisOptions{Addr: srv.Addr(), Prefix: "app1:"})
+	a.NotError(err)
+	defer r1.Close()
+	r2, err := NewRedis(&RedisOptions{Addr: srv.Addr(), Prefix: "app2:"})
+	a.NotError(err)
+	defer r2.Close()
+
+	a.NotError(r1.Set("id", rawData1, time.Minute))
+	a.NotError(r2.Set("id", rawData2, time.Minute))
+	a.Equal(srv.Keys(), []string{"app1:id", "app2:id"})
+
+	data, _, err := r1.Get("id")
+	a.NotError(err).Equal(data, rawData1)
+	data, _, err = r2.Get("id")
+	a.NotError(err).Equal(data, rawData2)
+
+	a.NotError(r1.Delete("id"))
+	a.Equal(srv.Keys(), []string{"app2:id"})
+}
+
+func TestRedis_Pool(t *testing.T) {
+	a := assert.New(t)
+	srv, err := resptest.NewServer("123")
+	a.NotError(err)
+	defer srv.Close()
+
+	// 密码错误
+	r, err := NewRedis(&RedisOptions{Addr: srv.Addr(), Password: "456"})
+	a.NotError(err)
+	a.Error(r.Set("id", rawData1, time.Minute))
+	a.NotError(r.Close())
+
+	r, err = NewRedis(&RedisOptions{Addr: srv.Addr(), Password: "123", MaxIdle: 2})
+	a.NotError(err)
+	defer r.Close()
+
+	// 顺序执行的命令复用同一个连接
+	conns := srv.Conns()
+	for i := 0; i < 10; i++ {
+		a.NotError(r.Set("id", rawData1, time.Minute))
+	}
+	a.Equal(srv.Conns(), conns+1)
+
+	// 并发执行之后，最多保留 MaxIdle 个空闲连接
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, _, err := r.Get("id")
+			errs <- err
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		a.NotError(<-errs)
+	}
+	a.True(r.pool.IdleLen() <= 2)
+
+	// 关闭之后不能再使用
+	a.NotError(r.Close())
+	a.Error(r.Set("id", rawData1, time.Minute))
+}
+
+func TestRedis_Context(t *testing.T) {
+	a := assert.New(t)
+	srv, err := resptest.NewServer("")
+	a.NotError(err)
+	defer srv.Close()
+
+	r, err := NewRedis(&RedisOptions{Addr: srv.Addr()})
+	a.NotError(err)
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	a.Equal(r.SetContext(ctx, "id", rawData1, time.Minute), context.Canceled)
+	a.Equal(len(srv.Keys()), 0)
+
+	// 通过NewRaw()转换成Store
+	store := NewRaw(r, nil, 60)
+	a.NotError(store.Save("id", testData1))
+	mapped, err := store.Get("id")
+	a.NotError(err).Equal(mapped, testData1)
+}
@@ -0,0 +1,444 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sql存储器的GC相关设置
+const (
+	sqlGCInterval = time.Minute // GC的执行间隔
+	sqlGCBatch    = 1000        // 每次DELETE最多删除的记录数
+)
+
+// 合法的表名
+var sqlTableName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Dialect 用于抹平各个数据库之间的差异。
+//
+// 所有传递给Dialect的语句都以 ? 作为占位符。
+type Dialect interface {
+	// 将语句中的 ? 占位符转换成当前数据库支持的格式。
+	Rebind(query string) string
+
+	// 保存二进制内容的字段类型。
+	BlobType() string
+
+	// 插入或是更新一条记录的语句，
+	// 参数依次为 id、data、created、accessed 和 expires，
+	// 更新时不能修改 created 字段。
+	Upsert(table string) string
+
+	// 删除过期数据的语句，每次最多删除batch条记录，
+	// 参数为当前时间。
+	DeleteExpired(table string, batch int) string
+}
+
+// SQLOptions 为 NewSQLWithOptions 的参数。
+type SQLOptions struct {
+	// 保存session数据的表名，只能包含字母、数字和下划线。
+	Table string
+
+	// GC时发生的错误会输出到Log，若指定为nil，则会向stderr输出错误信息。
+	Log *log.Logger
+}
+
+type sqlite struct{}
+
+type postgres struct{}
+
+type mysql struct{}
+
+// 以数据库作为存储的RawStore。
+type sqlStore struct {
+	*gcRunner
+
+	db      *sql.DB
+	dialect Dialect
+	table   string
+	log     *log.Logger
+
+	// 预先生成的SQL语句
+	getSQL, upsertSQL, touchSQL, deleteSQL, gcSQL string
+}
+
+// SQLite 返回SQLite的Dialect，需要 3.24 及以上的版本。
+func SQLite() Dialect {
+	return &sqlite{}
+}
+
+// PostgreSQL 返回PostgreSQL的Dialect，需要 9.5 及以上的版本。
+func PostgreSQL() Dialect {
+	return &postgres{}
+}
+
+// MySQL 返回MySQL的Dialect。
+func MySQL() Dialect {
+	return &mysql{}
+}
+
+func (d *sqlite) Rebind(query string) string {
+	return query
+}
+
+func (d *sqlite) BlobType() string {
+	return "BLOB"
+}
+
+func (d *sqlite) Upsert(table string) string {
+	return "INSERT INTO " + table + " (id, data, created, accessed, expires) VALUES (?, ?, ?, ?, ?)" +
+		" ON CONFLICT(id) DO UPDATE SET data=excluded.data, accessed=excluded.accessed, expires=excluded.expires"
+}
+
+func (d *sqlite) DeleteExpired(table string, batch int) string {
+	return "DELETE FROM " + table + " WHERE id IN (SELECT id FROM " + table +
+		" WHERE expires < ? LIMIT " + strconv.Itoa(batch) + ")"
+}
+
+func (d *postgres) Rebind(query string) string {
+	buf := new(strings.Builder)
+	index := 0
+	for _, r := range query {
+		if r != '?' {
+			buf.WriteRune(r)
+			continue
+		}
+
+		index++
+		buf.WriteByte('$')
+		buf.WriteString(strconv.Itoa(index))
+	}
+	return buf.String()
+}
+
+func (d *postgres) BlobType() string {
+	return "BYTEA"
+}
+
+func (d *postgres) Upsert(table string) string {
+	return "INSERT INTO " + table + " (id, data, created, accessed, expires) VALUES (?, ?, ?, ?, ?)" +
+		" ON CONFLICT(id) DO UPDATE SET data=EXCLUDED.data, accessed=EXCLUDED.accessed, expires=EXCLUDED.expires"
+}
+
+func (d *postgres) DeleteExpired(table string, batch int) string {
+	return "DELETE FROM " + table + " WHERE id IN (SELECT id FROM " + table +
+		" WHERE expires < ? LIMIT " + strconv.Itoa(batch) + ")"
+}
+
+func (d *mysql) Rebind(query string) string {
+	return query
+}
+
+func (d *mysql) BlobType() string {
+	return "LONGBLOB"
+}
+
+func (d *mysql) Upsert(table string) string {
+	return "INSERT INTO " + table + " (id, data, created, accessed, expires) VALUES (?, ?, ?, ?, ?)" +
+		" ON DUPLICATE KEY UPDATE data=VALUES(data), accessed=VALUES(accessed), expires=VALUES(expires)"
+}
+
+func (d *mysql) DeleteExpired(table string, batch int) string {
+	return "DELETE FROM " + table + " WHERE expires < ? LIMIT " + strconv.Itoa(batch)
+}
+
+// 声明一个以数据库作为存储的RawStore，可以通过NewRaw()将其转换成session.Store接口。
+//
+// table为保存session数据的表名，包含 id、data、created、accessed 和 expires 字段，
+// 其中时间字段都为毫秒级的时间戳。
+// 表结构的版本号保存在 table_version 表中，若表不存在或是版本较旧，会自动创建或升级。
+//
+// db由调用方管理，Close()并不会关闭db。
+func NewSQL(db *sql.DB, dialect Dialect, table string) (*sqlStore, error) {
+	return NewSQLWithOptions(db, dialect, &SQLOptions{Table: table})
+}
+
+// 声明一个以数据库作为存储的RawStore，与NewSQL()相同，但可以指定更多的参数。
+func NewSQLWithOptions(db *sql.DB, dialect Dialect, opt *SQLOptions) (*sqlStore, error) {
+	if opt == nil {
+		return nil, errors.New("opt 不能为空")
+	}
+
+	table := opt.Table
+	if !sqlTableName.MatchString(table) {
+		return nil, fmt.Errorf("无效的表名：%v", table)
+	}
+
+	l := opt.Log
+	if l == nil {
+		l = log.New(os.Stderr, "session.SQLStore", log.LstdFlags)
+	}
+
+	s := &sqlStore{
+		db:      db,
+		dialect: dialect,
+		table:   table,
+		log:     l,
+
+		getSQL:    dialect.Rebind("SELECT data, expires FROM " + table + " WHERE id=?"),
+		upsertSQL: dialect.Rebind(dialect.Upsert(table)),
+		touchSQL:  dialect.Rebind("UPDATE " + table + " SET accessed=?, expires=? WHERE id=? AND expires>?"),
+		deleteSQL: dialect.Rebind("DELETE FROM " + table + " WHERE id=?"),
+		gcSQL:     dialect.Rebind(dialect.DeleteExpired(table, sqlGCBatch)),
+	}
+	s.gcRunner = newGCRunner(sqlGCInterval, s.log, s.gc)
+
+	if err := s.migrate(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// 各个版本的表结构变更语句，第n个元素将版本从n升级到n+1。
+func (s *sqlStore) migrations() [][]string {
+	return [][]string{
+		{
+			"CREATE TABLE IF NOT EXISTS " + s.table + " (" +
+				"id VARCHAR(128) NOT NULL PRIMARY KEY," +
+				"data " + s.dialect.BlobType() + " NOT NULL," +
+				"created BIGINT NOT NULL," +
+				"accessed BIGINT NOT NULL," +
+				"expires BIGINT NOT NULL)",
+		},
+		{
+			"CREATE INDEX " + s.table + "_expires ON " + s.table + " (expires)",
+		},
+	}
+}
+
+// 创建或是升级数据表
+//
+// 多个进程可能同时对一个新的数据库执行升级，所以每一次升级都在事务中完成：
+// 先锁定版本号所在的记录，在锁中确认版本号之后，再执行升级语句。
+func (s *sqlStore) migrate(ctx context.Context) error {
+	versionTable := s.table + "_version"
+
+	if _, err := s.db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+versionTable+
+		" (id INTEGER NOT NULL PRIMARY KEY, version INTEGER NOT NULL)"); err != nil {
+		return err
+	}
+
+	// 主键保证只有一条记录，若已经被其它进程插入，则忽略插入时的错误。
+	if _, err := s.db.ExecContext(ctx, "INSERT INTO "+versionTable+" (id, version) VALUES (1, 0)"); err != nil {
+		if _, err1 := s.version(ctx, s.db); err1 != nil {
+			return err
+		}
+	}
+
+	migrations := s.migrations()
+	for {
+		before, err := s.version(ctx, s.db)
+		if err != nil {
+			return err
+		}
+
+		done, err := s.migrateStep(ctx, migrations)
+		if err != nil {
+			// MySQL中的DDL语句会隐式提交事务，锁定无效，
+			// 此时可能是其它进程已经完成了同一次升级，重新读取版本号确认。
+			if after, err1 := s.version(ctx, s.db); err1 == nil && after > before {
+				continue
+			}
+			return err
+		}
+
+		if done {
+			return nil
+		}
+	}
+}
+
+// *sql.DB和*sql.Tx共有的查询接口
+type sqlQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// 读取当前的版本号
+func (s *sqlStore) version(ctx context.Context, q sqlQueryer) (int, error) {
+	version := 0
+	err := q.QueryRowContext(ctx, "SELECT version FROM "+s.table+"_version WHERE id=1").Scan(&version)
+	return version, err
+}
+
+// 在一个事务中执行一次升级，done表示已经是最新的版本。
+func (s *sqlStore) migrateStep(ctx context.Context, migrations [][]string) (done bool, err error) {
+	versionTable := s.table + "_version"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback() // 提交之后再调用不会有任何影响
+
+	// 锁定版本号所在的记录，其它进程的升级会等待当前事务结束。
+	if _, err = tx.ExecContext(ctx, "UPDATE "+versionTable+" SET version=version WHERE id=1"); err != nil {
+		return false, err
+	}
+
+	version, err := s.version(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	if version > len(migrations) {
+		return false, fmt.Errorf("数据表 %v 的版本 %d 高于当前支持的版本 %d", s.table, version, len(migrations))
+	}
+	if version == len(migrations) {
+		return true, nil
+	}
+
+	for _, stmt := range migrations[version] {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return false, err
+		}
+	}
+
+	update := s.dialect.Rebind("UPDATE " + versionTable + " SET version=? WHERE id=1 AND version=?")
+	result, err := tx.ExecContext(ctx, update, version+1, version)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n != 1 {
+		return false, fmt.Errorf("数据表 %v 的版本已经被其它进程修改", s.table)
+	}
+
+	return false, tx.Commit()
+}
+
+// 转换成毫秒级的时间戳
+func sqlTime(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// session.RawStore.Get()
+func (s *sqlStore) Get(sessID string) ([]byte, time.Duration, error) {
+	return s.GetContext(context.Background(), sessID)
+}
+
+// session.ContextRawStore.GetContext()
+func (s *sqlStore) GetContext(ctx context.Context, sessID string) ([]byte, time.Duration, error) {
+	var data []byte
+	var expires int64
+	err := s.db.QueryRowContext(ctx, s.getSQL, sessID).Scan(&data, &expires)
+	if err == sql.ErrNoRows {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	ttl := time.Duration(expires-sqlTime(time.Now())) * time.Millisecond
+	if ttl <= 0 { // 已经过期，但还未被GC回收
+		return nil, 0, nil
+	}
+
+	if data == nil {
+		data = []byte{}
+	}
+	return data, ttl, nil
+}
+
+// session.RawStore.Set()
+func (s *sqlStore) Set(sessID string, data []byte, ttl time.Duration) error {
+	return s.SetContext(context.Background(), sessID, data, ttl)
+}
+
+// session.ContextRawStore.SetContext()
+func (s *sqlStore) SetContext(ctx context.Context, sessID string, data []byte, ttl time.Duration) error {
+	now := time.Now()
+	_, err := s.db.ExecContext(ctx, s.upsertSQL, sessID, data, sqlTime(now), sqlTime(now), sqlTime(now.Add(ttl)))
+	return err
+}
+
+// SetMultiContext 在同一个事务中写入items中的所有数据，实现了RawBatchSetter接口。
+func (s *sqlStore) SetMultiContext(ctx context.Context, items map[string][]byte, ttl time.Duration) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // 提交之后再调用不会有任何影响
+
+	stmt, err := tx.PrepareContext(ctx, s.upsertSQL)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := time.Now()
+	for sessID, data := range items {
+		if _, err = stmt.ExecContext(ctx, sessID, data, sqlTime(now), sqlTime(now), sqlTime(now.Add(ttl))); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// session.RawStore.Touch()
+func (s *sqlStore) Touch(sessID string, ttl time.Duration) error {
+	return s.TouchContext(context.Background(), sessID, ttl)
+}
+
+// session.ContextRawStore.TouchContext()
+func (s *sqlStore) TouchContext(ctx context.Context, sessID string, ttl time.Duration) error {
+	now := time.Now()
+	_, err := s.db.ExecContext(ctx, s.touchSQL, sqlTime(now), sqlTime(now.Add(ttl)), sessID, sqlTime(now))
+	return err
+}
+
+// session.RawStore.Delete()
+func (s *sqlStore) Delete(sessID string) error {
+	return s.DeleteContext(context.Background(), sessID)
+}
+
+// session.ContextRawStore.DeleteContext()
+func (s *sqlStore) DeleteContext(ctx context.Context, sessID string) error {
+	_, err := s.db.ExecContext(ctx, s.deleteSQL, sessID)
+	return err
+}
+
+// 分批删除过期的数据，避免长时间锁表。
+func (s *sqlStore) gc(ctx context.Context) (int, error) {
+	now := sqlTime(time.Now())
+
+	removed := 0
+	for {
+		rslt, err := s.db.ExecContext(ctx, s.gcSQL, now)
+		if err != nil {
+			return removed, err
+		}
+
+		n, err := rslt.RowsAffected()
+		if err != nil {
+			return removed, err
+		}
+		removed += int(n)
+
+		if n < sqlGCBatch {
+			return removed, nil
+		}
+	}
+}
+
+// session.RawStore.Close()
+//
+// 仅停止GC，数据表及其中的数据都会保留。
+func (s *sqlStore) Close() error {
+	s.stopGC()
+	return nil
+}
@@ -0,0 +1,247 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// 依赖 modernc.org/sqlite，需要先 go get modernc.org/sqlite，
+// 再通过 go test -tags sqlite 执行。
+
+//go:build sqlite
+
+package stores
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert"
+	"github.com/issue9/session/types"
+	_ "modernc.org/sqlite"
+)
+
+var (
+	_ types.ContextRawStore = &sqlStore{}
+	_ RawBatchSetter        = &sqlStore{}
+)
+
+// 返回一个新的SQLite数据库文件路径，以及用于清除的函数。
+func newSQLitePath(a *assert.Assertion) (string, func()) {
+	dir, err := ioutil.TempDir("", "session")
+	a.NotError(err)
+
+	return filepath.Join(dir, "session.db"), func() {
+		a.NotError(os.RemoveAll(dir))
+	}
+}
+
+func newSQLite(a *assert.Assertion) (*sql.DB, func()) {
+	path, cleanup := newSQLitePath(a)
+
+	db, err := sql.Open("sqlite", path)
+	a.NotError(err).NotNil(db)
+
+	return db, func() {
+		a.NotError(db.Close())
+		cleanup()
+	}
+}
+
+func TestDialect_Rebind(t *testing.T) {
+	a := assert.New(t)
+
+	query := "UPDATE t SET a=?, b=? WHERE id=?"
+	a.Equal(SQLite().Rebind(query), query)
+	a.Equal(MySQL().Rebind(query), query)
+	a.Equal(PostgreSQL().Rebind(query), "UPDATE t SET a=$1, b=$2 WHERE id=$3")
+}
+
+func TestNewSQL(t *testing.T) {
+	a := assert.New(t)
+	db, cleanup := newSQLite(a)
+	defer cleanup()
+
+	store, err := NewSQL(db, SQLite(), "sessions;drop")
+	a.Error(err).Nil(store)
+
+	store, err = NewSQL(db, SQLite(), "sessions")
+	a.NotError(err).NotNil(store)
+
+	var version int
+	a.NotError(db.QueryRow("SELECT version FROM sessions_version").Scan(&version))
+	a.Equal(version, len(store.migrations()))
+
+	// 再次初始化，不会重复执行升级语句
+	a.NotError(store.Set("id", rawData1, time.Minute))
+	store, err = NewSQL(db, SQLite(), "sessions")
+	a.NotError(err).NotNil(store)
+	data, _, err := store.Get("id")
+	a.NotError(err).Equal(data, rawData1)
+
+	// 版本高于当前支持的版本
+	_, err = db.Exec("UPDATE sessions_version SET version=100 WHERE id=1")
+	a.NotError(err)
+	store, err = NewSQL(db, SQLite(), "sessions")
+	a.Error(err).Nil(store)
+}
+
+func TestNewSQLWithOptions(t *testing.T) {
+	a := assert.New(t)
+	db, cleanup := newSQLite(a)
+	defer cleanup()
+
+	store, err := NewSQLWithOptions(db, SQLite(), nil)
+	a.Error(err).Nil(store)
+
+	buf := new(bytes.Buffer)
+	l := log.New(buf, "", 0)
+	store, err = NewSQLWithOptions(db, SQLite(), &SQLOptions{Table: "sessions", Log: l})
+	a.NotError(err).NotNil(store)
+	a.Equal(store.log, l)
+}
+
+// 多个实例同时初始化同一个新的数据库
+func TestNewSQL_Concurrent(t *testing.T) {
+	a := assert.New(t)
+	path, cleanup := newSQLitePath(a)
+	defer cleanup()
+
+	// 每个实例使用单独的连接，与多个进程的情况相同
+	dbs := make([]*sql.DB, 0, 4)
+	for i := 0; i < 4; i++ {
+		db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout%3d5000")
+		a.NotError(err)
+		dbs = append(dbs, db)
+	}
+
+	errs := make(chan error, len(dbs))
+	for _, db := range dbs {
+		go func(db *sql.DB) {
+			_, err := NewSQL(db, SQLite(), "sessions")
+			errs <- err
+		}(db)
+	}
+	for range dbs {
+		a.NotError(<-errs)
+	}
+
+	db := dbs[0]
+	defer func() {
+		for _, db := range dbs {
+			a.NotError(db.Close())
+		}
+	}()
+
+	var version, count int
+	a.NotError(db.QueryRow("SELECT COUNT(*), MAX(version) FROM sessions_version").Scan(&count, &version))
+	a.Equal(count, 1).Equal(version, 2)
+}
+
+func TestSQL(t *testing.T) {
+	a := assert.New(t)
+	db, cleanup := newSQLite(a)
+	defer cleanup()
+
+	store, err := NewSQL(db, SQLite(), "sessions")
+	a.NotError(err).NotNil(store)
+
+	// 添加数据
+	a.NotError(store.Set("testData1", rawData1, time.Minute))
+	data, ttl, err := store.Get("testData1")
+	a.NotError(err).Equal(data, rawData1)
+	a.True(ttl > 50*time.Second && ttl <= time.Minute)
+
+	// 更新数据，created 保持不变
+	var created1, created2 int64
+	a.NotError(db.QueryRow("SELECT created FROM sessions WHERE id='testData1'").Scan(&created1))
+	time.Sleep(10 * time.Millisecond)
+	a.NotError(store.Set("testData1", rawData2, time.Minute))
+	a.NotError(db.QueryRow("SELECT created FROM sessions WHERE id='testData1'").Scan(&created2))
+	a.Equal(created1, created2)
+	data, _, err = store.Get("testData1")
+	a.NotError(err).Equal(data, rawData2)
+
+	// 不存在的数据
+	data, ttl, err = store.Get("non")
+	a.NotError(err).Nil(data).Equal(ttl, 0)
+	a.NotError(store.Delete("non"))
+	a.NotError(store.Touch("non", time.Minute))
+
+	// Touch
+	a.NotError(store.Touch("testData1", time.Hour))
+	_, ttl, err = store.Get("testData1")
+	a.NotError(err).True(ttl > time.Minute)
+
+	// 已经过期的数据
+	a.NotError(store.Touch("testData1", -time.Second))
+	data, _, err = store.Get("testData1")
+	a.NotError(err).Nil(data)
+
+	// 已经过期但还未被GC回收的数据，Touch()不会使其恢复
+	a.NotError(store.Touch("testData1", time.Hour))
+	data, _, err = store.Get("testData1")
+	a.NotError(err).Nil(data)
+
+	// Delete
+	a.NotError(store.Set("testData2", rawData2, time.Minute))
+	a.NotError(store.Delete("testData2"))
+	data, _, err = store.Get("testData2")
+	a.NotError(err).Nil(data)
+
+	// 在同一个事务中批量写入
+	a.NotError(store.SetMultiContext(context.Background(), map[string][]byte{
+		"testData1": rawData1,
+		"testData2": rawData2,
+	}, time.Minute))
+	data, ttl, err = store.Get("testData2")
+	a.NotError(err).Equal(data, rawData2)
+	a.True(ttl > 50*time.Second)
+
+	// NewRaw()通过SetMultiContext()批量保存
+	r := NewRaw(store, nil, 60)
+	a.NotError(r.(BatchSaver).SaveMultiContext(context.Background(), map[string]map[interface{}]interface{}{
+		"testData1": testData1,
+		"testData2": testData2,
+	}))
+	mapped, err := r.Get("testData2")
+	a.NotError(err).Equal(mapped, testData2)
+
+	// 取消的context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	a.Error(store.SetContext(ctx, "testData2", rawData2, time.Minute))
+	a.Error(store.SetMultiContext(ctx, map[string][]byte{"testData2": rawData2}, time.Minute))
+
+	a.NotError(store.Close())
+}
+
+func TestSQL_GC(t *testing.T) {
+	a := assert.New(t)
+	db, cleanup := newSQLite(a)
+	defer cleanup()
+
+	store, err := NewSQL(db, SQLite(), "sessions")
+	a.NotError(err).NotNil(store)
+
+	// 超过一个批次的过期数据
+	for i := 0; i < sqlGCBatch+10; i++ {
+		a.NotError(store.Set("expired"+strconv.Itoa(i), rawData1, -time.Second))
+	}
+	a.NotError(store.Set("live", rawData2, time.Minute))
+
+	removed, err := store.GC(context.Background())
+	a.NotError(err).Equal(removed, sqlGCBatch+10)
+	a.Equal(store.GCStats().Removed, sqlGCBatch+10)
+
+	var count int
+	a.NotError(db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&count))
+	a.Equal(count, 1)
+	data, _, err := store.Get("live")
+	a.NotError(err).Equal(data, rawData2)
+}
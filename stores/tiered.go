@@ -0,0 +1,634 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/issue9/session/types"
+)
+
+// 分层存储器中锁的数量，同一sessionid的读写在同一个锁中完成。
+const tieredLockStripes = 64
+
+// Toucher 为可以延长session生存时间的Store。
+//
+// NewRaw()返回的实例实现了该接口。
+type Toucher interface {
+	// 将sessID对应数据的生存时间重置为初始值，数据不存在时不返回错误。
+	TouchContext(ctx context.Context, sessID string) error
+}
+
+// BatchSaver 为可以一次保存多个session的Store。
+//
+// NewRaw()返回的实例实现了该接口。
+type BatchSaver interface {
+	// 保存items中的所有session，键名为sessionid，返回错误时，所有session都当作未保存。
+	SaveMultiContext(ctx context.Context, items map[string]map[interface{}]interface{}) error
+}
+
+// TieredOptions 为 NewTiered 的参数。
+type TieredOptions struct {
+	// 本地的缓存层，比如NewMemory()返回的实例，不能为空。
+	//
+	// Local中数据的生存时间不应该超过Remote，否则可能会读取到Remote中已经过期的session。
+	Local types.Store
+
+	// 作为数据来源的持久层，比如 NewRaw(NewFile(...)) 或是 NewRaw(NewSQL(...))，不能为空。
+	//
+	// 若Remote实现了Toucher接口，从Local读取到数据时，会同时延长Remote中数据的生存时间，
+	// 否则只读取而不保存的session，可能会在Remote中先于Local过期。
+	Remote types.Store
+
+	// 从Local读取到数据时，同一session两次延长Remote中生存时间的最小间隔，默认为1分钟，
+	// 仅在Remote实现了Toucher接口时有效，应该远小于Remote中数据的生存时间。
+	//
+	// 延长生存时间失败时只输出到Log，依然返回Local中的数据。
+	TouchInterval time.Duration
+
+	// 是否以write-behind的方式写入Remote。
+	//
+	// 为false时，Save()同时写入Remote和Local(write-through)；
+	// 为true时，Save()只写入Local，由后台定期写入Remote，
+	// 进程崩溃时会丢失还未写入的数据，适用于同一session总是由同一实例处理的情况。
+	// 若Remote实现了BatchSaver接口，后台写入时每次最多批量写入FlushThreshold个session，
+	// 否则每个session单独调用一次Remote的SaveContext()。
+	WriteBehind bool
+
+	// 后台写入Remote的间隔，默认为1秒，仅在WriteBehind为true时有效。
+	FlushInterval time.Duration
+
+	// 等待写入的session达到该数量时，立即触发一次后台写入，默认为100，仅在WriteBehind为true时有效。
+	FlushThreshold int
+
+	// 等待写入的session的最大数量，默认为FlushThreshold的10倍，仅在WriteBehind为true时有效。
+	//
+	// Remote持续写入失败时，等待写入的数据不会无限增加，
+	// 达到该值之后，新的session在Save()时直接写入Remote，与write-through相同，
+	// 写入失败的错误也会直接返回给调用者。
+	MaxPending int
+
+	// 数据写入Remote或是从Remote删除之后调用。
+	//
+	// 多个实例共用同一个Remote时，可以在此通知其它实例调用Invalidate()，
+	// 以删除其Local中已经过时的数据。
+	// 该函数在当前sessionid的锁中调用，不能再调用当前实例的方法。
+	OnWrite func(sessID string)
+
+	// 后台写入Remote以及延长Remote中生存时间时发生的错误会输出到Log，
+	// 若指定为nil，则会向stderr输出错误信息。
+	Log *log.Logger
+}
+
+// 在Local中缓存Remote数据的Store。
+type tiered struct {
+	local   types.ContextStore
+	remote  types.ContextStore
+	onWrite func(sessID string)
+	log     *log.Logger
+	locks   [tieredLockStripes]sync.Mutex
+
+	toucher       Toucher    // Remote未实现Toucher时为nil
+	batch         BatchSaver // Remote未实现BatchSaver时为nil
+	touchInterval time.Duration
+	touchedMu     sync.Mutex
+	touched       map[string]time.Time // 最后一次延长或是写入Remote中数据的时间
+	pruned        time.Time            // 最后一次清理touched的时间
+
+	// 以下仅在write-behind时使用
+	writeBehind bool
+	threshold   int
+	maxPending  int
+	pendingMu   sync.Mutex
+	pending     map[string]map[interface{}]interface{} // 还未写入Remote的数据
+	flushMu     sync.Mutex                             // 同一时间只执行一次Flush()
+	flushC      chan struct{}                          // 通知后台立即写入
+	closeOnce   sync.Once
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// 声明一个分层的Store，以Local作为Remote的缓存。
+//
+// Get()时先读取Local，不存在时从Remote读取，并写入Local(read-through)；
+// Save()根据 TieredOptions.WriteBehind 决定是否同时写入Remote；
+// Delete()总是同时从Local和Remote中删除，已经删除的session不会再被写入Remote。
+//
+// Local无法区分不存在的session和空的session，所以空的session每次都会从Remote读取。
+// Close()时会先将还未写入的数据写入Remote，再关闭Local和Remote。
+func NewTiered(opt *TieredOptions) (*tiered, error) {
+	if opt == nil {
+		return nil, errors.New("opt 不能为空")
+	}
+	if opt.Local == nil {
+		return nil, errors.New("Local 不能为空")
+	}
+	if opt.Remote == nil {
+		return nil, errors.New("Remote 不能为空")
+	}
+
+	l := opt.Log
+	if l == nil {
+		l = log.New(os.Stderr, "session.TieredStore", log.LstdFlags)
+	}
+
+	t := &tiered{
+		local:       types.NewContextStore(opt.Local),
+		remote:      types.NewContextStore(opt.Remote),
+		onWrite:     opt.OnWrite,
+		log:         l,
+		writeBehind: opt.WriteBehind,
+	}
+	t.toucher, _ = opt.Remote.(Toucher)
+	t.batch, _ = opt.Remote.(BatchSaver)
+
+	if t.toucher != nil {
+		t.touchInterval = opt.TouchInterval
+		if t.touchInterval <= 0 {
+			t.touchInterval = time.Minute
+		}
+		t.touched = make(map[string]time.Time, 100)
+	}
+
+	if t.writeBehind {
+		interval := opt.FlushInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+
+		t.threshold = opt.FlushThreshold
+		if t.threshold <= 0 {
+			t.threshold = 100
+		}
+
+		t.maxPending = opt.MaxPending
+		if t.maxPending <= 0 {
+			t.maxPending = 10 * t.threshold
+		}
+
+		t.pending = make(map[string]map[interface{}]interface{}, t.threshold)
+		t.flushC = make(chan struct{}, 1)
+		t.stop = make(chan struct{})
+		t.done = make(chan struct{})
+		go t.flushLoop(interval)
+	}
+
+	return t, nil
+}
+
+// 返回sessID对应的锁在locks中的位置
+func tieredStripe(sessID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(sessID))
+	return int(h.Sum32() % tieredLockStripes)
+}
+
+// 返回sessID对应的锁
+func (t *tiered) lock(sessID string) *sync.Mutex {
+	return &t.locks[tieredStripe(sessID)]
+}
+
+// 锁定ids对应的所有锁，返回用于解锁的函数。
+//
+// 按锁的位置依次加锁，避免多个调用之间相互等待。
+func (t *tiered) lockAll(ids []string) func() {
+	stripes := make([]int, 0, len(ids))
+	seen := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if i := tieredStripe(id); !seen[i] {
+			seen[i] = true
+			stripes = append(stripes, i)
+		}
+	}
+	sort.Ints(stripes)
+
+	for _, i := range stripes {
+		t.locks[i].Lock()
+	}
+	return func() {
+		for _, i := range stripes {
+			t.locks[i].Unlock()
+		}
+	}
+}
+
+func (t *tiered) written(sessID string) {
+	if t.onWrite != nil {
+		t.onWrite(sessID)
+	}
+}
+
+// session.Store.Get()
+func (t *tiered) Get(sessID string) (map[interface{}]interface{}, error) {
+	return t.GetContext(context.Background(), sessID)
+}
+
+// session.ContextStore.GetContext()
+//
+// 整个读取过程都在锁中完成，避免以Remote中的旧数据覆盖同时写入Local的新数据。
+func (t *tiered) GetContext(ctx context.Context, sessID string) (map[interface{}]interface{}, error) {
+	l := t.lock(sessID)
+	l.Lock()
+	defer l.Unlock()
+
+	items, err := t.local.GetContext(ctx, sessID)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) > 0 {
+		t.touchRemote(ctx, sessID)
+		return items, nil
+	}
+
+	if t.writeBehind { // 已经被Local淘汰，但还未写入Remote
+		t.pendingMu.Lock()
+		items = t.pending[sessID]
+		t.pendingMu.Unlock()
+		if items != nil {
+			return deepCopy(items)
+		}
+	}
+
+	if items, err = t.remote.GetContext(ctx, sessID); err != nil || len(items) == 0 {
+		return items, err
+	}
+
+	if err = t.local.SaveContext(ctx, sessID, items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// 从Local读取到数据时，延长Remote中数据的生存时间，
+// 还未写入Remote的数据会在写入时重置生存时间，不需要处理。
+//
+// 同一session在touchInterval之内只会延长一次，失败时只输出到log。
+// 调用方需要持有sessID的锁。
+func (t *tiered) touchRemote(ctx context.Context, sessID string) {
+	if t.toucher == nil {
+		return
+	}
+
+	if t.writeBehind {
+		t.pendingMu.Lock()
+		_, found := t.pending[sessID]
+		t.pendingMu.Unlock()
+		if found {
+			return
+		}
+	}
+
+	now := time.Now()
+	t.touchedMu.Lock()
+	last, found := t.touched[sessID]
+	t.touchedMu.Unlock()
+	if found && now.Sub(last) < t.touchInterval {
+		return
+	}
+
+	if err := t.toucher.TouchContext(ctx, sessID); err != nil {
+		t.log.Printf("无法延长 %v 在 Remote 中的生存时间：%v\n", sessID, err)
+		return
+	}
+	t.setTouched(sessID, now)
+}
+
+// 记录sessID在Remote中的生存时间被重置的时间，
+// 同时每隔touchInterval清理一次已经不需要的记录。
+func (t *tiered) setTouched(sessID string, now time.Time) {
+	if t.toucher == nil {
+		return
+	}
+
+	t.touchedMu.Lock()
+	defer t.touchedMu.Unlock()
+
+	if now.Sub(t.pruned) >= t.touchInterval {
+		for id, last := range t.touched {
+			if now.Sub(last) >= t.touchInterval {
+				delete(t.touched, id)
+			}
+		}
+		t.pruned = now
+	}
+	t.touched[sessID] = now
+}
+
+// session.Store.Save()
+func (t *tiered) Save(sessID string, items map[interface{}]interface{}) error {
+	return t.SaveContext(context.Background(), sessID, items)
+}
+
+// session.ContextStore.SaveContext()
+func (t *tiered) SaveContext(ctx context.Context, sessID string, items map[interface{}]interface{}) error {
+	l := t.lock(sessID)
+	l.Lock()
+	defer l.Unlock()
+
+	if !t.writeBehind {
+		return t.saveThrough(ctx, sessID, items)
+	}
+
+	// 保存副本，之后再修改items不会影响写入Remote的数据。
+	copied, err := deepCopy(items)
+	if err != nil {
+		return err
+	}
+
+	// 先占用pending中的位置，保证等待写入的数量不会超过maxPending。
+	t.pendingMu.Lock()
+	old, exists := t.pending[sessID]
+	if !exists && len(t.pending) >= t.maxPending {
+		t.pendingMu.Unlock()
+		return t.saveThrough(ctx, sessID, items)
+	}
+	t.pending[sessID] = copied
+	full := len(t.pending) >= t.threshold
+	t.pendingMu.Unlock()
+
+	if err = t.local.SaveContext(ctx, sessID, items); err != nil {
+		t.pendingMu.Lock()
+		if exists {
+			t.pending[sessID] = old
+		} else {
+			delete(t.pending, sessID)
+		}
+		t.pendingMu.Unlock()
+		return err
+	}
+
+	if full {
+		select {
+		case t.flushC <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// 同时写入Remote和Local，调用方需要持有sessID的锁。
+func (t *tiered) saveThrough(ctx context.Context, sessID string, items map[interface{}]interface{}) error {
+	if err := t.remote.SaveContext(ctx, sessID, items); err != nil {
+		// Local中的数据可能已经与Remote不一致
+		t.local.DeleteContext(ctx, sessID)
+		return err
+	}
+	t.setTouched(sessID, time.Now())
+	if err := t.local.SaveContext(ctx, sessID, items); err != nil {
+		return err
+	}
+	t.written(sessID)
+	return nil
+}
+
+// session.Store.Delete()
+func (t *tiered) Delete(sessID string) error {
+	return t.DeleteContext(context.Background(), sessID)
+}
+
+// session.ContextStore.DeleteContext()
+func (t *tiered) DeleteContext(ctx context.Context, sessID string) error {
+	l := t.lock(sessID)
+	l.Lock()
+	defer l.Unlock()
+
+	if t.writeBehind {
+		t.pendingMu.Lock()
+		delete(t.pending, sessID)
+		t.pendingMu.Unlock()
+	}
+
+	if t.toucher != nil {
+		t.touchedMu.Lock()
+		delete(t.touched, sessID)
+		t.touchedMu.Unlock()
+	}
+
+	if err := t.local.DeleteContext(ctx, sessID); err != nil {
+		return err
+	}
+	if err := t.remote.DeleteContext(ctx, sessID); err != nil {
+		return err
+	}
+	t.written(sessID)
+	return nil
+}
+
+// 从Local中删除ids对应的数据，下次读取时会重新从Remote读取。
+//
+// 一般在其它实例的 TieredOptions.OnWrite 中调用，
+// 还未写入Remote的数据不受影响。
+func (t *tiered) Invalidate(ids ...string) error {
+	for _, id := range ids {
+		l := t.lock(id)
+		l.Lock()
+		err := t.local.Delete(id)
+		l.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 将还未写入的数据写入Remote，返回写入的session数量。
+//
+// 写入失败的数据会保留，等待下次写入，若同时有多个错误，只返回第一个。
+// 未启用write-behind时，不执行任何操作。
+//
+// 若Remote实现了BatchSaver，则每次最多批量写入FlushThreshold个session。
+func (t *tiered) Flush(ctx context.Context) (int, error) {
+	if !t.writeBehind {
+		return 0, nil
+	}
+
+	t.flushMu.Lock()
+	defer t.flushMu.Unlock()
+
+	t.pendingMu.Lock()
+	ids := make([]string, 0, len(t.pending))
+	for id := range t.pending {
+		ids = append(ids, id)
+	}
+	t.pendingMu.Unlock()
+
+	var err error
+	flushed := 0
+	if t.batch != nil {
+		for len(ids) > 0 {
+			if err1 := ctx.Err(); err1 != nil {
+				return flushed, err1
+			}
+
+			size := t.threshold
+			if size > len(ids) {
+				size = len(ids)
+			}
+			n, err1 := t.flushBatch(ctx, ids[:size])
+			flushed += n
+			if err1 != nil && err == nil {
+				err = err1
+			}
+			ids = ids[size:]
+		}
+		return flushed, err
+	}
+
+	for _, id := range ids {
+		if err1 := ctx.Err(); err1 != nil {
+			return flushed, err1
+		}
+
+		ok, err1 := t.flush(ctx, id)
+		if ok {
+			flushed++
+		}
+		if err1 != nil && err == nil {
+			err = err1
+		}
+	}
+
+	return flushed, err
+}
+
+// 将sessID的数据写入Remote，ok表示是否成功写入。
+//
+// 在锁中取出数据并写入，所以不会与Save()和Delete()交叉执行，
+// 已经删除的session不会被重新写入。
+func (t *tiered) flush(ctx context.Context, sessID string) (ok bool, err error) {
+	l := t.lock(sessID)
+	l.Lock()
+	defer l.Unlock()
+
+	t.pendingMu.Lock()
+	items, found := t.pending[sessID]
+	delete(t.pending, sessID)
+	t.pendingMu.Unlock()
+	if !found {
+		return false, nil
+	}
+
+	if err = t.remote.SaveContext(ctx, sessID, items); err != nil {
+		t.pendingMu.Lock()
+		t.pending[sessID] = items
+		t.pendingMu.Unlock()
+		return false, err
+	}
+
+	t.setTouched(sessID, time.Now())
+	t.written(sessID)
+	return true, nil
+}
+
+// 通过BatchSaver一次写入ids的数据，返回成功写入的数量。
+//
+// 与flush()相同，在ids对应的所有锁中取出数据并写入。
+// 批量写入失败时，再逐个写入，避免一个无法写入的session导致其它session都无法写入。
+func (t *tiered) flushBatch(ctx context.Context, ids []string) (int, error) {
+	unlock := t.lockAll(ids)
+
+	items := make(map[string]map[interface{}]interface{}, len(ids))
+	t.pendingMu.Lock()
+	for _, id := range ids {
+		if data, found := t.pending[id]; found {
+			items[id] = data
+			delete(t.pending, id)
+		}
+	}
+	t.pendingMu.Unlock()
+
+	if len(items) == 0 {
+		unlock()
+		return 0, nil
+	}
+
+	err := t.batch.SaveMultiContext(ctx, items)
+	if err == nil {
+		now := time.Now()
+		for id := range items {
+			t.setTouched(id, now)
+			t.written(id)
+		}
+		unlock()
+		return len(items), nil
+	}
+
+	t.pendingMu.Lock()
+	for id, data := range items {
+		t.pending[id] = data
+	}
+	t.pendingMu.Unlock()
+	unlock()
+
+	flushed := 0
+	err = nil
+	for id := range items {
+		ok, err1 := t.flush(ctx, id)
+		if ok {
+			flushed++
+		}
+		if err1 != nil && err == nil {
+			err = err1
+		}
+	}
+	return flushed, err
+}
+
+// 后台定期写入，或是在等待写入的数据达到FlushThreshold时立即写入。
+func (t *tiered) flushLoop(interval time.Duration) {
+	defer close(t.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		case <-t.flushC:
+		}
+
+		if _, err := t.Flush(context.Background()); err != nil {
+			t.log.Println(err.Error())
+		}
+	}
+}
+
+// session.Store.StartGC()
+func (t *tiered) StartGC() {
+	t.local.StartGC()
+	t.remote.StartGC()
+}
+
+// session.Store.Close()
+//
+// 先写入还未写入的数据，再依次关闭Local和Remote，若有多个错误，只返回第一个。
+func (t *tiered) Close() error {
+	var err error
+	if t.writeBehind {
+		t.closeOnce.Do(func() {
+			close(t.stop)
+			<-t.done
+		})
+		_, err = t.Flush(context.Background())
+	}
+
+	if err1 := t.local.Close(); err == nil {
+		err = err1
+	}
+	if err1 := t.remote.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
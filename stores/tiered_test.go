@@ -0,0 +1,488 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stores
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert"
+	"github.com/issue9/session/types"
+)
+
+var (
+	_ types.ContextStore = &tiered{}
+	_ Toucher            = &raw{}
+	_ Toucher            = &countStore{}
+	_ BatchSaver         = &raw{}
+	_ BatchSaver         = &batchStore{}
+)
+
+// 记录调用次数的Store
+type countStore struct {
+	types.Store
+	gets, saves, touches int32
+	err                  error // 不为nil时，Save()返回该错误
+	touchErr             error // 不为nil时，TouchContext()返回该错误
+}
+
+// 实现了BatchSaver接口的countStore
+type batchStore struct {
+	*countStore
+	batches int32
+	err     error // 不为nil时，SaveMultiContext()返回该错误
+}
+
+func (s *countStore) TouchContext(ctx context.Context, sessID string) error {
+	atomic.AddInt32(&s.touches, 1)
+	if s.touchErr != nil {
+		return s.touchErr
+	}
+	return s.Store.(Toucher).TouchContext(ctx, sessID)
+}
+
+func (s *batchStore) SaveMultiContext(ctx context.Context, items map[string]map[interface{}]interface{}) error {
+	atomic.AddInt32(&s.batches, 1)
+	if s.err != nil {
+		return s.err
+	}
+	return s.Store.(BatchSaver).SaveMultiContext(ctx, items)
+}
+
+func (s *countStore) Get(sessID string) (map[interface{}]interface{}, error) {
+	atomic.AddInt32(&s.gets, 1)
+	return s.Store.Get(sessID)
+}
+
+func (s *countStore) Save(sessID string, items map[interface{}]interface{}) error {
+	atomic.AddInt32(&s.saves, 1)
+	if s.err != nil {
+		return s.err
+	}
+	return s.Store.Save(sessID, items)
+}
+
+// 返回以文件存储器作为Remote的countStore
+func newTieredRemote(a *assert.Assertion, dir string) *countStore {
+	f, err := NewFile(dir, 100, nil)
+	a.NotError(err)
+	return &countStore{Store: NewRaw(f, nil, 100)}
+}
+
+func TestNewTiered(t *testing.T) {
+	a := assert.New(t)
+
+	tr, err := NewTiered(nil)
+	a.Error(err).Nil(tr)
+
+	tr, err = NewTiered(&TieredOptions{Local: NewMemory(10)})
+	a.Error(err).Nil(tr)
+
+	tr, err = NewTiered(&TieredOptions{Remote: NewMemory(10)})
+	a.Error(err).Nil(tr)
+
+	tr, err = NewTiered(&TieredOptions{Local: NewMemory(10), Remote: NewMemory(10)})
+	a.NotError(err).NotNil(tr)
+	a.NotError(tr.Close())
+}
+
+func TestTiered(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	written := []string{}
+	f, err := NewFile(dir, 100, nil)
+	a.NotError(err)
+	remote := &countStore{Store: NewRaw(f, nil, 100)}
+	tr, err := NewTiered(&TieredOptions{
+		Local:         NewMemory(10),
+		Remote:        remote,
+		TouchInterval: 50 * time.Millisecond,
+		OnWrite:       func(sessID string) { written = append(written, sessID) },
+	})
+	a.NotError(err)
+
+	// read-through
+	a.NotError(remote.Store.Save("id1", testData1))
+	mapped, err := tr.Get("id1")
+	a.NotError(err).Equal(mapped, testData1)
+	a.Equal(remote.gets, 1)
+	mapped, err = tr.Get("id1")
+	a.NotError(err).Equal(mapped, testData1)
+	a.Equal(remote.gets, 1)
+
+	// 从Local读取时，延长Remote中数据的生存时间，TouchInterval之内只延长一次
+	a.Equal(remote.touches, 1)
+	a.NotError(f.Touch("id1", time.Second))
+	mapped, err = tr.Get("id1")
+	a.NotError(err).Equal(mapped, testData1)
+	a.Equal(remote.touches, 1)
+	time.Sleep(60 * time.Millisecond)
+	mapped, err = tr.Get("id1")
+	a.NotError(err).Equal(mapped, testData1)
+	a.Equal(remote.touches, 2)
+	_, ttl, err := f.Get("id1")
+	a.NotError(err).True(ttl > 90*time.Second)
+
+	// 不存在的数据
+	mapped, err = tr.Get("non")
+	a.NotError(err).Equal(len(mapped), 0)
+	a.Equal(remote.gets, 2)
+
+	// write-through
+	a.NotError(tr.Save("id2", testData2))
+	a.Equal(remote.saves, 1)
+	mapped, err = remote.Store.Get("id2")
+	a.NotError(err).Equal(mapped, testData2)
+	mapped, err = tr.Get("id2")
+	a.NotError(err).Equal(mapped, testData2)
+	a.Equal(remote.gets, 2)
+	a.Equal(written, []string{"id2"})
+
+	// Delete
+	a.NotError(tr.Delete("id2"))
+	mapped, err = remote.Store.Get("id2")
+	a.NotError(err).Equal(len(mapped), 0)
+	mapped, err = tr.Get("id2")
+	a.NotError(err).Equal(len(mapped), 0)
+	a.Equal(written, []string{"id2", "id2"})
+
+	// 写入Remote失败时，Local中的数据也被删除
+	remote.err = errors.New("remote error")
+	a.Equal(tr.Save("id1", testData2), remote.err)
+	remote.err = nil
+	mapped, err = tr.Get("id1")
+	a.NotError(err).Equal(mapped, testData1)
+
+	// Flush()不执行任何操作
+	flushed, err := tr.Flush(context.Background())
+	a.NotError(err).Equal(flushed, 0)
+
+	a.NotError(tr.Close())
+}
+
+// 延长Remote中的生存时间失败时，依然返回Local中的数据
+func TestTiered_TouchError(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	buf := new(bytes.Buffer)
+	remote := newTieredRemote(a, dir)
+	tr, err := NewTiered(&TieredOptions{
+		Local:         NewMemory(10),
+		Remote:        remote,
+		TouchInterval: time.Hour,
+		Log:           log.New(buf, "", 0),
+	})
+	a.NotError(err)
+
+	a.NotError(remote.Store.Save("id", testData1))
+	mapped, err := tr.Get("id")
+	a.NotError(err).Equal(mapped, testData1)
+
+	remote.touchErr = errors.New("touch error")
+	mapped, err = tr.Get("id")
+	a.NotError(err).Equal(mapped, testData1)
+	a.Equal(remote.touches, 1)
+	a.True(strings.Contains(buf.String(), "touch error"))
+
+	// 失败之后，下次读取时会再次尝试
+	remote.touchErr = nil
+	mapped, err = tr.Get("id")
+	a.NotError(err).Equal(mapped, testData1)
+	a.Equal(remote.touches, 2)
+	mapped, err = tr.Get("id")
+	a.NotError(err).Equal(mapped, testData1)
+	a.Equal(remote.touches, 2)
+
+	// 写入Remote之后，不需要再延长
+	a.NotError(tr.Delete("id"))
+	a.NotError(tr.Save("id", testData2))
+	mapped, err = tr.Get("id")
+	a.NotError(err).Equal(mapped, testData2)
+	a.Equal(remote.touches, 2)
+
+	a.NotError(tr.Close())
+}
+
+// 多个实例共用同一个Remote，通过OnWrite通知其它实例
+func TestTiered_Invalidate(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	var tr1, tr2 *tiered
+	invalidate := func(target **tiered) func(string) {
+		return func(sessID string) { a.NotError((*target).Invalidate(sessID)) }
+	}
+
+	tr1, err := NewTiered(&TieredOptions{
+		Local:   NewMemory(10),
+		Remote:  newTieredRemote(a, dir),
+		OnWrite: invalidate(&tr2),
+	})
+	a.NotError(err)
+	defer tr1.Close()
+
+	tr2, err = NewTiered(&TieredOptions{
+		Local:   NewMemory(10),
+		Remote:  newTieredRemote(a, dir),
+		OnWrite: invalidate(&tr1),
+	})
+	a.NotError(err)
+	defer tr2.Close()
+
+	a.NotError(tr1.Save("id", testData1))
+	mapped, err := tr2.Get("id")
+	a.NotError(err).Equal(mapped, testData1)
+
+	a.NotError(tr1.Save("id", testData2))
+	mapped, err = tr2.Get("id")
+	a.NotError(err).Equal(mapped, testData2)
+
+	a.NotError(tr2.Delete("id"))
+	mapped, err = tr1.Get("id")
+	a.NotError(err).Equal(len(mapped), 0)
+}
+
+func TestTiered_WriteBehind(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	local, err := NewMemoryWithOptions(&MemoryOptions{Lifetime: 10, Shards: 1, MaxEntries: 2})
+	a.NotError(err)
+	remote := newTieredRemote(a, dir)
+	tr, err := NewTiered(&TieredOptions{
+		Local:          local,
+		Remote:         remote,
+		WriteBehind:    true,
+		FlushInterval:  time.Hour,
+		FlushThreshold: 5,
+	})
+	a.NotError(err)
+
+	// 只写入Local
+	items := map[interface{}]interface{}{"k": "v1"}
+	a.NotError(tr.Save("id1", items))
+	items["k"] = "v2"
+	a.NotError(tr.Save("id1", items))
+	a.NotError(tr.Save("id2", testData2))
+	a.Equal(remote.saves, 0)
+	mapped, err := tr.Get("id1")
+	a.NotError(err).Equal(mapped["k"], "v2")
+
+	// 已经被Local淘汰，但还未写入Remote
+	a.NotError(tr.Save("id3", testData1))
+	a.NotError(tr.Save("id4", testData1))
+	mapped, err = local.Get("id1")
+	a.NotError(err).Equal(len(mapped), 0)
+	mapped, err = tr.Get("id1")
+	a.NotError(err).Equal(mapped["k"], "v2")
+	a.Equal(remote.gets, 0)
+
+	// 删除的数据不会再被写入
+	a.NotError(tr.Delete("id4"))
+
+	flushed, err := tr.Flush(context.Background())
+	a.NotError(err).Equal(flushed, 3)
+	a.Equal(remote.saves, 3)
+	mapped, err = remote.Store.Get("id1")
+	a.NotError(err).Equal(mapped["k"], "v2")
+	mapped, err = remote.Store.Get("id4")
+	a.NotError(err).Equal(len(mapped), 0)
+	flushed, err = tr.Flush(context.Background())
+	a.NotError(err).Equal(flushed, 0)
+
+	// 写入失败的数据会保留
+	remote.err = errors.New("remote error")
+	a.NotError(tr.Save("id5", testData1))
+	flushed, err = tr.Flush(context.Background())
+	a.Equal(err, remote.err).Equal(flushed, 0)
+	remote.err = nil
+	flushed, err = tr.Flush(context.Background())
+	a.NotError(err).Equal(flushed, 1)
+
+	// 达到FlushThreshold时立即写入
+	saves := atomic.LoadInt32(&remote.saves)
+	for i := 0; i < 5; i++ {
+		a.NotError(tr.Save("batch"+strconv.Itoa(i), testData1))
+	}
+	time.Sleep(100 * time.Millisecond)
+	a.Equal(atomic.LoadInt32(&remote.saves), saves+5)
+
+	// Close()时写入剩余的数据
+	a.NotError(tr.Save("id6", testData1))
+	a.NotError(tr.Close())
+	a.Equal(remote.touches, 0)       // 从pending中读取，不需要延长
+	remote = newTieredRemote(a, dir) // remote已经随tr关闭
+	mapped, err = remote.Store.Get("id6")
+	a.NotError(err).Equal(mapped, testData1)
+	a.NotError(remote.Close())
+}
+
+// Remote实现了BatchSaver时，批量写入
+func TestTiered_Batch(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	remote := &batchStore{countStore: newTieredRemote(a, dir)}
+	tr, err := NewTiered(&TieredOptions{
+		Local:          NewMemory(10),
+		Remote:         remote,
+		WriteBehind:    true,
+		FlushInterval:  time.Hour,
+		FlushThreshold: 100,
+	})
+	a.NotError(err)
+
+	for i := 0; i < 5; i++ {
+		a.NotError(tr.Save("id"+strconv.Itoa(i), testData1))
+	}
+	flushed, err := tr.Flush(context.Background())
+	a.NotError(err).Equal(flushed, 5)
+	a.Equal(remote.batches, 1).Equal(remote.saves, 0)
+	for i := 0; i < 5; i++ {
+		mapped, err := remote.Store.Get("id" + strconv.Itoa(i))
+		a.NotError(err).Equal(mapped, testData1)
+	}
+
+	// 批量写入失败时，逐个写入
+	remote.err = errors.New("batch error")
+	a.NotError(tr.Save("id1", testData2))
+	a.NotError(tr.Save("id2", testData2))
+	flushed, err = tr.Flush(context.Background())
+	a.NotError(err).Equal(flushed, 2)
+	a.Equal(remote.batches, 2).Equal(remote.saves, 2)
+	mapped, err := remote.Store.Get("id1")
+	a.NotError(err).Equal(mapped, testData2)
+
+	// 都失败时，数据会保留
+	remote.countStore.err = errors.New("remote error")
+	a.NotError(tr.Save("id3", testData2))
+	flushed, err = tr.Flush(context.Background())
+	a.Equal(err, remote.countStore.err).Equal(flushed, 0)
+	a.Equal(len(tr.pending), 1)
+
+	remote.err = nil
+	remote.countStore.err = nil
+	flushed, err = tr.Flush(context.Background())
+	a.NotError(err).Equal(flushed, 1)
+	a.Equal(remote.batches, 4)
+	a.NotError(tr.Close())
+}
+
+// Remote持续写入失败时，等待写入的数据不会无限增加
+func TestTiered_MaxPending(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	remote := newTieredRemote(a, dir)
+	tr, err := NewTiered(&TieredOptions{
+		Local:          NewMemory(10),
+		Remote:         remote,
+		WriteBehind:    true,
+		FlushInterval:  time.Hour,
+		FlushThreshold: 100,
+		MaxPending:     3,
+	})
+	a.NotError(err)
+
+	remote.err = errors.New("remote error")
+	for i := 0; i < 3; i++ {
+		a.NotError(tr.Save("id"+strconv.Itoa(i), testData1))
+	}
+	_, err = tr.Flush(context.Background())
+	a.Equal(err, remote.err)
+
+	// 已经在等待写入的数据可以继续更新
+	a.NotError(tr.Save("id0", testData2))
+
+	// 超出MaxPending，直接写入Remote，并返回错误
+	a.Equal(tr.Save("id3", testData1), remote.err)
+	a.Equal(len(tr.pending), 3)
+	mapped, err := tr.Get("id3")
+	a.NotError(err).Equal(len(mapped), 0)
+
+	remote.err = nil
+	a.NotError(tr.Save("id3", testData1))
+	a.Equal(len(tr.pending), 3)
+	mapped, err = remote.Store.Get("id3")
+	a.NotError(err).Equal(mapped, testData1)
+
+	flushed, err := tr.Flush(context.Background())
+	a.NotError(err).Equal(flushed, 3)
+	mapped, err = remote.Store.Get("id0")
+	a.NotError(err).Equal(mapped, testData2)
+	a.NotError(tr.Close())
+}
+
+func TestTiered_Concurrent(t *testing.T) {
+	a := assert.New(t)
+	dir, cleanup := newFileDir(a)
+	defer cleanup()
+
+	for _, writeBehind := range []bool{false, true} {
+		remote := newTieredRemote(a, dir)
+		tr, err := NewTiered(&TieredOptions{
+			Local:          NewMemory(10),
+			Remote:         remote,
+			WriteBehind:    writeBehind,
+			FlushInterval:  time.Millisecond,
+			FlushThreshold: 3,
+		})
+		a.NotError(err)
+
+		errs := make(chan error, 4)
+		for g := 0; g < 4; g++ {
+			go func(g int) {
+				for i := 0; i < 50; i++ {
+					id := "id" + strconv.Itoa(i%5)
+					if err := tr.Save(id, map[interface{}]interface{}{"g": g}); err != nil {
+						errs <- err
+						return
+					}
+					if _, err := tr.Get(id); err != nil {
+						errs <- err
+						return
+					}
+					if i%7 == 0 {
+						if err := tr.Invalidate(id); err != nil {
+							errs <- err
+							return
+						}
+					}
+				}
+				errs <- nil
+			}(g)
+		}
+		for g := 0; g < 4; g++ {
+			a.NotError(<-errs)
+		}
+
+		// 最终Local与Remote一致
+		_, err = tr.Flush(context.Background())
+		a.NotError(err)
+		for i := 0; i < 5; i++ {
+			id := "id" + strconv.Itoa(i)
+			cached, err := tr.Get(id)
+			a.NotError(err)
+			stored, err := remote.Store.Get(id)
+			a.NotError(err).Equal(cached, stored)
+		}
+		a.NotError(tr.Close())
+	}
+}
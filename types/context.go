@@ -0,0 +1,144 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// 支持context.Context的Store接口。
+//
+// 各方法与Store中的同名方法功能相同，但在ctx被取消或是超时之后，
+// 应该尽快返回ctx.Err()。
+type ContextStore interface {
+	Store
+
+	GetContext(ctx context.Context, sessID string) (map[interface{}]interface{}, error)
+	SaveContext(ctx context.Context, sessID string, data map[interface{}]interface{}) error
+	DeleteContext(ctx context.Context, sessID string) error
+}
+
+// 支持context.Context的RawStore接口。
+type ContextRawStore interface {
+	RawStore
+
+	GetContext(ctx context.Context, sessID string) (data []byte, ttl time.Duration, err error)
+	SetContext(ctx context.Context, sessID string, data []byte, ttl time.Duration) error
+	DeleteContext(ctx context.Context, sessID string) error
+	TouchContext(ctx context.Context, sessID string, ttl time.Duration) error
+}
+
+// 支持context.Context的Provider接口。
+type ContextProvider interface {
+	Provider
+
+	GetContext(ctx context.Context, w http.ResponseWriter, r *http.Request) (sessID string, err error)
+	DeleteContext(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+}
+
+type contextStore struct {
+	Store
+}
+
+type contextRawStore struct {
+	RawStore
+}
+
+type contextProvider struct {
+	Provider
+}
+
+// 将Store转换成ContextStore。
+//
+// 若s本身已经实现了ContextStore，则直接返回s；
+// 否则返回的实例会在调用s的方法之前检测ctx是否已经被取消，
+// 但无法中断已经开始的操作。
+func NewContextStore(s Store) ContextStore {
+	if cs, ok := s.(ContextStore); ok {
+		return cs
+	}
+	return &contextStore{Store: s}
+}
+
+// 将RawStore转换成ContextRawStore，规则与NewContextStore()相同。
+func NewContextRawStore(s RawStore) ContextRawStore {
+	if cs, ok := s.(ContextRawStore); ok {
+		return cs
+	}
+	return &contextRawStore{RawStore: s}
+}
+
+// 将Provider转换成ContextProvider，规则与NewContextStore()相同。
+func NewContextProvider(p Provider) ContextProvider {
+	if cp, ok := p.(ContextProvider); ok {
+		return cp
+	}
+	return &contextProvider{Provider: p}
+}
+
+func (s *contextStore) GetContext(ctx context.Context, sessID string) (map[interface{}]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Get(sessID)
+}
+
+func (s *contextStore) SaveContext(ctx context.Context, sessID string, data map[interface{}]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Save(sessID, data)
+}
+
+func (s *contextStore) DeleteContext(ctx context.Context, sessID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Delete(sessID)
+}
+
+func (s *contextRawStore) GetContext(ctx context.Context, sessID string) ([]byte, time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return s.Get(sessID)
+}
+
+func (s *contextRawStore) SetContext(ctx context.Context, sessID string, data []byte, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Set(sessID, data, ttl)
+}
+
+func (s *contextRawStore) DeleteContext(ctx context.Context, sessID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Delete(sessID)
+}
+
+func (s *contextRawStore) TouchContext(ctx context.Context, sessID string, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Touch(sessID, ttl)
+}
+
+func (p *contextProvider) GetContext(ctx context.Context, w http.ResponseWriter, r *http.Request) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return p.Get(w, r)
+}
+
+func (p *contextProvider) DeleteContext(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return p.Delete(w, r)
+}
@@ -0,0 +1,137 @@
+// Copyright 2015 by caixw, All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert"
+)
+
+var (
+	_ ContextStore    = &contextStore{}
+	_ ContextRawStore = &contextRawStore{}
+	_ ContextProvider = &contextProvider{}
+)
+
+type testStore struct {
+	count int // 实际调用的次数
+}
+
+func (s *testStore) Delete(sessID string) error { s.count++; return nil }
+func (s *testStore) Get(sessID string) (map[interface{}]interface{}, error) {
+	s.count++
+	return map[interface{}]interface{}{}, nil
+}
+func (s *testStore) Save(sessID string, data map[interface{}]interface{}) error {
+	s.count++
+	return nil
+}
+func (s *testStore) StartGC()     {}
+func (s *testStore) Close() error { return nil }
+
+type testRawStore struct {
+	count int
+}
+
+func (s *testRawStore) Get(sessID string) ([]byte, time.Duration, error) {
+	s.count++
+	return nil, 0, nil
+}
+func (s *testRawStore) Set(sessID string, data []byte, ttl time.Duration) error {
+	s.count++
+	return nil
+}
+func (s *testRawStore) Delete(sessID string) error                   { s.count++; return nil }
+func (s *testRawStore) Touch(sessID string, ttl time.Duration) error { s.count++; return nil }
+func (s *testRawStore) StartGC()                                     {}
+func (s *testRawStore) Close() error                                 { return nil }
+
+type testProvider struct {
+	count int
+}
+
+func (p *testProvider) Get(w http.ResponseWriter, r *http.Request) (string, error) {
+	p.count++
+	return "id", nil
+}
+func (p *testProvider) Delete(w http.ResponseWriter, r *http.Request) error { p.count++; return nil }
+
+func TestNewContextStore(t *testing.T) {
+	a := assert.New(t)
+
+	s := &testStore{}
+	cs := NewContextStore(s)
+	a.NotNil(cs)
+	a.Equal(NewContextStore(cs), cs) // 已经是ContextStore
+
+	ctx := context.Background()
+	_, err := cs.GetContext(ctx, "id")
+	a.NotError(err)
+	a.NotError(cs.SaveContext(ctx, "id", nil))
+	a.NotError(cs.DeleteContext(ctx, "id"))
+	a.Equal(s.count, 3)
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = cs.GetContext(ctx, "id")
+	a.Equal(err, context.Canceled)
+	a.Equal(cs.SaveContext(ctx, "id", nil), context.Canceled)
+	a.Equal(cs.DeleteContext(ctx, "id"), context.Canceled)
+	a.Equal(s.count, 3)
+}
+
+func TestNewContextRawStore(t *testing.T) {
+	a := assert.New(t)
+
+	s := &testRawStore{}
+	cs := NewContextRawStore(s)
+	a.NotNil(cs)
+	a.Equal(NewContextRawStore(cs), cs)
+
+	ctx := context.Background()
+	_, _, err := cs.GetContext(ctx, "id")
+	a.NotError(err)
+	a.NotError(cs.SetContext(ctx, "id", nil, time.Second))
+	a.NotError(cs.TouchContext(ctx, "id", time.Second))
+	a.NotError(cs.DeleteContext(ctx, "id"))
+	a.Equal(s.count, 4)
+
+	ctx, cancel := context.WithTimeout(ctx, -time.Second)
+	defer cancel()
+	_, _, err = cs.GetContext(ctx, "id")
+	a.Equal(err, context.DeadlineExceeded)
+	a.Equal(cs.SetContext(ctx, "id", nil, time.Second), context.DeadlineExceeded)
+	a.Equal(cs.TouchContext(ctx, "id", time.Second), context.DeadlineExceeded)
+	a.Equal(cs.DeleteContext(ctx, "id"), context.DeadlineExceeded)
+	a.Equal(s.count, 4)
+}
+
+func TestNewContextProvider(t *testing.T) {
+	a := assert.New(t)
+
+	p := &testProvider{}
+	cp := NewContextProvider(p)
+	a.NotNil(cp)
+	a.Equal(NewContextProvider(cp), cp)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	sessID, err := cp.GetContext(r.Context(), w, r)
+	a.NotError(err).Equal(sessID, "id")
+	a.NotError(cp.DeleteContext(r.Context(), w, r))
+	a.Equal(p.count, 2)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	cancel()
+	_, err = cp.GetContext(ctx, w, r)
+	a.Equal(err, context.Canceled)
+	a.Equal(cp.DeleteContext(ctx, w, r), context.Canceled)
+	a.Equal(p.count, 2)
+}
@@ -5,7 +5,9 @@
 package types
 
 import (
+	"context"
 	"net/http"
+	"time"
 )
 
 // Session的存储接口。
@@ -30,6 +32,79 @@ type Store interface {
 	Close() error
 }
 
+// 以字节形式保存Session数据的存储接口。
+//
+// 与Store不同，RawStore不关心数据的序列化，只负责字节内容的存取，
+// 可以通过stores.NewRaw()与Codec组合成一个Store。
+type RawStore interface {
+	// 获取与sessID关联的数据及其剩余的生存时间，若不存在，则data返回nil。
+	Get(sessID string) (data []byte, ttl time.Duration, err error)
+
+	// 将data与sessID相关联，并在ttl之后过期。
+	Set(sessID string, data []byte, ttl time.Duration) error
+
+	// 从RawStore中删除指定sessionid的数据。
+	Delete(sessID string) error
+
+	// 将sessID对应数据的生存时间重置为ttl，若数据不存在，则不作任何操作。
+	Touch(sessID string, ttl time.Duration) error
+
+	// 启用GC。
+	StartGC()
+
+	// 关闭所有的GC操作并释放相关的资源。
+	Close() error
+}
+
+// GC的相关设置。
+type GCOptions struct {
+	// 两次GC之间的间隔，为0表示使用存储器的默认值，即StartGC()使用的间隔。
+	Interval time.Duration
+
+	// 每次间隔之外再随机增加[0, Jitter)的时间，
+	// 避免多个实例在同一时间执行GC，为0表示不增加。
+	Jitter time.Duration
+
+	// GC发生错误时调用，若指定为nil，则由存储器自行记录错误。
+	OnError func(error)
+}
+
+// GC的统计信息。
+type GCStats struct {
+	Runs         uint64        // 执行GC的次数，包括手动执行的次数
+	Removed      uint64        // 被删除的session总数
+	Errors       uint64        // 发生错误的次数
+	LastRun      time.Time     // 最后一次开始执行的时间
+	LastDuration time.Duration // 最后一次执行所用的时间
+	LastError    error         // 最后一次执行时发生的错误，成功时为nil
+}
+
+// Store和RawStore的可选接口，实现该接口的存储器可以控制GC的执行。
+type GCer interface {
+	// 立即执行一次GC，返回被删除的session数量。
+	//
+	// 可以在测试或是定时任务中手动执行，与后台的GC不会同时执行。
+	GC(ctx context.Context) (removed int, err error)
+
+	// 根据opt在后台定期执行GC，直到ctx被取消或是调用了Close()。
+	// opt为nil时与StartGC()相同，重复调用会停止之前启动的GC。
+	StartGCContext(ctx context.Context, opt *GCOptions)
+
+	// 返回GC的统计信息。
+	GCStats() GCStats
+}
+
+// Session数据的编解码接口。
+//
+// 所有以字节形式保存数据的Store，都应该通过Codec进行数据的序列化。
+type Codec interface {
+	// 将data编码成字节。
+	Encode(data map[interface{}]interface{}) ([]byte, error)
+
+	// 将Encode()编码的内容还原。
+	Decode(data []byte) (map[interface{}]interface{}, error)
+}
+
 // 提供sessionid的传递和保管。
 // 一般为通过cookie或是token等方式。
 type Provider interface {
@@ -39,3 +114,17 @@ type Provider interface {
 	// 删除当前保存的sessionid值。
 	Delete(w http.ResponseWriter, r *http.Request) error
 }
+
+// Provider的可选接口，实现该接口的Provider可以在不产生新值的情况下，
+// 判断请求中是否带有sessionid。
+type Lookuper interface {
+	// 从r中查找sessionid的值，found表示是否找到。
+	Lookup(r *http.Request) (sessID string, found bool, err error)
+}
+
+// Provider的可选接口，实现该接口的Provider可以强制产生一个新的sessionid，
+// 而不管请求中是否已经带有sessionid。
+type Issuer interface {
+	// 产生一个新的sessionid，并将其传递给客户端。
+	Issue(w http.ResponseWriter, r *http.Request) (sessID string, err error)
+}